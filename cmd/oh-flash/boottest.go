@@ -0,0 +1,127 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/devices/boards"
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// ramBootBoard is implemented by boards starting kernels loaded into memory.
+type ramBootBoard interface {
+	LoadKernel(uboot *ubootshell.UBootShell, kernelPath string) error
+	StartKernel(uboot *ubootshell.UBootShell) error
+}
+
+// runBootTest boots a kernel loaded into memory, without flashing it.
+func runBootTest(args []string) error {
+	var opts sessionOptions
+	var kernel, bootLog string
+	var check ubootshell.BootCheck
+	var watch time.Duration
+	var fitConfig string
+	fs := flag.NewFlagSet("oh-flash boot-test", flag.ExitOnError)
+	opts.addFlags(fs)
+	fs.StringVar(&kernel, "kernel", "", "Kernel image to boot, path, URL or - for standard input")
+	fs.StringVar(&bootLog, "boot-log", "", "Also write the console output of the booting kernel to a file")
+	fs.StringVar(&fitConfig, "fit-config", "", "Boot the kernel as a FIT image with bootm, with this configuration")
+	fs.DurationVar(&watch, "watch", 0, "Time to show the console output of the booting kernel, zero shows it until interrupted")
+	fs.StringVar(&check.Banner, "boot-check", "", "Text printed by the kernel once booted, such as a shell prompt, ends the test")
+	fs.DurationVar(&check.Timeout, "boot-check-timeout", 2*time.Minute, "Maximum time from starting the kernel until it is booted")
+	fs.StringVar(&check.Command, "boot-check-command", "", "Command to run in the shell of the booted system")
+	fs.StringVar(&check.Expect, "boot-check-output", "", "Text expected in the output of the boot check command")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if kernel == "" {
+		return usageErrorf("select kernel image to boot with -kernel")
+	}
+	if check.Banner == "" && check.Command != "" {
+		return usageErrorf("cannot use -boot-check-command without -boot-check")
+	}
+	b, err := newBoard(opts.boardType)
+	if err != nil {
+		return err
+	}
+	board, ok := b.(ramBootBoard)
+	if !ok {
+		return usageErrorf("board %s cannot boot a kernel from memory", opts.boardType)
+	}
+	if fitConfig != "" {
+		tunable, ok := b.(tunableBoard)
+		if !ok {
+			return usageErrorf("board %s does not support -fit-config", opts.boardType)
+		}
+		tunable.SetOptions(boards.Options{FITConfig: fitConfig})
+	}
+	var fetcher assetFetcher
+	defer fetcher.close()
+	if err := fetcher.fetch(&kernel, ""); err != nil {
+		return err
+	}
+
+	var console io.Writer = os.Stdout
+	if bootLog != "" {
+		f, err := os.Create(bootLog)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		console = io.MultiWriter(os.Stdout, f)
+	}
+	opts.events = textEvents{}
+	sess, err := openSession(&opts)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	if err := board.LoadKernel(sess.uboot, kernel); err != nil {
+		return err
+	}
+	// Start showing the console just before the kernel, so that the
+	// transfer does not clutter it.
+	stop := sess.console.LogUnattended(console)
+	defer stop()
+	if err := board.StartKernel(sess.uboot); err != nil {
+		return err
+	}
+	if check.Banner != "" {
+		err := flash.Run(sess.events, flash.Stage{Kind: flash.BootStage, Name: "boot kernel"}, func() error { return sess.uboot.CheckBoot(check) })
+		if err != nil {
+			return flash.WithKind(fmt.Errorf("kernel does not boot: %w", err), errValidationFailed)
+		}
+		stop()
+		fmt.Printf("\nKernel booted successfully\n")
+		return nil
+	}
+	var timeout <-chan time.Time
+	if watch > 0 {
+		timeout = time.After(watch)
+	}
+	select {
+	case <-sess.interrupt.Done():
+	case <-timeout:
+	}
+	return nil
+}
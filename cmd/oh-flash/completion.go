@@ -0,0 +1,228 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// completeCommand is the hidden command used by completion scripts.
+//
+// It is given the words of the command line after oh-flash, up to and
+// including the word being completed, and prints the candidates, one per
+// line. Nothing is printed when files should be completed instead.
+const completeCommand = "__complete"
+
+// errCompleting stops a command once parseFlags collected its flags.
+var errCompleting = errors.New("completing command line")
+
+// completingFlags, when set, is given the flags of the command being run by
+// parseFlags, instead of running it.
+var completingFlags func(fs *flag.FlagSet)
+
+// commandFlags returns the flags of the command run with the given arguments.
+func commandFlags(run func(args []string) error, args []string) *flag.FlagSet {
+	var flags *flag.FlagSet
+	completingFlags = func(fs *flag.FlagSet) { flags = fs }
+	defer func() { completingFlags = nil }()
+	if err := run(args); !errors.Is(err, errCompleting) {
+		return nil
+	}
+	return flags
+}
+
+// flagValues returns the values of the flag known without running anything.
+func flagValues(f *flag.Flag) []string {
+	if _, ok := f.Value.(*deviceName); ok {
+		inv, _, err := loadInventory()
+		if err != nil {
+			return nil
+		}
+		names := make([]string, 0, len(inv))
+		for name := range inv {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	if f.Name == "board" {
+		return boardTypes
+	}
+	return nil
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// completions returns the candidates completing the last of the words.
+func completions(words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur := words[len(words)-1]
+	words = words[:len(words)-1]
+	var candidates []string
+	if len(words) == 0 && !strings.HasPrefix(cur, "-") {
+		for _, cmd := range commands {
+			candidates = append(candidates, cmd.name)
+		}
+		return withPrefix(append(candidates, "help"), cur)
+	}
+	// Flags given without a command are passed to the flash command.
+	name, run, args := "flash", runFlash, []string(nil)
+	if len(words) > 0 && !strings.HasPrefix(words[0], "-") {
+		name, run, args = words[0], nil, words[1:]
+		for _, cmd := range commands {
+			if cmd.name == name {
+				run = cmd.run
+			}
+		}
+	}
+	switch {
+	case name == "help" && len(args) == 0:
+		return completions([]string{cur})
+	case run == nil:
+		return nil
+	case name == "env" && len(args) == 0:
+		return withPrefix([]string{"backup", "restore"}, cur)
+	case name == "env":
+		// Only the env command is needed to find its flags.
+		args = args[:1]
+	default:
+		args = nil
+	}
+	fs := commandFlags(run, args)
+	if fs == nil {
+		return nil
+	}
+	// Bash splits -flag=value into three words, other shells keep one.
+	var prev string
+	if len(words) > 0 {
+		prev = words[len(words)-1]
+	}
+	switch {
+	case cur == "=":
+		return flagValuesOf(fs, prev, "")
+	case prev == "=" && len(words) > 1:
+		return withPrefix(flagValuesOf(fs, words[len(words)-2], ""), cur)
+	case strings.HasPrefix(cur, "-") && strings.Contains(cur, "="):
+		idx := strings.IndexByte(cur, '=')
+		return withPrefix(flagValuesOf(fs, cur[:idx], cur[:idx+1]), cur)
+	case strings.HasPrefix(cur, "-"):
+		fs.VisitAll(func(f *flag.Flag) { candidates = append(candidates, "-"+f.Name) })
+		return withPrefix(candidates, cur)
+	case strings.HasPrefix(prev, "-") && !strings.Contains(prev, "="):
+		return withPrefix(flagValuesOf(fs, prev, ""), cur)
+	}
+	return nil
+}
+
+// flagValuesOf returns the values of the named flag, such as -board, each
+// with the given prefix.
+func flagValuesOf(fs *flag.FlagSet, name, prefix string) []string {
+	f := fs.Lookup(strings.TrimLeft(name, "-"))
+	if f == nil || isBoolFlag(f) {
+		return nil
+	}
+	var values []string
+	for _, value := range flagValues(f) {
+		values = append(values, prefix+value)
+	}
+	return values
+}
+
+// withPrefix returns the candidates starting with the given prefix.
+func withPrefix(candidates []string, prefix string) []string {
+	var matching []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			matching = append(matching, candidate)
+		}
+	}
+	return matching
+}
+
+func runComplete(args []string) error {
+	for _, candidate := range completions(args) {
+		fmt.Println(candidate)
+	}
+	return nil
+}
+
+func runCompletion(args []string) error {
+	fs := flag.NewFlagSet("oh-flash completion", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: oh-flash completion bash|zsh|fish\n")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("select shell to complete: bash, zsh or fish")
+	}
+	script, ok := completionScripts[fs.Arg(0)]
+	if !ok {
+		return usageErrorf("unsupported shell: %q", fs.Arg(0))
+	}
+	fmt.Print(script)
+	return nil
+}
+
+// completionScripts hold the completion script of each supported shell.
+//
+// The scripts ask oh-flash for candidates, so that boards and devices of the
+// inventory are completed as they are at the time, and complete files when
+// there are none.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for oh-flash, load with:
+#   source <(oh-flash completion bash)
+_oh_flash() {
+	local IFS=$'\n'
+	COMPREPLY=($(oh-flash __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _oh_flash oh-flash
+`,
+	"zsh": `#compdef oh-flash
+# zsh completion for oh-flash, load with:
+#   source <(oh-flash completion zsh)
+_oh_flash() {
+	local -a candidates
+	candidates=(${(f)"$(oh-flash __complete "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+	if (( ${#candidates} )); then
+		compadd -a candidates
+	else
+		_files
+	fi
+}
+compdef _oh_flash oh-flash
+`,
+	"fish": `# fish completion for oh-flash, load with:
+#   oh-flash completion fish | source
+function __oh_flash_complete
+	set -l words (commandline -opc) (commandline -ct)
+	oh-flash __complete $words[2..-1] 2>/dev/null
+end
+complete -c oh-flash -a '(__oh_flash_complete)'
+`,
+}
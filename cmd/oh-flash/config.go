@@ -0,0 +1,198 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configEnvPrefix is the prefix of environment variables providing defaults.
+const configEnvPrefix = "OH_FLASH_"
+
+// parseFlags parses command line arguments, after applying configured defaults.
+//
+// Defaults are taken from the configuration file and from environment
+// variables, in this order, with flags given on the command line taking
+// precedence over both. Values are applied to the flags of the same name,
+// so -command-retries is set with "command-retries = 5" in the configuration
+// file or with OH_FLASH_COMMAND_RETRIES=5 in the environment.
+//
+// The device selected with -device provides more defaults from the inventory
+// file, taking precedence over the configuration file and the environment.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if completingFlags != nil {
+		completingFlags(fs)
+		return errCompleting
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	// Defaults must not replace values given on the command line, or append
+	// to repeated ones.
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	section := strings.Replace(strings.TrimPrefix(fs.Name(), "oh-flash "), " ", ".", -1)
+	var setErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if setErr != nil || explicit[f.Name] {
+			return
+		}
+		if value, ok := config.lookup(section, f.Name); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				setErr = usageErrorf("invalid value %q of %s in configuration file: %w", value, f.Name, err)
+				return
+			}
+		}
+		envName := configEnvPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(envName); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				setErr = usageErrorf("invalid value %q of %s: %w", value, envName, err)
+			}
+		}
+	})
+	if setErr != nil {
+		return setErr
+	}
+	return applyDevice(fs, explicit)
+}
+
+// config holds values from the configuration file.
+//
+// Values outside of any section apply to all the commands, values in a
+// section apply to the command of the same name, such as [flash] or
+// [env.backup], and take precedence.
+type config map[string]map[string]string
+
+func (c config) lookup(section, key string) (string, bool) {
+	if value, ok := c[section][key]; ok {
+		return value, true
+	}
+	value, ok := c[""][key]
+	return value, ok
+}
+
+// configPath returns the location of the configuration file.
+//
+// The location can be changed with the OH_FLASH_CONFIG environment variable.
+func configPath() (string, error) {
+	if path := os.Getenv(configEnvPrefix + "CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "oh-flash", "config.toml"), nil
+}
+
+// loadConfig reads the configuration file, if one exists.
+func loadConfig() (config, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := readConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// readConfig reads a configuration file in a subset of the TOML format.
+//
+// Only sections and keys with string, integer and boolean values are
+// supported, which is all that is needed to express flag values.
+func readConfig(reader io.Reader) (config, error) {
+	c := config{"": {}}
+	section := ""
+	scanner := bufio.NewScanner(reader)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if c[section] == nil {
+				c[section] = make(map[string]string)
+			}
+			continue
+		}
+		idx := strings.IndexByte(line, '=')
+		if idx <= 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		key := strings.TrimSpace(line[:idx])
+		value := strings.TrimSpace(line[idx+1:])
+		if strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "'") {
+			quote := value[:1]
+			end := closingQuote(value)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string", lineno)
+			}
+			if quote == "\"" {
+				unquoted, err := strconv.Unquote(value[:end+1])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineno, err)
+				}
+				value = unquoted
+			} else {
+				// Literal strings have no escapes.
+				value = value[1:end]
+			}
+		} else if idx := strings.IndexByte(value, '#'); idx >= 0 {
+			value = strings.TrimSpace(value[:idx])
+		}
+		c[section][key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// closingQuote returns the index of the quote ending the string, or -1.
+func closingQuote(value string) int {
+	for i := 1; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && value[0] == '"':
+			i++
+		case value[i] == value[0]:
+			return i
+		}
+	}
+	return -1
+}
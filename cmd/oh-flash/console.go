@@ -0,0 +1,61 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"go.bug.st/serial.v1/enumerator"
+)
+
+func runConsole(args []string) error {
+	var boardType, portName string
+	fs := flag.NewFlagSet("oh-flash console", flag.ExitOnError)
+	fs.StringVar(&boardType, "board", "", "Type of the board to connect to")
+	fs.StringVar(&portName, "port", "", "Serial port, tcp://host:port or rfc2217://host:port, to use instead of the one found for the board")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	board, err := newBoard(boardType)
+	if err != nil {
+		return err
+	}
+	if portName == "" {
+		portInfos, err := enumerator.GetDetailedPortsList()
+		if err != nil {
+			return err
+		}
+		if portName, err = board.FindSerialPort(portInfos); err != nil {
+			return err
+		}
+	}
+	port, err := openBoardPort(board, portName)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+	fmt.Printf("Connected to %s, press Ctrl-C to quit\n", portName)
+
+	// Input is sent a line at a time, as the terminal is not switched to raw mode.
+	go io.Copy(port, os.Stdin)
+	_, err = io.Copy(os.Stdout, port)
+	return err
+}
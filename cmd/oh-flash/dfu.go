@@ -0,0 +1,92 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/zyga/oh-flash-tools/devices/dfu"
+	"github.com/zyga/oh-flash-tools/devices/usb"
+	"github.com/zyga/oh-flash-tools/progress"
+)
+
+// runDFU programs a microcontroller through its USB DFU bootloader.
+func runDFU(args []string) error {
+	fs := flag.NewFlagSet("oh-flash dfu", flag.ExitOnError)
+	device := fs.String("device", "0483:df11", "USB identifiers of the device in DFU mode, as vendor:product")
+	alt := fs.String("alt", "0", "DFU alternate setting to program, by number or name")
+	address := fs.String("address", "", "Address to write the file to, for DfuSe devices such as STM32")
+	leave := fs.Bool("leave", false, "Start the written firmware once done, for DfuSe devices")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("select firmware file to write")
+	}
+	vendor, product, err := usb.ParseID(*device)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	dev, err := dfu.OpenUSB(vendor, product, *alt)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	dfuse := dev.Functional().Version == dfu.VersionDfuSe
+	if dfuse && *address == "" {
+		return usageErrorf("select address to write to with -address, the device uses DfuSe")
+	}
+	if !dfuse && (*address != "" || *leave) {
+		return fmt.Errorf("-address and -leave are only supported by DfuSe devices")
+	}
+
+	bar := progress.NewBar(os.Stdout)
+	bar.Start(filepath.Base(fs.Arg(0)), int64(len(data)))
+	update := func(done int) { bar.Update(int64(done)) }
+	if !dfuse {
+		fmt.Printf("Writing %s over DFU\n", fs.Arg(0))
+		if err := dev.Download(data, update); err != nil {
+			return fmt.Errorf("cannot write %s: %w", fs.Arg(0), err)
+		}
+		bar.Finish()
+		return nil
+	}
+	addr, err := strconv.ParseUint(*address, 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid address: %q", *address)
+	}
+	fmt.Printf("Writing %s to memory at %#x over DfuSe\n", fs.Arg(0), addr)
+	if err := dev.DownloadTo(uint32(addr), data, update); err != nil {
+		return fmt.Errorf("cannot write %s: %w", fs.Arg(0), err)
+	}
+	bar.Finish()
+	if *leave {
+		fmt.Printf("Starting firmware at %#x\n", addr)
+		return dev.Leave(uint32(addr))
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+type dumpableBoard interface {
+	DumpFlash(uboot *ubootshell.UBootShell, offset, size uint64, w io.Writer) error
+}
+
+func runDump(args []string) error {
+	var opts sessionOptions
+	var offset, size uint64
+	var output string
+	fs := flag.NewFlagSet("oh-flash dump", flag.ExitOnError)
+	opts.addFlags(fs)
+	fs.Uint64Var(&offset, "offset", 0, "Offset of the flash region to read")
+	fs.Uint64Var(&size, "size", 0, "Size of the flash region to read")
+	fs.StringVar(&output, "o", "", "File to write the flash content to")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if output == "" {
+		return usageErrorf("select output file with -o")
+	}
+	if size == 0 {
+		return usageErrorf("select size of the flash region with -size")
+	}
+
+	sess, err := openSession(&opts)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	board, ok := sess.board.(dumpableBoard)
+	if !ok {
+		return fmt.Errorf("board %s does not support reading flash", opts.boardType)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := board.DumpFlash(sess.uboot, offset, size, w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Saved %d bytes of flash to %s\n", size, output)
+	return sess.uboot.Reset()
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+func runEnv(args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("select env command: backup or restore")
+	}
+	switch args[0] {
+	case "backup":
+		return runEnvBackup(args[1:])
+	case "restore":
+		return runEnvRestore(args[1:])
+	default:
+		return usageErrorf("unsupported env command: %q", args[0])
+	}
+}
+
+func runEnvBackup(args []string) error {
+	var opts sessionOptions
+	var output string
+	fs := flag.NewFlagSet("oh-flash env backup", flag.ExitOnError)
+	opts.addFlags(fs)
+	fs.StringVar(&output, "o", "", "File to write the environment to")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if output == "" {
+		return usageErrorf("select output file with -o")
+	}
+
+	sess, err := openSession(&opts)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	env, err := sess.uboot.PrintEnv()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if _, err := env.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Saved %d u-boot variables to %s\n", len(env), output)
+	return sess.uboot.Reset()
+}
+
+func runEnvRestore(args []string) error {
+	var opts sessionOptions
+	fs := flag.NewFlagSet("oh-flash env restore", flag.ExitOnError)
+	opts.addFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("select environment file to restore")
+	}
+
+	// Read the backup before touching the board.
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	env, err := ubootshell.ReadEnv(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	sess, err := openSession(&opts)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	if err := sess.uboot.RestoreEnv(env); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d u-boot variables from %s\n", len(env), fs.Arg(0))
+	return sess.uboot.Reset()
+}
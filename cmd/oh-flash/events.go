@@ -0,0 +1,89 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/ioextra"
+)
+
+// textEvents prints stages as they start and end.
+//
+// Progress is not printed, file transfers already draw a progress bar.
+type textEvents struct{}
+
+func (textEvents) StageStarted(stage flash.Stage) {
+	fmt.Printf("Stage: %s\n", stage.Name)
+}
+
+func (textEvents) StageProgress(stage flash.Stage, done, total int64) {}
+
+func (textEvents) StageCompleted(stage flash.Stage, elapsed time.Duration) {}
+
+func (textEvents) StageFailed(stage flash.Stage, elapsed time.Duration, err error) {
+	fmt.Printf("Stage failed after %s: %s\n", elapsed.Round(time.Millisecond), stage.Name)
+}
+
+// captureNotes notes stages in the capture of the serial port, so that the
+// replay of the capture shows where each stage starts and fails.
+//
+// Failure to note a stage is not reported, just like failure to write the
+// preview.
+type captureNotes struct {
+	transcript *ioextra.Transcript
+}
+
+func (notes captureNotes) StageStarted(stage flash.Stage) {
+	notes.transcript.Note(time.Now(), stage.Name)
+}
+
+func (notes captureNotes) StageProgress(stage flash.Stage, done, total int64) {}
+
+func (notes captureNotes) StageCompleted(stage flash.Stage, elapsed time.Duration) {}
+
+func (notes captureNotes) StageFailed(stage flash.Stage, elapsed time.Duration, err error) {
+	notes.transcript.Note(time.Now(), fmt.Sprintf("failed: %s: %s", stage.Name, err))
+}
+
+// openEventsOutput returns events written as JSON lines to the given file.
+//
+// The path "-" selects standard error, keeping events apart from messages
+// printed to standard output. The returned function closes the file.
+func openEventsOutput(path string) (flash.Events, func(), error) {
+	if path == "" {
+		return nil, func() {}, nil
+	}
+	if path == "-" {
+		return flash.NewJSONWriter(os.Stderr), func() {}, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return flash.NewJSONWriter(f), func() { closeEventsOutput(f, path) }, nil
+}
+
+func closeEventsOutput(f io.Closer, path string) {
+	if err := f.Close(); err != nil {
+		fmt.Printf("cannot write events to %s: %s\n", path, err)
+	}
+}
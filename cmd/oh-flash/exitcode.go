@@ -0,0 +1,67 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zyga/oh-flash-tools/devices/boards"
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// Exit codes of oh-flash, allowing scripts to tell kinds of failures apart.
+const (
+	exitFailure      = 1
+	exitUsage        = 2
+	exitNoDevice     = 3
+	exitTransfer     = 4
+	exitVerification = 5
+	exitValidation   = 6
+)
+
+var (
+	// errUsage is matched by errors of invalid flags or arguments.
+	errUsage = errors.New("invalid usage")
+	// errValidationFailed is matched by errors of the flashed system not
+	// booting or failing smoke tests.
+	errValidationFailed = errors.New("validation of flashed system failed")
+)
+
+// usageErrorf returns an error about invalid flags or arguments.
+func usageErrorf(format string, args ...interface{}) error {
+	return flash.WithKind(fmt.Errorf(format, args...), errUsage)
+}
+
+// exitCode returns the exit code reporting the error.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, boards.ErrPortNotFound):
+		return exitNoDevice
+	case errors.Is(err, ubootshell.ErrTransferFailed):
+		return exitTransfer
+	case errors.Is(err, openharmony.ErrVerificationFailed):
+		return exitVerification
+	case errors.Is(err, errValidationFailed):
+		return exitValidation
+	}
+	return exitFailure
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.bug.st/serial.v1/enumerator"
+
+	"github.com/zyga/oh-flash-tools/ioextra"
+)
+
+// factoryCounters counts units handled since the factory loop started,
+// which is usually one shift.
+type factoryCounters struct {
+	flashed, failed int
+}
+
+func (c factoryCounters) String() string {
+	return fmt.Sprintf("%d flashed, %d failed", c.flashed, c.failed)
+}
+
+// Cues shown once a unit is done, the bell rings once for success and three
+// times for failure, so that the operator can tell without looking.
+const (
+	passCue = "\a\033[1;37;42m  PASS  \033[0m"
+	failCue = "\a\a\a\033[1;37;41m  FAIL  \033[0m"
+)
+
+func runFactory(args []string) error {
+	var job flashJob
+	var logDir string
+	fs := flag.NewFlagSet("oh-flash factory", flag.ExitOnError)
+	job.addFlags(fs)
+	fs.StringVar(&logDir, "log-dir", "factory-logs", "Directory with the serial port log of each unit and the summary of all of them")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	defer job.close()
+	if err := job.prepare(); err != nil {
+		return err
+	}
+	board, err := newBoard(job.opts.boardType)
+	if err != nil {
+		return err
+	}
+	// Boards are told apart by plugging them in and out.
+	if ioextra.IsNetworkSerial(job.opts.portName) {
+		return fmt.Errorf("cannot tell when boards behind %s are replaced, use a local serial port", job.opts.portName)
+	}
+	if _, ok := board.(romBoard); !ok {
+		if job.bootCheck.Banner == "" {
+			return usageErrorf("select the text printed by the flashed system once booted with -boot-check, each unit is checked")
+		}
+		if job.powerAfter == "" {
+			job.powerAfter = "off"
+		}
+	}
+	job.opts.waitForBoard = true
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	summary, err := os.OpenFile(filepath.Join(logDir, "summary.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer summary.Close()
+
+	var counters factoryCounters
+	for unit := 1; ; unit++ {
+		start := time.Now()
+		name := fmt.Sprintf("unit-%s-%d.log", start.Format("20060102-150405"), unit)
+		job.opts.capture = filepath.Join(logDir, name)
+		fmt.Printf("Unit %d: plug in the next %s board\n", unit, job.opts.boardType)
+		err := job.run()
+		if errors.Is(err, context.Canceled) {
+			fmt.Printf("Factory loop interrupted, %s\n", counters)
+			return nil
+		}
+		result := "PASS"
+		if err != nil {
+			result = fmt.Sprintf("FAIL: %s", err)
+			counters.failed++
+			powerOffFailed(&job.opts)
+			fmt.Printf("%s unit %d: %s\n", failCue, unit, err)
+		} else {
+			counters.flashed++
+			fmt.Printf("%s unit %d flashed in %s\n", passCue, unit, time.Since(start).Round(time.Second))
+		}
+		fmt.Printf("Shift so far: %s\n", counters)
+		fmt.Fprintf(summary, "%s unit %d, log %s, %s (%s so far)\n", start.Format(time.RFC3339), unit, name, result, counters)
+		if err := waitForBoardRemoval(&job.opts, board); err != nil {
+			return err
+		}
+	}
+}
+
+// powerOffFailed switches off a unit that failed, if the power controller
+// does not need the operator, as the session was closed without doing it.
+func powerOffFailed(opts *sessionOptions) {
+	if opts.powerType == "" || opts.powerType == "manual" {
+		return
+	}
+	portInfos, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		fmt.Printf("cannot switch the board off: %s\n", err)
+		return
+	}
+	ctrl, err := newPowerController(opts, portInfos)
+	if err != nil {
+		fmt.Printf("cannot switch the board off: %s\n", err)
+		return
+	}
+	defer ctrl.Close()
+	if err := ctrl.PowerOff(); err != nil {
+		fmt.Printf("cannot switch the board off: %s\n", err)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/devices/fastboot"
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// fastbootBoard is implemented by boards which can be flashed over USB
+// fastboot, started from the u-boot shell.
+type fastbootBoard interface {
+	FastbootCommand() string
+	FlashFastboot(dev *fastboot.Device, assets *openharmony.Assets, events flash.Events, observer ubootshell.TransferObserver) error
+}
+
+// fastbootWaitTime is the time allowed for the board to appear on USB once
+// fastboot is started.
+const fastbootWaitTime = 10 * time.Second
+
+// openFastboot waits for a device in fastboot mode and opens it.
+func openFastboot() (*fastboot.Device, error) {
+	deadline := time.Now().Add(fastbootWaitTime)
+	for {
+		dev, err := fastboot.OpenUSB()
+		if err == nil || time.Now().After(deadline) {
+			return dev, err
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// flashFastboot starts fastboot from the u-boot shell and flashes the assets
+// over USB, instead of the serial port.
+func flashFastboot(sess *session, opts *sessionOptions, assets *openharmony.Assets) error {
+	board, ok := sess.board.(fastbootBoard)
+	if !ok {
+		return fmt.Errorf("board %s does not support -fastboot", opts.boardType)
+	}
+	cmd := board.FastbootCommand()
+	var dev *fastboot.Device
+	err := flash.Run(sess.events, flash.Stage{Kind: flash.BootStage, Name: "start fastboot"}, func() error {
+		if err := sess.uboot.RequireCommands(strings.Fields(cmd)[0]); err != nil {
+			return err
+		}
+		// The command runs until fastboot is left, the prompt does not re-appear.
+		if err := sess.uboot.SpecialCommand(cmd, "\n"); err != nil {
+			return err
+		}
+		var err error
+		dev, err = openFastboot()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	dev.WithInfo(func(msg string) { fmt.Printf("fastboot: %s\n", msg) })
+	if product, err := dev.GetVar("product"); err == nil {
+		fmt.Printf("Found fastboot device %s\n", product)
+	}
+	// U-boot reports problems on the serial console while flashing over USB.
+	return sess.unattended(func() error {
+		return board.FlashFastboot(dev, assets, sess.events, ubootshell.NewProgressBar(os.Stdout))
+	})
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/devices/fel"
+	"github.com/zyga/oh-flash-tools/progress"
+)
+
+// felStep is a step of booting over USB FEL, writing a file to memory or,
+// without a file, executing code at the address.
+type felStep struct {
+	addr uint32
+	path string
+}
+
+// felStepFlag appends steps given on the command line, keeping their order.
+type felStepFlag struct {
+	steps *[]felStep
+	exec  bool
+}
+
+func (f felStepFlag) String() string {
+	return ""
+}
+
+func (f felStepFlag) Set(value string) error {
+	addrText, path := value, ""
+	if !f.exec {
+		idx := strings.IndexByte(value, '=')
+		if idx < 0 {
+			return fmt.Errorf("expected address=path, such as 0x0=spl.bin")
+		}
+		addrText, path = value[:idx], value[idx+1:]
+	}
+	addr, err := strconv.ParseUint(addrText, 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid address: %q", addrText)
+	}
+	*f.steps = append(*f.steps, felStep{addr: uint32(addr), path: path})
+	return nil
+}
+
+// addFELFlags adds flags booting the board over USB FEL.
+func addFELFlags(fs *flag.FlagSet, steps *[]felStep) {
+	fs.Var(felStepFlag{steps: steps}, "fel-load", "Over USB FEL, write a file to memory, as address=path, may be repeated")
+	fs.Var(felStepFlag{steps: steps, exec: true}, "fel-exec", "Over USB FEL, execute code at the address, in order with -fel-load")
+}
+
+// felWaitTime is the time allowed for the board to appear on USB after reset.
+const felWaitTime = 10 * time.Second
+
+// openFEL waits for a device in FEL mode and opens it.
+func openFEL() (*fel.Device, error) {
+	deadline := time.Now().Add(felWaitTime)
+	for {
+		dev, err := fel.OpenUSB()
+		if err == nil || time.Now().After(deadline) {
+			return dev, err
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// bootFEL performs the steps over USB FEL.
+//
+// This allows starting u-boot on boards whose bootloader is missing or
+// broken, typically by loading and executing the SPL, which initializes
+// memory and returns to FEL, and then loading and executing u-boot itself.
+func bootFEL(steps []felStep) error {
+	dev, err := openFEL()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	version, err := dev.Version()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Found Allwinner %s in FEL mode\n", version.SocName())
+	for _, step := range steps {
+		if step.path == "" {
+			fmt.Printf("Executing code at %#x\n", step.addr)
+			if err := dev.Execute(step.addr); err != nil {
+				return fmt.Errorf("cannot execute code at %#x: %w", step.addr, err)
+			}
+			continue
+		}
+		data, err := ioutil.ReadFile(step.path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Writing %s to memory at %#x\n", step.path, step.addr)
+		bar := progress.NewBar(os.Stdout)
+		bar.Start(filepath.Base(step.path), int64(len(data)))
+		if err := dev.WriteMemory(step.addr, data, func(done int) { bar.Update(int64(done)) }); err != nil {
+			return fmt.Errorf("cannot write %s: %w", step.path, err)
+		}
+		bar.Finish()
+	}
+	return nil
+}
+
+func runFEL(args []string) error {
+	var steps []felStep
+	fs := flag.NewFlagSet("oh-flash fel", flag.ExitOnError)
+	addFELFlags(fs, &steps)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	return bootFEL(steps)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/zyga/oh-flash-tools/logging"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/openharmony/fetch"
+)
+
+// stdinLocation is given instead of a path to read a file from standard input.
+const stdinLocation = "-"
+
+// assetFetcher downloads assets given as URLs.
+type assetFetcher struct {
+	cache *fetch.Cache
+	// stdinPath holds the file read from standard input, removed by close.
+	stdinPath string
+}
+
+// fetch replaces the URL with the path of the downloaded file.
+//
+// Files given as "-" are read from standard input, to a temporary file, as
+// the size of files is needed before sending them. Local paths are left
+// unchanged.
+func (f *assetFetcher) fetch(location *string, digest string) error {
+	if *location == stdinLocation {
+		return f.readStdin(location)
+	}
+	if !fetch.IsURL(*location) {
+		return nil
+	}
+	if f.cache == nil {
+		cache, err := fetch.DefaultCache()
+		if err != nil {
+			return err
+		}
+		f.cache = cache.WithLogger(logging.Stdout)
+	}
+	name, err := f.cache.Fetch(*location, digest)
+	if err != nil {
+		return err
+	}
+	*location = name
+	return nil
+}
+
+// readStdin replaces the location with the path of a temporary file holding
+// the data read from standard input.
+func (f *assetFetcher) readStdin(location *string) error {
+	if f.stdinPath != "" {
+		return usageErrorf("only one file can be read from standard input")
+	}
+	tmp, err := ioutil.TempFile("", "oh-flash-stdin-")
+	if err != nil {
+		return err
+	}
+	f.stdinPath = tmp.Name()
+	if _, err := io.Copy(tmp, os.Stdin); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot read standard input: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	*location = f.stdinPath
+	return nil
+}
+
+// close removes the file read from standard input, if any.
+func (f *assetFetcher) close() {
+	if f.stdinPath != "" {
+		os.Remove(f.stdinPath)
+		f.stdinPath = ""
+	}
+}
+
+// fetchManifest downloads assets listed in the manifest, checking their digests.
+func (f *assetFetcher) fetchManifest(m *openharmony.Manifest) error {
+	for _, asset := range m.Entries() {
+		if err := f.fetch(&asset.Path, asset.SHA256); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchAssets downloads assets given on the command line.
+func (f *assetFetcher) fetchAssets(assets *openharmony.Assets) error {
+	for _, name := range assets.Names() {
+		location := assets.Get(name)
+		if err := f.fetch(&location, ""); err != nil {
+			return err
+		}
+		assets.Set(name, location)
+	}
+	return nil
+}
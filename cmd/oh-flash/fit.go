@@ -0,0 +1,203 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/ubootshell/fit"
+)
+
+// pathListFlag collects paths given by a repeated flag.
+type pathListFlag struct {
+	paths *[]string
+}
+
+func (f pathListFlag) String() string {
+	return ""
+}
+
+func (f pathListFlag) Set(value string) error {
+	*f.paths = append(*f.paths, value)
+	return nil
+}
+
+// kernelCompression returns the compression of the kernel, as known to
+// u-boot, guessed from the file name.
+func kernelCompression(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		return "gzip"
+	case ".lzma":
+		return "lzma"
+	case ".lz4":
+		return "lz4"
+	case ".bz2":
+		return "bzip2"
+	}
+	return "none"
+}
+
+// fitTimestamp returns the time of creation of FIT images, taken from
+// SOURCE_DATE_EPOCH for reproducible builds, as mkimage does.
+func fitTimestamp() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Now(), nil
+	}
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, usageErrorf("invalid SOURCE_DATE_EPOCH: %q", epoch)
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// runFIT builds a FIT image bundling a kernel with device trees and a ramdisk.
+func runFIT(args []string) error {
+	var kernel, ramdisk, output, source string
+	var fdts []string
+	img := fit.Image{Components: []fit.Component{{Name: "kernel-1", Type: fit.Kernel}}}
+	k := &img.Components[0]
+	var load, entry uint64
+	var hashAlgo string
+	fs := flag.NewFlagSet("oh-flash fit", flag.ExitOnError)
+	fs.StringVar(&kernel, "kernel", "", "Kernel image to bundle")
+	fs.Var(pathListFlag{&fdts}, "fdt", "Device tree to bundle, may be repeated, each gets its own configuration")
+	fs.StringVar(&ramdisk, "ramdisk", "", "Initial ramdisk to bundle")
+	fs.StringVar(&k.Arch, "arch", "arm", "Architecture of the kernel, such as arm or arm64")
+	fs.StringVar(&k.OS, "os", "linux", "Operating system of the kernel, as known to u-boot")
+	fs.StringVar(&k.Compression, "compression", "", "Compression of the kernel, guessed from the file name if empty")
+	fs.Uint64Var(&load, "load", 0, "Address in memory where u-boot places the kernel")
+	fs.Uint64Var(&entry, "entry", 0, "Entry point of the kernel, the load address if zero")
+	fs.StringVar(&hashAlgo, "hash", fit.SHA256, "Hash of each image verified by u-boot: crc32, sha1, sha256 or none")
+	fs.StringVar(&img.Description, "description", "OpenHarmony", "Description of the FIT image")
+	fs.StringVar(&output, "o", "", "File to write the FIT image to")
+	fs.StringVar(&source, "its", "", "Also write the image source, for mkimage -f, to this file")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if kernel == "" {
+		return usageErrorf("select kernel image with -kernel")
+	}
+	if load == 0 {
+		return usageErrorf("select load address of the kernel with -load")
+	}
+	if output == "" && source == "" {
+		return usageErrorf("select output file with -o or -its")
+	}
+	if hashAlgo == "none" {
+		hashAlgo = ""
+	}
+	if entry == 0 {
+		entry = load
+	}
+	var err error
+	if img.Timestamp, err = fitTimestamp(); err != nil {
+		return err
+	}
+	// The source refers to images by path, which mkimage resolves relative
+	// to the directory of the source.
+	abs := func(path string) string {
+		if source == "" {
+			return path
+		}
+		if p, err := filepath.Abs(path); err == nil {
+			return p
+		}
+		return path
+	}
+
+	k.Path, k.Load, k.Entry, k.Hash = abs(kernel), load, entry, hashAlgo
+	if k.Compression == "" {
+		k.Compression = kernelCompression(kernel)
+	}
+	k.Description = filepath.Base(kernel)
+	var ramdiskName string
+	if ramdisk != "" {
+		ramdiskName = "ramdisk-1"
+		img.Components = append(img.Components, fit.Component{
+			Name: ramdiskName, Description: filepath.Base(ramdisk), Type: fit.Ramdisk,
+			Arch: k.Arch, OS: k.OS, Path: abs(ramdisk), Hash: hashAlgo,
+		})
+	}
+	for i, path := range fdts {
+		name := fmt.Sprintf("fdt-%d", i+1)
+		img.Components = append(img.Components, fit.Component{
+			Name: name, Description: filepath.Base(path), Type: fit.FlatDT,
+			Arch: k.Arch, Path: abs(path), Hash: hashAlgo,
+		})
+		img.Configurations = append(img.Configurations, fit.Configuration{
+			Name: fmt.Sprintf("conf-%d", i+1), Description: filepath.Base(path),
+			Kernel: k.Name, FDT: name, Ramdisk: ramdiskName,
+		})
+	}
+	if len(fdts) == 0 {
+		img.Configurations = append(img.Configurations, fit.Configuration{
+			Name: "conf-1", Kernel: k.Name, Ramdisk: ramdiskName,
+		})
+	}
+	if err := img.Check(); err != nil {
+		return usageErrorf("%v", err)
+	}
+
+	for _, out := range []struct {
+		path  string
+		write func(f *os.File) error
+	}{
+		{output, func(f *os.File) error { return img.WriteBlob(f) }},
+		{source, func(f *os.File) error { return img.WriteSource(f) }},
+	} {
+		if out.path == "" {
+			continue
+		}
+		f, err := os.Create(out.path)
+		if err != nil {
+			return err
+		}
+		if err := out.write(f); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	for _, conf := range img.Configurations {
+		fmt.Printf("Configuration %s: %s\n", conf.Name, describeConfiguration(&img, &conf))
+	}
+	return nil
+}
+
+// describeConfiguration returns the descriptions of the components of the
+// configuration.
+func describeConfiguration(img *fit.Image, conf *fit.Configuration) string {
+	var parts []string
+	for _, name := range []string{conf.Kernel, conf.FDT, conf.Ramdisk} {
+		for _, comp := range img.Components {
+			if name != "" && comp.Name == name {
+				parts = append(parts, comp.Description)
+			}
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/flashhelper"
+	"github.com/zyga/oh-flash-tools/logging"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// helperBoard is implemented by boards which can be flashed from a flashing
+// helper booted from memory.
+type helperBoard interface {
+	BootHelper(uboot *ubootshell.UBootShell, assets *openharmony.Assets, helperPath string) ([]flashhelper.Target, error)
+}
+
+// helperOptions describe flashing from Linux userspace of a flashing helper,
+// instead of from u-boot.
+type helperOptions struct {
+	image       string
+	prompt      string
+	url         string
+	setup       string
+	dir         string
+	bootTimeout time.Duration
+	timeout     time.Duration
+}
+
+func (h *helperOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&h.image, "helper", "", "Flashing helper, a kernel with an initramfs, to boot from memory and flash images from Linux instead of u-boot")
+	fs.StringVar(&h.prompt, "helper-prompt", flashhelper.DefaultPrompt, "Shell prompt of the flashing helper")
+	fs.StringVar(&h.url, "helper-url", "", "Serve images to the flashing helper over HTTP at this URL, such as http://192.168.1.10:8080, instead of the serial port")
+	fs.StringVar(&h.setup, "helper-setup", "", "Command run in the flashing helper before writing images, such as udhcpc -i eth0")
+	fs.StringVar(&h.dir, "helper-dir", "/tmp", "Directory of the flashing helper receiving images sent over the serial port")
+	fs.DurationVar(&h.bootTimeout, "helper-boot-timeout", time.Minute, "Maximum time from starting the flashing helper until its shell prompt")
+	fs.DurationVar(&h.timeout, "helper-timeout", 10*time.Minute, "Maximum time for the flashing helper to write each image")
+}
+
+// listenAddr returns the address serving images, with the port of the URL.
+func (h *helperOptions) listenAddr() (string, error) {
+	u, err := url.Parse(h.url)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return "", usageErrorf("invalid -helper-url %q, expected http://address:port", h.url)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	return ":" + port, nil
+}
+
+// flashHelper boots the flashing helper and writes the assets from it,
+// instead of from u-boot. The board is then rebooted into the flashed system.
+func flashHelper(sess *session, opts *sessionOptions, assets *openharmony.Assets, h *helperOptions) error {
+	board, ok := sess.board.(helperBoard)
+	if !ok {
+		return usageErrorf("board %s does not support -helper", opts.boardType)
+	}
+	var transport flashhelper.Transport
+	if h.url != "" {
+		addr, err := h.listenAddr()
+		if err != nil {
+			return err
+		}
+		network, err := flashhelper.ServeNetwork(addr, h.url)
+		if err != nil {
+			return err
+		}
+		defer network.Close()
+		fmt.Printf("Serving images to the flashing helper at %s\n", h.url)
+		transport = network
+	} else {
+		transport = flashhelper.NewSerial(sess.interrupt, h.dir).WithObserver(ubootshell.NewProgressBar(os.Stdout))
+	}
+	targets, err := board.BootHelper(sess.uboot, assets, h.image)
+	if err != nil {
+		return err
+	}
+	shell := flashhelper.NewShell(sess.uboot.Console()).WithPrompt(h.prompt).WithTimeout(h.timeout).WithLogger(logging.Stdout)
+	err = flash.Run(sess.events, flash.Stage{Kind: flash.BootStage, Name: "wait for flashing helper"}, func() error { return shell.WaitForPrompt(h.bootTimeout) })
+	if err != nil {
+		return err
+	}
+	if h.setup != "" {
+		if _, err := shell.Run(h.setup); err != nil {
+			return fmt.Errorf("cannot set up flashing helper: %w", err)
+		}
+	}
+	helper := flashhelper.New(shell, transport).WithEvents(sess.events)
+	if err := helper.Flash(targets); err != nil {
+		return err
+	}
+	fmt.Printf("Rebooting into the flashed system\n")
+	return helper.Reboot()
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/zyga/oh-flash-tools/devices/boards"
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// errorHint returns a suggestion for recovering from the error, if any.
+func errorHint(err error) string {
+	switch {
+	case errors.Is(err, boards.ErrPortNotFound):
+		return "check that the board is connected, see list-ports, or pick the port with -port"
+	case errors.Is(err, ubootshell.ErrAutobootMissed):
+		return "check TX/RX wiring, the baud rate and that the board was reset; see -autoboot-banner and -interrupt-keys"
+	case errors.Is(err, ubootshell.ErrTransferFailed):
+		return "the serial link may be dropping data; try -write-chunk-size, -write-chunk-delay, -write-rate or a lower -transfer-baud-rate"
+	case errors.Is(err, ubootshell.ErrFlashWriteFailed):
+		return "the flash may be write-protected or worn out"
+	}
+	stage, ok := flash.FailedStage(err)
+	if !ok {
+		return ""
+	}
+	switch stage.Kind {
+	case flash.ResetStage:
+		return "check the power controller, see -power and -reset-method"
+	case flash.BootStage, flash.TestStage:
+		return "the image was written but the board did not boot as expected; record the console with -capture and inspect it with replay"
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/devices/hisi"
+	"github.com/zyga/oh-flash-tools/progress"
+)
+
+// hisiStep is a file, or the start of a file, written to memory by the boot
+// ROM of a HiSilicon SoC.
+type hisiStep struct {
+	addr uint32
+	size int64 // zero sends the whole file
+	path string
+}
+
+// hisiStepFlag appends steps given on the command line, keeping their order.
+type hisiStepFlag struct {
+	steps *[]hisiStep
+}
+
+func (f hisiStepFlag) String() string {
+	return ""
+}
+
+func (f hisiStepFlag) Set(value string) error {
+	idx := strings.IndexByte(value, '=')
+	if idx < 0 {
+		return fmt.Errorf("expected address=path or address:size=path, such as 0x4010500:0x4f00=u-boot.bin")
+	}
+	addrText, sizeText, path := value[:idx], "", value[idx+1:]
+	if idx := strings.IndexByte(addrText, ':'); idx >= 0 {
+		addrText, sizeText = addrText[:idx], addrText[idx+1:]
+	}
+	addr, err := strconv.ParseUint(addrText, 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid address: %q", addrText)
+	}
+	var size uint64
+	if sizeText != "" {
+		if size, err = strconv.ParseUint(sizeText, 0, 32); err != nil || size == 0 {
+			return fmt.Errorf("invalid size: %q", sizeText)
+		}
+	}
+	*f.steps = append(*f.steps, hisiStep{addr: uint32(addr), size: int64(size), path: path})
+	return nil
+}
+
+// addHiSiliconFlags adds flags booting the board with the serial download
+// protocol of HiSilicon boot ROMs.
+func addHiSiliconFlags(fs *flag.FlagSet, steps *[]hisiStep) {
+	fs.Var(hisiStepFlag{steps: steps}, "hisi-load", "Over the HiSilicon boot ROM serial download, write a file to memory, as address=path or address:size=path, may be repeated")
+}
+
+// bootHiSilicon performs the steps with the boot ROM of a HiSilicon SoC,
+// which polls the serial port right after reset.
+//
+// This allows starting u-boot on boards whose SPI flash is blank or holds a
+// broken bootloader, typically by loading the DDR initialization table of
+// the SoC, the start of u-boot to SRAM and then the whole u-boot to DRAM,
+// as HiTool does.
+func bootHiSilicon(port io.ReadWriter, steps []hisiStep) error {
+	dev := hisi.New(port)
+	if err := dev.WaitForBootMode(); err != nil {
+		return err
+	}
+	fmt.Printf("Found HiSilicon boot ROM waiting for download\n")
+	for _, step := range steps {
+		data, err := ioutil.ReadFile(step.path)
+		if err != nil {
+			return err
+		}
+		if step.size != 0 {
+			if step.size > int64(len(data)) {
+				return fmt.Errorf("cannot write %#x bytes of %s, the file has only %#x", step.size, step.path, len(data))
+			}
+			data = data[:step.size]
+		}
+		fmt.Printf("Writing %s to memory at %#x\n", step.path, step.addr)
+		bar := progress.NewBar(os.Stdout)
+		bar.Start(filepath.Base(step.path), int64(len(data)))
+		if err := dev.WriteMemory(step.addr, data, func(done int) { bar.Update(int64(done)) }); err != nil {
+			return fmt.Errorf("cannot write %s: %w", step.path, err)
+		}
+		bar.Finish()
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.bug.st/serial.v1"
+	"go.bug.st/serial.v1/enumerator"
+
+	"github.com/zyga/oh-flash-tools/devices/serialport"
+	"github.com/zyga/oh-flash-tools/ioextra"
+)
+
+// hotplugInterval is the time between looking for a board being plugged in.
+const hotplugInterval = 500 * time.Millisecond
+
+// waitForBoard waits until the serial port of the board appears, as selected
+// with -wait-for-board.
+//
+// A port given with -port is waited for by name, otherwise the board looks
+// for its port among those present. Ports are polled, which works the same
+// on all platforms. Ports on the network are not waited for.
+func waitForBoard(opts *sessionOptions, board serialBoard) error {
+	if ioextra.IsNetworkSerial(opts.portName) {
+		return nil
+	}
+	fmt.Printf("Waiting for %s board to be plugged in\n", opts.boardType)
+	for {
+		found, err := boardPresent(opts.portName, board)
+		if err != nil {
+			return err
+		}
+		if found {
+			return nil
+		}
+		time.Sleep(hotplugInterval)
+	}
+}
+
+// waitForBoardRemoval waits until the serial port of the board disappears,
+// once the board is unplugged.
+func waitForBoardRemoval(opts *sessionOptions, board serialBoard) error {
+	if ioextra.IsNetworkSerial(opts.portName) {
+		return nil
+	}
+	fmt.Printf("Unplug the %s board\n", opts.boardType)
+	for {
+		found, err := boardPresent(opts.portName, board)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+		time.Sleep(hotplugInterval)
+	}
+}
+
+// boardPresent returns true if the port, or the port of the board if no
+// port is given, is present.
+func boardPresent(portName string, board serialBoard) (bool, error) {
+	if portName != "" {
+		names, err := serial.GetPortsList()
+		if err != nil {
+			return false, err
+		}
+		portName = serialport.NormalizePortName(portName)
+		for _, name := range names {
+			if name == portName {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	portInfos, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return false, err
+	}
+	_, err = board.FindSerialPort(portInfos)
+	return err == nil, nil
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.bug.st/serial.v1/enumerator"
+)
+
+// inventory describes the devices of a lab, by name.
+//
+// Each device maps keys to values of the flags of the same name, such as
+// board, power and power-channel. The serial key holds the serial number of
+// the USB serial adapter of the board, which selects the port.
+type inventory map[string]map[string]string
+
+// deviceName is the value of -device, naming a device of the inventory.
+//
+// Other commands use -device differently, the type tells them apart.
+type deviceName string
+
+func (name *deviceName) String() string {
+	return string(*name)
+}
+
+func (name *deviceName) Set(value string) error {
+	*name = deviceName(value)
+	return nil
+}
+
+// inventoryPath returns the location of the inventory file.
+//
+// The location can be changed with the OH_FLASH_INVENTORY environment variable.
+func inventoryPath() (string, error) {
+	if path := os.Getenv(configEnvPrefix + "INVENTORY"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "oh-flash", "devices.yaml"), nil
+}
+
+// loadInventory reads the inventory file.
+func loadInventory() (inventory, string, error) {
+	path, err := inventoryPath()
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, path, err
+	}
+	defer f.Close()
+	inv, err := readInventory(f)
+	if err != nil {
+		return nil, path, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	return inv, path, nil
+}
+
+// readInventory reads an inventory file in a subset of the YAML format.
+//
+// Only a mapping of device names to mappings of keys to scalar values is
+// supported, nested by indentation:
+//
+//	camera-rig-3:
+//	  board: hi3518ev300
+//	  serial: A50285BI
+//	  power: ykush
+//	  power-channel: 3
+func readInventory(reader io.Reader) (inventory, error) {
+	inv := make(inventory)
+	var device map[string]string
+	scanner := bufio.NewScanner(reader)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		text := scanner.Text()
+		line := strings.TrimSpace(text)
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx <= 0 {
+			return nil, fmt.Errorf("line %d: expected key: value", lineno)
+		}
+		key, value := strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])
+		value, err := inventoryValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		if text[0] != ' ' && text[0] != '\t' {
+			if value != "" {
+				return nil, fmt.Errorf("line %d: expected device name followed by indented keys", lineno)
+			}
+			if inv[key] != nil {
+				return nil, fmt.Errorf("line %d: device %s defined again", lineno, key)
+			}
+			device = make(map[string]string)
+			inv[key] = device
+			continue
+		}
+		if device == nil {
+			return nil, fmt.Errorf("line %d: key %s outside of any device", lineno, key)
+		}
+		device[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// inventoryValue returns a scalar value, without quotes or trailing comment.
+func inventoryValue(value string) (string, error) {
+	if strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "'") {
+		end := closingQuote(value)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if value[0] == '"' {
+			return strconv.Unquote(value[:end+1])
+		}
+		// Single quotes are escaped by doubling them.
+		return strings.Replace(value[1:end], "''", "'", -1), nil
+	}
+	if idx := strings.Index(value, " #"); idx >= 0 {
+		value = strings.TrimSpace(value[:idx])
+	}
+	return value, nil
+}
+
+// applyDevice sets flags from the inventory entry of the device selected
+// with -device, except for flags given on the command line.
+//
+// Keys that are not flags of the command are ignored, as an entry describes
+// everything about the device while commands use some of it.
+func applyDevice(fs *flag.FlagSet, explicit map[string]bool) error {
+	f := fs.Lookup("device")
+	if f == nil {
+		return nil
+	}
+	device, ok := f.Value.(*deviceName)
+	if !ok || *device == "" {
+		return nil
+	}
+	name := device.String()
+	inv, path, err := loadInventory()
+	if err != nil {
+		return err
+	}
+	entry, ok := inv[name]
+	if !ok {
+		return fmt.Errorf("cannot find device %s in %s", name, path)
+	}
+	keys := make([]string, 0, len(entry))
+	for key := range entry {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := entry[key]
+		if key == "serial" {
+			if fs.Lookup("port") == nil || explicit["port"] {
+				continue
+			}
+			if value, err = findPortBySerial(value); err != nil {
+				return fmt.Errorf("cannot find serial port of device %s: %w", name, err)
+			}
+			key = "port"
+		}
+		if fs.Lookup(key) == nil || explicit[key] {
+			continue
+		}
+		if err := fs.Set(key, value); err != nil {
+			return fmt.Errorf("invalid value %q of %s of device %s: %w", value, key, name, err)
+		}
+	}
+	return nil
+}
+
+// findPortBySerial returns the name of the USB serial port with the given
+// serial number.
+func findPortBySerial(serial string) (string, error) {
+	portInfos, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, portInfo := range portInfos {
+		if portInfo.IsUSB && portInfo.SerialNumber == serial {
+			names = append(names, portInfo.Name)
+		}
+	}
+	if len(names) != 1 {
+		return "", fmt.Errorf("found %d ports with serial number %s", len(names), serial)
+	}
+	return names[0], nil
+}
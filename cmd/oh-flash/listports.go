@@ -0,0 +1,82 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"go.bug.st/serial.v1/enumerator"
+
+	"github.com/zyga/oh-flash-tools/devices/buspirate"
+	"github.com/zyga/oh-flash-tools/devices/serialport"
+)
+
+func runListPorts(args []string) error {
+	fs := flag.NewFlagSet("oh-flash list-ports", flag.ExitOnError)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	portInfos, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return err
+	}
+	if len(portInfos) == 0 {
+		fmt.Printf("No serial ports found\n")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "PORT\tUSB ID\tSERIAL\tPRODUCT\tDEVICE\n")
+	for _, portInfo := range portInfos {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", portInfo.Name, orDash(serialport.USBID(portInfo)),
+			orDash(portInfo.SerialNumber), orDash(portInfo.Product), identifyPort(portInfo))
+	}
+	return w.Flush()
+}
+
+// identifyPort returns the names of the known devices the port looks like.
+//
+// The same rules are used as when looking for the device before flashing, so
+// that ports of boards with ambiguous adapters are all listed as candidates.
+func identifyPort(portInfo *enumerator.PortDetails) string {
+	single := []*enumerator.PortDetails{portInfo}
+	var names []string
+	for _, boardType := range boardTypes {
+		board, err := newBoard(boardType)
+		if err != nil {
+			continue
+		}
+		if _, err := board.FindSerialPort(single); err == nil {
+			names = append(names, boardType)
+		}
+	}
+	if _, err := buspirate.FindBusPirate(single); err == nil {
+		names = append(names, "bus pirate")
+	}
+	return orDash(strings.Join(names, ", "))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -17,125 +17,495 @@ limitations under the License.
 package main
 
 import (
-	"context"
 	"flag"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
-
-	"go.bug.st/serial.v1/enumerator"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/zyga/oh-flash-tools/devices/boards"
-	"github.com/zyga/oh-flash-tools/devices/buspirate"
-	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/logging"
 	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/timing"
 	"github.com/zyga/oh-flash-tools/ubootshell"
 )
 
-func run() error {
-	var boardType string
-	var assets openharmony.Assets
-	var debug bool
-	flag.BoolVar(&debug, "debug", false, "Show debugging messages")
-	flag.StringVar(&boardType, "board", "", "Type of the board to program")
-	flag.StringVar(&assets.BootLoaderPath, "bootloader", "", "Bootloader image to use")
-	flag.StringVar(&assets.KernelPath, "kernel", "", "Kernel image to use")
-	flag.StringVar(&assets.RootfsPath, "rootfs", "", "Root file system image to use")
-	flag.StringVar(&assets.UserfsPath, "userfs", "", "User file system image to use")
-	flag.Parse()
-
-	type flashableBoard interface {
-		FindSerialPort(portInfos []*enumerator.PortDetails) (string, error)
-		OpenSerialPort(portName string) (io.ReadWriteCloser, error)
-		FlashAssets(uboot *ubootshell.UBootShell, assets *openharmony.Assets) error
-	}
-	var board flashableBoard
-
-	switch boardType {
-	case "hi3518ev300":
-		board = &boards.Hi3518ev300{}
-	case "":
-		return fmt.Errorf("select board type with -board")
-	default:
-		return fmt.Errorf("unsupported board type: %q", boardType)
+// flashJob describes flashing a board, as given on the command line.
+type flashJob struct {
+	opts         sessionOptions
+	assets       openharmony.Assets
+	manifestPath string
+	bundlePath   string
+	checks       assetChecks
+	fetcher      assetFetcher
+	bootCheck    ubootshell.BootCheck
+	smokeTest    smokeTestOptions
+	timingPath   string
+	eventsPath   string
+	powerAfter   string
+	only, skip   string
+	attempts     int
+	useFastboot  bool
+	helper       helperOptions
+	flashOpts    boards.Options
+	provision    provisionOptions
+	secureBoot   secureBootOptions
+
+	cleanup []func() // run by close
+}
+
+func (job *flashJob) addFlags(fs *flag.FlagSet) {
+	job.opts.addFlags(fs)
+	fs.StringVar(&job.assets.BootLoaderPath, "bootloader", "", "Bootloader image to use, path or URL")
+	fs.StringVar(&job.assets.KernelPath, "kernel", "", "Kernel image to use, path or URL")
+	fs.StringVar(&job.assets.DTBPath, "dtb", "", "Device tree blob to use, path or URL")
+	fs.StringVar(&job.assets.RootfsPath, "rootfs", "", "Root file system image to use, path or URL")
+	fs.StringVar(&job.assets.UserfsPath, "userfs", "", "User file system image to use, path or URL")
+	fs.StringVar(&job.assets.UBootPath, "uboot", "", "U-boot partition image to use, path or URL")
+	fs.StringVar(&job.assets.BootLinuxPath, "boot-linux", "", "Boot image with the Linux kernel, path or URL")
+	fs.StringVar(&job.assets.SystemPath, "system", "", "System partition image to use, path or URL")
+	fs.StringVar(&job.assets.VendorPath, "vendor", "", "Vendor partition image to use, path or URL")
+	fs.StringVar(&job.assets.UserdataPath, "userdata", "", "User data partition image to use, path or URL")
+	fs.Var(imageFlag{&job.assets}, "image", "Image of any partition as name=path, such as trust=trust.img, may be repeated")
+	fs.StringVar(&job.bundlePath, "bundle", "", "Archive with images to use, path or URL, individual images take precedence")
+	fs.StringVar(&job.checks.checksums, "checksums", "", "SHA256SUMS file listing digests of all the images")
+	fs.StringVar(&job.checks.signature, "checksums-signature", "", "Detached signature of the checksums file, .minisig or gpg")
+	fs.StringVar(&job.checks.key, "signing-key", "", "Minisign public key or gpg keyring checking the signature")
+	fs.BoolVar(&job.checks.requireSigned, "require-signed", false, "Refuse to flash images without signed checksums")
+	fs.StringVar(&job.manifestPath, "manifest", "", "Manifest describing the board and all the images to use")
+	fs.StringVar(&job.only, "only", "", "Comma-separated images to flash, such as bootloader,kernel, others are skipped")
+	fs.StringVar(&job.skip, "skip", "", "Comma-separated images not to flash, such as rootfs,userfs")
+	fs.StringVar(&job.bootCheck.Banner, "boot-check", "", "Text printed by the flashed system once booted, such as a shell prompt")
+	fs.DurationVar(&job.bootCheck.Timeout, "boot-check-timeout", 2*time.Minute, "Maximum time from reset until the system is booted")
+	fs.StringVar(&job.bootCheck.Command, "boot-check-command", "", "Command to run in the shell of the booted system")
+	fs.StringVar(&job.bootCheck.Expect, "boot-check-output", "", "Text expected in the output of the boot check command")
+	fs.StringVar(&job.smokeTest.script, "smoke-test", "", "Script of commands to run in the shell of the booted system")
+	job.smokeTest.addFlags(fs)
+	fs.StringVar(&job.timingPath, "timing-report", "", "Write duration of each stage of flashing to a JSON file")
+	fs.StringVar(&job.eventsPath, "events", "", "Write start, progress and end of each stage as JSON lines to a file, - for standard error")
+	fs.BoolVar(&job.flashOpts.SparseErase, "sparse-erase", false, "Erase and write only the blocks of flash whose content changes")
+	fs.BoolVar(&job.flashOpts.UBootDecompress, "uboot-decompress", false, "Send .gz and .lzma images compressed and decompress them with u-boot")
+	fs.StringVar(&job.flashOpts.FITConfig, "fit-config", "", "Boot the kernel as a FIT image with bootm, with this configuration")
+	fs.StringVar(&job.flashOpts.BootCmd, "bootcmd", "", "Template of bootcmd set after flashing, with placeholders such as {kerneladdr}, instead of the default of the board")
+	fs.StringVar(&job.flashOpts.BootArgs, "bootargs", "", "Template of bootargs set after flashing, with placeholders such as {rootaddr} or {console}, instead of the default of the board")
+	fs.Var(regionFlag{&job.flashOpts.DTBOffset, &job.flashOpts.DTBSize}, "dtb-partition", "Region of flash holding the device tree, as offset:size, on boards without a dtb partition")
+	fs.BoolVar(&job.useFastboot, "fastboot", false, "Flash images over USB fastboot started from u-boot, for boards supporting it")
+	fs.IntVar(&job.attempts, "attempts", 1, "Total number of flashing attempts, the board is power-cycled and flashed again after a failure")
+	fs.StringVar(&job.powerAfter, "power-after", "", "Power state of the board after flashing (on, off or cycle), unchanged by default")
+	job.provision.addFlags(fs)
+	job.secureBoot.addFlags(fs)
+	job.helper.addFlags(fs)
+}
+
+// close removes temporary files used by the job.
+func (job *flashJob) close() {
+	for i := len(job.cleanup) - 1; i >= 0; i-- {
+		job.cleanup[i]()
 	}
-	// TODO: verify assets before loading.
+	job.cleanup = nil
+}
 
-	portInfos, err := enumerator.GetDetailedPortsList()
-	if err != nil {
+// prepare checks the options and finds, fetches and verifies the images.
+func (job *flashJob) prepare() error {
+	opts, assets := &job.opts, &job.assets
+	job.cleanup = append(job.cleanup, job.fetcher.close)
+	if job.bootCheck.Banner == "" && job.bootCheck.Command != "" {
+		return usageErrorf("cannot use -boot-check-command without -boot-check")
+	}
+	switch job.powerAfter {
+	case "", "on", "off", "cycle":
+	default:
+		return usageErrorf("unsupported power state after flashing: %q", job.powerAfter)
+	}
+	if job.attempts < 1 {
+		return usageErrorf("number of attempts must be at least one")
+	}
+	if job.useFastboot && job.helper.image != "" {
+		return usageErrorf("cannot use -fastboot together with -helper")
+	}
+	if job.useFastboot && (job.flashOpts.FITConfig != "" || job.flashOpts.BootCmd != "" || job.flashOpts.BootArgs != "") {
+		return usageErrorf("cannot use -fastboot together with -fit-config, -bootcmd or -bootargs")
+	}
+	if job.helper.image != "" {
+		if err := job.fetcher.fetch(&job.helper.image, ""); err != nil {
+			return err
+		}
+	}
+	if err := job.provision.open(); err != nil {
 		return err
 	}
-
-	var pirate *buspirate.BusPirate
-	fmt.Printf("Looking for bus pirate\n")
-	// TODO: make this configurable
-	piratePortName, err := buspirate.FindBusPirate(portInfos)
-	if err != nil {
-		fmt.Printf("%s\n", err)
-		fmt.Printf("Flashing process will not be unattended\n")
-	} else {
-		fmt.Printf("Found bus pirate serial port %s\n", piratePortName)
-		pirate, err = buspirate.OpenBusPirate(piratePortName)
+	if job.manifestPath != "" {
+		if !assets.Empty() {
+			return usageErrorf("cannot use -manifest together with individual images")
+		}
+		m, err := openharmony.LoadManifest(job.manifestPath)
 		if err != nil {
 			return err
 		}
-		defer func() {
-			if err := pirate.Close(); err != nil {
-				fmt.Printf("cannot close bus pirate serial port: %s", err)
-			}
-		}()
-		fmt.Printf("Entering PSU mode\n")
-		if err := pirate.EnterPSUMode(); err != nil {
+		if opts.boardType == "" {
+			opts.boardType = m.Board
+		}
+		if m.Board != "" && m.Board != opts.boardType {
+			return fmt.Errorf("manifest is for %s board, not %s", m.Board, opts.boardType)
+		}
+		if err := job.fetcher.fetchManifest(m); err != nil {
 			return err
 		}
+		fmt.Printf("Verifying images listed in %s\n", job.manifestPath)
+		if err := m.Verify(); err != nil {
+			return err
+		}
+		*assets = *m.Assets()
+	} else if err := job.fetcher.fetchAssets(assets); err != nil {
+		return err
 	}
-
-	fmt.Printf("Looking for %s board\n", boardType)
-	boardPortName, err := board.FindSerialPort(portInfos)
-	if err != nil {
+	if job.bundlePath != "" {
+		if job.manifestPath != "" {
+			return usageErrorf("cannot use -manifest together with -bundle")
+		}
+		if err := job.fetcher.fetch(&job.bundlePath, ""); err != nil {
+			return err
+		}
+		dir, err := ioutil.TempDir("", "oh-flash-bundle-")
+		if err != nil {
+			return err
+		}
+		job.cleanup = append(job.cleanup, func() { os.RemoveAll(dir) })
+		bundled, err := openharmony.ExtractBundle(job.bundlePath, dir, logging.Stdout)
+		if err != nil {
+			return err
+		}
+		assets.Merge(bundled)
+	}
+	given := assets.Clone()
+	// Images not flashed, such as keys, may still be used by the script.
+	if err := job.secureBoot.load(given); err != nil {
+		return err
+	}
+	if err := assets.Select(splitList(job.only), splitList(job.skip)); err != nil {
 		return err
 	}
-	fmt.Printf("Found %s serial port %s\n", boardType, boardPortName)
-	boardPort, err := board.OpenSerialPort(boardPortName)
+	names := openharmony.AssetNames
+	if board, err := newBoard(opts.boardType); err == nil {
+		if tunable, ok := board.(tunableBoard); ok {
+			tunable.SetOptions(job.flashOpts)
+		}
+		if board, ok := board.(assetBoard); ok {
+			names = board.AssetNames()
+		}
+	}
+	printAssetPlan(given, assets, names)
+	return job.checks.verify(assets)
+}
+
+// run flashes a board with the prepared images, and then checks that the
+// flashed system boots, if requested.
+func (job *flashJob) run() error {
+	opts := &job.opts
+	jsonEvents, closeEvents, err := openEventsOutput(job.eventsPath)
 	if err != nil {
 		return err
 	}
+	defer closeEvents()
+	timings := timing.NewReport()
+	// The report is most useful when something is slow or fails.
 	defer func() {
-		if err := boardPort.Close(); err != nil {
-			fmt.Printf("cannot close board serial port: %s", err)
+		if err := reportTimings(timings, job.timingPath); err != nil {
+			fmt.Printf("cannot write timing report: %s\n", err)
 		}
 	}()
-
-	if debug {
-		boardPort = ioextra.NewIOPreview(boardPort)
-		fmt.Printf("Serial port preview enabled, serial port data displayed as follows:\n")
-		fmt.Printf("  <<< incoming serial port data\n")
-		fmt.Printf("  >>> outgoing serial port data\n")
+	opts.events = flash.Multi(textEvents{}, timings, jsonEvents)
+	if board, err := newBoard(opts.boardType); err == nil {
+		if board, ok := board.(romBoard); ok {
+			if job.useFastboot || job.helper.image != "" || job.bootCheck.Banner != "" || job.smokeTest.script != "" || job.powerAfter != "" {
+				return usageErrorf("board %s does not support -fastboot, -helper, -boot-check, -smoke-test or -power-after", opts.boardType)
+			}
+			if job.provision.enabled() || job.secureBoot.script != "" {
+				return usageErrorf("board %s does not support provisioning units or -secure-boot-script", opts.boardType)
+			}
+			return flashROM(opts, board, &job.assets)
+		}
 	}
-	uboot := ubootshell.NewUBootShell(context.TODO(), boardPort)
-
-	if pirate != nil {
-		if err := pirate.DisablePower(); err != nil {
+	var sess *session
+	for attempt := 1; ; attempt++ {
+		var interrupted bool
+		sess, interrupted, err = flashOnce(opts, &job.assets, job.flashOpts, job.useFastboot, &job.helper)
+		if err == nil {
+			break
+		}
+		if interrupted || attempt >= job.attempts {
+			return err
+		}
+		fmt.Printf("Attempt %d of %d failed: %s\n", attempt, job.attempts, err)
+		fmt.Printf("Starting again with a power cycle\n")
+	}
+	defer sess.Close()
+	if job.provision.enabled() {
+		if err := job.provision.provision(sess, sess.events); err != nil {
+			return fmt.Errorf("cannot provision the unit: %w", err)
+		}
+	}
+	if job.secureBoot.script != "" {
+		if err := job.secureBoot.run(sess, sess.events); err != nil {
+			return fmt.Errorf("cannot run %s: %w", job.secureBoot.script, err)
+		}
+	}
+	// Power is switched on or cycled before checking the flashed system,
+	// so that a cold boot is checked, but switched off only afterwards.
+	switch job.powerAfter {
+	case "on":
+		fmt.Printf("Leaving the board powered\n")
+		if err := sess.unattended(sess.power.PowerOn); err != nil {
+			return err
+		}
+	case "cycle":
+		fmt.Printf("Power-cycling the board\n")
+		if err := sess.unattended(sess.power.Cycle); err != nil {
 			return err
 		}
-		if err := pirate.EnablePower(); err != nil {
+	}
+	if job.bootCheck.Banner != "" {
+		err := flash.Run(sess.events, flash.Stage{Kind: flash.BootStage, Name: "boot flashed system"}, func() error { return sess.uboot.CheckBoot(job.bootCheck) })
+		if err != nil {
+			return flash.WithKind(fmt.Errorf("flashed system does not boot: %w", err), errValidationFailed)
+		}
+		fmt.Printf("Flashed system booted successfully\n")
+	}
+	if job.smokeTest.script != "" {
+		if err := flash.Run(sess.events, flash.Stage{Kind: flash.TestStage, Name: "run smoke tests"}, func() error { return job.smokeTest.run(sess.uboot.Console()) }); err != nil {
 			return err
 		}
+	}
+	if job.powerAfter == "off" {
+		fmt.Printf("Switching the board off\n")
+		if err := sess.unattended(sess.power.PowerOff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runFlash(args []string) error {
+	var job flashJob
+	fs := flag.NewFlagSet("oh-flash flash", flag.ExitOnError)
+	job.addFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	defer job.close()
+	if err := job.prepare(); err != nil {
+		return err
+	}
+	return job.run()
+}
+
+// flashOnce opens a session, which resets the board, and flashes the assets,
+// over the serial port, over fastboot or from the flashing helper.
+//
+// The session is closed on failure. Failures caused by the user
+// interrupting the process are not worth retrying and are indicated.
+func flashOnce(opts *sessionOptions, assets *openharmony.Assets, flashOpts boards.Options, useFastboot bool, helper *helperOptions) (sess *session, interrupted bool, err error) {
+	sess, err = openSession(opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if board, ok := sess.board.(tunableBoard); ok {
+		board.SetOptions(flashOpts)
+	} else if flashOpts != (boards.Options{}) {
+		sess.Close()
+		return nil, false, usageErrorf("board %s does not support -sparse-erase, -uboot-decompress, -fit-config, -bootcmd, -bootargs or -dtb-partition", opts.boardType)
+	}
+	if useFastboot {
+		err = flashFastboot(sess, opts, assets)
+	} else if helper.image != "" {
+		err = flashHelper(sess, opts, assets, helper)
 	} else {
-		fmt.Printf("NOTE: power-cycle the board manually now\n")
+		err = sess.board.FlashAssets(sess.uboot, assets)
+	}
+	if err != nil {
+		interrupted = sess.interrupt.Err() != nil
+		sess.Close()
+		return nil, interrupted, err
+	}
+	return sess, false, nil
+}
+
+// imageFlag sets images of partitions given on the command line as name=path.
+type imageFlag struct {
+	assets *openharmony.Assets
+}
+
+func (f imageFlag) String() string {
+	return ""
+}
+
+func (f imageFlag) Set(value string) error {
+	idx := strings.IndexByte(value, '=')
+	if idx <= 0 || idx == len(value)-1 || strings.ContainsRune(value[:idx], ',') {
+		return fmt.Errorf("expected name=path, such as trust=trust.img")
+	}
+	f.assets.Set(value[:idx], value[idx+1:])
+	return nil
+}
+
+// regionFlag sets a region of flash given on the command line as offset:size.
+type regionFlag struct {
+	offset, size *uint64
+}
+
+func (f regionFlag) String() string {
+	if f.size == nil || *f.size == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%#x:%#x", *f.offset, *f.size)
+}
+
+func (f regionFlag) Set(value string) error {
+	colon := strings.IndexByte(value, ':')
+	if colon < 0 {
+		return fmt.Errorf("expected offset:size, such as 0x1000000:0x10000")
+	}
+	offset, err := strconv.ParseUint(value[:colon], 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid offset: %q", value[:colon])
 	}
-	if err := uboot.InterruptBoot(); err != nil {
+	size, err := strconv.ParseUint(value[colon+1:], 0, 64)
+	if err != nil || size == 0 {
+		return fmt.Errorf("invalid size: %q", value[colon+1:])
+	}
+	*f.offset, *f.size = offset, size
+	return nil
+}
+
+// splitList splits a comma-separated list given on the command line.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// printAssetPlan tells what is going to happen to each partition.
+//
+// Given are the images found on the command line, in the manifest or in the
+// bundle, selected are those left after -only and -skip. Names are those of
+// the assets used by the board, other assets are listed only if given.
+func printAssetPlan(given, selected *openharmony.Assets, names []string) {
+	fmt.Printf("Flashing plan:\n")
+	for _, name := range given.Names() {
+		used := false
+		for _, n := range names {
+			used = used || n == name
+		}
+		switch {
+		case !used && given.Get(name) == "":
+			// Assets of other boards are of no interest.
+		case selected.Get(name) != "":
+			fmt.Printf("  %s: flash from %s\n", name, selected.Get(name))
+		case given.Get(name) != "":
+			fmt.Printf("  %s: skipped, excluded with -only or -skip\n", name)
+		default:
+			fmt.Printf("  %s: skipped, no image given\n", name)
+		}
+	}
+}
+
+// reportTimings prints the duration of each stage and optionally saves them as JSON.
+func reportTimings(report *timing.Report, path string) error {
+	fmt.Printf("Duration of flashing stages:\n")
+	if err := report.Write(os.Stdout); err != nil {
+		return err
+	}
+	if path == "" {
+		return nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
 		return err
 	}
-	if err := uboot.ProbePrompt(); err != nil {
+	if err := report.WriteJSON(f); err != nil {
+		f.Close()
 		return err
 	}
-	return board.FlashAssets(uboot, &assets)
+	return f.Close()
+}
+
+// command is a sub-command of oh-flash.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"flash", "Flash images to the board", runFlash},
+	{"factory", "Flash boards one after another on a production line", runFactory},
+	{"list-ports", "List serial ports and the devices behind them", runListPorts},
+	{"console", "Connect the terminal to the serial console of the board", runConsole},
+	{"env", "Back up or restore u-boot environment", runEnv},
+	{"dump", "Read the content of flash memory", runDump},
+	{"power", "Switch power of the board on or off", runPower},
+	{"fel", "Load and execute code on Allwinner boards in USB FEL mode", runFEL},
+	{"dfu", "Program microcontrollers through their USB DFU bootloader", runDFU},
+	{"uf2", "Copy firmware to the mass-storage volume of a UF2 bootloader", runUF2},
+	{"boot-test", "Boot a kernel loaded into memory, without flashing it", runBootTest},
+	{"fit", "Build a FIT image bundling a kernel with device trees and a ramdisk", runFIT},
+	{"smoke-test", "Run commands in the shell of the booted system", runSmokeTest},
+	{"uboot-script", "Run a script of u-boot commands", runUBootScript},
+	{"replay", "Show serial port traffic captured with -capture", runReplay},
+	{"completion", "Print the shell completion script for bash, zsh or fish", runCompletion},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: oh-flash <command> [flags]\n\n")
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nUse oh-flash help <command> for the flags of each command.\n")
+	fmt.Fprintf(os.Stderr, "Flags given without a command are passed to the flash command.\n")
+}
+
+func run(args []string) error {
+	// Flashing used to be the only mode, keep accepting its flags alone.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runFlash(args)
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	if args[0] == completeCommand {
+		return runComplete(args[1:])
+	}
+	if args[0] == "help" {
+		if len(args) > 1 {
+			for _, cmd := range commands {
+				if cmd.name == args[1] {
+					return cmd.run([]string{"-help"})
+				}
+			}
+		}
+		usage()
+		return nil
+	}
+	usage()
+	return usageErrorf("unknown command: %q", args[0])
 }
 
 func main() {
-	if err := run(); err != nil {
+	if err := run(os.Args[1:]); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %s\n", err)
-		os.Exit(1)
+		if hint := errorHint(err); hint != "" {
+			fmt.Fprintf(os.Stderr, "hint: %s\n", hint)
+		}
+		os.Exit(exitCode(err))
 	}
 }
@@ -0,0 +1,55 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+
+	"go.bug.st/serial.v1/enumerator"
+)
+
+func runPower(args []string) error {
+	var opts sessionOptions
+	fs := flag.NewFlagSet("oh-flash power", flag.ExitOnError)
+	opts.addPowerFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("select power command: on, off or cycle")
+	}
+
+	portInfos, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return err
+	}
+	ctrl, err := newPowerController(&opts, portInfos)
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+	switch fs.Arg(0) {
+	case "on":
+		return ctrl.PowerOn()
+	case "off":
+		return ctrl.PowerOff()
+	case "cycle":
+		return ctrl.Cycle()
+	default:
+		return usageErrorf("unsupported power command: %q", fs.Arg(0))
+	}
+}
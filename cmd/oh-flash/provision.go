@@ -0,0 +1,194 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/devices/boards"
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/provision"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// blobBoard is implemented by boards writing unit-specific data to regions
+// of storage reserved for it.
+type blobBoard interface {
+	AddBlobs(plan *ubootshell.FlashPlan, uboot *ubootshell.UBootShell, blobs []boards.Blob) error
+}
+
+// blobRegion is where the file named by a value of the unit is written.
+type blobRegion struct {
+	name         string
+	offset, size uint64
+}
+
+// blobRegionFlag appends regions given on the command line as name=offset:size.
+type blobRegionFlag struct {
+	regions *[]blobRegion
+}
+
+func (f blobRegionFlag) String() string {
+	return ""
+}
+
+func (f blobRegionFlag) Set(value string) error {
+	idx := strings.IndexByte(value, '=')
+	colon := strings.LastIndexByte(value, ':')
+	if idx <= 0 || colon < idx {
+		return fmt.Errorf("expected name=offset:size, such as calibration=0xff0000:0x10000")
+	}
+	offsetText, sizeText := value[idx+1:colon], value[colon+1:]
+	offset, err := strconv.ParseUint(offsetText, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid offset: %q", offsetText)
+	}
+	size, err := strconv.ParseUint(sizeText, 0, 64)
+	if err != nil || size == 0 {
+		return fmt.Errorf("invalid size: %q", sizeText)
+	}
+	*f.regions = append(*f.regions, blobRegion{name: value[:idx], offset: offset, size: size})
+	return nil
+}
+
+// sequenceFlag appends sequences given on the command line.
+type sequenceFlag struct {
+	sequences *[]*provision.Sequence
+}
+
+func (f sequenceFlag) String() string {
+	return ""
+}
+
+func (f sequenceFlag) Set(value string) error {
+	seq, err := provision.ParseSequence(value)
+	if err != nil {
+		return err
+	}
+	*f.sequences = append(*f.sequences, seq)
+	return nil
+}
+
+// provisionOptions describe values personalizing each flashed unit.
+type provisionOptions struct {
+	csvPath   string
+	sequences []*provision.Sequence
+	statePath string
+	regions   []blobRegion
+
+	alloc *provision.Allocator
+}
+
+func (p *provisionOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&p.csvPath, "provision-csv", "", "CSV file with a header row naming values and a row of values for each unit")
+	fs.Var(sequenceFlag{sequences: &p.sequences}, "provision-seq", "Value counting up for each unit, as name=start, name=start:format or name=mac:address, may be repeated")
+	fs.StringVar(&p.statePath, "provision-state", "provision-state.json", "File remembering values handed out to units")
+	fs.Var(blobRegionFlag{regions: &p.regions}, "provision-blob", "Write the file named by a value to flash instead of the environment, as name=offset:size, may be repeated")
+}
+
+// enabled returns true if units are provisioned after flashing.
+func (p *provisionOptions) enabled() bool {
+	return p.csvPath != "" || len(p.sequences) > 0
+}
+
+// open reads what was handed out so far and the CSV file, if any.
+func (p *provisionOptions) open() error {
+	if !p.enabled() {
+		if len(p.regions) > 0 {
+			return fmt.Errorf("-provision-blob requires -provision-csv")
+		}
+		return nil
+	}
+	alloc, err := provision.NewAllocator(p.statePath)
+	if err != nil {
+		return err
+	}
+	if p.csvPath != "" {
+		if err := alloc.LoadCSV(p.csvPath); err != nil {
+			return err
+		}
+	}
+	for _, seq := range p.sequences {
+		alloc.AddSequence(seq)
+	}
+	p.alloc = alloc
+	return nil
+}
+
+// region returns the region of storage the named value is written to, if any.
+func (p *provisionOptions) region(name string) (blobRegion, bool) {
+	for _, region := range p.regions {
+		if region.name == name {
+			return region, true
+		}
+	}
+	return blobRegion{}, false
+}
+
+// provision writes the values of the next unit to the board, which is reset
+// after flashing, and resets it again.
+//
+// Blobs are written to their regions of storage, other values to the u-boot
+// environment. Values are not handed out again, even if this fails.
+func (p *provisionOptions) provision(sess *session, events flash.Events) error {
+	board, ok := sess.board.(blobBoard)
+	if !ok && len(p.regions) > 0 {
+		return fmt.Errorf("board does not support -provision-blob")
+	}
+	unit, err := p.alloc.Next()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Provisioning the unit with:\n")
+	for _, v := range unit {
+		fmt.Printf("  %s=%s\n", v.Name, v.Value)
+	}
+	if err := interruptAutoboot(sess, events, "interrupt auto-boot of flashed u-boot"); err != nil {
+		return err
+	}
+	plan := ubootshell.NewFlashPlan()
+	var blobs []boards.Blob
+	var env []provision.Value
+	for _, v := range unit {
+		region, ok := p.region(v.Name)
+		if !ok {
+			env = append(env, v)
+			continue
+		}
+		path := v.Value
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(p.alloc.CSVDir(), path)
+		}
+		blobs = append(blobs, boards.Blob{Name: v.Name, Path: path, Offset: region.offset, Size: region.size})
+	}
+	if len(blobs) > 0 {
+		if err := board.AddBlobs(plan, sess.uboot, blobs); err != nil {
+			return err
+		}
+	}
+	for _, v := range env {
+		plan.SetEnv(v.Name, v.Value)
+	}
+	if len(env) > 0 {
+		plan.SaveEnv()
+	}
+	return plan.Reset().Execute(sess.uboot)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/ioextra/replay"
+	"github.com/zyga/oh-flash-tools/progress"
+)
+
+// lineJoiner joins captured data into lines before rendering it, like the
+// live preview does.
+//
+// A partial line is rendered when data starts going the other way, so that
+// the order of the traffic is kept.
+type lineJoiner struct {
+	renderer ioextra.PreviewRenderer
+	dir      ioextra.Direction
+	buf      []byte
+	last     time.Time
+}
+
+func (lj *lineJoiner) add(ev replay.Event) {
+	if ev.Dir != lj.dir {
+		lj.flush()
+		lj.dir = ev.Dir
+	}
+	lj.buf = append(lj.buf, ev.Data...)
+	lj.last = ev.Time
+	for {
+		idx := bytes.IndexByte(lj.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		lj.renderer.Render(ioextra.PreviewEvent{Direction: lj.dir, Data: lj.buf[:idx+1], Time: lj.last})
+		lj.buf = lj.buf[idx+1:]
+	}
+}
+
+func (lj *lineJoiner) flush() {
+	if len(lj.buf) > 0 {
+		lj.renderer.Render(ioextra.PreviewEvent{Direction: lj.dir, Data: lj.buf, Time: lj.last})
+		lj.buf = nil
+	}
+}
+
+func runReplay(args []string) error {
+	var mode, stage string
+	var color, listStages bool
+	fs := flag.NewFlagSet("oh-flash replay", flag.ExitOnError)
+	fs.StringVar(&mode, "preview", "text", "Rendering of serial port traffic (text, hex, both or dump)")
+	fs.BoolVar(&color, "color", progress.IsTerminal(os.Stdout), "Show incoming traffic in green, outgoing in yellow and control bytes highlighted")
+	fs.StringVar(&stage, "stage", "", "Start at the first stage whose name contains the text, such as failed")
+	fs.BoolVar(&listStages, "stages", false, "List the stages noted in the capture, without the traffic")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("select capture file to replay, as recorded with -capture")
+	}
+	previewMode, err := parsePreviewMode(mode)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	events, err := replay.ReadTranscript(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("nothing was captured in %s", fs.Arg(0))
+	}
+	start := events[0].Time
+	fmt.Printf("Capture started at %s, times are in seconds since then\n", start.Local().Format("2006-01-02 15:04:05"))
+	if listStages {
+		for _, ev := range events {
+			if ev.Note != "" {
+				fmt.Printf("%10.3f %s\n", ev.Time.Sub(start).Seconds(), ev.Note)
+			}
+		}
+		return nil
+	}
+	if stage != "" {
+		idx := -1
+		for i, ev := range events {
+			if ev.Note != "" && strings.Contains(ev.Note, stage) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return fmt.Errorf("no stage of %s matches %q, see -stages", fs.Arg(0), stage)
+		}
+		events = events[idx:]
+	}
+	var renderer ioextra.PreviewRenderer = ioextra.NewTextRenderer(os.Stdout).WithMode(previewMode).WithTimestamps(start)
+	noteFormat := "%10.3f === %s\n"
+	if color {
+		renderer = ioextra.NewColorRenderer(os.Stdout).WithMode(previewMode).WithTimestamps(start)
+		noteFormat = "\033[1m%10.3f === %s\033[0m\n"
+	}
+	lines := &lineJoiner{renderer: renderer}
+	for _, ev := range events {
+		if ev.Note == "" {
+			lines.add(ev)
+			continue
+		}
+		lines.flush()
+		fmt.Printf(noteFormat, ev.Time.Sub(start).Seconds(), ev.Note)
+	}
+	lines.flush()
+	return nil
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"go.bug.st/serial.v1/enumerator"
+
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// romBoard is implemented by boards without u-boot, flashed by the
+// bootloader in the ROM of the chip over the serial port.
+type romBoard interface {
+	serialBoard
+	FlashROM(port io.ReadWriteCloser, assets *openharmony.Assets, events flash.Events, observer ubootshell.TransferObserver) error
+}
+
+// flashROM flashes a board through its ROM bootloader.
+//
+// The board resets itself through the serial port, neither the power
+// controller nor the u-boot shell are used.
+func flashROM(opts *sessionOptions, board romBoard, assets *openharmony.Assets) error {
+	if opts.waitForBoard {
+		if err := flash.Run(opts.events, flash.Stage{Kind: flash.PortStage, Name: "wait for board"}, func() error { return waitForBoard(opts, board) }); err != nil {
+			return err
+		}
+	}
+	var port io.ReadWriteCloser
+	err := flash.Run(opts.events, flash.Stage{Kind: flash.PortStage, Name: "find and open board serial port"}, func() error {
+		portName := opts.portName
+		if portName == "" {
+			portInfos, err := enumerator.GetDetailedPortsList()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Looking for %s board\n", opts.boardType)
+			if portName, err = board.FindSerialPort(portInfos); err != nil {
+				return err
+			}
+			fmt.Printf("Found %s serial port %s\n", opts.boardType, portName)
+		}
+		var err error
+		port, err = openBoardPort(board, portName)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+	return board.FlashROM(port, assets, opts.events, ubootshell.NewProgressBar(os.Stdout))
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// secureBootOptions describe a script of vendor commands, such as burning
+// keys or checking signatures, run with the flashed u-boot.
+type secureBootOptions struct {
+	script string
+	plan   *ubootshell.FlashPlan
+}
+
+func (opts *secureBootOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.script, "secure-boot-script", "", "U-boot script run after flashing, such as burning keys, with {{name}} replaced by the path of image name and {{name.size}} by its size")
+}
+
+// load reads the script, with placeholders replaced by paths and sizes of
+// the given images, before touching the board.
+func (opts *secureBootOptions) load(images *openharmony.Assets) error {
+	if opts.script == "" {
+		return nil
+	}
+	vars := make(map[string]string)
+	for _, name := range images.Names() {
+		path := images.Get(name)
+		if path == "" {
+			continue
+		}
+		// Relative paths in scripts are relative to the script.
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		vars[name] = path
+		vars[name+".size"] = fmt.Sprintf("0x%x", fi.Size())
+	}
+	plan, err := ubootshell.LoadTemplate(opts.script, vars)
+	if err != nil {
+		return err
+	}
+	// The board boots with what the script changed, such as burned keys.
+	opts.plan = plan.Reset()
+	return nil
+}
+
+// run runs the script with u-boot of the board, which is reset after
+// flashing.
+func (opts *secureBootOptions) run(sess *session, events flash.Events) error {
+	if err := interruptAutoboot(sess, events, "interrupt auto-boot of flashed u-boot"); err != nil {
+		return err
+	}
+	fmt.Printf("Running %d steps of %s\n", len(opts.plan.Steps), opts.script)
+	return opts.plan.Execute(sess.uboot)
+}
@@ -0,0 +1,632 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"go.bug.st/serial.v1/enumerator"
+
+	"github.com/zyga/oh-flash-tools/devices/boards"
+	"github.com/zyga/oh-flash-tools/devices/buspirate"
+	"github.com/zyga/oh-flash-tools/devices/power"
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/logging"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+	"github.com/zyga/oh-flash-tools/ubootshell/ymodem"
+)
+
+// serialBoard is a board reached over a serial port.
+type serialBoard interface {
+	FindSerialPort(portInfos []*enumerator.PortDetails) (string, error)
+	OpenSerialPort(portName string) (io.ReadWriteCloser, error)
+}
+
+// flashableBoard is a board flashed from the u-boot shell.
+type flashableBoard interface {
+	serialBoard
+	FlashAssets(uboot *ubootshell.UBootShell, assets *openharmony.Assets) error
+}
+
+// autobootBoard is implemented by boards with non-standard auto-boot prompts.
+type autobootBoard interface {
+	AutobootBanners() []string
+	InterruptKeys() string
+	RepeatInterruptKeys() bool
+}
+
+// fileSenderBoard is implemented by boards with a preferred transfer protocol.
+type fileSenderBoard interface {
+	FileSender() ubootshell.FileSender
+}
+
+// assetBoard is implemented by boards telling which assets they use.
+type assetBoard interface {
+	AssetNames() []string
+}
+
+// tunableBoard is implemented by boards supporting options of flashing.
+type tunableBoard interface {
+	SetOptions(opts boards.Options)
+}
+
+// boardTypes lists the names of all the supported boards.
+var boardTypes = []string{"esp32", "hi3516ev200", "hi3518ev300", "rk3568"}
+
+func newBoard(boardType string) (serialBoard, error) {
+	switch boardType {
+	case "esp32":
+		return &boards.Esp32{}, nil
+	case "hi3516ev200":
+		return &boards.Hi3516ev200{}, nil
+	case "hi3518ev300":
+		return &boards.Hi3518ev300{}, nil
+	case "rk3568":
+		return &boards.Rk3568{}, nil
+	case "":
+		return nil, usageErrorf("select board type with -board")
+	default:
+		return nil, usageErrorf("unsupported board type: %q", boardType)
+	}
+}
+
+// sessionOptions describe how to reach the u-boot shell of a board.
+type sessionOptions struct {
+	boardType    string
+	portName     string
+	waitForBoard bool
+	debug        bool
+	preview      string
+	previewColor bool
+	retryCount   int
+	strictUBoot  bool
+	device       deviceName // resolved from the inventory by parseFlags
+	powerType    string
+	powerChannel int
+	powerAddress string
+	gpioChip     string
+	gpioLine     int
+	gpioLow      bool
+	resetMethod  string
+	capture      string
+	capturePcap  string
+	consoleLog   string
+	readTimeout  time.Duration
+	banner       string
+	keys         string
+	repeatKeys   bool
+	transferRate int
+	protocol     string
+	streaming    bool
+	pacing       ioextra.Pacing
+	turnaround   time.Duration
+	charDelay    time.Duration
+	charEcho     bool
+	fel          []felStep
+	uartBoot     uartBoot
+	hisi         []hisiStep
+
+	events flash.Events // optional, notified about stages
+}
+
+func (opts *sessionOptions) addFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&opts.debug, "debug", false, "Show debugging messages, including serial port traffic")
+	fs.StringVar(&opts.preview, "preview", "off", "Show serial port traffic (off, text, hex, both or dump)")
+	fs.BoolVar(&opts.previewColor, "preview-color", false, "Show incoming serial port traffic in green, outgoing in yellow and control bytes highlighted")
+	fs.DurationVar(&opts.readTimeout, "read-timeout", 0, "Maximum time to wait for data from the board, zero waits forever")
+	fs.StringVar(&opts.capture, "capture", "", "Record board serial port traffic to a file")
+	fs.StringVar(&opts.capturePcap, "capture-pcap", "", "Record board serial port traffic to a pcapng file")
+	fs.StringVar(&opts.consoleLog, "console-log", "", "Write board console output arriving while not reading it, such as during power cycles, to a file")
+	fs.StringVar(&opts.boardType, "board", "", "Type of the board to program")
+	fs.StringVar(&opts.portName, "port", "", "Serial port of the board, tcp://host:port or rfc2217://host:port, instead of looking for it")
+	fs.BoolVar(&opts.waitForBoard, "wait-for-board", false, "Wait until the serial port of the board appears, such as when the next board is plugged in")
+	fs.IntVar(&opts.retryCount, "command-retries", 3, "Number of times to retry garbled u-boot commands")
+	fs.DurationVar(&opts.turnaround, "turnaround-delay", 0, "Pause after the u-boot prompt before typing a command, for boards dropping the first characters")
+	fs.DurationVar(&opts.charDelay, "char-delay", 0, "Pause between characters of typed u-boot commands")
+	fs.BoolVar(&opts.charEcho, "char-echo", false, "Type u-boot commands one character at a time, checking the echo of each")
+	fs.BoolVar(&opts.strictUBoot, "strict-uboot-version", false, "Refuse to work with versions of u-boot not known to work with the board")
+	fs.StringVar(&opts.banner, "autoboot-banner", "", "Message printed by u-boot before auto-boot, if different from the board default")
+	fs.StringVar(&opts.keys, "interrupt-keys", "", "Keys stopping u-boot auto-boot, with Go escapes such as \\x03, if different from the board default")
+	fs.BoolVar(&opts.repeatKeys, "interrupt-repeat", false, "Repeat interrupt keys during the auto-boot count-down, as required for secret keywords")
+	fs.IntVar(&opts.transferRate, "transfer-baud-rate", 0, "Baud rate used for file transfers, such as 921600, zero keeps the default")
+	fs.StringVar(&opts.protocol, "transfer-protocol", "", "Protocol used for file transfers (ymodem, xmodem, zmodem, kermit or auto), board default if unset")
+	fs.BoolVar(&opts.streaming, "ymodem-streaming", false, "Send ymodem data blocks without waiting for acknowledgment (YMODEM-G) if u-boot asks for it, for reliable links only")
+	fs.IntVar(&opts.pacing.ChunkSize, "write-chunk-size", 0, "Write at most this many bytes to the board at once, zero writes everything at once")
+	fs.DurationVar(&opts.pacing.Delay, "write-chunk-delay", 0, "Pause after each chunk written to the board, for adapters dropping bytes in bursts")
+	fs.IntVar(&opts.pacing.Rate, "write-rate", 0, "Maximum rate of writing to the board in bytes per second, zero is unlimited")
+	fs.StringVar(&opts.resetMethod, "reset-method", "power", "Method of resetting the board (power or aux)")
+	opts.addPowerFlags(fs)
+	addFELFlags(fs, &opts.fel)
+	addUARTBootFlags(fs, &opts.uartBoot)
+	addHiSiliconFlags(fs, &opts.hisi)
+}
+
+// addPowerFlags adds flags selecting the power controller.
+func (opts *sessionOptions) addPowerFlags(fs *flag.FlagSet) {
+	fs.Var(&opts.device, "device", "Name of the device in the lab inventory, providing the board, serial port and power controller")
+	fs.StringVar(&opts.powerType, "power", "", "Power controller to use (buspirate, ykush, relay, pdu, gpio or manual)")
+	fs.IntVar(&opts.powerChannel, "power-channel", 1, "Relay channel, hub port or PDU outlet powering the board")
+	fs.StringVar(&opts.powerAddress, "power-address", "", "Network address of the PDU")
+	fs.StringVar(&opts.gpioChip, "gpio-chip", "gpiochip0", "GPIO chip controlling power of the board")
+	fs.IntVar(&opts.gpioLine, "gpio-line", -1, "GPIO line controlling power of the board")
+	fs.BoolVar(&opts.gpioLow, "gpio-active-low", false, "Power the board when the GPIO line is low")
+}
+
+// newPowerController returns the power controller selected with -power.
+//
+// Without explicit selection the bus pirate is used if one is attached,
+// otherwise the user is asked to control power manually.
+func newPowerController(opts *sessionOptions, portInfos []*enumerator.PortDetails) (power.Controller, error) {
+	switch opts.powerType {
+	case "", "buspirate":
+		fmt.Printf("Looking for bus pirate\n")
+		piratePortName, err := buspirate.FindBusPirate(portInfos)
+		if err != nil {
+			if opts.powerType != "" {
+				return nil, flash.WithKind(err, boards.ErrPortNotFound)
+			}
+			fmt.Printf("%s\n", err)
+			fmt.Printf("Flashing process will not be unattended\n")
+			return power.NewManual(logging.Stdout, os.Stdin), nil
+		}
+		fmt.Printf("Found bus pirate serial port %s\n", piratePortName)
+		pirate, err := buspirate.OpenBusPirate(piratePortName)
+		if err != nil {
+			return nil, err
+		}
+		version := pirate.Version()
+		fmt.Printf("Detected %s\n", &version)
+		fmt.Printf("Entering PSU mode\n")
+		if err := pirate.EnterPSUMode(); err != nil {
+			pirate.Close()
+			return nil, err
+		}
+		return pirate, nil
+	case "ykush":
+		return power.OpenYKUSH(opts.powerChannel)
+	case "relay":
+		return power.OpenUSBRelay(opts.powerChannel)
+	case "pdu":
+		if opts.powerAddress == "" {
+			return nil, usageErrorf("select PDU address with -power-address")
+		}
+		return power.OpenPDU(opts.powerAddress, opts.powerChannel)
+	case "gpio":
+		return power.OpenGPIO(opts.gpioChip, opts.gpioLine, opts.gpioLow)
+	case "manual":
+		return power.NewManual(logging.Stdout, os.Stdin), nil
+	default:
+		return nil, usageErrorf("unsupported power controller: %q", opts.powerType)
+	}
+}
+
+// negotiationTimeout is the maximum time from reset to the u-boot prompt.
+const negotiationTimeout = 2 * time.Minute
+
+// auxResetPulse is the duration of the reset pulse on the bus pirate AUX pin.
+const auxResetPulse = 100 * time.Millisecond
+
+// resetBoard resets the board using the method selected with -reset-method.
+func resetBoard(opts *sessionOptions, ctrl power.Controller) error {
+	switch opts.resetMethod {
+	case "power":
+		return ctrl.Cycle()
+	case "aux":
+		pirate, ok := ctrl.(*buspirate.BusPirate)
+		if !ok {
+			return fmt.Errorf("resetting with the AUX pin requires the bus pirate")
+		}
+		if err := pirate.PowerOn(); err != nil {
+			return err
+		}
+		fmt.Printf("Resetting the board with the bus pirate AUX pin\n")
+		return pirate.PulseAux(auxResetPulse)
+	default:
+		return usageErrorf("unsupported reset method: %q", opts.resetMethod)
+	}
+}
+
+// checkVoltages reports voltages measured by the bus pirate and checks them.
+func checkVoltages(pirate *buspirate.BusPirate) error {
+	v, err := pirate.ReadVoltages()
+	if err != nil {
+		return err
+	}
+	if v.RailsMeasured {
+		fmt.Printf("Bus pirate supply voltages: 3.3V: %.2fV, 5V: %.2fV\n", v.Supply3V3, v.Supply5V)
+	} else {
+		fmt.Printf("Bus pirate ADC probe voltage: %.2fV\n", v.ADC)
+	}
+	return v.Check()
+}
+
+// session is a connection to the u-boot shell of a freshly powered board.
+type session struct {
+	board   flashableBoard
+	power   power.Controller
+	uboot   *ubootshell.UBootShell
+	console *ioextra.ConsoleMux
+	closers []func()
+
+	consoleLog io.Writer    // optional, receives console output while unattended
+	events     flash.Events // optional, notified about stages, also noted in the capture
+
+	interrupt context.Context // cancelled on SIGINT or SIGTERM
+	poweredOn bool            // power of the board was enabled by the session
+}
+
+// openSession finds the board, power-cycles it and interrupts the boot process.
+func openSession(opts *sessionOptions) (sess *session, err error) {
+	b, err := newBoard(opts.boardType)
+	if err != nil {
+		return nil, err
+	}
+	board, ok := b.(flashableBoard)
+	if !ok {
+		return nil, fmt.Errorf("board %s has no u-boot shell", opts.boardType)
+	}
+	if opts.uartBoot.uboot != "" && opts.uartBoot.spl == "" {
+		return nil, fmt.Errorf("-uart-boot-uboot requires -uart-boot-spl")
+	}
+	sess = &session{board: board, events: opts.events}
+	// Failures return a nil session, close the one opened so far.
+	opened := sess
+	defer func() {
+		if err != nil {
+			opened.Close()
+		}
+	}()
+
+	if opts.waitForBoard {
+		if err := flash.Run(opts.events, flash.Stage{Kind: flash.PortStage, Name: "wait for board"}, func() error { return waitForBoard(opts, board) }); err != nil {
+			return nil, err
+		}
+	}
+	portInfos, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl, err := newPowerController(opts, portInfos)
+	if err != nil {
+		return nil, err
+	}
+	sess.power = ctrl
+	sess.closers = append(sess.closers, func() {
+		if err := ctrl.Close(); err != nil {
+			fmt.Printf("cannot close power controller: %s\n", err)
+		}
+	})
+
+	var boardPort io.ReadWriteCloser
+	err = flash.Run(opts.events, flash.Stage{Kind: flash.PortStage, Name: "find and open board serial port"}, func() error {
+		boardPortName := opts.portName
+		if boardPortName == "" {
+			fmt.Printf("Looking for %s board\n", opts.boardType)
+			boardPortName, err = board.FindSerialPort(portInfos)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Found %s serial port %s\n", opts.boardType, boardPortName)
+		}
+		boardPort, err = openBoardPort(board, boardPortName)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	port := boardPort
+	setter, _ := boardPort.(ubootshell.BaudRateSetter)
+	sess.closers = append(sess.closers, func() {
+		if err := port.Close(); err != nil {
+			fmt.Printf("cannot close board serial port: %s\n", err)
+		}
+	})
+	if opts.pacing.Enabled() {
+		fmt.Printf("Pacing writes to the board\n")
+		boardPort = ioextra.NewPacedReadWriteCloser(boardPort, opts.pacing)
+	}
+	// Reading in the background keeps what the board prints between stages.
+	sess.console = ioextra.NewConsoleMux(boardPort)
+	boardPort = ioextra.NewTimeoutReadWriteCloser(sess.console, opts.readTimeout, 0)
+	if opts.consoleLog != "" {
+		f, err := os.Create(opts.consoleLog)
+		if err != nil {
+			return nil, err
+		}
+		sess.closers = append(sess.closers, func() {
+			if err := f.Close(); err != nil {
+				fmt.Printf("cannot close console log: %s\n", err)
+			}
+		})
+		sess.consoleLog = f
+	}
+
+	var recorders []ioextra.Recorder
+	if opts.capture != "" {
+		f, err := sess.createCaptureFile(opts.capture)
+		if err != nil {
+			return nil, err
+		}
+		transcript := ioextra.NewTranscript(f)
+		recorders = append(recorders, transcript)
+		sess.events = flash.Multi(sess.events, captureNotes{transcript: transcript})
+	}
+	if opts.capturePcap != "" {
+		f, err := sess.createCaptureFile(opts.capturePcap)
+		if err != nil {
+			return nil, err
+		}
+		recorders = append(recorders, ioextra.NewPcapNG(f))
+	}
+	if len(recorders) > 0 {
+		boardPort = ioextra.NewRecordingReadWriteCloser(boardPort, recorders...)
+	}
+
+	previewMode, err := parsePreviewMode(opts.preview)
+	if err != nil {
+		return nil, err
+	}
+	if opts.debug || opts.preview != "off" {
+		var renderer ioextra.PreviewRenderer = ioextra.NewTextRenderer(os.Stdout).WithMode(previewMode)
+		if opts.previewColor {
+			renderer = ioextra.NewColorRenderer(os.Stdout).WithMode(previewMode)
+		}
+		boardPort = ioextra.NewIOPreview(boardPort).WithRenderer(renderer)
+		fmt.Printf("Serial port preview enabled, serial port data displayed as follows:\n")
+		fmt.Printf("  <<< incoming serial port data\n")
+		fmt.Printf("  >>> outgoing serial port data\n")
+	}
+	// Limit the time spent waiting for u-boot to a reasonable amount.
+	ctx, cancel := context.WithTimeout(context.Background(), negotiationTimeout)
+	sess.closers = append(sess.closers, cancel)
+	sess.uboot = ubootshell.NewUBootShell(ctx, boardPort).WithRetryCount(opts.retryCount).WithStrictVersionCheck(opts.strictUBoot)
+	sess.uboot.WithTurnaroundDelay(opts.turnaround, opts.charDelay).WithCharacterEcho(opts.charEcho)
+	sess.uboot.WithEvents(sess.events)
+	sess.uboot.WithLogger(logging.Stdout).WithTransferObserver(ubootshell.NewProgressBar(os.Stdout))
+	interruptCtx, stop := interruptContext()
+	sess.closers = append(sess.closers, stop)
+	sess.interrupt = interruptCtx
+	sess.uboot.WithContext(interruptCtx)
+	if err := configureAutoboot(opts, board, sess.uboot); err != nil {
+		return nil, err
+	}
+	if err := configureFileSender(opts, board, sess.uboot); err != nil {
+		return nil, err
+	}
+	if opts.transferRate != 0 {
+		if setter == nil {
+			return nil, fmt.Errorf("%s serial port does not support changing baud rate", opts.boardType)
+		}
+		sess.uboot.WithTransferBaudRate(opts.transferRate, setter)
+	}
+
+	if err := flash.Run(sess.events, flash.Stage{Kind: flash.ResetStage, Name: "reset board"}, func() error {
+		return sess.unattended(func() error { return resetBoard(opts, ctrl) })
+	}); err != nil {
+		return nil, err
+	}
+	sess.poweredOn = true
+	if pirate, ok := ctrl.(*buspirate.BusPirate); ok {
+		if err := checkVoltages(pirate); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.fel) > 0 {
+		// U-boot started over FEL then talks over the serial port as usual.
+		if err := flash.Run(sess.events, flash.Stage{Kind: flash.BootStage, Name: "boot over USB FEL"}, func() error { return bootFEL(opts.fel) }); err != nil {
+			return nil, err
+		}
+	}
+	if opts.uartBoot.spl != "" {
+		// The ROM polls the serial port right after reset, u-boot loaded
+		// that way auto-boots as usual.
+		if err := flash.Run(sess.events, flash.Stage{Kind: flash.BootStage, Name: "boot over UART"}, func() error { return bootUART(sess.uboot, opts.uartBoot) }); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.hisi) > 0 {
+		if err := flash.Run(sess.events, flash.Stage{Kind: flash.BootStage, Name: "boot over HiSilicon serial download"}, func() error { return bootHiSilicon(sess.uboot.Console(), opts.hisi) }); err != nil {
+			return nil, err
+		}
+	}
+	if err := interruptAutoboot(sess, sess.events, "interrupt auto-boot"); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// interruptAutoboot stops auto-boot of u-boot, which was just reset, and
+// checks that the prompt responds.
+func interruptAutoboot(sess *session, events flash.Events, name string) error {
+	return flash.Run(events, flash.Stage{Kind: flash.InterruptStage, Name: name}, func() error {
+		if err := sess.uboot.InterruptBoot(); err != nil {
+			return err
+		}
+		return sess.uboot.ProbePrompt()
+	})
+}
+
+// configureAutoboot sets the auto-boot message and interrupt keys of the shell.
+//
+// Values given on the command line take precedence over those of the board.
+func configureAutoboot(opts *sessionOptions, board flashableBoard, uboot *ubootshell.UBootShell) error {
+	if board, ok := board.(autobootBoard); ok {
+		uboot.WithAutobootBanners(board.AutobootBanners()...).WithInterruptKeys(board.InterruptKeys())
+		uboot.WithRepeatedInterrupt(board.RepeatInterruptKeys())
+	}
+	if opts.repeatKeys {
+		uboot.WithRepeatedInterrupt(true)
+	}
+	if opts.banner != "" {
+		uboot.WithAutobootBanners(opts.banner)
+	}
+	if opts.keys != "" {
+		keys, err := strconv.Unquote(`"` + opts.keys + `"`)
+		if err != nil {
+			return fmt.Errorf("invalid interrupt keys %q: %w", opts.keys, err)
+		}
+		uboot.WithInterruptKeys(keys)
+	}
+	return nil
+}
+
+// configureFileSender selects the transfer protocol of the shell.
+//
+// The protocol given on the command line takes precedence over the board
+// default. Auto-detection is used if neither is given. Streaming is only
+// available when ymodem is selected either way.
+func configureFileSender(opts *sessionOptions, board flashableBoard, uboot *ubootshell.UBootShell) error {
+	var sender ubootshell.FileSender
+	switch opts.protocol {
+	case "":
+		if board, ok := board.(fileSenderBoard); ok {
+			sender = board.FileSender()
+		}
+	case "auto":
+	default:
+		var err error
+		sender, err = ubootshell.NewFileSender(opts.protocol)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.streaming {
+		ymodemSender, ok := sender.(*ubootshell.YModemSender)
+		if !ok {
+			return usageErrorf("-ymodem-streaming requires ymodem transfers, select them with -transfer-protocol ymodem")
+		}
+		ymodemSender.Mode = ymodem.StreamingMode
+	}
+	uboot.WithFileSender(sender)
+	return nil
+}
+
+// networkBaudRate is the baud rate of remote serial ports.
+//
+// All the supported boards use the same rate, see OpenSerialPort.
+const networkBaudRate = 115200
+
+// openBoardPort opens the serial port of the board.
+//
+// Remote serial ports, such as tcp://host:port or rfc2217://host:port, are
+// opened without help of the board.
+func openBoardPort(board serialBoard, portName string) (io.ReadWriteCloser, error) {
+	if ioextra.IsNetworkSerial(portName) {
+		return ioextra.DialSerial(portName, networkBaudRate)
+	}
+	return board.OpenSerialPort(portName)
+}
+
+// parsePreviewMode returns the preview mode selected with -preview.
+//
+// With just -debug, lines are shown as text and binary transfers in hex.
+func parsePreviewMode(name string) (ioextra.PreviewMode, error) {
+	switch name {
+	case "off":
+		return ioextra.DefaultPreview, nil
+	case "text":
+		return ioextra.TextPreview, nil
+	case "hex":
+		return ioextra.HexPreview, nil
+	case "both":
+		return ioextra.BothPreview, nil
+	case "dump":
+		return ioextra.DumpPreview, nil
+	default:
+		return ioextra.DefaultPreview, usageErrorf("unsupported preview mode: %q", name)
+	}
+}
+
+// interruptContext returns a context cancelled when the user presses Ctrl-C
+// or the process is terminated.
+//
+// The first signal cancels the context, so that transfers can be aborted
+// cleanly and no further commands are started. Commands that are already
+// running, such as erasing flash, are allowed to complete. Subsequent
+// interrupts terminate the process as usual.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-ch:
+			fmt.Printf("\nInterrupted, stopping after the current command, interrupt again to exit immediately\n")
+			signal.Stop(ch)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(ch)
+		cancel()
+	}
+}
+
+// unattended runs the function, which does not read the console, writing
+// what the board prints meanwhile to the console log, if any.
+func (sess *session) unattended(f func() error) error {
+	if sess.consoleLog == nil {
+		return f()
+	}
+	stop := sess.console.LogUnattended(sess.consoleLog)
+	defer stop()
+	return f()
+}
+
+// createCaptureFile creates a file closed together with the session.
+func (sess *session) createCaptureFile(name string) (*os.File, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	sess.closers = append(sess.closers, func() {
+		if err := f.Close(); err != nil {
+			fmt.Printf("cannot close capture file: %s\n", err)
+		}
+	})
+	fmt.Printf("Recording serial port traffic to %s\n", name)
+	return f, nil
+}
+
+// Close releases serial ports used by the session.
+//
+// If the session was interrupted, power supplied by the bus pirate is
+// disabled, so that a partially flashed board is not left running.
+func (sess *session) Close() {
+	if pirate, ok := sess.power.(*buspirate.BusPirate); ok && sess.poweredOn && sess.interrupt != nil && sess.interrupt.Err() != nil {
+		fmt.Printf("Disabling bus pirate power supply\n")
+		if err := pirate.PowerOff(); err != nil {
+			fmt.Printf("cannot disable bus pirate power supply: %s\n", err)
+		}
+	}
+	for i := len(sess.closers) - 1; i >= 0; i-- {
+		sess.closers[i]()
+	}
+	sess.closers = nil
+}
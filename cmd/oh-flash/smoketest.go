@@ -0,0 +1,113 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/smoketest"
+	"go.bug.st/serial.v1/enumerator"
+)
+
+// smokeTestOptions describe how to reach the shell of the booted system.
+type smokeTestOptions struct {
+	script   string
+	prompt   string
+	user     string
+	password string
+	timeout  time.Duration
+}
+
+func (opts *smokeTestOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.prompt, "shell-prompt", smoketest.DefaultPrompt, "Prompt of the shell of the booted system")
+	fs.StringVar(&opts.user, "login-user", "", "User to log in as, if the booted system asks to log in")
+	fs.StringVar(&opts.password, "login-password", "", "Password of the login user")
+	fs.DurationVar(&opts.timeout, "smoke-test-timeout", 30*time.Second, "Maximum time to log in and to run each test command")
+}
+
+// run logs into the shell, runs the tests from the script and prints the report.
+func (opts *smokeTestOptions) run(stream io.ReadWriter) error {
+	f, err := os.Open(opts.script)
+	if err != nil {
+		return err
+	}
+	tests, err := smoketest.ReadScript(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("cannot load %s: %w", opts.script, err)
+	}
+	runner := smoketest.NewRunner(stream).WithPrompt(opts.prompt).WithTimeout(opts.timeout).WithLogin(opts.user, opts.password)
+	fmt.Printf("Logging into the shell of the booted system\n")
+	if err := runner.Login(); err != nil {
+		return flash.WithKind(err, errValidationFailed)
+	}
+	fmt.Printf("Running %d smoke tests from %s\n", len(tests), opts.script)
+	report := runner.RunAll(tests)
+	if err := report.Write(os.Stdout); err != nil {
+		return err
+	}
+	if failed := report.Failed(); failed > 0 {
+		return flash.WithKind(fmt.Errorf("%d of %d smoke tests failed", failed, len(tests)), errValidationFailed)
+	}
+	if len(report.Results) < len(tests) {
+		return flash.WithKind(fmt.Errorf("only %d of %d smoke tests were run", len(report.Results), len(tests)), errValidationFailed)
+	}
+	return nil
+}
+
+func runSmokeTest(args []string) error {
+	var boardType, portName string
+	var opts smokeTestOptions
+	fs := flag.NewFlagSet("oh-flash smoke-test", flag.ExitOnError)
+	fs.StringVar(&boardType, "board", "", "Type of the board to connect to")
+	fs.StringVar(&portName, "port", "", "Serial port, tcp://host:port or rfc2217://host:port, to use instead of the one found for the board")
+	opts.addFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("select smoke test script to run")
+	}
+	opts.script = fs.Arg(0)
+
+	board, err := newBoard(boardType)
+	if err != nil {
+		return err
+	}
+	if portName == "" {
+		portInfos, err := enumerator.GetDetailedPortsList()
+		if err != nil {
+			return err
+		}
+		if portName, err = board.FindSerialPort(portInfos); err != nil {
+			return err
+		}
+	}
+	port, err := openBoardPort(board, portName)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+	// Time out reads regularly, so that the deadline of each test is checked.
+	return opts.run(ioextra.NewTimeoutReadWriteCloser(port, time.Second, 0))
+}
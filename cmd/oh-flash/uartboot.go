@@ -0,0 +1,54 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// uartBoot describes files sent to the boot ROM over the serial port.
+type uartBoot struct {
+	spl   string
+	uboot string
+}
+
+// addUARTBootFlags adds flags booting the board over the serial port.
+func addUARTBootFlags(fs *flag.FlagSet, boot *uartBoot) {
+	fs.StringVar(&boot.spl, "uart-boot-spl", "", "Send SPL to the boot ROM over the serial port with xmodem, as in AM335x UART boot mode")
+	fs.StringVar(&boot.uboot, "uart-boot-uboot", "", "Send u-boot to the SPL started with -uart-boot-spl with ymodem")
+}
+
+// bootUART sends SPL to the boot ROM polling the serial port and then u-boot
+// to the SPL, which loads it over the serial port in the same way.
+//
+// This allows starting u-boot on TI AM335x boards, such as the BeagleBone,
+// with an empty or broken eMMC and SD card, once the boot pins select UART
+// boot. The ROM only accepts xmodem, the SPL only ymodem.
+func bootUART(uboot *ubootshell.UBootShell, boot uartBoot) error {
+	fmt.Printf("Sending %s to the boot ROM\n", boot.spl)
+	if err := uboot.SendBootFile(boot.spl, ubootshell.NewXModemSender()); err != nil {
+		return err
+	}
+	if boot.uboot == "" {
+		return nil
+	}
+	fmt.Printf("Sending %s to the SPL\n", boot.uboot)
+	return uboot.SendBootFile(boot.uboot, ubootshell.NewYModemSender())
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+func runUBootScript(args []string) error {
+	var opts sessionOptions
+	fs := flag.NewFlagSet("oh-flash uboot-script", flag.ExitOnError)
+	opts.addFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("select u-boot script to run")
+	}
+
+	// Read the script before touching the board.
+	plan, err := ubootshell.LoadScript(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	sess, err := openSession(&opts)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	if err := plan.Execute(sess.uboot); err != nil {
+		return err
+	}
+	fmt.Printf("Completed %d steps of %s\n", len(plan.Steps), fs.Arg(0))
+	return nil
+}
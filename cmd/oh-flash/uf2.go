@@ -0,0 +1,110 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/devices/uf2"
+	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/progress"
+)
+
+// runUF2 flashes a board with a UF2 bootloader, such as the Raspberry Pi Pico.
+func runUF2(args []string) error {
+	fs := flag.NewFlagSet("oh-flash uf2", flag.ExitOnError)
+	volume := fs.String("volume", "", "Mount point of the UF2 bootloader volume, instead of looking for it")
+	base := fs.String("base", "0x10000000", "Flash address of binary images converted to UF2")
+	family := fs.String("family", "rp2040", "UF2 family of binary images converted to UF2, by name or number")
+	wait := fs.Duration("wait", 30*time.Second, "Maximum time to wait for the bootloader volume to appear")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("select firmware file to write")
+	}
+	path := fs.Arg(0)
+	r, _, err := ioextra.OpenDecompressed(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if !uf2.IsUF2(data) {
+		addr, err := strconv.ParseUint(*base, 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid base address: %q", *base)
+		}
+		familyID, err := uf2.ParseFamily(*family)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Converting %s to UF2 at %#x\n", path, addr)
+		data = uf2.Convert(data, uint32(addr), familyID)
+	}
+
+	vol, err := findUF2Volume(*volume, *wait)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Found UF2 bootloader volume %s, board %s\n", vol.Path, orDash(vol.Info["Board-ID"]))
+	fmt.Printf("Writing %s\n", path)
+	bar := progress.NewBar(os.Stdout)
+	bar.Start(filepath.Base(path), int64(len(data)))
+	if err := vol.Write(data, func(done int) { bar.Update(int64(done)) }); err != nil {
+		return fmt.Errorf("cannot write %s: %w", path, err)
+	}
+	bar.Finish()
+	return nil
+}
+
+// findUF2Volume returns the volume at the given path or waits for a single
+// volume of a UF2 bootloader to be mounted, as boards enter the bootloader
+// only when reset with a button held.
+func findUF2Volume(path string, wait time.Duration) (uf2.Volume, error) {
+	if path != "" {
+		return uf2.OpenVolume(path)
+	}
+	deadline := time.Now().Add(wait)
+	for announced := false; ; {
+		vols, err := uf2.FindVolumes()
+		if err != nil {
+			return uf2.Volume{}, err
+		}
+		switch {
+		case len(vols) == 1:
+			return vols[0], nil
+		case len(vols) > 1:
+			return uf2.Volume{}, fmt.Errorf("found %d UF2 bootloader volumes, select one with -volume", len(vols))
+		case time.Now().After(deadline):
+			return uf2.Volume{}, fmt.Errorf("cannot find UF2 bootloader volume")
+		case !announced:
+			fmt.Printf("Waiting for UF2 bootloader volume, reset the board holding BOOTSEL\n")
+			announced = true
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
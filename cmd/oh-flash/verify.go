@@ -0,0 +1,74 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/openharmony"
+)
+
+// assetChecks describe how images are verified before flashing.
+type assetChecks struct {
+	checksums     string
+	signature     string
+	key           string
+	requireSigned bool
+}
+
+// verify checks the signature of the checksums file and the images.
+//
+// Without an explicit signature, a signature next to the checksums file, with
+// the .minisig, .asc or .sig extension, is used if present.
+func (checks *assetChecks) verify(assets *openharmony.Assets) error {
+	if checks.checksums == "" {
+		if checks.requireSigned {
+			return usageErrorf("select signed checksums file with -checksums")
+		}
+		return nil
+	}
+	signature := checks.signature
+	if signature == "" {
+		for _, ext := range []string{".minisig", ".asc", ".sig"} {
+			if _, err := os.Stat(checks.checksums + ext); err == nil {
+				signature = checks.checksums + ext
+				break
+			}
+		}
+	}
+	if signature != "" {
+		fmt.Printf("Verifying signature %s\n", signature)
+		if err := openharmony.VerifySignature(checks.checksums, signature, checks.key); err != nil {
+			return err
+		}
+	} else if checks.requireSigned {
+		return flash.WithKind(fmt.Errorf("cannot find signature of %s", checks.checksums), openharmony.ErrVerificationFailed)
+	}
+	f, err := os.Open(checks.checksums)
+	if err != nil {
+		return err
+	}
+	sums, err := openharmony.ReadChecksums(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Verifying images listed in %s\n", checks.checksums)
+	return openharmony.Verify(assets, sums)
+}
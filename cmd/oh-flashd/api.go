@@ -0,0 +1,377 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.bug.st/serial.v1/enumerator"
+
+	"github.com/zyga/oh-flash-tools/devices/boards"
+	"github.com/zyga/oh-flash-tools/devices/serialport"
+	"github.com/zyga/oh-flash-tools/openharmony/fetch"
+)
+
+// maxUploadSize limits the total size of images uploaded with a job.
+const maxUploadSize = 256 << 20
+
+// portFinder finds the serial port of a board.
+type portFinder interface {
+	FindSerialPort(portInfos []*enumerator.PortDetails) (string, error)
+}
+
+// knownBoards are the boards that can be flashed by oh-flash.
+var knownBoards = map[string]portFinder{
+	"esp32":       &boards.Esp32{},
+	"hi3516ev200": &boards.Hi3516ev200{},
+	"hi3518ev300": &boards.Hi3518ev300{},
+	"rk3568":      &boards.Rk3568{},
+}
+
+// server implements the HTTP API of the daemon.
+type server struct {
+	queue *jobQueue
+}
+
+// boardInfo describes a serial port and the boards that may be behind it.
+//
+// Boards using the same USB to serial adapter cannot be told apart, all of
+// them are listed.
+type boardInfo struct {
+	Port    string   `json:"port"`
+	USBID   string   `json:"usb_id,omitempty"`
+	Serial  string   `json:"serial,omitempty"`
+	Product string   `json:"product,omitempty"`
+	Boards  []string `json:"boards,omitempty"`
+}
+
+// knownBoardNames returns the names of the known boards in alphabetical order.
+func knownBoardNames() []string {
+	names := make([]string, 0, len(knownBoards))
+	for name := range knownBoards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (srv *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/boards", srv.handleBoards)
+	mux.HandleFunc("/api/jobs", srv.handleJobs)
+	mux.HandleFunc("/api/jobs/", srv.handleJob)
+	mux.Handle("/metrics", srv.queue.metrics)
+	return mux
+}
+
+// handleBoards lists serial ports and identifies the boards behind them.
+func (srv *server) handleBoards(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	portInfos, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	infos := make([]boardInfo, 0, len(portInfos))
+	for _, portInfo := range portInfos {
+		info := boardInfo{
+			Port:    portInfo.Name,
+			USBID:   serialport.USBID(portInfo),
+			Serial:  portInfo.SerialNumber,
+			Product: portInfo.Product,
+		}
+		for _, name := range knownBoardNames() {
+			if _, err := knownBoards[name].FindSerialPort([]*enumerator.PortDetails{portInfo}); err == nil {
+				info.Boards = append(info.Boards, name)
+			}
+		}
+		infos = append(infos, info)
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// handleJobs lists jobs or submits a new one.
+func (srv *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, srv.queue.list())
+	case http.MethodPost:
+		srv.submitJob(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// submitJob accepts a job described with JSON or with a multipart form.
+//
+// Forms carry the same fields as JSON requests. Images may be uploaded as
+// files, in the form fields named after the image.
+func (srv *server) submitJob(w http.ResponseWriter, r *http.Request) {
+	var req jobRequest
+	var dir string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		var err error
+		if req, dir, err = readUpload(w, r); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("cannot decode job: %w", err))
+			return
+		}
+	}
+	if err := checkRequest(&req, dir); err != nil {
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	j, err := srv.queue.submit(req, dir)
+	if err != nil {
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	fmt.Printf("Job %d submitted for %s board\n", j.ID, req.Board)
+	snapshot, _ := srv.queue.get(j.ID)
+	writeJSON(w, http.StatusCreated, snapshot)
+}
+
+// imageFields are the form fields carrying images. Images of other
+// partitions are carried by fields named with imageFieldPrefix and the name
+// of the partition, such as "image.trust".
+var imageFields = []string{"bootloader", "kernel", "dtb", "rootfs", "userfs", "uboot", "boot_linux", "system", "vendor", "userdata", "bundle"}
+
+// imageFieldPrefix starts the names of form fields carrying images of other
+// partitions.
+const imageFieldPrefix = "image."
+
+// readUpload reads a job submitted as a multipart form.
+//
+// Uploaded files are stored in a new temporary directory, under the name of
+// the form field.
+func readUpload(w http.ResponseWriter, r *http.Request) (req jobRequest, dir string, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return req, "", fmt.Errorf("cannot read uploaded form: %w", err)
+	}
+	req.Board = r.FormValue("board")
+	req.Port = r.FormValue("port")
+	values := []*string{&req.BootLoader, &req.Kernel, &req.DTB, &req.Rootfs, &req.Userfs, &req.UBoot, &req.BootLinux, &req.System, &req.Vendor, &req.Userdata, &req.Bundle}
+	others := otherImageFields(r.MultipartForm)
+	fields := append(append([]string(nil), imageFields...), others...)
+	for range others {
+		values = append(values, new(string))
+	}
+	for i, field := range fields {
+		*values[i] = r.FormValue(field)
+		file, header, err := r.FormFile(field)
+		if err == http.ErrMissingFile {
+			continue
+		}
+		if err != nil {
+			return req, dir, err
+		}
+		if dir == "" {
+			if dir, err = ioutil.TempDir("", "oh-flashd-"); err != nil {
+				file.Close()
+				return req, "", err
+			}
+		}
+		// Keep the extension, bundles are recognized by it.
+		name := field + filepath.Ext(header.Filename)
+		err = saveFile(file, filepath.Join(dir, name))
+		file.Close()
+		if err != nil {
+			os.RemoveAll(dir)
+			return req, "", err
+		}
+		*values[i] = name
+	}
+	for i, field := range others {
+		if req.Images == nil {
+			req.Images = make(map[string]string, len(others))
+		}
+		req.Images[strings.TrimPrefix(field, imageFieldPrefix)] = *values[len(imageFields)+i]
+	}
+	return req, dir, nil
+}
+
+// otherImageFields returns the sorted names of the form fields carrying
+// images of other partitions.
+func otherImageFields(form *multipart.Form) []string {
+	seen := make(map[string]bool)
+	for field := range form.Value {
+		seen[field] = true
+	}
+	for field := range form.File {
+		seen[field] = true
+	}
+	var fields []string
+	for field := range seen {
+		if strings.HasPrefix(field, imageFieldPrefix) && len(field) > len(imageFieldPrefix) {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func saveFile(r io.Reader, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkRequest checks that the job can be run.
+//
+// Images must be uploaded or given as URLs, local paths of the host running
+// the daemon are not accepted.
+func checkRequest(req *jobRequest, dir string) error {
+	if _, ok := knownBoards[req.Board]; !ok {
+		return fmt.Errorf("unsupported board type: %q", req.Board)
+	}
+	images := []string{req.BootLoader, req.Kernel, req.DTB, req.Rootfs, req.Userfs, req.UBoot, req.BootLinux, req.System, req.Vendor, req.Userdata, req.Bundle}
+	names := append([]string(nil), imageFields...)
+	for name, image := range req.Images {
+		if name == "" || strings.ContainsAny(name, "=,") {
+			return fmt.Errorf("invalid image name: %q", name)
+		}
+		images = append(images, image)
+		names = append(names, name)
+	}
+	empty := true
+	for i, image := range images {
+		if image == "" {
+			continue
+		}
+		empty = false
+		if fetch.IsURL(image) {
+			continue
+		}
+		if dir != "" && image == filepath.Base(image) {
+			if _, err := os.Stat(filepath.Join(dir, image)); err == nil {
+				continue
+			}
+		}
+		return fmt.Errorf("%s image must be uploaded or given as an URL", names[i])
+	}
+	if empty {
+		return fmt.Errorf("no images to flash")
+	}
+	return nil
+}
+
+// handleJob returns the status, the log or the events of a single job.
+func (srv *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+	idText, suffix := rest, ""
+	if idx := strings.IndexByte(rest, '/'); idx >= 0 {
+		idText, suffix = rest[:idx], rest[idx:]
+	}
+	id, err := strconv.Atoi(idText)
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such job: %q", idText))
+		return
+	}
+	j, ok := srv.queue.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such job: %d", id))
+		return
+	}
+	switch suffix {
+	case "":
+		writeJSON(w, http.StatusOK, j)
+	case "/log":
+		streamLog(w, r, j.log, "text/plain; charset=utf-8")
+	case "/events":
+		streamLog(w, r, j.events, "application/x-ndjson")
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such resource: %s", r.URL.Path))
+	}
+}
+
+// streamLog sends the log or the events of a job, following them until the
+// job is finished.
+func streamLog(w http.ResponseWriter, r *http.Request, log *jobLog, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	flusher, _ := w.(http.Flusher)
+	for offset := 0; ; {
+		data, closed, updated := log.since(offset)
+		if len(data) > 0 {
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			offset += len(data)
+			continue
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-updated:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
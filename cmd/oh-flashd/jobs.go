@@ -0,0 +1,355 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/timing"
+)
+
+// jobState is the state of a flash job.
+type jobState string
+
+const (
+	jobQueued    jobState = "queued"
+	jobRunning   jobState = "running"
+	jobSucceeded jobState = "succeeded"
+	jobFailed    jobState = "failed"
+)
+
+// jobRequest describes what to flash.
+//
+// Images are given as http or https URLs, or as names of files uploaded
+// together with the request.
+type jobRequest struct {
+	Board      string `json:"board"`
+	Port       string `json:"port,omitempty"`
+	BootLoader string `json:"bootloader,omitempty"`
+	Kernel     string `json:"kernel,omitempty"`
+	DTB        string `json:"dtb,omitempty"`
+	Rootfs     string `json:"rootfs,omitempty"`
+	Userfs     string `json:"userfs,omitempty"`
+	UBoot      string `json:"uboot,omitempty"`
+	BootLinux  string `json:"boot_linux,omitempty"`
+	System     string `json:"system,omitempty"`
+	Vendor     string `json:"vendor,omitempty"`
+	Userdata   string `json:"userdata,omitempty"`
+	Bundle     string `json:"bundle,omitempty"`
+	// Images are images of other partitions, by the name of the partition.
+	Images map[string]string `json:"images,omitempty"`
+}
+
+// args returns the arguments of oh-flash flash performing the job.
+func (req *jobRequest) args() []string {
+	args := []string{"flash", "-board", req.Board}
+	for _, arg := range []struct{ flag, value string }{
+		{"-port", req.Port},
+		{"-bootloader", req.BootLoader},
+		{"-kernel", req.Kernel},
+		{"-dtb", req.DTB},
+		{"-rootfs", req.Rootfs},
+		{"-userfs", req.Userfs},
+		{"-uboot", req.UBoot},
+		{"-boot-linux", req.BootLinux},
+		{"-system", req.System},
+		{"-vendor", req.Vendor},
+		{"-userdata", req.Userdata},
+		{"-bundle", req.Bundle},
+	} {
+		if arg.value != "" {
+			args = append(args, arg.flag, arg.value)
+		}
+	}
+	names := make([]string, 0, len(req.Images))
+	for name := range req.Images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "-image", name+"="+req.Images[name])
+	}
+	return args
+}
+
+// job is a single flashing request and its outcome.
+type job struct {
+	ID       int        `json:"id"`
+	Request  jobRequest `json:"request"`
+	State    jobState   `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Stage is the stage of flashing being performed by a running job.
+	Stage string `json:"stage,omitempty"`
+
+	dir    string // uploaded files, removed when the job is finished
+	log    *jobLog
+	events *jobLog // events emitted by oh-flash, as JSON lines
+}
+
+// jobLog is the output of a job, which can be followed while it is written.
+type jobLog struct {
+	mu      sync.Mutex
+	data    []byte
+	closed  bool
+	updated chan struct{} // closed and replaced on each update
+}
+
+func newJobLog() *jobLog {
+	return &jobLog{updated: make(chan struct{})}
+}
+
+// Write appends data to the log and wakes up followers.
+func (log *jobLog) Write(p []byte) (int, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.data = append(log.data, p...)
+	close(log.updated)
+	log.updated = make(chan struct{})
+	return len(p), nil
+}
+
+// Close marks the end of the log.
+func (log *jobLog) Close() error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.closed = true
+	close(log.updated)
+	log.updated = make(chan struct{})
+	return nil
+}
+
+// since returns the log starting at the given offset, whether the log is
+// complete and a channel closed when more data arrives.
+func (log *jobLog) since(offset int) ([]byte, bool, <-chan struct{}) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.data[offset:], log.closed, log.updated
+}
+
+// jobQueue runs flash jobs one at a time, in the order of submission.
+//
+// Boards attached to a single host usually share power controllers and USB
+// hubs, so jobs are never run concurrently.
+type jobQueue struct {
+	ohFlash string // path of the oh-flash executable
+	metrics *metrics
+
+	mu      sync.Mutex
+	jobs    []*job
+	pending chan *job
+}
+
+func newJobQueue(ohFlash string) *jobQueue {
+	return &jobQueue{ohFlash: ohFlash, metrics: newMetrics(), pending: make(chan *job, 100)}
+}
+
+// submit adds a job to the queue.
+//
+// The directory, if any, holds uploaded files and is removed once the job
+// is finished.
+func (q *jobQueue) submit(req jobRequest, dir string) (*job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := &job{
+		ID:      len(q.jobs) + 1,
+		Request: req,
+		State:   jobQueued,
+		Created: time.Now(),
+		dir:     dir,
+		log:     newJobLog(),
+		events:  newJobLog(),
+	}
+	select {
+	case q.pending <- j:
+	default:
+		return nil, fmt.Errorf("cannot submit job, too many jobs are waiting")
+	}
+	q.jobs = append(q.jobs, j)
+	return j, nil
+}
+
+// get returns a snapshot of the job with the given ID.
+func (q *jobQueue) get(id int) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if id < 1 || id > len(q.jobs) {
+		return job{}, false
+	}
+	return *q.jobs[id-1], true
+}
+
+// list returns snapshots of all the jobs.
+func (q *jobQueue) list() []job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		jobs = append(jobs, *j)
+	}
+	return jobs
+}
+
+// run executes jobs until the context is cancelled.
+func (q *jobQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-q.pending:
+			q.execute(ctx, j)
+		}
+	}
+}
+
+// execute runs oh-flash to perform the job.
+func (q *jobQueue) execute(ctx context.Context, j *job) {
+	q.update(j, func() {
+		j.State = jobRunning
+		now := time.Now()
+		j.Started = &now
+	})
+	defer j.log.Close()
+	defer j.events.Close()
+	if j.dir != "" {
+		defer os.RemoveAll(j.dir)
+	}
+	args := j.Request.args()
+	fmt.Fprintf(j.log, "Running %s %q\n", filepath.Base(q.ohFlash), args)
+	// The timing report tells which stage failed and how fast transfers were.
+	timingPath, err := tempPath("oh-flashd-timing-*.json")
+	if err == nil {
+		defer os.Remove(timingPath)
+		args = append(args, "-timing-report", timingPath)
+	}
+	// Events are written to standard error, together with the final error.
+	args = append(args, "-events", "-")
+	stderr := &eventFilter{queue: q, job: j}
+	cmd := exec.CommandContext(ctx, q.ohFlash, args...)
+	cmd.Dir = j.dir
+	cmd.Stdout = j.log
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	stderr.flush()
+	q.update(j, func() {
+		now := time.Now()
+		j.Finished = &now
+		j.Stage = ""
+		if err != nil {
+			j.State = jobFailed
+			j.Error = err.Error()
+		} else {
+			j.State = jobSucceeded
+		}
+	})
+	fmt.Printf("Job %d %s\n", j.ID, j.State)
+	q.metrics.record(j, readTimingReport(timingPath))
+}
+
+// eventFilter separates events written by oh-flash from other output.
+//
+// Events are kept in the event log of the job and update its stage, other
+// lines are appended to the regular log.
+type eventFilter struct {
+	queue *jobQueue
+	job   *job
+	buf   []byte
+}
+
+func (filter *eventFilter) Write(p []byte) (int, error) {
+	filter.buf = append(filter.buf, p...)
+	for {
+		idx := bytes.IndexByte(filter.buf, '\n')
+		if idx < 0 {
+			return len(p), nil
+		}
+		filter.line(filter.buf[:idx+1])
+		filter.buf = filter.buf[idx+1:]
+	}
+}
+
+func (filter *eventFilter) line(line []byte) {
+	event, err := flash.ParseEvent(line)
+	if err != nil {
+		filter.job.log.Write(line)
+		return
+	}
+	filter.job.events.Write(line)
+	switch event.Type {
+	case flash.StartedEvent:
+		filter.queue.update(filter.job, func() { filter.job.Stage = event.Stage.Name })
+	case flash.CompletedEvent, flash.FailedEvent:
+		filter.queue.update(filter.job, func() { filter.job.Stage = "" })
+	}
+}
+
+// flush writes the last line, if it was not terminated.
+func (filter *eventFilter) flush() {
+	if len(filter.buf) > 0 {
+		filter.line(filter.buf)
+		filter.buf = nil
+	}
+}
+
+// tempPath returns the path of a new empty temporary file.
+func tempPath(pattern string) (string, error) {
+	f, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// readTimingReport reads the timing report written by oh-flash.
+//
+// Nil is returned if the report is missing, as oh-flash may fail before
+// writing it.
+func readTimingReport(path string) *timing.Report {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	report, err := timing.ReadJSON(f)
+	if err != nil {
+		return nil
+	}
+	return report
+}
+
+// update changes the job while holding the lock of the queue.
+func (q *jobQueue) update(j *job, fn func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fn()
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command oh-flashd is a service flashing boards on request.
+//
+// Jobs are submitted over HTTP and performed one at a time by running
+// oh-flash. The API is described in README.md.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds the time spent waiting for open API requests.
+const shutdownTimeout = 5 * time.Second
+
+// findOhFlash returns the path of the oh-flash executable.
+//
+// The executable installed next to oh-flashd is preferred over the one found
+// in PATH.
+func findOhFlash() string {
+	if self, err := os.Executable(); err == nil {
+		candidate := filepath.Join(filepath.Dir(self), "oh-flash"+filepath.Ext(self))
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	if path, err := exec.LookPath("oh-flash"); err == nil {
+		return path
+	}
+	return "oh-flash"
+}
+
+func run(args []string) error {
+	var listen, ohFlash string
+	fs := flag.NewFlagSet("oh-flashd", flag.ExitOnError)
+	fs.StringVar(&listen, "listen", "localhost:8080", "Address to serve the HTTP API on")
+	fs.StringVar(&ohFlash, "oh-flash", findOhFlash(), "Path of the oh-flash executable used to flash boards")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := newJobQueue(ohFlash)
+	go queue.run(ctx)
+
+	srv := &server{queue: queue}
+	httpServer := &http.Server{Addr: listen, Handler: srv.routes()}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Printf("Shutting down\n")
+		// Running jobs are killed, the board is left in an unknown state.
+		cancel()
+		shutdownCtx, done := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer done()
+		_ = httpServer.Shutdown(shutdownCtx)
+	}()
+	fmt.Printf("Serving API on http://%s/api/\n", listen)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
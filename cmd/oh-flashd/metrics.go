@@ -0,0 +1,190 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/timing"
+)
+
+// throughputBuckets are upper bounds of the transfer throughput histogram,
+// in bytes per second. They cover rates from a slow 115200 bps link to
+// several megabits per second.
+var throughputBuckets = []float64{2000, 5000, 10000, 20000, 50000, 100000, 200000, 500000}
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	counts []uint64 // one per bucket, plus +Inf
+	sum    float64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(throughputBuckets)+1)
+	}
+	for i, bound := range throughputBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(throughputBuckets)]++
+	h.sum += value
+}
+
+// metrics are statistics of finished jobs, exposed for Prometheus.
+type metrics struct {
+	mu         sync.Mutex
+	jobs       map[[2]string]uint64 // by board and state
+	failures   map[[2]string]uint64 // by board and kind of the failed stage
+	throughput map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		jobs:       make(map[[2]string]uint64),
+		failures:   make(map[[2]string]uint64),
+		throughput: make(map[string]*histogram),
+	}
+}
+
+// record adds the outcome of a finished job.
+//
+// The timing report of the job is nil if oh-flash did not write one, for
+// example because it failed before flashing started.
+func (m *metrics) record(j *job, report *timing.Report) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	board := j.Request.Board
+	m.jobs[[2]string{board, string(j.State)}]++
+	if j.State == jobFailed {
+		stage, ok := report.Failed()
+		if !ok {
+			stage.Kind = flash.OtherStage
+		}
+		m.failures[[2]string{board, stage.Kind}]++
+	}
+	if report == nil {
+		return
+	}
+	for _, stage := range report.Stages {
+		if stage.Kind != flash.TransferStage || stage.Failed || stage.Bytes == 0 {
+			continue
+		}
+		h := m.throughput[board]
+		if h == nil {
+			h = &histogram{}
+			m.throughput[board] = h
+		}
+		h.observe(stage.Throughput())
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+func (m *metrics) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "# HELP oh_flashd_jobs_total Finished flash jobs.\n")
+	fmt.Fprintf(bw, "# TYPE oh_flashd_jobs_total counter\n")
+	for _, key := range sortedKeys(m.jobs) {
+		fmt.Fprintf(bw, "oh_flashd_jobs_total{board=%s,state=%s} %d\n", quote(key[0]), quote(key[1]), m.jobs[key])
+	}
+
+	fmt.Fprintf(bw, "# HELP oh_flashd_job_failures_total Failed flash jobs by the kind of the failed stage.\n")
+	fmt.Fprintf(bw, "# TYPE oh_flashd_job_failures_total counter\n")
+	for _, key := range sortedKeys(m.failures) {
+		fmt.Fprintf(bw, "oh_flashd_job_failures_total{board=%s,stage=%s} %d\n", quote(key[0]), quote(key[1]), m.failures[key])
+	}
+
+	fmt.Fprintf(bw, "# HELP oh_flashd_job_success_ratio Fraction of finished flash jobs that succeeded.\n")
+	fmt.Fprintf(bw, "# TYPE oh_flashd_job_success_ratio gauge\n")
+	finished := make(map[string]uint64)
+	for key, n := range m.jobs {
+		finished[key[0]] += n
+	}
+	for _, board := range sortedBoards(finished) {
+		succeeded := m.jobs[[2]string{board, string(jobSucceeded)}]
+		fmt.Fprintf(bw, "oh_flashd_job_success_ratio{board=%s} %g\n", quote(board), float64(succeeded)/float64(finished[board]))
+	}
+
+	fmt.Fprintf(bw, "# HELP oh_flashd_transfer_throughput_bytes_per_second Throughput of file transfers to boards.\n")
+	fmt.Fprintf(bw, "# TYPE oh_flashd_transfer_throughput_bytes_per_second histogram\n")
+	boards := make([]string, 0, len(m.throughput))
+	for board := range m.throughput {
+		boards = append(boards, board)
+	}
+	sort.Strings(boards)
+	for _, board := range boards {
+		h := m.throughput[board]
+		for i, bound := range throughputBuckets {
+			fmt.Fprintf(bw, "oh_flashd_transfer_throughput_bytes_per_second_bucket{board=%s,le=\"%g\"} %d\n", quote(board), bound, h.counts[i])
+		}
+		count := h.counts[len(throughputBuckets)]
+		fmt.Fprintf(bw, "oh_flashd_transfer_throughput_bytes_per_second_bucket{board=%s,le=\"+Inf\"} %d\n", quote(board), count)
+		fmt.Fprintf(bw, "oh_flashd_transfer_throughput_bytes_per_second_sum{board=%s} %g\n", quote(board), h.sum)
+		fmt.Fprintf(bw, "oh_flashd_transfer_throughput_bytes_per_second_count{board=%s} %d\n", quote(board), count)
+	}
+	return bw.Flush()
+}
+
+// sortedKeys returns the keys of a labelled counter in a stable order.
+func sortedKeys(counters map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+// sortedBoards returns the boards of a per-board counter in a stable order.
+func sortedBoards(counters map[string]uint64) []string {
+	boards := make([]string, 0, len(counters))
+	for board := range counters {
+		boards = append(boards, board)
+	}
+	sort.Strings(boards)
+	return boards
+}
+
+// quote returns the label value escaped as required by the text format.
+func quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package boards
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Placeholders of templates of bootcmd and bootargs, see Options.
+const (
+	placeholderConsole    = "console"    // serial console of the kernel
+	placeholderRootAddr   = "rootaddr"   // offset of the root file system, such as 7M
+	placeholderRootSize   = "rootsize"   // size of the root file system partition
+	placeholderKernelAddr = "kerneladdr" // location of the kernel in storage
+	placeholderKernelSize = "kernelsize"
+	placeholderDTBAddr    = "dtbaddr" // location of the device tree in storage
+	placeholderDTBSize    = "dtbsize"
+	placeholderLoadAddr   = "loadaddr" // memory the kernel is read to
+	placeholderFDTAddr    = "fdtaddr"  // memory the device tree is read to
+	placeholderBoot       = "boot"     // command starting the kernel
+)
+
+// expandBootTemplate replaces placeholders such as {rootaddr} in a template
+// of the named environment variable with their values.
+//
+// References to environment variables, such as ${bootargs}, are left for
+// u-boot to expand. Placeholders without a value on the board are reported
+// as errors.
+func expandBootTemplate(name, template string, values map[string]string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			b.WriteString(template)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("cannot expand %s template: unterminated placeholder", name)
+		}
+		end += start
+		b.WriteString(template[:start])
+		if start > 0 && template[start-1] == '$' {
+			b.WriteString(template[start : end+1])
+		} else {
+			placeholder := template[start+1 : end]
+			value, ok := values[placeholder]
+			if !ok {
+				return "", fmt.Errorf("cannot expand %s template: no value for placeholder {%s}, expected one of %s",
+					name, placeholder, placeholderNames(values))
+			}
+			b.WriteString(value)
+		}
+		template = template[end+1:]
+	}
+}
+
+// placeholderNames returns the sorted placeholders, in braces.
+func placeholderNames(values map[string]string) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, "{"+name+"}")
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// usesPlaceholder returns true if any of the templates refers to any of the
+// placeholders.
+func usesPlaceholder(templates []string, placeholders ...string) bool {
+	for _, template := range templates {
+		for _, placeholder := range placeholders {
+			if strings.Contains(template, "{"+placeholder+"}") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// kernelArgSize formats a size or offset for the kernel command line, in
+// megabytes or kilobytes if aligned, such as 7M.
+func kernelArgSize(size uint64) string {
+	switch {
+	case size%(1<<20) == 0:
+		return fmt.Sprintf("%dM", size>>20)
+	case size%(1<<10) == 0:
+		return fmt.Sprintf("%dK", size>>10)
+	}
+	return fmt.Sprintf("%d", size)
+}
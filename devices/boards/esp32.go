@@ -0,0 +1,192 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package boards
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"go.bug.st/serial.v1"
+	"go.bug.st/serial.v1/enumerator"
+
+	"github.com/zyga/oh-flash-tools/devices/esprom"
+	"github.com/zyga/oh-flash-tools/devices/serialport"
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// Esp32 is a development board with an Espressif ESP32 or ESP32-C3 chip,
+// running OpenHarmony LiteOS-M.
+//
+// There is no u-boot, images are written to flash by the bootloader in the
+// ROM of the chip, reached over the serial port of the board.
+type Esp32 struct{}
+
+// esp32PartitionTable is the name of the image of the partition table.
+const esp32PartitionTable = "partition-table"
+
+// esp32Partitions lists the names of the partitions that can be flashed, in
+// the order of flashing.
+var esp32Partitions = []string{openharmony.BootLoader, esp32PartitionTable, openharmony.Kernel}
+
+// esp32Layout returns the partitions of flash, in the order of flashing.
+//
+// The partition table is at a fixed location, where the bootloader looks for
+// it, and describes the application partition holding the OpenHarmony image.
+// The bootloader starts at an offset depending on the chip. At most 16MB of
+// flash are addressed by the chips.
+func esp32Layout(chip esprom.Chip) []partition {
+	return []partition{
+		{name: openharmony.BootLoader, flashAddr: uint64(chip.BootloaderOffset), eraseSize: 0x8_000 - uint64(chip.BootloaderOffset)},
+		{name: esp32PartitionTable, flashAddr: 0x8_000, eraseSize: 0x1_000},
+		{name: openharmony.Kernel, flashAddr: 0x10_000, eraseSize: 0x1_000_000 - 0x10_000},
+	}
+}
+
+// FindSerialPort finds a serial port appropriate for interacting with the bootloader.
+//
+// Development boards use a Silicon Labs CP210x, using USB vendor 0x10c4 and
+// USB product 0xea60, or a WCH CH340 or CH9102, using USB vendor 0x1a86 and
+// USB product 0x7523 or 0x55d4. Their DTR and RTS lines reset the chip.
+func (board *Esp32) FindSerialPort(portInfos []*enumerator.PortDetails) (string, error) {
+	names := make([]string, 0, 1)
+	for _, portInfo := range portInfos {
+		if serialport.MatchUSB(portInfo, "10c4", "ea60") || serialport.MatchUSB(portInfo, "1a86", "7523") || serialport.MatchUSB(portInfo, "1a86", "55d4") {
+			names = append(names, portInfo.Name)
+		}
+	}
+	if len(names) != 1 {
+		return "", portNotFound("esp32", len(names))
+	}
+	return names[0], nil
+}
+
+// OpenSerialPort opens the given serial port.
+//
+// The returned port implements esprom.ModemControl.
+func (board *Esp32) OpenSerialPort(portName string) (io.ReadWriteCloser, error) {
+	return openSerialPort(portName, &serial.Mode{
+		BaudRate: 115200,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	})
+}
+
+// AssetNames returns the names of the assets used by the board.
+func (board *Esp32) AssetNames() []string {
+	return esp32Partitions
+}
+
+// FlashROM flashes an esp32 board with given assets through the ROM
+// bootloader and resets it.
+//
+// The chip is reset into the bootloader through DTR and RTS of the port, if
+// it supports them, otherwise it must be reset by hand with the BOOT button
+// held. Each image is verified once written. Writes are reported to the
+// observer, if not nil.
+func (board *Esp32) FlashROM(port io.ReadWriteCloser, assets *openharmony.Assets, events flash.Events, observer ubootshell.TransferObserver) error {
+	dev := esprom.New(port)
+	defer dev.Close()
+	stage := flash.Stage{Kind: flash.ResetStage, Name: "reset into the ROM bootloader"}
+	err := flash.Run(events, stage, func() error {
+		if err := dev.ResetToBootloader(); err != nil && err != esprom.ErrNoModemControl {
+			return err
+		}
+		return dev.Sync()
+	})
+	if err != nil {
+		return err
+	}
+	var layout []partition
+	stage = flash.Stage{Kind: flash.CheckStage, Name: "detect chip and check images"}
+	err = flash.Run(events, stage, func() error {
+		chip, err := dev.DetectChip()
+		if err != nil {
+			return err
+		}
+		layout = esp32Layout(chip)
+		if err := checkAssets(layout, assets); err != nil {
+			return err
+		}
+		return dev.AttachFlash()
+	})
+	if err != nil {
+		return err
+	}
+	for _, part := range layout {
+		path := assets.Get(part.name)
+		if path == "" {
+			continue
+		}
+		size, err := ioextra.DecompressedSize(path)
+		if err != nil {
+			return err
+		}
+		stage := flash.Stage{Kind: flash.WriteStage, Name: fmt.Sprintf("write %s to flash at %#x", path, part.flashAddr), Bytes: size}
+		err = flash.Run(events, stage, func() error {
+			return esp32WriteImage(dev, path, uint32(part.flashAddr), stage, events, observer)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return flash.Run(events, flash.Stage{Kind: flash.ResetStage, Name: "reset the board"}, func() error {
+		if err := dev.FlashEnd(false); err != nil {
+			return err
+		}
+		if err := dev.HardReset(); err == esprom.ErrNoModemControl {
+			return dev.FlashEnd(true)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// esp32WriteImage writes an image to flash, decompressing it first, and
+// verifies it.
+func esp32WriteImage(dev *esprom.Device, path string, offset uint32, stage flash.Stage, events flash.Events, observer ubootshell.TransferObserver) error {
+	r, size, err := ioextra.OpenDecompressed(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if observer != nil {
+		observer.Start(path, size)
+		defer observer.Finish()
+	}
+	err = dev.WriteFlash(offset, data, func(done int) {
+		if observer != nil {
+			observer.Progress(int64(done), size)
+		}
+		if events != nil {
+			events.StageProgress(stage, int64(done), size)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return dev.VerifyFlash(offset, data)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package boards
+
+import (
+	"fmt"
+
+	"github.com/zyga/oh-flash-tools/devices/fastboot"
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// flashFastbootAssets flashes the assets to the partitions of the same name
+// over fastboot, in the given order, followed by other assets.
+//
+// Each partition is a separate stage, the transfer is reported to the
+// observer, if not nil.
+func flashFastbootAssets(dev *fastboot.Device, names []string, assets *openharmony.Assets, events flash.Events, observer ubootshell.TransferObserver) error {
+	order := append([]string(nil), names...)
+	for _, name := range assets.Names() {
+		known := false
+		for _, n := range names {
+			known = known || n == name
+		}
+		if !known {
+			order = append(order, name)
+		}
+	}
+	for _, name := range order {
+		path := assets.Get(name)
+		if path == "" {
+			continue
+		}
+		size, err := ioextra.DecompressedSize(path)
+		if err != nil {
+			return err
+		}
+		stage := flash.Stage{Kind: flash.WriteStage, Name: fmt.Sprintf("flash %s to %s partition over fastboot", path, name), Bytes: size}
+		err = flash.Run(events, stage, func() error {
+			return flashFastbootImage(dev, name, path, stage, events, observer)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flashFastbootImage flashes a single image, decompressing it on the fly.
+func flashFastbootImage(dev *fastboot.Device, name, path string, stage flash.Stage, events flash.Events, observer ubootshell.TransferObserver) error {
+	r, size, err := ioextra.OpenDecompressed(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if observer != nil {
+		observer.Start(path, size)
+		defer observer.Finish()
+	}
+	return dev.FlashImage(name, r, size, func(done int64) {
+		if observer != nil {
+			observer.Progress(done, size)
+		}
+		if events != nil {
+			events.StageProgress(stage, done, size)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package boards
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/flashhelper"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// hisiSPIFlashDevice is the name of the SPI flash controller in Linux kernels
+// for HiSilicon boards, as used by the mtdparts kernel argument.
+const hisiSPIFlashDevice = "hi_sfc"
+
+// addSPIFlashHelper appends steps booting the flashing helper with the
+// partitions of the layout as MTD devices, in order, so that the partition
+// at index i is /dev/mtd<i>.
+func addSPIFlashHelper(plan *ubootshell.FlashPlan, mem staging, layout []partition, helperPath string) {
+	parts := make([]string, len(layout))
+	for i, part := range layout {
+		parts[i] = fmt.Sprintf("%#x@%#x(%s)", part.eraseSize, part.flashAddr, part.name)
+	}
+	// The environment is not saved, the flashed system keeps its arguments.
+	plan.SetEnv("bootargs", fmt.Sprintf("console=ttyAMA0,115200 mtdparts=%s:%s", hisiSPIFlashDevice, strings.Join(parts, ",")))
+	plan.LoadFile(mem.loadAddr, helperPath).BootImage(mem.loadAddr)
+}
+
+// spiFlashHelperTargets returns the MTD partitions written with the assets
+// by a helper booted by addSPIFlashHelper.
+func spiFlashHelperTargets(layout []partition, assets *openharmony.Assets) []flashhelper.Target {
+	var targets []flashhelper.Target
+	for i, part := range layout {
+		if path := assets.Get(part.name); path != "" {
+			targets = append(targets, flashhelper.Target{Name: part.name, Path: path, Device: fmt.Sprintf("/dev/mtd%d", i), MTD: true})
+		}
+	}
+	return targets
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package boards
+
+import (
+	"io"
+
+	"go.bug.st/serial.v1"
+	"go.bug.st/serial.v1/enumerator"
+
+	"github.com/zyga/oh-flash-tools/devices/serialport"
+	"github.com/zyga/oh-flash-tools/flashhelper"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// Hi3516ev200 is a development board for IP Cameras, the smaller sibling of
+// hi3518ev300 with 64MB of memory built into the SoC.
+type Hi3516ev200 struct {
+	opts Options
+}
+
+// Partitions of the SPI NOR flash of hi3516ev200.
+var (
+	hi3516ev200BootLoader = partition{name: "bootloader", flashAddr: 0x0, eraseSize: 0x80_000}
+	hi3516ev200Kernel     = partition{name: "kernel", flashAddr: 0x80_000, eraseSize: 0x580_000}
+	hi3516ev200Rootfs     = partition{name: "rootfs", flashAddr: 0x600_000, eraseSize: 0x900_000}
+	hi3516ev200Userfs     = partition{name: "userfs", flashAddr: 0xf00_000, eraseSize: 0x100_000}
+)
+
+// hi3516ev200Layout lists all the partitions, in the order of flashing.
+var hi3516ev200Layout = []partition{hi3516ev200BootLoader, hi3516ev200Kernel, hi3516ev200Rootfs, hi3516ev200Userfs}
+
+// hi3516ev200Staging is the memory where images are loaded before writing
+// them. The largest partition, decompressed, ends before the scratch area,
+// both fit in the 64MB of memory.
+var hi3516ev200Staging = staging{loadAddr: 0x41_000_000, scratchAddr: 0x42_000_000}
+
+// hi3516ev200KernelAddr is where the kernel is loaded in memory and started.
+const hi3516ev200KernelAddr = 0x40_000_000
+
+// hi3516ev200Console is the serial console of the kernel.
+const hi3516ev200Console = "ttyAMA0,115200n8"
+
+// layout returns the partitions of flash, with the device tree if its
+// location is given by the options.
+func (board *Hi3516ev200) layout() []partition {
+	return withDTB(hi3516ev200Layout, board.opts)
+}
+
+// FindSerialPort finds a serial port appropriate for interacting with the bootloader.
+//
+// The adapter bundled with the development kit is a Prolific Technology Inc
+// USB to Serial converter, like the one of hi3518ev300, using USB vendor
+// 0x067b and USB product 0x2303 without a serial number.
+func (board *Hi3516ev200) FindSerialPort(portInfos []*enumerator.PortDetails) (string, error) {
+	names := make([]string, 0, 1)
+	for _, portInfo := range portInfos {
+		if serialport.MatchUSB(portInfo, "067b", "2303") && portInfo.SerialNumber == "" {
+			names = append(names, portInfo.Name)
+		}
+	}
+	if len(names) != 1 {
+		return "", portNotFound("hi3516ev200", len(names))
+	}
+	return names[0], nil
+}
+
+// OpenSerialPort opens the given serial port.
+//
+// The returned port implements ubootshell.BaudRateSetter.
+func (board *Hi3516ev200) OpenSerialPort(portName string) (io.ReadWriteCloser, error) {
+	return openSerialPort(portName, &serial.Mode{
+		BaudRate: 115200,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	})
+}
+
+// AutobootBanners returns the messages printed by u-boot before auto-boot.
+//
+// The u-boot of the development kit only stops on Ctrl-C and says so.
+func (board *Hi3516ev200) AutobootBanners() []string {
+	return []string{"Hit ctrl+c to stop autoboot"}
+}
+
+// InterruptKeys returns the keys that stop u-boot auto-boot.
+func (board *Hi3516ev200) InterruptKeys() string {
+	return "\x03"
+}
+
+// RepeatInterruptKeys returns false as a single Ctrl-C stops auto-boot.
+func (board *Hi3516ev200) RepeatInterruptKeys() bool {
+	return false
+}
+
+// FileSender returns the sender of files to u-boot.
+//
+// Like on hi3518ev300, YMODEM is the fastest protocol u-boot supports.
+func (board *Hi3516ev200) FileSender() ubootshell.FileSender {
+	return ubootshell.NewYModemSender()
+}
+
+// AssetNames returns the names of the assets used by the board.
+func (board *Hi3516ev200) AssetNames() []string {
+	return layoutNames(board.layout())
+}
+
+// SupportedUBootVersions returns the versions of u-boot known to work with the board.
+//
+// The development kit ships with u-boot 2016.11, patched by HiSilicon.
+func (board *Hi3516ev200) SupportedUBootVersions() []ubootshell.VersionRange {
+	v := ubootshell.Version{Year: 2016, Month: 11}
+	return []ubootshell.VersionRange{{Min: v, Max: v}}
+}
+
+// SetOptions tunes the way the board is flashed.
+func (board *Hi3516ev200) SetOptions(opts Options) {
+	board.opts = opts
+}
+
+// FlashAssets flashes an hi3516ev200 board with given assets.
+func (board *Hi3516ev200) FlashAssets(uboot *ubootshell.UBootShell, assets *openharmony.Assets) error {
+	if err := checkSPIFlash(uboot, "hi3516ev200", board.SupportedUBootVersions(), board.layout(), assets, board.opts); err != nil {
+		return err
+	}
+	plan, err := board.FlashPlan(uboot, assets)
+	if err != nil {
+		return err
+	}
+	return executePlan(uboot, plan, board.layout())
+}
+
+// FlashPlan returns the plan of flashing an hi3516ev200 board with given assets.
+//
+// It fails if the templates of bootcmd or bootargs in the options cannot be
+// expanded.
+func (board *Hi3516ev200) FlashPlan(uboot *ubootshell.UBootShell, assets *openharmony.Assets) (*ubootshell.FlashPlan, error) {
+	plan := ubootshell.NewFlashPlan()
+	addSPIFlashAssets(plan, uboot, hi3516ev200Staging, board.layout(), assets, board.opts)
+	if err := board.configureUBoot(plan); err != nil {
+		return nil, err
+	}
+	return plan.Reset(), nil
+}
+
+// BootHelper checks the flash layout and the assets, configures u-boot to
+// boot the flashed system and boots the flashing helper instead of flashing
+// from u-boot. It returns the partitions written by the helper.
+func (board *Hi3516ev200) BootHelper(uboot *ubootshell.UBootShell, assets *openharmony.Assets, helperPath string) ([]flashhelper.Target, error) {
+	if err := checkSPIFlash(uboot, "hi3516ev200", board.SupportedUBootVersions(), board.layout(), assets, board.opts); err != nil {
+		return nil, err
+	}
+	plan := ubootshell.NewFlashPlan()
+	if err := board.configureUBoot(plan); err != nil {
+		return nil, err
+	}
+	addSPIFlashHelper(plan, hi3516ev200Staging, board.layout(), helperPath)
+	if err := plan.Execute(uboot); err != nil {
+		return nil, err
+	}
+	return spiFlashHelperTargets(board.layout(), assets), nil
+}
+
+// AddBlobs appends steps writing unit-specific data to regions of the SPI flash.
+func (board *Hi3516ev200) AddBlobs(plan *ubootshell.FlashPlan, uboot *ubootshell.UBootShell, blobs []Blob) error {
+	return addSPIFlashBlobs(plan, uboot, hi3516ev200Staging, blobs)
+}
+
+// LoadKernel loads the kernel into memory, to be started by StartKernel
+// without writing it to flash. With Options.FITConfig, the kernel must be a
+// FIT image.
+func (board *Hi3516ev200) LoadKernel(uboot *ubootshell.UBootShell, kernelPath string) error {
+	return loadKernel(uboot, hi3516ev200Staging, hi3516ev200KernelAddr, kernelPath, board.opts)
+}
+
+// StartKernel starts the kernel loaded by LoadKernel.
+func (board *Hi3516ev200) StartKernel(uboot *ubootshell.UBootShell) error {
+	return startKernel(uboot, hi3516ev200Staging, hi3516ev200KernelAddr, board.opts)
+}
+
+// DumpFlash reads a region of the SPI flash and writes it to the given writer.
+//
+// This is very slow but works with an unmodified u-boot.
+func (board *Hi3516ev200) DumpFlash(uboot *ubootshell.UBootShell, offset, size uint64, w io.Writer) error {
+	return dumpSPIFlash(uboot, hi3516ev200Staging.loadAddr, offset, size, w)
+}
+
+// configureUBoot appends steps making u-boot boot the kernel from flash.
+func (board *Hi3516ev200) configureUBoot(plan *ubootshell.FlashPlan) error {
+	bootcmd, bootargs, err := spiFlashBootEnv(board.layout(), hi3516ev200Staging, hi3516ev200KernelAddr, hi3516ev200Console, board.opts)
+	if err != nil {
+		return err
+	}
+	plan.SetEnv("bootcmd", bootcmd)
+	plan.SetEnv("bootargs", bootargs)
+	plan.SaveEnv()
+	return nil
+}
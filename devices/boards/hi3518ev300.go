@@ -17,20 +17,48 @@ limitations under the License.
 package boards
 
 import (
-	"fmt"
 	"io"
-	"strings"
 
 	"go.bug.st/serial.v1"
 	"go.bug.st/serial.v1/enumerator"
 
-	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/devices/serialport"
+	"github.com/zyga/oh-flash-tools/flashhelper"
 	"github.com/zyga/oh-flash-tools/openharmony"
 	"github.com/zyga/oh-flash-tools/ubootshell"
 )
 
 // Hi3518ev300 is a development board for IP Cameras
-type Hi3518ev300 struct{}
+type Hi3518ev300 struct {
+	opts Options
+}
+
+// Partitions of the SPI NOR flash of hi3518ev300.
+var (
+	hi3518ev300BootLoader = partition{name: "bootloader", flashAddr: 0x0, eraseSize: 0x100_000}
+	hi3518ev300Kernel     = partition{name: "kernel", flashAddr: 0x100_000, eraseSize: 0x600_000}
+	hi3518ev300Rootfs     = partition{name: "rootfs", flashAddr: 0x700_000, eraseSize: 0x800_000}
+	hi3518ev300Userfs     = partition{name: "userfs", flashAddr: 0xf00_000, eraseSize: 0x100_000}
+)
+
+// hi3518ev300Layout lists all the partitions, in the order of flashing.
+var hi3518ev300Layout = []partition{hi3518ev300BootLoader, hi3518ev300Kernel, hi3518ev300Rootfs, hi3518ev300Userfs}
+
+// hi3518ev300Staging is the memory where images are loaded before writing
+// them. The largest partition, decompressed, ends before the scratch area.
+var hi3518ev300Staging = staging{loadAddr: 0x41_000_000, scratchAddr: 0x42_000_000}
+
+// hi3518ev300KernelAddr is where the kernel is loaded in memory and started.
+const hi3518ev300KernelAddr = 0x40_000_000
+
+// hi3518ev300Console is the serial console of the kernel.
+const hi3518ev300Console = "ttyAMA0,115200n8"
+
+// layout returns the partitions of flash, with the device tree if its
+// location is given by the options.
+func (board *Hi3518ev300) layout() []partition {
+	return withDTB(hi3518ev300Layout, board.opts)
+}
 
 // FindSerialPort finds a serial port appropriate for interacting with the bootloader.
 //
@@ -39,139 +67,145 @@ type Hi3518ev300 struct{}
 func (board *Hi3518ev300) FindSerialPort(portInfos []*enumerator.PortDetails) (string, error) {
 	names := make([]string, 0, 1)
 	for _, portInfo := range portInfos {
-		// XXX: Windows / Linux differ in capitalization of those fields. It's unfortunate they are strings.
-		if portInfo.IsUSB && strings.ToLower(portInfo.VID) == "067b" && portInfo.PID == "2303" && portInfo.SerialNumber == "" {
+		if serialport.MatchUSB(portInfo, "067b", "2303") && portInfo.SerialNumber == "" {
 			names = append(names, portInfo.Name)
 		}
 	}
 	if len(names) != 1 {
-		return "", fmt.Errorf("cannot find hi3518ev300 serial port, found %d candidates", len(names))
+		return "", portNotFound("hi3518ev300", len(names))
 	}
 	return names[0], nil
 }
 
 // OpenSerialPort opens the given serial port.
+//
+// The returned port implements ubootshell.BaudRateSetter.
 func (board *Hi3518ev300) OpenSerialPort(portName string) (io.ReadWriteCloser, error) {
-	port, err := serial.Open(portName, &serial.Mode{
+	return openSerialPort(portName, &serial.Mode{
 		BaudRate: 115200,
 		DataBits: 8,
 		Parity:   serial.NoParity,
 		StopBits: serial.OneStopBit,
 	})
-	if err != nil {
-		return nil, err
-	}
-	return ioextra.NewRestartingReadWriteCloser(port), nil
+}
+
+// AutobootBanners returns the messages printed by u-boot before auto-boot.
+func (board *Hi3518ev300) AutobootBanners() []string {
+	return []string{ubootshell.DefaultAutobootBanner}
+}
+
+// InterruptKeys returns the keys that stop u-boot auto-boot.
+func (board *Hi3518ev300) InterruptKeys() string {
+	return ubootshell.DefaultInterruptKeys
+}
+
+// RepeatInterruptKeys returns false as any key stops auto-boot.
+func (board *Hi3518ev300) RepeatInterruptKeys() bool {
+	return false
+}
+
+// FileSender returns the sender of files to u-boot.
+//
+// The u-boot of the development kit lacks loadz, YMODEM is the fastest
+// protocol it supports.
+func (board *Hi3518ev300) FileSender() ubootshell.FileSender {
+	return ubootshell.NewYModemSender()
+}
+
+// AssetNames returns the names of the assets used by the board.
+func (board *Hi3518ev300) AssetNames() []string {
+	return layoutNames(board.layout())
+}
+
+// SupportedUBootVersions returns the versions of u-boot known to work with the board.
+//
+// The development kit ships with u-boot 2016.11, patched by HiSilicon.
+func (board *Hi3518ev300) SupportedUBootVersions() []ubootshell.VersionRange {
+	v := ubootshell.Version{Year: 2016, Month: 11}
+	return []ubootshell.VersionRange{{Min: v, Max: v}}
+}
+
+// SetOptions tunes the way the board is flashed.
+func (board *Hi3518ev300) SetOptions(opts Options) {
+	board.opts = opts
 }
 
 // FlashAssets flashes an hi3518ev300 board with given assets.
 func (board *Hi3518ev300) FlashAssets(uboot *ubootshell.UBootShell, assets *openharmony.Assets) error {
-	ver, err := uboot.Command("getinfo version")
-	if err != nil {
-		return err
-	}
-	// TODO: validate expected u-boot version.
-	fmt.Printf("u-boot version: %q\n", strings.TrimSpace(ver))
-	if _, err := uboot.Command("sf probe 0"); err != nil {
-		return err
-	}
-	if err := board.flashBootLoader(uboot, assets.BootLoaderPath); err != nil {
-		return err
-	}
-	if err := board.flashKernel(uboot, assets.KernelPath); err != nil {
-		return err
-	}
-	if err := board.flashRootfs(uboot, assets.RootfsPath); err != nil {
+	if err := checkSPIFlash(uboot, "hi3518ev300", board.SupportedUBootVersions(), board.layout(), assets, board.opts); err != nil {
 		return err
 	}
-	if err := board.flashUserfs(uboot, assets.UserfsPath); err != nil {
+	plan, err := board.FlashPlan(uboot, assets)
+	if err != nil {
 		return err
 	}
+	return executePlan(uboot, plan, board.layout())
+}
+
+// FlashPlan returns the plan of flashing an hi3518ev300 board with given assets.
+//
+// It fails if the templates of bootcmd or bootargs in the options cannot be
+// expanded.
+func (board *Hi3518ev300) FlashPlan(uboot *ubootshell.UBootShell, assets *openharmony.Assets) (*ubootshell.FlashPlan, error) {
+	plan := ubootshell.NewFlashPlan()
+	addSPIFlashAssets(plan, uboot, hi3518ev300Staging, board.layout(), assets, board.opts)
 	// XXX: should we reboot first that the new uboot has a chance to saveenv?
-	if err := board.configureUBoot(uboot); err != nil {
-		return err
-	}
-	if err := uboot.Reset(); err != nil {
-		return err
+	if err := board.configureUBoot(plan); err != nil {
+		return nil, err
 	}
-	return nil
+	return plan.Reset(), nil
 }
 
-func (board *Hi3518ev300) configureUBoot(uboot *ubootshell.UBootShell) error {
-	const loadAddr = 0x40_000_000 // load everything at this address in memory
-	const flashAddr = 0x100_000   // from this address in flash
-	const loadSize = 0x600_000    // load exactly this many bytes
-	bootcmd := fmt.Sprintf("sf probe 0; sf read %#x %#x %#x; go %#x", loadAddr, flashAddr, loadSize, loadAddr)
-	if err := uboot.SetEnv("bootcmd", bootcmd); err != nil {
-		return err
+// BootHelper checks the flash layout and the assets, configures u-boot to
+// boot the flashed system and boots the flashing helper instead of flashing
+// from u-boot. It returns the partitions written by the helper.
+func (board *Hi3518ev300) BootHelper(uboot *ubootshell.UBootShell, assets *openharmony.Assets, helperPath string) ([]flashhelper.Target, error) {
+	if err := checkSPIFlash(uboot, "hi3518ev300", board.SupportedUBootVersions(), board.layout(), assets, board.opts); err != nil {
+		return nil, err
 	}
-	// XXX: those should be related to the constants above
-	bootargs := fmt.Sprintf("console=ttyAMA0,115200n8 root=flash fstype=jffs2 rw rootaddr=7M rootsize=8M")
-	if err := uboot.SetEnv("bootargs", bootargs); err != nil {
-		return err
+	plan := ubootshell.NewFlashPlan()
+	if err := board.configureUBoot(plan); err != nil {
+		return nil, err
 	}
-	if err := uboot.SaveEnv(); err != nil {
-		return err
+	addSPIFlashHelper(plan, hi3518ev300Staging, board.layout(), helperPath)
+	if err := plan.Execute(uboot); err != nil {
+		return nil, err
 	}
-	return nil
+	return spiFlashHelperTargets(board.layout(), assets), nil
 }
 
-func (board *Hi3518ev300) flashBootLoader(uboot *ubootshell.UBootShell, bootLoaderPath string) error {
-	const flashAddr = 0x0       // at this address
-	const eraseSize = 0x100_000 // erase the entire "partition"
-	const writeSize = 0x40_000  // and write this amount
-	return board.flashAsset(uboot, bootLoaderPath, flashAddr, eraseSize, writeSize)
+// AddBlobs appends steps writing unit-specific data to regions of the SPI flash.
+func (board *Hi3518ev300) AddBlobs(plan *ubootshell.FlashPlan, uboot *ubootshell.UBootShell, blobs []Blob) error {
+	return addSPIFlashBlobs(plan, uboot, hi3518ev300Staging, blobs)
 }
 
-func (board *Hi3518ev300) flashKernel(uboot *ubootshell.UBootShell, kernelPath string) error {
-	const flashAddr = 0x100_000 // at this address
-	const eraseSize = 0x600_000 // erase the entire "partition"
-	const writeSize = 0x3f0_000 // and write this amount
-	return board.flashAsset(uboot, kernelPath, flashAddr, eraseSize, writeSize)
+// LoadKernel loads the kernel into memory, to be started by StartKernel
+// without writing it to flash. With Options.FITConfig, the kernel must be a
+// FIT image.
+func (board *Hi3518ev300) LoadKernel(uboot *ubootshell.UBootShell, kernelPath string) error {
+	return loadKernel(uboot, hi3518ev300Staging, hi3518ev300KernelAddr, kernelPath, board.opts)
 }
 
-func (board *Hi3518ev300) flashRootfs(uboot *ubootshell.UBootShell, rootfsPath string) error {
-	const flashAddr = 0x700_000 // at this address
-	const eraseSize = 0x800_000 // erase the entire "partition"
-	const writeSize = 0x670_000 // and write this amount
-	return board.flashAsset(uboot, rootfsPath, flashAddr, eraseSize, writeSize)
+// StartKernel starts the kernel loaded by LoadKernel.
+func (board *Hi3518ev300) StartKernel(uboot *ubootshell.UBootShell) error {
+	return startKernel(uboot, hi3518ev300Staging, hi3518ev300KernelAddr, board.opts)
 }
 
-func (board *Hi3518ev300) flashUserfs(uboot *ubootshell.UBootShell, userfsPath string) error {
-	const flashAddr = 0xf00_000 // at this address
-	const eraseSize = 0x100_000 // erase the entire "partition"
-	const writeSize = 0x10_000  // and write this amount
-	return board.flashAsset(uboot, userfsPath, flashAddr, eraseSize, writeSize)
+// DumpFlash reads a region of the SPI flash and writes it to the given writer.
+//
+// This is very slow but works with an unmodified u-boot.
+func (board *Hi3518ev300) DumpFlash(uboot *ubootshell.UBootShell, offset, size uint64, w io.Writer) error {
+	return dumpSPIFlash(uboot, hi3518ev300Staging.loadAddr, offset, size, w)
 }
 
-func (board *Hi3518ev300) flashAsset(uboot *ubootshell.UBootShell, assetPath string, flashAddr, eraseSize, writeSize uint64) error {
-	const loadAddr = 0x41_000_000
-	// Assets are entirely optional.
-	if assetPath == "" {
-		return nil
-	}
-
-	// Write 0xFF to memory region where we will copy the data
-	if _, err := uboot.Command(fmt.Sprintf("mw.b %#x 0xff %#x", loadAddr, writeSize)); err != nil {
-		return err
-	}
-	// Copy the file from local disk to device memory with ymodem
-	if err := uboot.SpecialCommand(
-		fmt.Sprintf("loady %#x", loadAddr),
-		fmt.Sprintf("## Ready for binary (ymodem) download to %#x at 115200 bps...\r\n", loadAddr),
-	); err != nil {
-		return err
-	}
-	if err := uboot.SendFile(assetPath); err != nil {
-		return err
-	}
-	// Erase flash memory
-	if _, err := uboot.Command(fmt.Sprintf("sf erase %#x %#x", flashAddr, eraseSize)); err != nil {
-		return err
-	}
-	// Program flash memory
-	if _, err := uboot.Command(fmt.Sprintf("sf write %#x %#x %#x", loadAddr, flashAddr, writeSize)); err != nil {
+// configureUBoot appends steps making u-boot boot the kernel from flash.
+func (board *Hi3518ev300) configureUBoot(plan *ubootshell.FlashPlan) error {
+	bootcmd, bootargs, err := spiFlashBootEnv(board.layout(), hi3518ev300Staging, hi3518ev300KernelAddr, hi3518ev300Console, board.opts)
+	if err != nil {
 		return err
 	}
+	plan.SetEnv("bootcmd", bootcmd)
+	plan.SetEnv("bootargs", bootargs)
+	plan.SaveEnv()
 	return nil
 }
@@ -0,0 +1,287 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package boards
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+	"github.com/zyga/oh-flash-tools/ubootshell/fit"
+)
+
+// partition describes a region of flash memory holding one asset.
+//
+// Only the asset is written, the rest of the partition is left erased.
+type partition struct {
+	name      string
+	flashAddr uint64 // offset of the partition in flash
+	eraseSize uint64 // size of the entire partition
+}
+
+// checkLayout returns an error if any of the partitions exceeds the flash
+// size or overlaps another partition.
+func checkLayout(layout []partition, flashSize uint64) error {
+	for i, part := range layout {
+		if part.flashAddr > flashSize || part.eraseSize > flashSize-part.flashAddr {
+			return fmt.Errorf("cannot flash %s partition at %#x-%#x, flash size is only %#x",
+				part.name, part.flashAddr, part.flashAddr+part.eraseSize, flashSize)
+		}
+		for _, other := range layout[:i] {
+			if part.flashAddr < other.flashAddr+other.eraseSize && other.flashAddr < part.flashAddr+part.eraseSize {
+				return fmt.Errorf("cannot flash %s partition at %#x-%#x, it overlaps %s partition",
+					part.name, part.flashAddr, part.flashAddr+part.eraseSize, other.name)
+			}
+		}
+	}
+	return nil
+}
+
+// findPartition returns the named partition of the layout.
+func findPartition(layout []partition, name string) (partition, bool) {
+	for _, part := range layout {
+		if part.name == name {
+			return part, true
+		}
+	}
+	return partition{}, false
+}
+
+// withDTB returns the layout with a partition for the device tree at the
+// location given by the options, if any.
+func withDTB(layout []partition, opts Options) []partition {
+	if opts.DTBSize == 0 {
+		return layout
+	}
+	dtb := partition{name: openharmony.DTB, flashAddr: opts.DTBOffset, eraseSize: opts.DTBSize}
+	return append(append([]partition(nil), layout...), dtb)
+}
+
+// layoutNames returns the names of the partitions.
+func layoutNames(layout []partition) []string {
+	names := make([]string, 0, len(layout))
+	for _, part := range layout {
+		names = append(names, part.name)
+	}
+	return names
+}
+
+// modifiedPartitions returns names of the partitions overlapping any of the regions.
+func modifiedPartitions(layout []partition, regions []ubootshell.Region) []string {
+	var names []string
+	for _, part := range layout {
+		for _, region := range regions {
+			if region.Offset < part.flashAddr+part.eraseSize && part.flashAddr < region.Offset+region.Size {
+				names = append(names, part.name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// executePlan executes the plan and reports partitions modified before a failure.
+func executePlan(uboot *ubootshell.UBootShell, plan *ubootshell.FlashPlan, layout []partition) error {
+	if err := plan.Execute(uboot); err != nil {
+		if names := modifiedPartitions(layout, plan.Modified()); len(names) > 0 {
+			return fmt.Errorf("%w, partitions already modified: %s", err, strings.Join(names, ", "))
+		}
+		return err
+	}
+	return nil
+}
+
+// checkAssets returns an error if any of the assets does not fit its partition,
+// or if there is no partition for it at all.
+//
+// Sizes of compressed assets are checked after decompression.
+func checkAssets(layout []partition, assets *openharmony.Assets) error {
+	for _, name := range assets.Names() {
+		if assets.Get(name) == "" {
+			continue
+		}
+		found := false
+		for _, part := range layout {
+			found = found || part.name == name
+		}
+		if !found {
+			return fmt.Errorf("cannot flash %s image, the board has no %s partition", name, name)
+		}
+	}
+	for _, part := range layout {
+		path := assets.Get(part.name)
+		if path == "" {
+			continue
+		}
+		size, err := ioextra.DecompressedSize(path)
+		if err != nil {
+			return err
+		}
+		if uint64(size) > part.eraseSize {
+			return fmt.Errorf("cannot flash %s partition, %s has %#x bytes and does not fit in %#x bytes",
+				part.name, path, size, part.eraseSize)
+		}
+	}
+	return nil
+}
+
+// alignUp rounds the size up to a multiple of the alignment.
+func alignUp(size, alignment uint64) uint64 {
+	if rem := size % alignment; rem != 0 {
+		return size + alignment - rem
+	}
+	return size
+}
+
+// Options tune the way boards are flashed.
+type Options struct {
+	// SparseErase selects erasing and writing only the blocks of flash
+	// whose content changes, instead of entire partitions.
+	SparseErase bool
+	// UBootDecompress selects sending images compressed with gzip or lzma
+	// as they are, for u-boot to decompress them in memory.
+	UBootDecompress bool
+	// FITConfig selects booting the kernel as a FIT image with bootm,
+	// with the named configuration of kernel, device tree and ramdisk.
+	FITConfig string
+	// BootCmd and BootArgs are templates of the bootcmd and bootargs
+	// variables set after flashing, replacing the defaults of the board.
+	// Placeholders, such as {rootaddr}, {rootsize} or {console}, are
+	// replaced with values computed from the layout of the board.
+	BootCmd, BootArgs string
+	// DTBOffset and DTBSize locate the device tree in flash, on boards
+	// without a partition for it.
+	DTBOffset, DTBSize uint64
+}
+
+// checkFITConfig returns an error if a configuration of FIT image is selected
+// but the kernel image at the given path, if any, does not have it.
+func checkFITConfig(uboot *ubootshell.UBootShell, kernelPath string, opts Options) error {
+	if opts.FITConfig == "" {
+		return nil
+	}
+	if err := uboot.RequireCommands("bootm"); err != nil {
+		return fmt.Errorf("cannot boot FIT image: %w", err)
+	}
+	if kernelPath == "" {
+		return nil
+	}
+	return fit.CheckConfiguration(kernelPath, opts.FITConfig)
+}
+
+// staging describes memory where assets are prepared before writing.
+type staging struct {
+	loadAddr    uint64 // assets are loaded here
+	scratchAddr uint64 // compressed assets are loaded here and decompressed to loadAddr
+}
+
+// loadAsset adds a step loading the asset to memory.
+func loadAsset(plan *ubootshell.FlashPlan, mem staging, assetPath string, opts Options) {
+	if opts.UBootDecompress {
+		plan.LoadFileDecompressed(mem.loadAddr, mem.scratchAddr, assetPath)
+	} else {
+		plan.LoadFile(mem.loadAddr, assetPath)
+	}
+}
+
+// addAsset adds steps loading a file to memory and writing it to the given partition.
+//
+// Only the file is written, rounded up to the write alignment of the storage.
+// The memory after the end of the file is filled with 0xFF, so that the
+// partition is padded as if it was erased. When the size of the file is not
+// known, the entire partition is filled and written.
+// Nothing is added if the path is empty.
+//
+// With sparse erase, the storage is updated instead, if it supports that. The
+// entire partition is then padded in memory and compared with its content,
+// only the erase blocks holding different data are erased and written.
+func addAsset(plan *ubootshell.FlashPlan, storage ubootshell.Storage, mem staging, assetPath string, part partition, opts Options) {
+	// Assets are entirely optional.
+	if assetPath == "" {
+		return
+	}
+	loadAddr := mem.loadAddr
+	fileSize, err := ioextra.DecompressedSize(assetPath)
+	if err != nil {
+		plan.Fill(loadAddr, part.eraseSize, 0xff)
+		loadAsset(plan, mem, assetPath, opts)
+		plan.Erase(storage, part.flashAddr, part.eraseSize)
+		plan.Write(storage, loadAddr, part.flashAddr, part.eraseSize)
+		return
+	}
+	size := uint64(fileSize)
+	if updatable, ok := storage.(ubootshell.UpdatableStorage); ok && opts.SparseErase {
+		loadAsset(plan, mem, assetPath, opts)
+		plan.Fill(loadAddr+size, part.eraseSize-size, 0xff)
+		plan.Update(updatable, loadAddr, part.flashAddr, part.eraseSize)
+		return
+	}
+	writeSize := alignUp(size, ubootshell.WriteAlignment(storage))
+	if writeSize > part.eraseSize {
+		writeSize = part.eraseSize
+	}
+	loadAsset(plan, mem, assetPath, opts)
+	// Padding is filled after loading, some protocols pad the file themselves.
+	if writeSize > size {
+		plan.Fill(loadAddr+size, writeSize-size, 0xff)
+	}
+	plan.Erase(storage, part.flashAddr, part.eraseSize)
+	plan.Write(storage, loadAddr, part.flashAddr, writeSize)
+}
+
+// addChunkedAsset adds steps loading a file to memory and writing it to the
+// given partition of block storage, such as eMMC, which is not erased.
+//
+// Files larger than the chunk size are loaded and written in parts, so that
+// images of file systems larger than the memory of the board can be flashed.
+// Files compressed with gzip or lzma, which fit in a single chunk once
+// decompressed, are decompressed by u-boot if selected in the options. The
+// last chunk is padded to the write alignment of the storage.
+func addChunkedAsset(plan *ubootshell.FlashPlan, storage ubootshell.Storage, mem staging, chunkSize uint64, assetPath string, part partition, opts Options) error {
+	// Assets are entirely optional.
+	if assetPath == "" {
+		return nil
+	}
+	fileSize, err := ioextra.DecompressedSize(assetPath)
+	if err != nil {
+		return err
+	}
+	size := uint64(fileSize)
+	alignment := ubootshell.WriteAlignment(storage)
+	if size <= chunkSize && opts.UBootDecompress {
+		loadAsset(plan, mem, assetPath, opts)
+		if padded := alignUp(size, alignment); padded > size {
+			plan.Fill(mem.loadAddr+size, padded-size, 0xff)
+		}
+		plan.Write(storage, mem.loadAddr, part.flashAddr, size)
+		return nil
+	}
+	for offset := uint64(0); offset < size; offset += chunkSize {
+		n := size - offset
+		if n > chunkSize {
+			n = chunkSize
+		}
+		plan.LoadFileRange(mem.loadAddr, assetPath, offset, n)
+		if padded := alignUp(n, alignment); padded > n {
+			plan.Fill(mem.loadAddr+n, padded-n, 0xff)
+		}
+		plan.Write(storage, mem.loadAddr, part.flashAddr+offset, n)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package boards
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// Blob is data specific to one unit, such as calibration data, written to a
+// region of storage reserved for it.
+type Blob struct {
+	Name         string
+	Path         string
+	Offset, Size uint64 // region of storage, a multiple of its erase size
+}
+
+// blobPartition returns the region of the blob, once it is known to fit.
+func blobPartition(blob Blob) (partition, error) {
+	fi, err := os.Stat(blob.Path)
+	if err != nil {
+		return partition{}, err
+	}
+	if uint64(fi.Size()) > blob.Size {
+		return partition{}, fmt.Errorf("%s of %s is %d bytes, larger than its region of %d bytes", blob.Path, blob.Name, fi.Size(), blob.Size)
+	}
+	return partition{name: blob.Name, flashAddr: blob.Offset, eraseSize: blob.Size}, nil
+}
+
+// addSPIFlashBlobs appends steps writing the blobs to the SPI flash, each
+// padded to the size of its region as if erased.
+func addSPIFlashBlobs(plan *ubootshell.FlashPlan, uboot *ubootshell.UBootShell, mem staging, blobs []Blob) error {
+	storage := ubootshell.NewSPIFlash(uboot)
+	for _, blob := range blobs {
+		part, err := blobPartition(blob)
+		if err != nil {
+			return err
+		}
+		addAsset(plan, storage, mem, blob.Path, part, Options{})
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package boards
+
+import (
+	"fmt"
+	"io"
+
+	"go.bug.st/serial.v1"
+	"go.bug.st/serial.v1/enumerator"
+
+	"github.com/zyga/oh-flash-tools/devices/fastboot"
+	"github.com/zyga/oh-flash-tools/devices/serialport"
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/flashhelper"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// Rk3568 is the HiHope DAYU200 development board, the reference board of
+// standard OpenHarmony systems, built around the Rockchip RK3568 SoC.
+//
+// Images are written to eMMC from the u-boot shell on the debug serial port,
+// or over fastboot on the USB OTG port, which is much faster. The partitions
+// are looked up by name in the GPT partition table, which is created by the
+// Rockchip tools when the board is first programmed over USB.
+type Rk3568 struct {
+	opts Options
+}
+
+// rk3568Partitions lists the names of the partitions that can be flashed, in
+// the order of flashing.
+var rk3568Partitions = []string{
+	openharmony.UBoot,
+	openharmony.DTB,
+	openharmony.BootLinux,
+	openharmony.System,
+	openharmony.Vendor,
+	openharmony.Userdata,
+}
+
+// rk3568Staging is the memory where images are loaded before writing them.
+//
+// Images are loaded in chunks of 256MB, well within the 2GB of memory of the
+// board, away from u-boot itself at the end of the memory.
+var rk3568Staging = staging{loadAddr: 0x10_000_000, scratchAddr: 0x20_000_000}
+
+// rk3568ChunkSize is the largest part of an image loaded at once.
+const rk3568ChunkSize = 0x10_000_000
+
+// FindSerialPort finds a serial port appropriate for interacting with the bootloader.
+//
+// The debug port of the board is a WCH CH340 USB to Serial converter using
+// USB vendor 0x1a86 and USB product 0x7523 without a serial number.
+func (board *Rk3568) FindSerialPort(portInfos []*enumerator.PortDetails) (string, error) {
+	names := make([]string, 0, 1)
+	for _, portInfo := range portInfos {
+		if serialport.MatchUSB(portInfo, "1a86", "7523") && portInfo.SerialNumber == "" {
+			names = append(names, portInfo.Name)
+		}
+	}
+	if len(names) != 1 {
+		return "", portNotFound("rk3568", len(names))
+	}
+	return names[0], nil
+}
+
+// OpenSerialPort opens the given serial port.
+//
+// Rockchip boards use the unusual rate of 1500000 baud for the debug port.
+// The returned port implements ubootshell.BaudRateSetter.
+func (board *Rk3568) OpenSerialPort(portName string) (io.ReadWriteCloser, error) {
+	return openSerialPort(portName, &serial.Mode{
+		BaudRate: 1500000,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	})
+}
+
+// AutobootBanners returns the messages printed by u-boot before auto-boot.
+func (board *Rk3568) AutobootBanners() []string {
+	return []string{"Hit key to stop autoboot('CTRL+C')"}
+}
+
+// InterruptKeys returns the keys that stop u-boot auto-boot.
+func (board *Rk3568) InterruptKeys() string {
+	return "\x03"
+}
+
+// RepeatInterruptKeys returns false as a single Ctrl-C stops auto-boot.
+//
+// Every Ctrl-C typed into the shell prints <INTERRUPT> and another prompt,
+// which would get in the way of prompt detection.
+func (board *Rk3568) RepeatInterruptKeys() bool {
+	return false
+}
+
+// AssetNames returns the names of the assets used by the board.
+func (board *Rk3568) AssetNames() []string {
+	return rk3568Partitions
+}
+
+// SupportedUBootVersions returns the versions of u-boot known to work with the board.
+//
+// The board ships with u-boot 2017.09, patched by Rockchip.
+func (board *Rk3568) SupportedUBootVersions() []ubootshell.VersionRange {
+	v := ubootshell.Version{Year: 2017, Month: 9}
+	return []ubootshell.VersionRange{{Min: v, Max: v}}
+}
+
+// SetOptions tunes the way the board is flashed.
+//
+// Sparse erase does not apply to eMMC, which is written without erasing. The
+// device tree is written to the dtb partition, found by name like the others,
+// so DTBOffset and DTBSize do not apply either.
+func (board *Rk3568) SetOptions(opts Options) {
+	board.opts = opts
+}
+
+// FlashAssets flashes an rk3568 board with given assets.
+func (board *Rk3568) FlashAssets(uboot *ubootshell.UBootShell, assets *openharmony.Assets) error {
+	layout, err := board.check(uboot, assets)
+	if err != nil {
+		return err
+	}
+	plan, err := board.flashPlan(uboot, assets, layout)
+	if err != nil {
+		return err
+	}
+	return executePlan(uboot, plan, layout)
+}
+
+// BootHelper checks the partition table and the assets and boots the
+// flashing helper instead of flashing from u-boot. It returns the
+// partitions written by the helper, found by name.
+//
+// The helper must be in a format known to the bootm command, such as a FIT
+// image with the kernel, the device tree and the initramfs.
+func (board *Rk3568) BootHelper(uboot *ubootshell.UBootShell, assets *openharmony.Assets, helperPath string) ([]flashhelper.Target, error) {
+	layout, err := board.check(uboot, assets)
+	if err != nil {
+		return nil, err
+	}
+	plan := ubootshell.NewFlashPlan()
+	if err := board.configureUBoot(plan, uboot); err != nil {
+		return nil, err
+	}
+	plan.LoadFile(rk3568Staging.loadAddr, helperPath).BootImage(rk3568Staging.loadAddr)
+	if err := plan.Execute(uboot); err != nil {
+		return nil, err
+	}
+	targets := make([]flashhelper.Target, len(layout))
+	for i, part := range layout {
+		targets[i] = flashhelper.Target{Name: part.name, Path: assets.Get(part.name), Partition: part.name}
+	}
+	return targets, nil
+}
+
+// check checks u-boot and the assets and returns the partitions of eMMC
+// needed to flash them.
+func (board *Rk3568) check(uboot *ubootshell.UBootShell, assets *openharmony.Assets) ([]partition, error) {
+	var layout []partition
+	stage := flash.Stage{Kind: flash.CheckStage, Name: "check u-boot and partition table"}
+	err := flash.Run(uboot.Events(), stage, func() error {
+		if _, err := uboot.CheckVersion(board.SupportedUBootVersions()...); err != nil {
+			return err
+		}
+		if err := uboot.RequireCommands("mmc", "part"); err != nil {
+			return fmt.Errorf("cannot flash rk3568: %w", err)
+		}
+		var err error
+		if layout, err = rk3568Layout(uboot, assets); err != nil {
+			return err
+		}
+		if err := checkAssets(layout, assets); err != nil {
+			return err
+		}
+		return checkFITConfig(uboot, assets.BootLinuxPath, board.opts)
+	})
+	return layout, err
+}
+
+// rk3568Layout finds the partitions of eMMC needed to flash the assets.
+func rk3568Layout(uboot *ubootshell.UBootShell, assets *openharmony.Assets) ([]partition, error) {
+	var layout []partition
+	for _, name := range rk3568Partitions {
+		if assets.Get(name) == "" {
+			continue
+		}
+		part, err := uboot.FindPartition("mmc", 0, name)
+		if err != nil {
+			return nil, err
+		}
+		layout = append(layout, partition{name: name, flashAddr: part.Offset, eraseSize: part.Size})
+	}
+	return layout, nil
+}
+
+// flashPlan returns the plan of flashing an rk3568 board with given assets,
+// to the given partitions.
+func (board *Rk3568) flashPlan(uboot *ubootshell.UBootShell, assets *openharmony.Assets, layout []partition) (*ubootshell.FlashPlan, error) {
+	storage := ubootshell.NewMMC(uboot, 0)
+	plan := ubootshell.NewFlashPlan()
+	for _, part := range layout {
+		if err := addChunkedAsset(plan, storage, rk3568Staging, rk3568ChunkSize, assets.Get(part.name), part, board.opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := board.configureUBoot(plan, uboot); err != nil {
+		return nil, err
+	}
+	return plan.Reset(), nil
+}
+
+// rk3568FITBootCmd is the default template of bootcmd with a configuration
+// of FIT image selected, reading the boot partition from eMMC.
+const rk3568FITBootCmd = "mmc dev 0; mmc read {loadaddr} {kerneladdr} {kernelsize}; {boot}"
+
+// rk3568Console is the serial console of the kernel.
+const rk3568Console = "ttyFIQ0,1500000n8"
+
+// configureUBoot appends steps setting bootcmd and bootargs from the
+// templates of the options. With a configuration of FIT image selected,
+// bootcmd defaults to booting the image in the boot partition with it.
+// Otherwise the boot command of the board is left alone.
+//
+// Locations of the kernel, the boot partition, and of the device tree are in
+// blocks, as used by mmc read. The partitions are only looked up if used.
+func (board *Rk3568) configureUBoot(plan *ubootshell.FlashPlan, uboot *ubootshell.UBootShell) error {
+	bootcmd, bootargs := board.opts.BootCmd, board.opts.BootArgs
+	if bootcmd == "" && board.opts.FITConfig != "" {
+		bootcmd = rk3568FITBootCmd
+	}
+	if bootcmd == "" && bootargs == "" {
+		return nil
+	}
+	loadAddr := rk3568Staging.loadAddr
+	values := map[string]string{
+		placeholderConsole:  rk3568Console,
+		placeholderLoadAddr: fmt.Sprintf("%#x", loadAddr),
+		placeholderFDTAddr:  fmt.Sprintf("%#x", rk3568Staging.scratchAddr),
+		placeholderBoot:     ubootshell.BootmCommand(loadAddr, board.opts.FITConfig),
+	}
+	const blockSize = 512 // mmc read counts blocks
+	templates := []string{bootcmd, bootargs}
+	for _, v := range []struct{ part, addr, size string }{
+		{openharmony.BootLinux, placeholderKernelAddr, placeholderKernelSize},
+		{openharmony.DTB, placeholderDTBAddr, placeholderDTBSize},
+	} {
+		if !usesPlaceholder(templates, v.addr, v.size) {
+			continue
+		}
+		part, err := uboot.FindPartition("mmc", 0, v.part)
+		if err != nil {
+			return err
+		}
+		values[v.addr] = fmt.Sprintf("%#x", part.Offset/blockSize)
+		values[v.size] = fmt.Sprintf("%#x", part.Size/blockSize)
+	}
+	for _, env := range []struct{ name, template string }{{"bootcmd", bootcmd}, {"bootargs", bootargs}} {
+		if env.template == "" {
+			continue
+		}
+		value, err := expandBootTemplate(env.name, env.template, values)
+		if err != nil {
+			return err
+		}
+		plan.SetEnv(env.name, value)
+	}
+	plan.SaveEnv()
+	return nil
+}
+
+// AddBlobs appends steps writing unit-specific data to regions of the eMMC.
+func (board *Rk3568) AddBlobs(plan *ubootshell.FlashPlan, uboot *ubootshell.UBootShell, blobs []Blob) error {
+	storage := ubootshell.NewMMC(uboot, 0)
+	for _, blob := range blobs {
+		part, err := blobPartition(blob)
+		if err != nil {
+			return err
+		}
+		if err := addChunkedAsset(plan, storage, rk3568Staging, rk3568ChunkSize, blob.Path, part, Options{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadKernel loads the kernel into memory, to be started by StartKernel
+// without writing it to eMMC. With Options.FITConfig, the kernel must be a
+// FIT image with that configuration.
+//
+// The kernel must be in a format known to the bootm command, such as a FIT
+// image bundling the kernel and the device tree.
+func (board *Rk3568) LoadKernel(uboot *ubootshell.UBootShell, kernelPath string) error {
+	if err := checkFITConfig(uboot, kernelPath, board.opts); err != nil {
+		return err
+	}
+	return ubootshell.NewFlashPlan().LoadFile(rk3568Staging.loadAddr, kernelPath).Execute(uboot)
+}
+
+// StartKernel boots the kernel loaded by LoadKernel.
+func (board *Rk3568) StartKernel(uboot *ubootshell.UBootShell) error {
+	return ubootshell.NewFlashPlan().BootConfiguration(rk3568Staging.loadAddr, board.opts.FITConfig).Execute(uboot)
+}
+
+// FastbootCommand returns the u-boot command starting fastboot on the USB OTG port.
+func (board *Rk3568) FastbootCommand() string {
+	return "fastboot usb 0"
+}
+
+// FlashFastboot flashes an rk3568 board with given assets over fastboot and
+// resets it.
+//
+// The bootloader looks up the partitions by name, images larger than its
+// download buffer are sent in parts.
+func (board *Rk3568) FlashFastboot(dev *fastboot.Device, assets *openharmony.Assets, events flash.Events, observer ubootshell.TransferObserver) error {
+	if err := flashFastbootAssets(dev, rk3568Partitions, assets, events, observer); err != nil {
+		return err
+	}
+	return flash.Run(events, flash.Stage{Kind: flash.ResetStage, Name: "reset the board"}, dev.Reboot)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package boards
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"go.bug.st/serial.v1"
+
+	"github.com/zyga/oh-flash-tools/devices/serialport"
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/ioextra"
+)
+
+// ErrPortNotFound is matched by errors of FindSerialPort finding no serial
+// port of the board, or more than one.
+var ErrPortNotFound = errors.New("serial port of the board not found")
+
+// portNotFound returns the error of FindSerialPort finding the given number
+// of candidates, other than one.
+func portNotFound(board string, candidates int) error {
+	return flash.WithKind(fmt.Errorf("cannot find %s serial port, found %d candidates", board, candidates), ErrPortNotFound)
+}
+
+// serialPort is a serial port with adjustable baud rate.
+type serialPort struct {
+	io.ReadWriteCloser
+	port serial.Port
+	mode serial.Mode
+}
+
+// openSerialPort opens the given serial port with EINTR handling.
+func openSerialPort(portName string, mode *serial.Mode) (*serialPort, error) {
+	port, err := serialport.Open(portName, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &serialPort{
+		ReadWriteCloser: ioextra.NewRestartingReadWriteCloser(port),
+		port:            port,
+		mode:            *mode,
+	}, nil
+}
+
+// BaudRate returns the current baud rate of the port.
+func (p *serialPort) BaudRate() int {
+	return p.mode.BaudRate
+}
+
+// SetBaudRate changes the baud rate of the port, keeping other settings.
+func (p *serialPort) SetBaudRate(baudRate int) error {
+	mode := p.mode
+	mode.BaudRate = baudRate
+	if err := p.port.SetMode(&mode); err != nil {
+		return err
+	}
+	p.mode = mode
+	return nil
+}
+
+// SetDTR sets the DTR line of the port.
+func (p *serialPort) SetDTR(dtr bool) error {
+	return p.port.SetDTR(dtr)
+}
+
+// SetRTS sets the RTS line of the port.
+func (p *serialPort) SetRTS(rts bool) error {
+	return p.port.SetRTS(rts)
+}
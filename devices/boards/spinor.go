@@ -0,0 +1,183 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package boards
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/openharmony"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// The flow shared by HiSilicon camera boards, booting from SPI NOR flash with
+// a fixed partition layout. Images are sent to memory over the serial line
+// and written to flash with the sf command.
+
+// checkSPIFlash checks u-boot, the flash chip and the assets before flashing
+// the given board.
+func checkSPIFlash(uboot *ubootshell.UBootShell, boardName string, versions []ubootshell.VersionRange, layout []partition, assets *openharmony.Assets, opts Options) error {
+	stage := flash.Stage{Kind: flash.CheckStage, Name: "check u-boot and flash layout"}
+	return flash.Run(uboot.Events(), stage, func() error {
+		if _, err := uboot.CheckVersion(versions...); err != nil {
+			return err
+		}
+		if err := uboot.RequireCommands("sf", "mw"); err != nil {
+			return fmt.Errorf("cannot flash %s: %w", boardName, err)
+		}
+		// Check the layout before erasing anything.
+		chip, err := uboot.ProbeFlash()
+		if err != nil {
+			return err
+		}
+		if err := checkLayout(layout, chip.Size); err != nil {
+			return fmt.Errorf("cannot flash %s: %w", chip.Model, err)
+		}
+		if err := checkAssets(layout, assets); err != nil {
+			return err
+		}
+		return checkFITConfig(uboot, assets.KernelPath, opts)
+	})
+}
+
+// Default templates of bootcmd and bootargs of HiSilicon boards, reading the
+// kernel from flash and mounting the root file system from flash.
+const (
+	spiFlashBootCmd  = "sf probe 0; sf read {loadaddr} {kerneladdr} {kernelsize}; {boot}"
+	spiFlashBootArgs = "console={console} root=flash fstype=jffs2 rw rootaddr={rootaddr} rootsize={rootsize}"
+)
+
+// spiFlashBootEnv returns bootcmd and bootargs booting the flashed system,
+// expanded from the templates of the options or the defaults.
+//
+// The kernel is read to kernelAddr and started with go. With a configuration
+// of FIT image selected, the image is read to the staging memory instead and
+// booted with bootm, which moves the kernel to the load address given by the
+// image. Locations in flash are in bytes, as used by sf read.
+func spiFlashBootEnv(layout []partition, mem staging, kernelAddr uint64, console string, opts Options) (bootcmd, bootargs string, err error) {
+	values := map[string]string{
+		placeholderConsole:  console,
+		placeholderLoadAddr: fmt.Sprintf("%#x", kernelAddr),
+		placeholderFDTAddr:  fmt.Sprintf("%#x", mem.scratchAddr),
+		placeholderBoot:     fmt.Sprintf("go %#x", kernelAddr),
+	}
+	if opts.FITConfig != "" {
+		values[placeholderLoadAddr] = fmt.Sprintf("%#x", mem.loadAddr)
+		values[placeholderBoot] = ubootshell.BootmCommand(mem.loadAddr, opts.FITConfig)
+	}
+	for _, v := range []struct {
+		part       string
+		addr, size string
+		format     func(uint64) string
+	}{
+		{openharmony.Kernel, placeholderKernelAddr, placeholderKernelSize, func(v uint64) string { return fmt.Sprintf("%#x", v) }},
+		{openharmony.DTB, placeholderDTBAddr, placeholderDTBSize, func(v uint64) string { return fmt.Sprintf("%#x", v) }},
+		{openharmony.Rootfs, placeholderRootAddr, placeholderRootSize, kernelArgSize},
+	} {
+		if part, ok := findPartition(layout, v.part); ok {
+			values[v.addr] = v.format(part.flashAddr)
+			values[v.size] = v.format(part.eraseSize)
+		}
+	}
+	bootcmd, bootargs = opts.BootCmd, opts.BootArgs
+	if bootcmd == "" {
+		bootcmd = spiFlashBootCmd
+	}
+	if bootargs == "" {
+		bootargs = spiFlashBootArgs
+	}
+	if bootcmd, err = expandBootTemplate("bootcmd", bootcmd, values); err != nil {
+		return "", "", err
+	}
+	if bootargs, err = expandBootTemplate("bootargs", bootargs, values); err != nil {
+		return "", "", err
+	}
+	return bootcmd, bootargs, nil
+}
+
+// addSPIFlashAssets appends steps flashing the assets to the partitions of
+// the layout, in order.
+func addSPIFlashAssets(plan *ubootshell.FlashPlan, uboot *ubootshell.UBootShell, mem staging, layout []partition, assets *openharmony.Assets, opts Options) {
+	storage := ubootshell.NewSPIFlash(uboot)
+	for _, part := range layout {
+		addAsset(plan, storage, mem, assets.Get(part.name), part, opts)
+	}
+}
+
+// dumpSPIFlash reads a region of the SPI flash and writes it to the given writer.
+//
+// Flash is copied to memory at loadAddr with sf read, in chunks, and then
+// retrieved with the md.b command. This is very slow but works with an
+// unmodified u-boot.
+func dumpSPIFlash(uboot *ubootshell.UBootShell, loadAddr, offset, size uint64, w io.Writer) error {
+	const chunkSize = 0x10_000 // one 64KB block at a time
+	chip, err := uboot.ProbeFlash()
+	if err != nil {
+		return err
+	}
+	if offset > chip.Size || size > chip.Size-offset {
+		return fmt.Errorf("cannot dump %#x bytes at %#x, flash size is %#x", size, offset, chip.Size)
+	}
+	storage := ubootshell.NewSPIFlash(uboot)
+	stage := flash.Stage{Kind: flash.ReadStage, Name: fmt.Sprintf("dump %#x bytes of flash at %#x", size, offset)}
+	return flash.Run(uboot.Events(), stage, func() error {
+		for done := uint64(0); done < size; {
+			n := size - done
+			if n > chunkSize {
+				n = chunkSize
+			}
+			if err := storage.Read(loadAddr, offset+done, n); err != nil {
+				return err
+			}
+			data, err := uboot.ReadMemory(loadAddr, n)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			done += n
+			uboot.Logger().Printf("Dumped %d of %d bytes\n", done, size)
+			if events := uboot.Events(); events != nil {
+				events.StageProgress(stage, int64(done), int64(size))
+			}
+		}
+		return nil
+	})
+}
+
+// loadKernel loads the kernel into memory at kernelAddr, without writing it
+// to flash. FIT images are loaded to the staging memory instead.
+func loadKernel(uboot *ubootshell.UBootShell, mem staging, kernelAddr uint64, kernelPath string, opts Options) error {
+	if opts.FITConfig != "" {
+		if err := checkFITConfig(uboot, kernelPath, opts); err != nil {
+			return err
+		}
+		kernelAddr = mem.loadAddr
+	}
+	return ubootshell.NewFlashPlan().LoadFile(kernelAddr, kernelPath).Execute(uboot)
+}
+
+// startKernel starts the kernel loaded by loadKernel, with go or, for FIT
+// images, with bootm.
+func startKernel(uboot *ubootshell.UBootShell, mem staging, kernelAddr uint64, opts Options) error {
+	if opts.FITConfig != "" {
+		return ubootshell.NewFlashPlan().BootConfiguration(mem.loadAddr, opts.FITConfig).Execute(uboot)
+	}
+	return ubootshell.NewFlashPlan().StartApplication(kernelAddr).Execute(uboot)
+}
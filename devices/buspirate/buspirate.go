@@ -20,7 +20,11 @@ package buspirate
 import (
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/zyga/oh-flash-tools/devices/serialport"
 	"github.com/zyga/oh-flash-tools/ioextra"
 
 	"go.bug.st/serial.v1"
@@ -32,7 +36,7 @@ func FindBusPirate(portInfos []*enumerator.PortDetails) (string, error) {
 	names := make([]string, 0, 1)
 	for _, portInfo := range portInfos {
 		// TODO: add a way to pass serial number as a hint.
-		if portInfo.IsUSB && portInfo.VID == "0403" && portInfo.PID == "6001" {
+		if serialport.MatchUSB(portInfo, "0403", "6001") {
 			names = append(names, portInfo.Name)
 		}
 	}
@@ -43,14 +47,40 @@ func FindBusPirate(portInfos []*enumerator.PortDetails) (string, error) {
 }
 
 // BusPirate provides interaction with the BusPirate v3 board.
+//
+// Firmware v5 and newer is controlled using the binary bitbang protocol,
+// older firmware is controlled using the text user interface.
 type BusPirate struct {
 	stream io.ReadWriteCloser
 	expect *ioextra.ExpectEngine
+
+	version Version
+	atHiZ   bool // the user terminal is at the HiZ prompt
+	binary  bool // binary bitbang mode is active
+	pins    byte // state of pins in binary bitbang mode
+	inputs  byte // pins configured as inputs in binary bitbang mode
 }
 
+// Binary bitbang protocol commands and pin bits.
+const (
+	bbioReset      = 0x00 // enter or reset bitbang mode
+	bbioResetBoard = 0x0f // reset back to the user terminal
+	bbioReadADC    = 0x14 // read the ADC probe
+	bbioConfigPins = 0x40 // 0b010xxxxx, set pin direction, 1 is input
+	bbioSetPins    = 0x80 // 0b1xxxxxxx, set pin state
+	bbioPinPower   = 0x40
+	bbioPinPullUp  = 0x20
+	bbioPinAux     = 0x10
+)
+
+// binaryModeMinMajor is the oldest major version of firmware using binary mode.
+const binaryModeMinMajor = 5
+
 // OpenBusPirate opens a BusPirate on a specific serial port name.
+//
+// The bus pirate is reset to a known state and its version is detected.
 func OpenBusPirate(serialPortName string) (*BusPirate, error) {
-	port, err := serial.Open(serialPortName, &serial.Mode{
+	port, err := serialport.Open(serialPortName, &serial.Mode{
 		BaudRate: 115200,
 		DataBits: 8,
 		Parity:   serial.NoParity,
@@ -59,46 +89,346 @@ func OpenBusPirate(serialPortName string) (*BusPirate, error) {
 	if err != nil {
 		return nil, err
 	}
-	stream := ioextra.NewRestartingReadWriteCloser(port)
+	// The bus pirate responds right away, don't wait forever if it doesn't.
+	stream := ioextra.NewTimeoutReadWriteCloser(ioextra.NewRestartingReadWriteCloser(port), 5*time.Second, 5*time.Second)
 	pirate := &BusPirate{
 		stream: stream,
-		expect: ioextra.NewExpectEngine(stream),
+		expect: ioextra.NewExpectEngine(stream).WithWriter(stream),
+	}
+	if err := pirate.reset(); err != nil {
+		stream.Close()
+		return nil, err
 	}
 	return pirate, nil
 }
 
 // Close closes the stream representing the bus pirate connection.
+//
+// The bus pirate is not reset, so that the state of the power supply is
+// retained. The next session resets the bus pirate when entering PSU mode.
 func (pirate *BusPirate) Close() error {
 	return pirate.stream.Close()
 }
 
-// EnterPSUMode resets the bus pirate and enters 1-WIRE mode.
-// In this mode the 5V and 3V pins can supply up to 150mA of current.
+// EnterPSUMode enters a mode where the 5V and 3V pins can be used as a power
+// supply, with up to 150mA of current. The bus pirate is reset first, unless
+// it is still at the HiZ prompt.
+//
+// Firmware supporting it is switched to binary bitbang mode, older firmware
+// is switched to the 1-WIRE mode of the text user interface.
 func (pirate *BusPirate) EnterPSUMode() error {
-	if _, err := pirate.stream.Write([]byte("#\n")); err != nil {
+	if !pirate.atHiZ {
+		if err := pirate.reset(); err != nil {
+			return err
+		}
+	}
+	pirate.atHiZ = false
+	if !pirate.version.SupportsBinaryMode() {
+		if err := pirate.expect.SendLine("m2"); err != nil {
+			return err
+		}
+		return pirate.expect.DiscardUntil([]byte("Ready\r\n"))
+	}
+	// Twenty zero bytes switch the user terminal to binary bitbang mode.
+	if _, err := pirate.stream.Write(make([]byte, 20)); err != nil {
 		return err
 	}
-	if err := pirate.expect.DiscardUntil([]byte("HiZ>")); err != nil {
+	if err := pirate.expect.DiscardUntil([]byte("BBIO1")); err != nil {
 		return err
 	}
-	if _, err := pirate.stream.Write([]byte("m2\n")); err != nil {
+	pirate.binary = true
+	// Configure all pins as outputs, except for AUX, which is left floating
+	// as it may be wired to the reset line of the board.
+	if err := pirate.configPins(bbioPinAux); err != nil {
 		return err
 	}
-	return pirate.expect.DiscardUntil([]byte("Ready\r\n"))
+	pirate.pins = 0
+	return pirate.binaryCommand(bbioSetPins | pirate.pins)
 }
 
-// EnablePower enables the on-board 5V and 3V power supplies.
-func (pirate *BusPirate) EnablePower() error {
-	if _, err := pirate.stream.Write([]byte("W\n")); err != nil {
+// handshakeTimeout bounds the time waiting for the bus pirate to respond.
+const handshakeTimeout = 2 * time.Second
+
+// reset brings the bus pirate to the HiZ prompt of the user terminal and
+// reads its version.
+//
+// A previous session may have left the bus pirate in binary mode, where
+// text commands are not understood. If the bus pirate does not respond to
+// the reset command of the user terminal, binary mode is left and the reset
+// is attempted again.
+func (pirate *BusPirate) reset() error {
+	banner, err := pirate.terminalReset()
+	if err != nil {
+		if err := pirate.leaveBinaryMode(); err != nil {
+			return fmt.Errorf("cannot reset bus pirate, it responds to neither text nor binary commands: %w", err)
+		}
+		if banner, err = pirate.terminalReset(); err != nil {
+			return fmt.Errorf("cannot reset bus pirate after leaving binary mode: %w", err)
+		}
+	}
+	version, err := parseBanner(banner)
+	if err != nil {
+		return err
+	}
+	pirate.version = *version
+	pirate.binary = false
+	pirate.atHiZ = true
+	return nil
+}
+
+// terminalReset resets the user terminal and returns the banner it prints.
+func (pirate *BusPirate) terminalReset() ([]byte, error) {
+	pirate.expect.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer pirate.expect.SetDeadline(time.Time{})
+	// The first new line completes any partially typed command.
+	if _, err := pirate.stream.Write([]byte("\n#\n")); err != nil {
+		return nil, err
+	}
+	if err := pirate.expect.DiscardUntil([]byte("RESET")); err != nil {
+		return nil, err
+	}
+	return pirate.expect.CollectUntil([]byte("HiZ>"))
+}
+
+// leaveBinaryMode returns from binary mode to the user terminal.
+//
+// Zero bytes return from any of the binary protocol modes to binary bitbang
+// mode, which is then left by resetting the board.
+func (pirate *BusPirate) leaveBinaryMode() error {
+	pirate.expect.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer pirate.expect.SetDeadline(time.Time{})
+	if _, err := pirate.stream.Write(make([]byte, 20)); err != nil {
+		return err
+	}
+	if err := pirate.expect.DiscardUntil([]byte("BBIO1")); err != nil {
+		return err
+	}
+	if _, err := pirate.stream.Write([]byte{bbioResetBoard}); err != nil {
+		return err
+	}
+	// Give the bus pirate time to reset, input is lost in the meantime.
+	time.Sleep(100 * time.Millisecond)
+	return nil
+}
+
+// Version returns the version of the bus pirate, detected when it was opened.
+func (pirate *BusPirate) Version() Version {
+	return pirate.version
+}
+
+// binaryCommand sends a single byte command and reads the single byte reply.
+func (pirate *BusPirate) binaryCommand(cmd byte) error {
+	if _, err := pirate.stream.Write([]byte{cmd}); err != nil {
+		return err
+	}
+	_, err := pirate.expect.ReadByte()
+	return err
+}
+
+// configPins changes direction of pins in binary bitbang mode.
+func (pirate *BusPirate) configPins(inputs byte) error {
+	if err := pirate.binaryCommand(bbioConfigPins | inputs); err != nil {
+		return err
+	}
+	pirate.inputs = inputs
+	return nil
+}
+
+// setPin changes the state of one of the pins in binary bitbang mode.
+func (pirate *BusPirate) setPin(pin byte, on bool) error {
+	pins := pirate.pins &^ pin
+	if on {
+		pins |= pin
+	}
+	if err := pirate.binaryCommand(bbioSetPins | pins); err != nil {
+		return err
+	}
+	pirate.pins = pins
+	return nil
+}
+
+// textCommand sends a command to the user terminal and waits for the prompt.
+func (pirate *BusPirate) textCommand(cmd string) error {
+	if err := pirate.expect.SendLine(cmd); err != nil {
 		return err
 	}
 	return pirate.expect.DiscardUntil([]byte("1-WIRE>"))
 }
 
+// EnablePower enables the on-board 5V and 3V power supplies.
+func (pirate *BusPirate) EnablePower() error {
+	if pirate.binary {
+		return pirate.setPin(bbioPinPower, true)
+	}
+	return pirate.textCommand("W")
+}
+
 // DisablePower disables the on-board 5V and 3V power supplies.
 func (pirate *BusPirate) DisablePower() error {
-	if _, err := pirate.stream.Write([]byte("w\n")); err != nil {
+	if pirate.binary {
+		return pirate.setPin(bbioPinPower, false)
+	}
+	return pirate.textCommand("w")
+}
+
+// SetPullUps enables or disables the on-board pull-up resistors.
+func (pirate *BusPirate) SetPullUps(on bool) error {
+	if pirate.binary {
+		return pirate.setPin(bbioPinPullUp, on)
+	}
+	if on {
+		return pirate.textCommand("P")
+	}
+	return pirate.textCommand("p")
+}
+
+// SetAux drives the AUX pin high or low.
+func (pirate *BusPirate) SetAux(high bool) error {
+	if pirate.binary {
+		if err := pirate.configPins(pirate.inputs &^ bbioPinAux); err != nil {
+			return err
+		}
+		return pirate.setPin(bbioPinAux, high)
+	}
+	if high {
+		return pirate.textCommand("A")
+	}
+	return pirate.textCommand("a")
+}
+
+// PulseAux drives the AUX pin low for the given duration.
+//
+// Afterwards the AUX pin is left floating, so that it can be wired directly
+// to an active-low reset line, with a pull-up resistor on the board.
+func (pirate *BusPirate) PulseAux(duration time.Duration) error {
+	if err := pirate.SetAux(false); err != nil {
 		return err
 	}
-	return pirate.expect.DiscardUntil([]byte("1-WIRE>"))
+	time.Sleep(duration)
+	if pirate.binary {
+		return pirate.configPins(pirate.inputs | bbioPinAux)
+	}
+	// Reading the state of the AUX pin makes it an input.
+	return pirate.textCommand("@")
+}
+
+// Voltages describes voltages measured by the bus pirate.
+type Voltages struct {
+	// RailsMeasured indicates that the supply rails were measured. This is
+	// only possible with the text user interface.
+	RailsMeasured bool
+	Supply3V3     float64
+	Supply5V      float64
+	// ADC is the voltage on the ADC probe.
+	ADC float64
+}
+
+// Check returns an error if the supply rails are out of range.
+//
+// Voltage sagging after enabling power indicates a short circuit on the
+// board, or the board drawing too much current.
+func (v *Voltages) Check() error {
+	if !v.RailsMeasured {
+		return nil
+	}
+	if v.Supply3V3 < 3.0 || v.Supply3V3 > 3.6 {
+		return fmt.Errorf("bus pirate 3.3V supply out of range: %.2fV", v.Supply3V3)
+	}
+	if v.Supply5V < 4.5 || v.Supply5V > 5.5 {
+		return fmt.Errorf("bus pirate 5V supply out of range: %.2fV", v.Supply5V)
+	}
+	return nil
+}
+
+// ReadVoltages measures voltages with the bus pirate.
+//
+// In binary bitbang mode only the ADC probe can be measured. Connect it to
+// the supply of the board to observe it. In the text user interface both
+// supply rails and the ADC probe are measured.
+func (pirate *BusPirate) ReadVoltages() (*Voltages, error) {
+	if pirate.binary {
+		if _, err := pirate.stream.Write([]byte{bbioReadADC}); err != nil {
+			return nil, err
+		}
+		hi, err := pirate.expect.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		lo, err := pirate.expect.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		// The ADC is 10 bit, measuring 3.3V behind a voltage divider.
+		return &Voltages{ADC: float64(uint16(hi)<<8|uint16(lo)) / 1024 * 6.6}, nil
+	}
+	if err := pirate.expect.SendLine("v"); err != nil {
+		return nil, err
+	}
+	output, err := pirate.expect.CollectUntil([]byte("1-WIRE>"))
+	if err != nil {
+		return nil, err
+	}
+	return parsePinStates(string(output))
+}
+
+// parsePinStates parses the output of the "v" command.
+//
+// The output is a table, with pin names in one row and measured voltages or
+// logic levels in the last row, both starting with "GND".
+func parsePinStates(output string) (*Voltages, error) {
+	var names, values []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "GND" {
+			continue
+		}
+		if names == nil {
+			names = fields
+		} else {
+			values = fields
+		}
+	}
+	if len(names) == 0 || len(names) != len(values) {
+		return nil, fmt.Errorf("cannot parse bus pirate pin states: %q", output)
+	}
+	v := &Voltages{RailsMeasured: true}
+	measured := map[string]*float64{"3.3V": &v.Supply3V3, "5.0V": &v.Supply5V, "ADC": &v.ADC}
+	found := 0
+	for i, name := range names {
+		ptr, ok := measured[name]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSuffix(values[i], "V"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse bus pirate %s voltage: %q", name, values[i])
+		}
+		*ptr = value
+		found++
+	}
+	if found != len(measured) {
+		return nil, fmt.Errorf("cannot find bus pirate voltages in: %q", output)
+	}
+	return v, nil
+}
+
+// PowerOn enables the on-board power supplies.
+//
+// PowerOn, PowerOff and Cycle allow the bus pirate to act as a power
+// controller. The bus pirate must be in PSU mode.
+func (pirate *BusPirate) PowerOn() error {
+	return pirate.EnablePower()
+}
+
+// PowerOff disables the on-board power supplies.
+func (pirate *BusPirate) PowerOff() error {
+	return pirate.DisablePower()
+}
+
+// Cycle disables and re-enables the on-board power supplies.
+func (pirate *BusPirate) Cycle() error {
+	if err := pirate.DisablePower(); err != nil {
+		return err
+	}
+	return pirate.EnablePower()
 }
@@ -0,0 +1,81 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buspirate
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Version describes the hardware and firmware of a bus pirate.
+//
+// It is parsed from the banner printed by the user terminal on reset, for
+// example:
+//
+//	Bus Pirate v3.5
+//	Firmware v6.1 r1676  Bootloader v4.4
+type Version struct {
+	Hardware      string // for example "v3.5", empty if not printed
+	Firmware      string // for example "v6.1 r1676"
+	FirmwareMajor int
+	FirmwareMinor int
+	Bootloader    string // for example "v4.4", empty if not printed
+}
+
+var (
+	hardwareRegexp   = regexp.MustCompile(`Bus Pirate (v[^\s]+)`)
+	firmwareRegexp   = regexp.MustCompile(`Firmware (v(\d+)\.(\d+)[^\s]*(?: \(?r\d+\)?)?)`)
+	bootloaderRegexp = regexp.MustCompile(`Bootloader (v[^\s]+)`)
+)
+
+// parseBanner parses the version of the bus pirate from its reset banner.
+func parseBanner(banner []byte) (*Version, error) {
+	match := firmwareRegexp.FindSubmatch(banner)
+	if match == nil {
+		return nil, fmt.Errorf("cannot find bus pirate firmware version in %q", banner)
+	}
+	v := &Version{Firmware: string(match[1])}
+	v.FirmwareMajor, _ = strconv.Atoi(string(match[2]))
+	v.FirmwareMinor, _ = strconv.Atoi(string(match[3]))
+	if match := hardwareRegexp.FindSubmatch(banner); match != nil {
+		v.Hardware = string(match[1])
+	}
+	if match := bootloaderRegexp.FindSubmatch(banner); match != nil {
+		v.Bootloader = string(match[1])
+	}
+	return v, nil
+}
+
+// String returns the version in a form suitable for logging.
+func (v *Version) String() string {
+	hardware := v.Hardware
+	if hardware == "" {
+		hardware = "of unknown version"
+	}
+	s := fmt.Sprintf("Bus Pirate %s, firmware %s", hardware, v.Firmware)
+	if v.Bootloader != "" {
+		s += fmt.Sprintf(", bootloader %s", v.Bootloader)
+	}
+	return s
+}
+
+// SupportsBinaryMode returns true if the firmware supports the binary
+// bitbang protocol.
+func (v *Version) SupportsBinaryMode() bool {
+	return v.FirmwareMajor >= binaryModeMinMajor
+}
@@ -0,0 +1,389 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dfu implements the USB Device Firmware Upgrade protocol, version 1.1,
+// and the DfuSe extension of STMicroelectronics.
+//
+// Microcontrollers, such as those of the STM32 family, often have a DFU
+// bootloader in ROM, which allows programming internal flash over USB. DFU
+// itself only transfers a firmware image in blocks, where it is stored is up
+// to the device. DfuSe adds commands selecting the address and erasing pages,
+// the memory layout is described by the name of the alternate setting.
+package dfu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Transport performs control transfers with the DFU interface.
+type Transport interface {
+	// Control performs a control transfer, returning the transferred length.
+	Control(requestType, request uint8, value, index uint16, data []byte) (int, error)
+	io.Closer
+}
+
+// Class specific requests.
+const (
+	requestDetach    = 0
+	requestDnload    = 1
+	requestUpload    = 2
+	requestGetStatus = 3
+	requestClrStatus = 4
+	requestGetState  = 5
+	requestAbort     = 6
+)
+
+// Request types of requests to the interface, host to device and back.
+const (
+	requestTypeOut = 0x21
+	requestTypeIn  = 0xa1
+)
+
+// State is the state of the device.
+type State uint8
+
+// States defined by the specification.
+const (
+	AppIdle              State = 0
+	AppDetach            State = 1
+	DFUIdle              State = 2
+	DFUDnloadSync        State = 3
+	DFUDnbusy            State = 4
+	DFUDnloadIdle        State = 5
+	DFUManifestSync      State = 6
+	DFUManifest          State = 7
+	DFUManifestWaitReset State = 8
+	DFUUploadIdle        State = 9
+	DFUError             State = 10
+)
+
+var stateNames = [...]string{
+	"appIDLE",
+	"appDETACH",
+	"dfuIDLE",
+	"dfuDNLOAD-SYNC",
+	"dfuDNBUSY",
+	"dfuDNLOAD-IDLE",
+	"dfuMANIFEST-SYNC",
+	"dfuMANIFEST",
+	"dfuMANIFEST-WAIT-RESET",
+	"dfuUPLOAD-IDLE",
+	"dfuERROR",
+}
+
+func (s State) String() string {
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("state %d", uint8(s))
+}
+
+// statusNames describe the status codes defined by the specification.
+var statusNames = [...]string{
+	"no error",
+	"file is not targeted for use by this device",
+	"file is for this device but fails some vendor-specific verification test",
+	"device is unable to write memory",
+	"memory erase function failed",
+	"memory erase check failed",
+	"program memory function failed",
+	"programmed memory failed verification",
+	"cannot program memory due to received address that is out of range",
+	"received DFU_DNLOAD with wLength = 0, but device does not think it has all of the data yet",
+	"device's firmware is corrupt",
+	"vendor-specific error",
+	"unexpected USB reset signaling",
+	"unexpected POR",
+	"something went wrong, but the device does not know what it was",
+	"device stalled an unexpected request",
+}
+
+// Status is the result of the GETSTATUS request.
+type Status struct {
+	Status      uint8
+	PollTimeout time.Duration // time to wait before the next GETSTATUS request
+	State       State
+}
+
+// Err returns an error describing a status other than OK.
+func (s Status) Err() error {
+	if s.Status == 0 {
+		return nil
+	}
+	if int(s.Status) < len(statusNames) {
+		return fmt.Errorf("device in %s: %s", s.State, statusNames[s.Status])
+	}
+	return fmt.Errorf("device in %s: status %d", s.State, s.Status)
+}
+
+// Functional is the DFU functional descriptor.
+type Functional struct {
+	Attributes    uint8
+	DetachTimeout uint16 // in milliseconds
+	TransferSize  uint16 // maximum number of bytes in a control transfer
+	Version       uint16 // in BCD, 0x011a for DfuSe
+}
+
+// Bits of Attributes.
+const (
+	CanDownload           = 1 << 0
+	CanUpload             = 1 << 1
+	ManifestationTolerant = 1 << 2
+	WillDetach            = 1 << 3
+)
+
+// descriptorFunctional is the type of the DFU functional descriptor.
+const descriptorFunctional = 0x21
+
+// parseFunctional parses the DFU functional descriptor.
+func parseFunctional(d []byte) (Functional, bool) {
+	if len(d) < 7 || d[1] != descriptorFunctional {
+		return Functional{}, false
+	}
+	fd := Functional{
+		Attributes:    d[2],
+		DetachTimeout: binary.LittleEndian.Uint16(d[3:]),
+		TransferSize:  binary.LittleEndian.Uint16(d[5:]),
+		Version:       0x0100,
+	}
+	if len(d) >= 9 {
+		fd.Version = binary.LittleEndian.Uint16(d[7:])
+	}
+	return fd, true
+}
+
+// defaultTransferSize is used when the device does not tell its own.
+const defaultTransferSize = 1024
+
+// Device is a device in DFU mode.
+type Device struct {
+	transport    Transport
+	iface        uint16
+	functional   Functional
+	transferSize int
+	layout       []Segment
+}
+
+// New returns a device talking over the given transport to the interface with
+// the given number and functional descriptor.
+func New(transport Transport, iface int, functional Functional) *Device {
+	transferSize := int(functional.TransferSize)
+	if transferSize == 0 {
+		transferSize = defaultTransferSize
+	}
+	return &Device{transport: transport, iface: uint16(iface), functional: functional, transferSize: transferSize}
+}
+
+// Close closes the transport.
+func (dev *Device) Close() error {
+	return dev.transport.Close()
+}
+
+// Functional returns the DFU functional descriptor of the device.
+func (dev *Device) Functional() Functional {
+	return dev.functional
+}
+
+// Detach asks a device in run-time mode to enter DFU mode.
+//
+// Devices without the WillDetach attribute wait for a USB reset within the
+// detach timeout.
+func (dev *Device) Detach() error {
+	_, err := dev.transport.Control(requestTypeOut, requestDetach, dev.functional.DetachTimeout, dev.iface, nil)
+	if err != nil {
+		return fmt.Errorf("cannot detach: %w", err)
+	}
+	return nil
+}
+
+// GetStatus returns the status of the device.
+//
+// In some states, the request also makes the device act on the data
+// received so far.
+func (dev *Device) GetStatus() (Status, error) {
+	buf := make([]byte, 6)
+	n, err := dev.transport.Control(requestTypeIn, requestGetStatus, 0, dev.iface, buf)
+	if err != nil {
+		return Status{}, fmt.Errorf("cannot get status: %w", err)
+	}
+	if n < len(buf) {
+		return Status{}, fmt.Errorf("cannot get status: short response")
+	}
+	pollTimeout := uint32(buf[1]) | uint32(buf[2])<<8 | uint32(buf[3])<<16
+	return Status{Status: buf[0], PollTimeout: time.Duration(pollTimeout) * time.Millisecond, State: State(buf[4])}, nil
+}
+
+// GetState returns the state of the device.
+func (dev *Device) GetState() (State, error) {
+	buf := make([]byte, 1)
+	n, err := dev.transport.Control(requestTypeIn, requestGetState, 0, dev.iface, buf)
+	if err != nil {
+		return 0, fmt.Errorf("cannot get state: %w", err)
+	}
+	if n < len(buf) {
+		return 0, fmt.Errorf("cannot get state: short response")
+	}
+	return State(buf[0]), nil
+}
+
+// ClearStatus clears the error status, returning the device to dfuIDLE.
+func (dev *Device) ClearStatus() error {
+	if _, err := dev.transport.Control(requestTypeOut, requestClrStatus, 0, dev.iface, nil); err != nil {
+		return fmt.Errorf("cannot clear status: %w", err)
+	}
+	return nil
+}
+
+// Abort returns the device to dfuIDLE from an idle state of a transfer.
+func (dev *Device) Abort() error {
+	if _, err := dev.transport.Control(requestTypeOut, requestAbort, 0, dev.iface, nil); err != nil {
+		return fmt.Errorf("cannot abort: %w", err)
+	}
+	return nil
+}
+
+// Idle brings the device to dfuIDLE, leaving errors or unfinished transfers.
+func (dev *Device) Idle() error {
+	status, err := dev.GetStatus()
+	if err != nil {
+		return err
+	}
+	switch status.State {
+	case DFUIdle:
+		return nil
+	case DFUError:
+		err = dev.ClearStatus()
+	case DFUDnloadIdle, DFUUploadIdle:
+		err = dev.Abort()
+	case AppIdle, AppDetach:
+		return fmt.Errorf("device in %s is not in DFU mode", status.State)
+	default:
+		return fmt.Errorf("device in %s is busy", status.State)
+	}
+	if err != nil {
+		return err
+	}
+	if status, err = dev.GetStatus(); err != nil {
+		return err
+	}
+	if status.State != DFUIdle {
+		return fmt.Errorf("device in %s instead of %s", status.State, DFUIdle)
+	}
+	return nil
+}
+
+// dnload sends a block of data and waits until the device has processed it.
+func (dev *Device) dnload(block uint16, data []byte) error {
+	if _, err := dev.transport.Control(requestTypeOut, requestDnload, block, dev.iface, data); err != nil {
+		return fmt.Errorf("cannot send block %d: %w", block, err)
+	}
+	return dev.waitWhile(DFUDnloadSync, DFUDnbusy)
+}
+
+// waitWhile polls the status of the device as long as it is in one of the
+// given states, failing if the device reports an error.
+func (dev *Device) waitWhile(states ...State) error {
+	for {
+		status, err := dev.GetStatus()
+		if err != nil {
+			return err
+		}
+		if err := status.Err(); err != nil {
+			return err
+		}
+		busy := false
+		for _, state := range states {
+			busy = busy || status.State == state
+		}
+		if !busy {
+			return nil
+		}
+		time.Sleep(status.PollTimeout)
+	}
+}
+
+// Download sends a firmware image to the device and waits for the device to
+// store it.
+//
+// The progress function, if not nil, is called with the number of bytes
+// sent so far. Devices which are not manifestation tolerant reset once done.
+func (dev *Device) Download(data []byte, progress func(done int)) error {
+	if err := dev.Idle(); err != nil {
+		return err
+	}
+	block := uint16(0)
+	for done := 0; done < len(data); block++ {
+		n := len(data) - done
+		if n > dev.transferSize {
+			n = dev.transferSize
+		}
+		if err := dev.dnload(block, data[done:done+n]); err != nil {
+			return err
+		}
+		done += n
+		if progress != nil {
+			progress(done)
+		}
+	}
+	// An empty block ends the transfer and starts the manifestation phase.
+	if _, err := dev.transport.Control(requestTypeOut, requestDnload, block, dev.iface, nil); err != nil {
+		return fmt.Errorf("cannot end download: %w", err)
+	}
+	err := dev.waitWhile(DFUManifestSync, DFUManifest)
+	if err != nil && dev.functional.Attributes&ManifestationTolerant == 0 {
+		// The device may have reset before answering.
+		return nil
+	}
+	return err
+}
+
+// Upload reads the firmware image from the device, up to size bytes.
+func (dev *Device) Upload(size int) ([]byte, error) {
+	if err := dev.Idle(); err != nil {
+		return nil, err
+	}
+	data, err := dev.upload(0, size)
+	if err != nil {
+		return nil, err
+	}
+	return data, dev.Abort()
+}
+
+// upload reads blocks starting with the given number until a short block
+// or size bytes are read.
+func (dev *Device) upload(block uint16, size int) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for len(data) < size {
+		n := size - len(data)
+		if n > dev.transferSize {
+			n = dev.transferSize
+		}
+		buf := make([]byte, n)
+		got, err := dev.transport.Control(requestTypeIn, requestUpload, block, dev.iface, buf)
+		if err != nil {
+			return nil, fmt.Errorf("cannot receive block %d: %w", block, err)
+		}
+		data = append(data, buf[:got]...)
+		if got < n {
+			break
+		}
+		block++
+	}
+	return data, nil
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dfu
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// fakeDevice is a transport to a simulated DFU device, following the state
+// diagram of the specification.
+type fakeDevice struct {
+	state     State
+	status    uint8
+	tolerant  bool
+	failBlock int // block failing to be written, if not negative
+	firmware  []byte
+	blocks    [][]byte
+	requests  []uint8
+	uploaded  int
+}
+
+var errReset = errors.New("device reset")
+
+func (dev *fakeDevice) Control(requestType, request uint8, value, index uint16, data []byte) (int, error) {
+	dev.requests = append(dev.requests, request)
+	switch request {
+	case requestGetStatus:
+		switch dev.state {
+		case DFUDnloadSync:
+			dev.state = DFUDnbusy
+		case DFUDnbusy:
+			if len(dev.blocks)-1 == dev.failBlock {
+				dev.state, dev.status = DFUError, 3
+			} else {
+				dev.state = DFUDnloadIdle
+			}
+		case DFUManifestSync:
+			dev.state = DFUManifest
+		case DFUManifest:
+			if !dev.tolerant {
+				return 0, errReset
+			}
+			dev.state = DFUIdle
+		}
+		copy(data, []byte{dev.status, 0, 0, 0, byte(dev.state), 0})
+		return 6, nil
+	case requestGetState:
+		data[0] = byte(dev.state)
+		return 1, nil
+	case requestClrStatus:
+		if dev.state == DFUError {
+			dev.state, dev.status = DFUIdle, 0
+		}
+	case requestAbort:
+		dev.state = DFUIdle
+	case requestDnload:
+		if len(data) == 0 {
+			dev.state = DFUManifestSync
+		} else {
+			dev.blocks = append(dev.blocks, append([]byte(nil), data...))
+			dev.state = DFUDnloadSync
+		}
+	case requestUpload:
+		n := copy(data, dev.firmware[dev.uploaded:])
+		dev.uploaded += n
+		dev.state = DFUUploadIdle
+		if n < len(data) {
+			dev.state = DFUIdle
+		}
+		return n, nil
+	}
+	return len(data), nil
+}
+
+func (dev *fakeDevice) Close() error { return nil }
+
+func TestStatusErr(t *testing.T) {
+	for _, tc := range []struct {
+		status   Status
+		expected string
+	}{
+		{Status{Status: 0, State: DFUIdle}, ""},
+		{Status{Status: 3, State: DFUError}, "device in dfuERROR: device is unable to write memory"},
+		{Status{Status: 8, State: DFUError}, "device in dfuERROR: cannot program memory due to received address that is out of range"},
+		{Status{Status: 15, State: DFUError}, "device in dfuERROR: device stalled an unexpected request"},
+		{Status{Status: 16, State: State(11)}, "device in state 11: status 16"},
+	} {
+		err := tc.status.Err()
+		if (err == nil) != (tc.expected == "") || err != nil && err.Error() != tc.expected {
+			t.Fatalf("unexpected error of %+v: %v", tc.status, err)
+		}
+	}
+}
+
+func TestParseFunctional(t *testing.T) {
+	for _, tc := range []struct {
+		descriptor []byte
+		expected   Functional
+		ok         bool
+	}{
+		{[]byte{9, 0x21, 0x0b, 0xff, 0x00, 0x00, 0x08, 0x1a, 0x01}, Functional{Attributes: 0x0b, DetachTimeout: 255, TransferSize: 2048, Version: 0x011a}, true},
+		// DFU 1.0 descriptors lack the version.
+		{[]byte{7, 0x21, 0x03, 0x10, 0x27, 0x00, 0x04}, Functional{Attributes: 0x03, DetachTimeout: 10000, TransferSize: 1024, Version: 0x0100}, true},
+		{[]byte{9, 0x04, 0x0b, 0xff, 0x00, 0x00, 0x08, 0x1a, 0x01}, Functional{}, false},
+		{[]byte{6, 0x21, 0x0b, 0xff, 0x00, 0x00}, Functional{}, false},
+	} {
+		fd, ok := parseFunctional(tc.descriptor)
+		if fd != tc.expected || ok != tc.ok {
+			t.Fatalf("unexpected parsing of %x: %+v, %v", tc.descriptor, fd, ok)
+		}
+	}
+}
+
+func TestIdle(t *testing.T) {
+	for _, tc := range []struct {
+		state    State
+		status   uint8
+		requests []uint8
+		err      string
+	}{
+		{state: DFUIdle, requests: []uint8{requestGetStatus}},
+		{state: DFUError, status: 3, requests: []uint8{requestGetStatus, requestClrStatus, requestGetStatus}},
+		{state: DFUDnloadIdle, requests: []uint8{requestGetStatus, requestAbort, requestGetStatus}},
+		{state: DFUUploadIdle, requests: []uint8{requestGetStatus, requestAbort, requestGetStatus}},
+		{state: AppIdle, requests: []uint8{requestGetStatus}, err: "device in appIDLE is not in DFU mode"},
+		{state: DFUManifestWaitReset, requests: []uint8{requestGetStatus}, err: "device in dfuMANIFEST-WAIT-RESET is busy"},
+	} {
+		fake := &fakeDevice{state: tc.state, status: tc.status}
+		err := New(fake, 0, Functional{}).Idle()
+		if (err == nil) != (tc.err == "") || err != nil && err.Error() != tc.err {
+			t.Fatalf("unexpected error leaving %s: %v", tc.state, err)
+		}
+		if !bytes.Equal(fake.requests, tc.requests) {
+			t.Fatalf("unexpected requests leaving %s: %v", tc.state, fake.requests)
+		}
+		if tc.err == "" && fake.state != DFUIdle {
+			t.Fatalf("device left in %s instead of %s", fake.state, DFUIdle)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	data := []byte("0123456789")
+	for _, tc := range []struct {
+		name      string
+		tolerant  bool
+		failBlock int
+		blocks    int
+		state     State
+		err       string
+	}{
+		{name: "manifestation tolerant", tolerant: true, failBlock: -1, blocks: 3, state: DFUIdle},
+		// The device resets after manifestation, without answering.
+		{name: "not manifestation tolerant", failBlock: -1, blocks: 3, state: DFUManifest},
+		{name: "write failure", tolerant: true, failBlock: 1, blocks: 2, state: DFUError, err: "device in dfuERROR: device is unable to write memory"},
+	} {
+		fake := &fakeDevice{state: DFUIdle, tolerant: tc.tolerant, failBlock: tc.failBlock}
+		attrs := uint8(CanDownload)
+		if tc.tolerant {
+			attrs |= ManifestationTolerant
+		}
+		var progress []int
+		err := New(fake, 0, Functional{Attributes: attrs, TransferSize: 4}).Download(data, func(done int) {
+			progress = append(progress, done)
+		})
+		if (err == nil) != (tc.err == "") || err != nil && err.Error() != tc.err {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if fake.state != tc.state {
+			t.Fatalf("%s: device in %s instead of %s", tc.name, fake.state, tc.state)
+		}
+		if len(fake.blocks) != tc.blocks {
+			t.Fatalf("%s: unexpected blocks %q", tc.name, fake.blocks)
+		}
+		if tc.err != "" {
+			continue
+		}
+		if received := bytes.Join(fake.blocks, nil); !bytes.Equal(received, data) {
+			t.Fatalf("%s: device received %q", tc.name, received)
+		}
+		if len(progress) != 3 || progress[0] != 4 || progress[1] != 8 || progress[2] != 10 {
+			t.Fatalf("%s: unexpected progress %v", tc.name, progress)
+		}
+	}
+}
+
+func TestUpload(t *testing.T) {
+	for _, tc := range []struct {
+		size     int
+		expected string
+		requests int
+	}{
+		// A short block ends the upload.
+		{size: 16, expected: "abcdef", requests: 2},
+		{size: 4, expected: "abcd", requests: 1},
+	} {
+		fake := &fakeDevice{state: DFUIdle, firmware: []byte("abcdef")}
+		data, err := New(fake, 0, Functional{TransferSize: 4}).Upload(tc.size)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(data) != tc.expected {
+			t.Fatalf("unexpected upload of %d bytes: %q", tc.size, data)
+		}
+		uploads := 0
+		for _, request := range fake.requests {
+			if request == requestUpload {
+				uploads++
+			}
+		}
+		if uploads != tc.requests {
+			t.Fatalf("unexpected number of uploads: %d", uploads)
+		}
+		if fake.state != DFUIdle {
+			t.Fatalf("device left in %s", fake.state)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dfu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VersionDfuSe is the DFU version reported by devices with the DfuSe extension.
+const VersionDfuSe = 0x011a
+
+// Commands of DfuSe, sent as the data of block 0.
+const (
+	dfuseSetAddress = 0x21
+	dfuseErase      = 0x41
+)
+
+// dfuseDataBlock is the number of the first block of data, the address of a
+// block is relative to the address last set.
+const dfuseDataBlock = 2
+
+// Segment is a part of the memory of a DfuSe device, made of pages of the
+// same size.
+type Segment struct {
+	Start      uint32
+	PageSize   uint32
+	Pages      int
+	Attributes uint8
+}
+
+// Bits of Segment.Attributes.
+const (
+	Readable = 1 << 0
+	Erasable = 1 << 1
+	Writable = 1 << 2
+)
+
+// End returns the address following the segment.
+func (seg Segment) End() uint64 {
+	return uint64(seg.Start) + uint64(seg.PageSize)*uint64(seg.Pages)
+}
+
+// ParseLayout parses the memory layout from the name of a DfuSe alternate
+// setting, such as "@Internal Flash  /0x08000000/04*016Kg,01*064Kg,07*128Kg".
+//
+// Each address is followed by groups of pages, given as number*size, where the
+// size is followed by a unit, K, M or a space for bytes, and by a letter
+// from 'a' to 'g' encoding the attributes, as 'a' - 1 + Readable|Erasable|Writable.
+func ParseLayout(name string) ([]Segment, error) {
+	parts := strings.Split(name, "/")
+	if !strings.HasPrefix(name, "@") || len(parts) < 3 || len(parts)%2 == 0 {
+		return nil, fmt.Errorf("invalid DfuSe memory layout %q", name)
+	}
+	var layout []Segment
+	for i := 1; i < len(parts); i += 2 {
+		addr, err := strconv.ParseUint(strings.TrimSpace(parts[i]), 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address in DfuSe memory layout %q", name)
+		}
+		for _, group := range strings.Split(parts[i+1], ",") {
+			seg, err := parsePages(strings.TrimLeft(group, " "))
+			if err != nil {
+				return nil, fmt.Errorf("invalid pages %q in DfuSe memory layout %q", group, name)
+			}
+			seg.Start = uint32(addr)
+			layout = append(layout, seg)
+			addr = seg.End()
+		}
+	}
+	return layout, nil
+}
+
+// parsePages parses a group of pages, such as "04*016Kg".
+func parsePages(group string) (Segment, error) {
+	idx := strings.IndexByte(group, '*')
+	if idx < 0 || len(group) < idx+3 {
+		return Segment{}, fmt.Errorf("invalid group of pages")
+	}
+	pages, err := strconv.Atoi(group[:idx])
+	if err != nil {
+		return Segment{}, err
+	}
+	rest := group[idx+1:]
+	end := 0
+	for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+		end++
+	}
+	size, err := strconv.ParseUint(rest[:end], 10, 32)
+	if err != nil {
+		return Segment{}, err
+	}
+	rest = rest[end:]
+	if len(rest) == 2 {
+		switch rest[0] {
+		case 'K':
+			size <<= 10
+		case 'M':
+			size <<= 20
+		case ' ':
+		default:
+			return Segment{}, fmt.Errorf("invalid unit %q", rest[0])
+		}
+		rest = rest[1:]
+	}
+	if len(rest) != 1 || rest[0] < 'a' || rest[0] > 'g' {
+		return Segment{}, fmt.Errorf("invalid attributes %q", rest)
+	}
+	return Segment{PageSize: uint32(size), Pages: pages, Attributes: rest[0] - 'a' + 1}, nil
+}
+
+// WithLayout returns the device with the given memory layout, for DownloadTo.
+func (dev *Device) WithLayout(layout []Segment) *Device {
+	dev.layout = layout
+	return dev
+}
+
+// command sends a DfuSe command and waits until the device has executed it.
+func (dev *Device) command(cmd byte, addr uint32) error {
+	data := make([]byte, 5)
+	data[0] = cmd
+	binary.LittleEndian.PutUint32(data[1:], addr)
+	return dev.dnload(0, data)
+}
+
+// SetAddress sets the address of the following data blocks.
+func (dev *Device) SetAddress(addr uint32) error {
+	if err := dev.command(dfuseSetAddress, addr); err != nil {
+		return fmt.Errorf("cannot set address %#x: %w", addr, err)
+	}
+	return nil
+}
+
+// ErasePage erases the page at the given address.
+func (dev *Device) ErasePage(addr uint32) error {
+	if err := dev.command(dfuseErase, addr); err != nil {
+		return fmt.Errorf("cannot erase page at %#x: %w", addr, err)
+	}
+	return nil
+}
+
+// DownloadTo writes data to memory at the given address of a DfuSe device.
+//
+// The pages covering the data are erased first, the memory must be writable
+// according to the layout of the device. The progress function, if not nil,
+// is called with the number of bytes written so far.
+func (dev *Device) DownloadTo(addr uint32, data []byte, progress func(done int)) error {
+	if dev.layout == nil {
+		return fmt.Errorf("memory layout of the device is unknown")
+	}
+	start, end := uint64(addr), uint64(addr)+uint64(len(data))
+	var pages []uint32
+	for pos := start; pos < end; {
+		seg, ok := dev.segment(pos)
+		if !ok || seg.Attributes&Writable == 0 {
+			return fmt.Errorf("memory at %#x is not writable", pos)
+		}
+		page := uint64(seg.Start) + (pos-uint64(seg.Start))/uint64(seg.PageSize)*uint64(seg.PageSize)
+		if seg.Attributes&Erasable != 0 {
+			pages = append(pages, uint32(page))
+		}
+		pos = page + uint64(seg.PageSize)
+	}
+	if err := dev.Idle(); err != nil {
+		return err
+	}
+	for _, page := range pages {
+		if err := dev.ErasePage(page); err != nil {
+			return err
+		}
+	}
+	for done := 0; done < len(data); {
+		n := len(data) - done
+		if n > dev.transferSize {
+			n = dev.transferSize
+		}
+		if err := dev.SetAddress(addr + uint32(done)); err != nil {
+			return err
+		}
+		if err := dev.dnload(dfuseDataBlock, data[done:done+n]); err != nil {
+			return fmt.Errorf("cannot write memory at %#x: %w", addr+uint32(done), err)
+		}
+		done += n
+		if progress != nil {
+			progress(done)
+		}
+	}
+	return dev.Abort()
+}
+
+// segment returns the segment containing the given address.
+func (dev *Device) segment(addr uint64) (Segment, bool) {
+	for _, seg := range dev.layout {
+		if addr >= uint64(seg.Start) && addr < seg.End() && seg.PageSize > 0 {
+			return seg, true
+		}
+	}
+	return Segment{}, false
+}
+
+// Leave makes a DfuSe device leave DFU mode and start the code at the given
+// address.
+func (dev *Device) Leave(addr uint32) error {
+	if err := dev.Idle(); err != nil {
+		return err
+	}
+	if err := dev.SetAddress(addr); err != nil {
+		return err
+	}
+	// An empty data block makes the device jump to the address.
+	if _, err := dev.transport.Control(requestTypeOut, requestDnload, dfuseDataBlock, dev.iface, nil); err != nil {
+		return fmt.Errorf("cannot leave DFU mode: %w", err)
+	}
+	// The device starts the code when asked for its status, and may not answer.
+	dev.GetStatus()
+	return nil
+}
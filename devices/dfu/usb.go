@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dfu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/devices/usb"
+)
+
+// Class and subclass of DFU interfaces.
+const (
+	interfaceClass    = 0xfe
+	interfaceSubClass = 0x01
+)
+
+// AltSetting is an alternate setting of a DFU interface, typically selecting
+// the memory to program.
+type AltSetting struct {
+	Interface  int
+	AltSetting int
+	Name       string
+}
+
+// OpenUSB opens the only USB device with the given identifiers and selects
+// the DFU alternate setting given by number or by name.
+//
+// The memory layout of DfuSe devices is parsed from the name of the setting.
+func OpenUSB(vendor, product uint16, alt string) (*Device, error) {
+	dev, err := usb.Open(vendor, product)
+	if err != nil {
+		return nil, err
+	}
+	d, err := openUSB(dev, alt)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func openUSB(dev *usb.Device, alt string) (*Device, error) {
+	var settings []AltSetting
+	var functional Functional
+	found := -1
+	for _, iface := range dev.Interfaces() {
+		if iface.Class != interfaceClass || iface.SubClass != interfaceSubClass {
+			continue
+		}
+		for _, extra := range iface.Extra {
+			if fd, ok := parseFunctional(extra); ok {
+				functional = fd
+			}
+		}
+		name, err := dev.String(iface.NameIndex)
+		if err != nil {
+			return nil, err
+		}
+		setting := AltSetting{Interface: iface.Number, AltSetting: iface.AltSetting, Name: name}
+		if n, err := strconv.Atoi(alt); (err == nil && n == setting.AltSetting) || (err != nil && alt == name) {
+			found = len(settings)
+		}
+		settings = append(settings, setting)
+	}
+	if len(settings) == 0 {
+		return nil, fmt.Errorf("device has no DFU interface")
+	}
+	if found < 0 {
+		names := make([]string, 0, len(settings))
+		for _, setting := range settings {
+			names = append(names, fmt.Sprintf("%d %q", setting.AltSetting, setting.Name))
+		}
+		return nil, fmt.Errorf("cannot find DFU alternate setting %q, available are: %s", alt, strings.Join(names, ", "))
+	}
+	setting := settings[found]
+	if err := dev.ClaimInterface(setting.Interface); err != nil {
+		return nil, err
+	}
+	if err := dev.SetAltSetting(setting.Interface, setting.AltSetting); err != nil {
+		return nil, err
+	}
+	d := New(dev, setting.Interface, functional)
+	if functional.Version == VersionDfuSe {
+		layout, err := ParseLayout(setting.Name)
+		if err != nil {
+			return nil, err
+		}
+		d.WithLayout(layout)
+	}
+	return d, nil
+}
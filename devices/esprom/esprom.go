@@ -0,0 +1,423 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package esprom implements the serial protocol of the bootloader in the ROM
+// of Espressif ESP32 chips.
+//
+// The ROM bootloader starts when the chip is reset with GPIO0 (or GPIO9 on
+// ESP32-C3) held low, which development boards do through the DTR and RTS
+// lines of their USB to serial adapters. Commands and responses are framed
+// with SLIP. The bootloader can read registers and write flash memory, which
+// is enough to program the partitions of a firmware image.
+package esprom
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ModemControl is implemented by serial ports able to drive DTR and RTS,
+// which are wired to the reset and boot mode pins of most development boards.
+type ModemControl interface {
+	SetDTR(dtr bool) error
+	SetRTS(rts bool) error
+}
+
+// ErrNoModemControl is returned when the chip cannot be reset through the
+// serial port. It must then be reset into the bootloader by hand.
+var ErrNoModemControl = errors.New("serial port cannot drive DTR and RTS")
+
+// Commands of the ROM bootloader.
+const (
+	cmdFlashBegin = 0x02
+	cmdFlashData  = 0x03
+	cmdFlashEnd   = 0x04
+	cmdSync       = 0x08
+	cmdReadReg    = 0x0a
+	cmdSPIAttach  = 0x0d
+	cmdFlashMD5   = 0x13
+)
+
+// FlashBlockSize is the amount of data written with a single command.
+const FlashBlockSize = 0x400
+
+// Timeouts of commands, some depend on the amount of data processed.
+const (
+	defaultTimeout    = 3 * time.Second
+	syncTimeout       = 100 * time.Millisecond
+	eraseTimeoutPerMB = 30 * time.Second
+	writeTimeoutPerMB = 40 * time.Second
+	md5TimeoutPerMB   = 8 * time.Second
+)
+
+// timeoutPerMB returns the timeout of processing size bytes, but not less than
+// the default timeout.
+func timeoutPerMB(perMB time.Duration, size int) time.Duration {
+	timeout := time.Duration(float64(perMB) * float64(size) / 1e6)
+	if timeout < defaultTimeout {
+		return defaultTimeout
+	}
+	return timeout
+}
+
+// Chip is a chip of the ESP32 family.
+type Chip struct {
+	Name string
+	// BootloaderOffset is the location of the second stage bootloader in flash.
+	BootloaderOffset uint32
+	// flashBeginEncrypted tells if FLASH_BEGIN takes a flag selecting encryption.
+	flashBeginEncrypted bool
+}
+
+// Known chips.
+var (
+	ESP32   = Chip{Name: "ESP32", BootloaderOffset: 0x1000}
+	ESP32S2 = Chip{Name: "ESP32-S2", BootloaderOffset: 0x1000, flashBeginEncrypted: true}
+	ESP32S3 = Chip{Name: "ESP32-S3", BootloaderOffset: 0x0, flashBeginEncrypted: true}
+	ESP32C3 = Chip{Name: "ESP32-C3", BootloaderOffset: 0x0, flashBeginEncrypted: true}
+)
+
+// chipMagicAddr is the address of a ROM word identifying the chip.
+const chipMagicAddr = 0x40001000
+
+// chipMagic maps values found at chipMagicAddr to the chips.
+var chipMagic = map[uint32]Chip{
+	0x00f01d83: ESP32,
+	0x000007c6: ESP32S2,
+	0x00000009: ESP32S3,
+	0x6921506f: ESP32C3,
+	0x1b31506f: ESP32C3,
+	0x4881606f: ESP32C3,
+	0x4361606f: ESP32C3,
+}
+
+// Device is the ROM bootloader of an ESP32 chip.
+type Device struct {
+	port   io.ReadWriter
+	chip   Chip
+	frames chan frame
+	done   chan struct{}
+}
+
+// frame is a SLIP frame received from the chip, or the error ending reception.
+type frame struct {
+	data []byte
+	err  error
+}
+
+// New returns a device talking over the given serial port.
+//
+// Data is read from the port in the background until Close is called and
+// the port is closed.
+func New(port io.ReadWriter) *Device {
+	dev := &Device{port: port, chip: ESP32, frames: make(chan frame, 16), done: make(chan struct{})}
+	go dev.readFrames()
+	return dev
+}
+
+// Close stops reading from the port, which is not closed.
+func (dev *Device) Close() error {
+	close(dev.done)
+	return nil
+}
+
+// SLIP special bytes.
+const (
+	slipEnd    = 0xc0
+	slipEsc    = 0xdb
+	slipEscEnd = 0xdc
+	slipEscEsc = 0xdd
+)
+
+// readFrames decodes SLIP frames, discarding anything between them, such as
+// boot messages.
+func (dev *Device) readFrames() {
+	r := bufio.NewReader(dev.port)
+	var data []byte
+	inFrame, escaped := false, false
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			select {
+			case dev.frames <- frame{err: err}:
+			case <-dev.done:
+			}
+			return
+		}
+		switch {
+		case b == slipEnd && inFrame && len(data) > 0:
+			select {
+			case dev.frames <- frame{data: data}:
+			case <-dev.done:
+				return
+			}
+			data, inFrame = nil, false
+		case b == slipEnd:
+			inFrame = true
+		case !inFrame:
+		case escaped:
+			switch b {
+			case slipEscEnd:
+				data = append(data, slipEnd)
+			case slipEscEsc:
+				data = append(data, slipEsc)
+			}
+			escaped = false
+		case b == slipEsc:
+			escaped = true
+		default:
+			data = append(data, b)
+		}
+	}
+}
+
+// writeFrame encodes the data as a SLIP frame and sends it.
+func (dev *Device) writeFrame(data []byte) error {
+	buf := make([]byte, 0, len(data)+len(data)/16+2)
+	buf = append(buf, slipEnd)
+	for _, b := range data {
+		switch b {
+		case slipEnd:
+			buf = append(buf, slipEsc, slipEscEnd)
+		case slipEsc:
+			buf = append(buf, slipEsc, slipEscEsc)
+		default:
+			buf = append(buf, b)
+		}
+	}
+	buf = append(buf, slipEnd)
+	_, err := dev.port.Write(buf)
+	return err
+}
+
+// checksum computes the checksum of data sent with FLASH_DATA.
+func checksum(data []byte) uint32 {
+	sum := byte(0xef)
+	for _, b := range data {
+		sum ^= b
+	}
+	return uint32(sum)
+}
+
+// statusSize is the size of the status at the end of responses of the ROM.
+const statusSize = 4
+
+// command sends a command and waits for its response, returning the value
+// and the data of the response without the status.
+func (dev *Device) command(cmd byte, data []byte, sum uint32, timeout time.Duration) (uint32, []byte, error) {
+	packet := make([]byte, 8, 8+len(data))
+	packet[1] = cmd
+	binary.LittleEndian.PutUint16(packet[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(packet[4:], sum)
+	packet = append(packet, data...)
+	if err := dev.writeFrame(packet); err != nil {
+		return 0, nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		var f frame
+		select {
+		case f = <-dev.frames:
+		case <-timer.C:
+			return 0, nil, fmt.Errorf("timeout waiting for response to command %#02x", cmd)
+		}
+		if f.err != nil {
+			return 0, nil, f.err
+		}
+		// Responses to earlier commands, such as repeated SYNC, are skipped.
+		resp := f.data
+		if len(resp) < 8 || resp[0] != 1 || resp[1] != cmd {
+			continue
+		}
+		size := int(binary.LittleEndian.Uint16(resp[2:]))
+		if size < statusSize || len(resp) < 8+size {
+			return 0, nil, fmt.Errorf("invalid response to command %#02x", cmd)
+		}
+		value := binary.LittleEndian.Uint32(resp[4:])
+		body, status := resp[8:8+size-statusSize], resp[8+size-statusSize:8+size]
+		if status[0] != 0 {
+			return 0, nil, fmt.Errorf("command %#02x failed with error %#02x", cmd, status[1])
+		}
+		return value, body, nil
+	}
+}
+
+// ResetToBootloader resets the chip with the boot mode pin held low, which
+// starts the ROM bootloader.
+//
+// On development boards, RTS drives the EN pin and DTR the boot mode pin,
+// both inverted. ErrNoModemControl is returned if the port cannot drive them.
+func (dev *Device) ResetToBootloader() error {
+	ctrl, ok := dev.port.(ModemControl)
+	if !ok {
+		return ErrNoModemControl
+	}
+	steps := []struct {
+		dtr, rts bool
+		wait     time.Duration
+	}{
+		{dtr: false, rts: true, wait: 100 * time.Millisecond}, // in reset, boot pin high
+		{dtr: true, rts: false, wait: 50 * time.Millisecond},  // out of reset, boot pin low
+		{dtr: false, rts: false},                              // boot pin released
+	}
+	for _, step := range steps {
+		if err := ctrl.SetDTR(step.dtr); err != nil {
+			return err
+		}
+		if err := ctrl.SetRTS(step.rts); err != nil {
+			return err
+		}
+		time.Sleep(step.wait)
+	}
+	return nil
+}
+
+// HardReset resets the chip, which then starts the flashed firmware.
+func (dev *Device) HardReset() error {
+	ctrl, ok := dev.port.(ModemControl)
+	if !ok {
+		return ErrNoModemControl
+	}
+	if err := ctrl.SetRTS(true); err != nil {
+		return err
+	}
+	time.Sleep(100 * time.Millisecond)
+	return ctrl.SetRTS(false)
+}
+
+// syncAttempts is the number of SYNC commands sent before giving up.
+const syncAttempts = 20
+
+// Sync synchronizes with the bootloader, which detects the baud rate.
+func (dev *Device) Sync() error {
+	data := append([]byte{0x07, 0x07, 0x12, 0x20}, make([]byte, 32)...)
+	for i := 4; i < len(data); i++ {
+		data[i] = 0x55
+	}
+	var err error
+	for i := 0; i < syncAttempts; i++ {
+		if _, _, err = dev.command(cmdSync, data, 0, syncTimeout); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot synchronize with the ESP32 ROM bootloader: %w", err)
+}
+
+// ReadReg reads a register, or any other word of memory.
+func (dev *Device) ReadReg(addr uint32) (uint32, error) {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, addr)
+	value, _, err := dev.command(cmdReadReg, data, 0, defaultTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read register %#x: %w", addr, err)
+	}
+	return value, nil
+}
+
+// DetectChip identifies the chip, which selects the variant of the protocol.
+func (dev *Device) DetectChip() (Chip, error) {
+	magic, err := dev.ReadReg(chipMagicAddr)
+	if err != nil {
+		return Chip{}, err
+	}
+	chip, ok := chipMagic[magic]
+	if !ok {
+		return Chip{}, fmt.Errorf("unsupported chip, magic value %#08x", magic)
+	}
+	dev.chip = chip
+	return chip, nil
+}
+
+// AttachFlash attaches the SPI flash, which the ROM requires before writing.
+func (dev *Device) AttachFlash() error {
+	if _, _, err := dev.command(cmdSPIAttach, make([]byte, 8), 0, defaultTimeout); err != nil {
+		return fmt.Errorf("cannot attach SPI flash: %w", err)
+	}
+	return nil
+}
+
+// WriteFlash erases flash at the given offset and writes the data there.
+//
+// The progress function, if not nil, is called with the number of bytes
+// written so far.
+func (dev *Device) WriteFlash(offset uint32, data []byte, progress func(done int)) error {
+	blocks := (len(data) + FlashBlockSize - 1) / FlashBlockSize
+	params := make([]byte, 16, 20)
+	binary.LittleEndian.PutUint32(params[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(params[4:], uint32(blocks))
+	binary.LittleEndian.PutUint32(params[8:], FlashBlockSize)
+	binary.LittleEndian.PutUint32(params[12:], offset)
+	if dev.chip.flashBeginEncrypted {
+		params = append(params, 0, 0, 0, 0)
+	}
+	if _, _, err := dev.command(cmdFlashBegin, params, 0, timeoutPerMB(eraseTimeoutPerMB, len(data))); err != nil {
+		return fmt.Errorf("cannot erase flash at %#x: %w", offset, err)
+	}
+	for seq := 0; seq < blocks; seq++ {
+		block := make([]byte, 16+FlashBlockSize)
+		binary.LittleEndian.PutUint32(block[0:], FlashBlockSize)
+		binary.LittleEndian.PutUint32(block[4:], uint32(seq))
+		n := copy(block[16:], data[seq*FlashBlockSize:])
+		// The last block is padded as if erased.
+		for i := 16 + n; i < len(block); i++ {
+			block[i] = 0xff
+		}
+		if _, _, err := dev.command(cmdFlashData, block, checksum(block[16:]), timeoutPerMB(writeTimeoutPerMB, FlashBlockSize)); err != nil {
+			return fmt.Errorf("cannot write flash at %#x: %w", offset+uint32(seq*FlashBlockSize), err)
+		}
+		if progress != nil {
+			progress(seq*FlashBlockSize + n)
+		}
+	}
+	return nil
+}
+
+// VerifyFlash checks that flash at the given offset holds the data, comparing
+// MD5 digests computed by the ROM and locally.
+func (dev *Device) VerifyFlash(offset uint32, data []byte) error {
+	params := make([]byte, 16)
+	binary.LittleEndian.PutUint32(params[0:], offset)
+	binary.LittleEndian.PutUint32(params[4:], uint32(len(data)))
+	_, body, err := dev.command(cmdFlashMD5, params, 0, timeoutPerMB(md5TimeoutPerMB, len(data)))
+	if err != nil {
+		return fmt.Errorf("cannot compute digest of flash at %#x: %w", offset, err)
+	}
+	// The ROM sends the digest in hex.
+	digest := md5.Sum(data)
+	if string(body) != hex.EncodeToString(digest[:]) {
+		return fmt.Errorf("flash at %#x does not hold the written data", offset)
+	}
+	return nil
+}
+
+// FlashEnd ends writing flash, optionally rebooting the chip.
+func (dev *Device) FlashEnd(reboot bool) error {
+	data := []byte{1, 0, 0, 0}
+	if reboot {
+		data[0] = 0
+	}
+	if _, _, err := dev.command(cmdFlashEnd, data, 0, defaultTimeout); err != nil && !reboot {
+		return fmt.Errorf("cannot end writing flash: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package esprom
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestWriteFrame(t *testing.T) {
+	for _, tc := range []struct {
+		data     string
+		expected string
+	}{
+		{"", "\xc0\xc0"},
+		{"abc", "\xc0abc\xc0"},
+		{"\xc0", "\xc0\xdb\xdc\xc0"},
+		{"\xdb", "\xc0\xdb\xdd\xc0"},
+		{"a\xdb\xdcb\xc0\xdd", "\xc0a\xdb\xdd\xdcb\xdb\xdc\xdd\xc0"},
+	} {
+		var buf bytes.Buffer
+		dev := &Device{port: &buf}
+		if err := dev.writeFrame([]byte(tc.data)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf.String() != tc.expected {
+			t.Fatalf("unexpected frame of %q: %q, expected %q", tc.data, buf.String(), tc.expected)
+		}
+	}
+}
+
+// readAll returns the frames decoded from the given stream.
+func readAll(t *testing.T, stream string) []string {
+	t.Helper()
+	dev := &Device{port: bytes.NewBufferString(stream), frames: make(chan frame, 16), done: make(chan struct{})}
+	dev.readFrames()
+	var frames []string
+	for f := range dev.frames {
+		if f.err != nil {
+			if f.err != io.EOF {
+				t.Fatalf("unexpected error: %v", f.err)
+			}
+			return frames
+		}
+		frames = append(frames, string(f.data))
+	}
+	return frames
+}
+
+func TestReadFrames(t *testing.T) {
+	for _, tc := range []struct {
+		stream   string
+		expected []string
+	}{
+		{"\xc0abc\xc0", []string{"abc"}},
+		{"\xc0\xdb\xdc\xdb\xdd\xc0", []string{"\xc0\xdb"}},
+		// Boot messages between frames are discarded.
+		{"ets Jun  8 2016\r\n\xc0a\xc0waiting for download\r\n\xc0b\xc0", []string{"a", "b"}},
+		// Empty frames are ignored, like esptool every frame has its own
+		// opening byte.
+		{"\xc0\xc0\xc0a\xc0b\xc0c\xc0", []string{"a", "c"}},
+		// An unterminated frame is never returned.
+		{"\xc0a\xc0\xc0b", []string{"a"}},
+	} {
+		frames := readAll(t, tc.stream)
+		if len(frames) != len(tc.expected) {
+			t.Fatalf("unexpected frames of %q: %q", tc.stream, frames)
+		}
+		for i := range frames {
+			if frames[i] != tc.expected[i] {
+				t.Fatalf("unexpected frames of %q: %q", tc.stream, frames)
+			}
+		}
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	var buf bytes.Buffer
+	dev := &Device{port: &buf}
+	if err := dev.writeFrame(data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	frames := readAll(t, buf.String())
+	if len(frames) != 1 || frames[0] != string(data) {
+		t.Fatalf("unexpected frames %q", frames)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	for _, tc := range []struct {
+		data     string
+		expected uint32
+	}{
+		{"", 0xef},
+		{"\xef", 0x00},
+		{"\x01\x02\x04", 0xe8},
+		{"\xff\xff", 0xef},
+	} {
+		if sum := checksum([]byte(tc.data)); sum != tc.expected {
+			t.Fatalf("unexpected checksum of %q: %#x", tc.data, sum)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fastboot implements the fastboot protocol of Android bootloaders,
+// also found in u-boot and in the bootloaders of many OpenHarmony devices.
+//
+// Commands are short ASCII strings sent to the bulk OUT endpoint, answered
+// by packets on the bulk IN endpoint starting with OKAY, FAIL, DATA, or INFO
+// and TEXT for messages sent while the command is running.
+package fastboot
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Transport exchanges packets with the bulk endpoints of the device.
+type Transport interface {
+	// Write sends all the data to the OUT endpoint.
+	Write(p []byte) error
+	// Read receives a single packet of up to len(p) bytes from the IN endpoint.
+	Read(p []byte) (int, error)
+	io.Closer
+}
+
+// Limits of the protocol.
+const (
+	maxCommand  = 64
+	maxResponse = 256
+)
+
+// downloadChunk is the amount of data sent at once, between progress reports.
+const downloadChunk = 1 << 20
+
+// Device is a bootloader in fastboot mode.
+type Device struct {
+	transport Transport
+	info      func(msg string)
+}
+
+// New returns a device talking over the given transport.
+func New(transport Transport) *Device {
+	return &Device{transport: transport}
+}
+
+// WithInfo returns the device passing messages sent by the bootloader while
+// running commands to the given function.
+func (dev *Device) WithInfo(info func(msg string)) *Device {
+	dev.info = info
+	return dev
+}
+
+// Close closes the transport.
+func (dev *Device) Close() error {
+	return dev.transport.Close()
+}
+
+// Command sends a command and returns the payload of the OKAY response.
+func (dev *Device) Command(cmd string) (string, error) {
+	if err := dev.send(cmd); err != nil {
+		return "", err
+	}
+	status, payload, err := dev.response(cmd)
+	if err != nil {
+		return "", err
+	}
+	if status != "OKAY" {
+		return "", fmt.Errorf("unexpected response to %s: %s%s", cmd, status, payload)
+	}
+	return payload, nil
+}
+
+// send sends a command.
+func (dev *Device) send(cmd string) error {
+	if len(cmd) > maxCommand {
+		return fmt.Errorf("fastboot command too long: %q", cmd)
+	}
+	if err := dev.transport.Write([]byte(cmd)); err != nil {
+		return fmt.Errorf("cannot send %s: %w", cmd, err)
+	}
+	return nil
+}
+
+// response returns the final response to the command, OKAY or DATA, passing
+// messages to the info function and turning FAIL into an error.
+func (dev *Device) response(cmd string) (status, payload string, err error) {
+	buf := make([]byte, maxResponse)
+	for {
+		n, err := dev.transport.Read(buf)
+		if err != nil {
+			return "", "", fmt.Errorf("cannot receive response to %s: %w", cmd, err)
+		}
+		if n < 4 {
+			return "", "", fmt.Errorf("invalid response to %s: %q", cmd, buf[:n])
+		}
+		status, payload := string(buf[:4]), string(buf[4:n])
+		switch status {
+		case "INFO", "TEXT":
+			if dev.info != nil {
+				dev.info(payload)
+			}
+		case "FAIL":
+			return "", "", fmt.Errorf("%s failed: %s", cmd, payload)
+		case "OKAY", "DATA":
+			return status, payload, nil
+		default:
+			return "", "", fmt.Errorf("invalid response to %s: %q", cmd, buf[:n])
+		}
+	}
+}
+
+// GetVar returns the value of a bootloader variable, such as "product".
+func (dev *Device) GetVar(name string) (string, error) {
+	return dev.Command("getvar:" + name)
+}
+
+// MaxDownloadSize returns the size of the largest download accepted by the device.
+func (dev *Device) MaxDownloadSize() (int64, error) {
+	value, err := dev.GetVar("max-download-size")
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(value), 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid max-download-size: %q", value)
+	}
+	return size, nil
+}
+
+// Download sends data to the memory of the device, for a following command
+// such as flash.
+//
+// The progress function, if not nil, is called with the number of bytes sent
+// so far.
+func (dev *Device) Download(data []byte, progress func(done int)) error {
+	cmd := fmt.Sprintf("download:%08x", len(data))
+	if err := dev.send(cmd); err != nil {
+		return err
+	}
+	status, payload, err := dev.response(cmd)
+	if err != nil {
+		return err
+	}
+	if status != "DATA" {
+		return fmt.Errorf("unexpected response to %s: %s%s", cmd, status, payload)
+	}
+	if size, err := strconv.ParseUint(payload, 16, 32); err != nil || int(size) != len(data) {
+		return fmt.Errorf("device accepts %q bytes instead of %#x", payload, len(data))
+	}
+	for done := 0; done < len(data); {
+		n := len(data) - done
+		if n > downloadChunk {
+			n = downloadChunk
+		}
+		if err := dev.transport.Write(data[done : done+n]); err != nil {
+			return fmt.Errorf("cannot send data: %w", err)
+		}
+		done += n
+		if progress != nil {
+			progress(done)
+		}
+	}
+	if status, payload, err = dev.response(cmd); err != nil {
+		return err
+	}
+	if status != "OKAY" {
+		return fmt.Errorf("unexpected response to %s: %s%s", cmd, status, payload)
+	}
+	return nil
+}
+
+// Flash writes the downloaded data to the partition.
+func (dev *Device) Flash(partition string) error {
+	_, err := dev.Command("flash:" + partition)
+	return err
+}
+
+// Erase erases the partition.
+func (dev *Device) Erase(partition string) error {
+	_, err := dev.Command("erase:" + partition)
+	return err
+}
+
+// Reboot restarts the device normally.
+func (dev *Device) Reboot() error {
+	_, err := dev.Command("reboot")
+	return err
+}
+
+// RebootBootloader restarts the device into fastboot mode again.
+func (dev *Device) RebootBootloader() error {
+	_, err := dev.Command("reboot-bootloader")
+	return err
+}
+
+// Continue leaves fastboot mode and continues booting.
+func (dev *Device) Continue() error {
+	_, err := dev.Command("continue")
+	return err
+}
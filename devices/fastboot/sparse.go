@@ -0,0 +1,143 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fastboot
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Android sparse images describe the content of a partition in chunks, some
+// of them holding data and some just skipping blocks. Bootloaders write them
+// to partitions as they are flashed.
+const (
+	sparseMagic      = 0xed26ff3a
+	sparseHeaderSize = 28
+	chunkHeaderSize  = 12
+	chunkRaw         = 0xcac1
+	chunkDontCare    = 0xcac3
+	sparseBlockSize  = 4096
+)
+
+// FlashImage reads an image of the given size and writes it to the partition.
+//
+// Images larger than the largest download are sent in parts, as sparse images
+// each holding data of one part and skipping the rest of the partition. The
+// last block is then padded with zeros. The progress function, if not nil, is
+// called with the number of bytes of the image sent so far.
+func (dev *Device) FlashImage(partition string, r io.Reader, size int64, progress func(done int64)) error {
+	maxSize, err := dev.MaxDownloadSize()
+	if err != nil {
+		return err
+	}
+	if size <= maxSize {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		err := dev.Download(data, func(done int) {
+			if progress != nil {
+				progress(int64(done))
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return dev.Flash(partition)
+	}
+	partBlocks := (maxSize - sparseHeaderSize - 3*chunkHeaderSize) / sparseBlockSize
+	if partBlocks <= 0 {
+		return fmt.Errorf("cannot flash %s, max-download-size is only %#x", partition, maxSize)
+	}
+	totalBlocks := (size + sparseBlockSize - 1) / sparseBlockSize
+	for block := int64(0); block < totalBlocks; block += partBlocks {
+		blocks := totalBlocks - block
+		if blocks > partBlocks {
+			blocks = partBlocks
+		}
+		data := make([]byte, blocks*sparseBlockSize)
+		n := int64(len(data))
+		if rest := size - block*sparseBlockSize; n > rest {
+			n = rest
+		}
+		if _, err := io.ReadFull(r, data[:n]); err != nil {
+			return err
+		}
+		image := sparseImage(totalBlocks, block, data)
+		// Progress is reported in bytes of the image, without sparse headers.
+		sent, headers := block*sparseBlockSize, sparseHeaderSize+chunkHeaderSize
+		if block > 0 {
+			headers += chunkHeaderSize
+		}
+		err := dev.Download(image, func(done int) {
+			if progress == nil || done <= headers {
+				return
+			}
+			if pos := sent + int64(done-headers); pos < size {
+				progress(pos)
+			} else {
+				progress(size)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if err := dev.Flash(partition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sparseImage returns a sparse image of the given number of blocks, holding
+// the data, a multiple of the block size, at the given block.
+func sparseImage(totalBlocks, block int64, data []byte) []byte {
+	var chunks [][]byte
+	if block > 0 {
+		chunks = append(chunks, chunkHeader(chunkDontCare, block, 0))
+	}
+	blocks := int64(len(data)) / sparseBlockSize
+	chunks = append(chunks, chunkHeader(chunkRaw, blocks, len(data)), data)
+	if rest := totalBlocks - block - blocks; rest > 0 {
+		chunks = append(chunks, chunkHeader(chunkDontCare, rest, 0))
+	}
+	header := make([]byte, sparseHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], sparseMagic)
+	binary.LittleEndian.PutUint16(header[4:], 1) // major version
+	binary.LittleEndian.PutUint16(header[6:], 0) // minor version
+	binary.LittleEndian.PutUint16(header[8:], sparseHeaderSize)
+	binary.LittleEndian.PutUint16(header[10:], chunkHeaderSize)
+	binary.LittleEndian.PutUint32(header[12:], sparseBlockSize)
+	binary.LittleEndian.PutUint32(header[16:], uint32(totalBlocks))
+	binary.LittleEndian.PutUint32(header[20:], uint32(len(chunks)-1)) // data is not a chunk
+	image := header
+	for _, chunk := range chunks {
+		image = append(image, chunk...)
+	}
+	return image
+}
+
+// chunkHeader returns the header of a chunk of the given number of blocks,
+// followed by the given amount of data.
+func chunkHeader(chunkType uint16, blocks int64, dataSize int) []byte {
+	header := make([]byte, chunkHeaderSize)
+	binary.LittleEndian.PutUint16(header[0:], chunkType)
+	binary.LittleEndian.PutUint32(header[4:], uint32(blocks))
+	binary.LittleEndian.PutUint32(header[8:], uint32(chunkHeaderSize+dataSize))
+	return header
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fastboot
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/devices/usb"
+)
+
+// Class, subclass and protocol of fastboot USB interfaces.
+const (
+	interfaceClass    = 0xff
+	interfaceSubClass = 0x42
+	interfaceProtocol = 0x03
+)
+
+// usbTimeout is the timeout of transfers, flashing and erasing large
+// partitions takes long before the response arrives.
+const usbTimeout = 5 * time.Minute
+
+// OpenUSB opens the only device in fastboot mode attached over USB.
+func OpenUSB() (*Device, error) {
+	dev, err := usb.OpenInterface(interfaceClass, interfaceSubClass, interfaceProtocol)
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range dev.Interfaces() {
+		if iface.Class != interfaceClass || iface.SubClass != interfaceSubClass || iface.Protocol != interfaceProtocol {
+			continue
+		}
+		t := &usbTransport{dev: dev.WithTimeout(usbTimeout)}
+		for _, addr := range iface.Endpoints {
+			if addr&0x80 != 0 {
+				t.in = addr
+			} else {
+				t.out = addr
+			}
+		}
+		if t.in == 0 || t.out == 0 {
+			break
+		}
+		if err := dev.ClaimInterface(iface.Number); err != nil {
+			dev.Close()
+			return nil, err
+		}
+		return New(t), nil
+	}
+	dev.Close()
+	return nil, fmt.Errorf("cannot find bulk endpoints of fastboot interface")
+}
+
+// usbTransport exchanges packets with the bootloader over USB.
+type usbTransport struct {
+	dev     *usb.Device
+	in, out uint8
+}
+
+// Write sends all the data to the OUT endpoint.
+func (t *usbTransport) Write(p []byte) error {
+	for len(p) > 0 {
+		n, err := t.dev.Bulk(t.out, p)
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// Read receives a single packet from the IN endpoint.
+func (t *usbTransport) Read(p []byte) (int, error) {
+	return t.dev.Bulk(t.in, p)
+}
+
+// Close closes the device.
+func (t *usbTransport) Close() error {
+	return t.dev.Close()
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fel implements the FEL protocol of the boot ROM of Allwinner SoCs.
+//
+// SoCs without a working bootloader, or with the FEL button held during
+// power-on, wait for commands over USB. FEL allows reading and writing memory
+// and executing code, which is enough to start u-boot without touching
+// storage, and then flash the board over the serial line as usual.
+//
+// Only SRAM is usable right after reset, DRAM must be initialized first, by
+// loading and executing an SPL which returns to FEL once done, like the SPL of
+// u-boot for sunxi does.
+package fel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// USB identifiers of the boot ROM in FEL mode.
+const (
+	USBVendor  = 0x1f3a
+	USBProduct = 0xefe8
+)
+
+// Transport exchanges data with the bulk endpoints of the device.
+type Transport interface {
+	// BulkWrite sends all the data to the OUT endpoint.
+	BulkWrite(p []byte) error
+	// BulkRead receives exactly len(p) bytes from the IN endpoint.
+	BulkRead(p []byte) error
+	io.Closer
+}
+
+// Requests of the USB layer, wrapping everything else.
+const (
+	usbRead  = 0x11
+	usbWrite = 0x12
+)
+
+// Requests of the FEL layer.
+const (
+	felVersion = 0x001
+	felWrite   = 0x101
+	felExec    = 0x102
+	felRead    = 0x103
+)
+
+// maxChunk is the largest amount of memory read or written with a single request.
+const maxChunk = 64 << 10
+
+// Device is the boot ROM of an Allwinner SoC in FEL mode.
+type Device struct {
+	transport Transport
+}
+
+// New returns a device talking over the given transport.
+func New(transport Transport) *Device {
+	return &Device{transport: transport}
+}
+
+// Close closes the transport.
+func (dev *Device) Close() error {
+	return dev.transport.Close()
+}
+
+// Version describes the SoC, as reported by the boot ROM.
+type Version struct {
+	SocID      uint32
+	Firmware   uint32
+	Protocol   uint16
+	Scratchpad uint32 // address of memory available to FEL code
+}
+
+// socNames are the names of known SoCs, by identifier.
+var socNames = map[uint32]string{
+	0x1623: "A10",
+	0x1625: "A13",
+	0x1633: "A31",
+	0x1639: "A80",
+	0x1650: "A23",
+	0x1651: "A20",
+	0x1667: "A33",
+	0x1673: "A83T",
+	0x1680: "H3",
+	0x1681: "V3s",
+	0x1689: "A64",
+	0x1701: "R40",
+	0x1718: "H5",
+	0x1728: "H6",
+	0x1817: "V831",
+	0x1823: "H616",
+}
+
+// SocName returns the name of the SoC, or its identifier if not known.
+func (v Version) SocName() string {
+	if name, ok := socNames[v.SocID]; ok {
+		return name
+	}
+	return fmt.Sprintf("%#04x", v.SocID)
+}
+
+// Version returns the version of the boot ROM and the identifier of the SoC.
+func (dev *Device) Version() (Version, error) {
+	if err := dev.request(felVersion, 0, 0); err != nil {
+		return Version{}, err
+	}
+	buf := make([]byte, 32)
+	if err := dev.usbRead(buf); err != nil {
+		return Version{}, err
+	}
+	if err := dev.readStatus(); err != nil {
+		return Version{}, err
+	}
+	if !bytes.HasPrefix(buf, []byte("AWUSBFEX")) {
+		return Version{}, fmt.Errorf("cannot read FEL version, unexpected signature %q", buf[:8])
+	}
+	return Version{
+		SocID:      binary.LittleEndian.Uint32(buf[8:]) >> 8 & 0xffff,
+		Firmware:   binary.LittleEndian.Uint32(buf[12:]),
+		Protocol:   binary.LittleEndian.Uint16(buf[16:]),
+		Scratchpad: binary.LittleEndian.Uint32(buf[20:]),
+	}, nil
+}
+
+// WriteMemory writes data to memory at the given address.
+//
+// Progress, if not nil, is called with the number of bytes written so far.
+func (dev *Device) WriteMemory(addr uint32, data []byte, progress func(done int)) error {
+	for done := 0; done < len(data); {
+		n := len(data) - done
+		if n > maxChunk {
+			n = maxChunk
+		}
+		if err := dev.request(felWrite, addr+uint32(done), uint32(n)); err != nil {
+			return err
+		}
+		if err := dev.usbWrite(data[done : done+n]); err != nil {
+			return err
+		}
+		if err := dev.readStatus(); err != nil {
+			return err
+		}
+		done += n
+		if progress != nil {
+			progress(done)
+		}
+	}
+	return nil
+}
+
+// ReadMemory reads size bytes of memory at the given address.
+func (dev *Device) ReadMemory(addr, size uint32) ([]byte, error) {
+	data := make([]byte, size)
+	for done := uint32(0); done < size; {
+		n := size - done
+		if n > maxChunk {
+			n = maxChunk
+		}
+		if err := dev.request(felRead, addr+done, n); err != nil {
+			return nil, err
+		}
+		if err := dev.usbRead(data[done : done+n]); err != nil {
+			return nil, err
+		}
+		if err := dev.readStatus(); err != nil {
+			return nil, err
+		}
+		done += n
+	}
+	return data, nil
+}
+
+// Execute calls code at the given address.
+//
+// Code returning to the boot ROM, such as the SPL, allows using FEL again.
+func (dev *Device) Execute(addr uint32) error {
+	if err := dev.request(felExec, addr, 0); err != nil {
+		return err
+	}
+	return dev.readStatus()
+}
+
+// request sends a request of the FEL layer.
+func (dev *Device) request(request, addr, length uint32) error {
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint32(buf[0:], request)
+	binary.LittleEndian.PutUint32(buf[4:], addr)
+	binary.LittleEndian.PutUint32(buf[8:], length)
+	return dev.usbWrite(buf)
+}
+
+// readStatus reads the status concluding each request of the FEL layer.
+func (dev *Device) readStatus() error {
+	return dev.usbRead(make([]byte, 8))
+}
+
+// usbWrite sends data wrapped by the USB layer.
+func (dev *Device) usbWrite(data []byte) error {
+	if err := dev.usbRequest(usbWrite, len(data)); err != nil {
+		return err
+	}
+	if err := dev.transport.BulkWrite(data); err != nil {
+		return fmt.Errorf("cannot send FEL data: %w", err)
+	}
+	return dev.usbResponse()
+}
+
+// usbRead receives data wrapped by the USB layer.
+func (dev *Device) usbRead(data []byte) error {
+	if err := dev.usbRequest(usbRead, len(data)); err != nil {
+		return err
+	}
+	if err := dev.transport.BulkRead(data); err != nil {
+		return fmt.Errorf("cannot receive FEL data: %w", err)
+	}
+	return dev.usbResponse()
+}
+
+// usbRequest announces the direction and length of the following transfer.
+func (dev *Device) usbRequest(request uint16, length int) error {
+	buf := make([]byte, 32)
+	copy(buf, "AWUC")
+	binary.LittleEndian.PutUint32(buf[8:], uint32(length))
+	binary.LittleEndian.PutUint32(buf[12:], 0x0c000000)
+	binary.LittleEndian.PutUint16(buf[16:], request)
+	binary.LittleEndian.PutUint32(buf[18:], uint32(length))
+	if err := dev.transport.BulkWrite(buf); err != nil {
+		return fmt.Errorf("cannot send FEL request: %w", err)
+	}
+	return nil
+}
+
+// usbResponse reads the status of a transfer of the USB layer.
+func (dev *Device) usbResponse() error {
+	buf := make([]byte, 13)
+	if err := dev.transport.BulkRead(buf); err != nil {
+		return fmt.Errorf("cannot receive FEL response: %w", err)
+	}
+	if !bytes.HasPrefix(buf, []byte("AWUS")) {
+		return fmt.Errorf("unexpected FEL response %q", buf[:4])
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fel
+
+import (
+	"fmt"
+
+	"github.com/zyga/oh-flash-tools/devices/usb"
+)
+
+// Endpoints of the boot ROM in FEL mode.
+const (
+	endpointOut = 0x01
+	endpointIn  = 0x82
+)
+
+// OpenUSB opens the only device in FEL mode attached over USB.
+func OpenUSB() (*Device, error) {
+	dev, err := usb.Open(USBVendor, USBProduct)
+	if err != nil {
+		return nil, err
+	}
+	if err := dev.ClaimInterface(0); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return New(&usbTransport{dev: dev}), nil
+}
+
+// usbTransport exchanges data with the boot ROM over USB.
+type usbTransport struct {
+	dev *usb.Device
+}
+
+// BulkWrite sends all the data to the OUT endpoint.
+func (t *usbTransport) BulkWrite(p []byte) error {
+	for len(p) > 0 {
+		n, err := t.dev.Bulk(endpointOut, p)
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// BulkRead receives exactly len(p) bytes from the IN endpoint.
+func (t *usbTransport) BulkRead(p []byte) error {
+	for len(p) > 0 {
+		n, err := t.dev.Bulk(endpointIn, p)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("short USB read")
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// Close closes the device.
+func (t *usbTransport) Close() error {
+	return t.dev.Close()
+}
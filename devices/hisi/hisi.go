@@ -0,0 +1,179 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package hisi implements the serial download protocol of the boot ROM of
+// HiSilicon Hi35xx SoCs, known as bootdownload.
+//
+// When the SPI flash holds no valid bootloader, and briefly after every
+// power-on, the boot ROM polls the serial console for a download. Files are
+// then written to memory with a sequence of framed transfers, each one
+// acknowledged by the ROM. This is how HiTool recovers boards, by loading a
+// DDR initialization table and u-boot, which then runs from memory.
+package hisi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Bytes exchanged with the boot ROM.
+const (
+	bootPoll = 0x20 // sent repeatedly by the ROM waiting for a download
+	ack      = 0xaa // sent to enter download mode and to acknowledge frames
+)
+
+// Kinds of frames sent to the boot ROM.
+const (
+	frameHead = 0xfe
+	frameData = 0xda
+	frameTail = 0xed
+)
+
+// minPolls is the number of consecutive polls identifying the boot ROM.
+//
+// Polls are spaces, the ROM is not mistaken for text printed by a
+// bootloader, which seldom contains that many spaces in a row.
+const minPolls = 5
+
+// maxChunk is the largest amount of data sent in a single frame.
+const maxChunk = 1024
+
+// ErrNotAcknowledged is returned when the boot ROM rejects a frame too many
+// times.
+var ErrNotAcknowledged = errors.New("frame not acknowledged by boot ROM")
+
+// Device is the boot ROM of a HiSilicon SoC waiting for a serial download.
+type Device struct {
+	port       io.ReadWriter
+	retryCount int
+}
+
+// New returns a device talking over the given serial port.
+//
+// The port should time out reads, so that a silent ROM is detected.
+func New(port io.ReadWriter) *Device {
+	return &Device{port: port, retryCount: 10}
+}
+
+// WithRetryCount sets the number of times a rejected frame is sent again.
+func (dev *Device) WithRetryCount(retryCount int) *Device {
+	dev.retryCount = retryCount
+	return dev
+}
+
+// WaitForBootMode waits for the boot ROM to poll for a download and enters
+// download mode.
+//
+// The ROM polls only briefly after power-on unless the SPI flash is blank,
+// the board should be reset right before.
+func (dev *Device) WaitForBootMode() error {
+	for polls := 0; polls < minPolls; {
+		b, err := dev.readByte()
+		if err != nil {
+			return fmt.Errorf("cannot find boot ROM: %w", err)
+		}
+		if b == bootPoll {
+			polls++
+		} else {
+			polls = 0
+		}
+	}
+	_, err := dev.port.Write([]byte{ack})
+	return err
+}
+
+// WriteMemory writes data to memory at the given address.
+//
+// The boot ROM decides what to do with the data depending on the address and
+// the SoC, such as applying a DDR initialization table or running u-boot.
+// Progress, if not nil, is called with the number of bytes written so far.
+func (dev *Device) WriteMemory(addr uint32, data []byte, progress func(done int)) error {
+	head := []byte{frameHead, 0x00, 0xff, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(head[4:], uint32(len(data)))
+	binary.BigEndian.PutUint32(head[8:], addr)
+	if err := dev.sendFrame(head); err != nil {
+		return fmt.Errorf("cannot start writing memory at %#x: %w", addr, err)
+	}
+	seq := byte(1)
+	for done := 0; done < len(data); {
+		n := len(data) - done
+		if n > maxChunk {
+			n = maxChunk
+		}
+		frame := append([]byte{frameData, seq, ^seq}, data[done:done+n]...)
+		if err := dev.sendFrame(frame); err != nil {
+			return fmt.Errorf("cannot write memory at %#x: %w", addr+uint32(done), err)
+		}
+		seq++
+		done += n
+		if progress != nil {
+			progress(done)
+		}
+	}
+	if err := dev.sendFrame([]byte{frameTail, seq, ^seq}); err != nil {
+		return fmt.Errorf("cannot finish writing memory at %#x: %w", addr, err)
+	}
+	return nil
+}
+
+// sendFrame sends a frame, followed by its CRC, until the ROM acknowledges it.
+func (dev *Device) sendFrame(frame []byte) error {
+	crc := crc16(frame)
+	frame = append(frame, byte(crc>>8), byte(crc))
+	for attempt := 0; attempt <= dev.retryCount; attempt++ {
+		if _, err := dev.port.Write(frame); err != nil {
+			return err
+		}
+		b, err := dev.readByte()
+		// Polls sent before the ROM entered download mode may be buffered.
+		for err == nil && b == bootPoll {
+			b, err = dev.readByte()
+		}
+		if err != nil {
+			return err
+		}
+		if b == ack {
+			return nil
+		}
+	}
+	return ErrNotAcknowledged
+}
+
+func (dev *Device) readByte() (byte, error) {
+	var buf [1]byte
+	if _, err := io.ReadFull(dev.port, buf[:]); err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+// crc16 computes CRC-16/XMODEM of the data.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package power
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Linux GPIO character device interface, version 1.
+const (
+	gpioHandlesMax          = 64
+	gpioHandleRequestOutput = 1 << 1
+	gpioHandleRequestLow    = 1 << 2
+	gpioGetLineHandleIoctl  = 3<<30 | uintptr(unsafe.Sizeof(gpioHandleRequest{}))<<16 | 0xb4<<8 | 0x03
+	gpioSetLineValuesIoctl  = 3<<30 | uintptr(unsafe.Sizeof(gpioHandleData{}))<<16 | 0xb4<<8 | 0x09
+)
+
+type gpioHandleRequest struct {
+	lineOffsets   [gpioHandlesMax]uint32
+	flags         uint32
+	defaultValues [gpioHandlesMax]uint8
+	consumerLabel [32]byte
+	lines         uint32
+	fd            int32
+}
+
+type gpioHandleData struct {
+	values [gpioHandlesMax]uint8
+}
+
+// GPIO controls power of the board with a GPIO line of the host.
+//
+// The line drives a relay or a transistor switching power of the board. The
+// line is active, that is high or low depending on the active level, when
+// the board is powered.
+type GPIO struct {
+	chip      *os.File
+	line      uint32
+	activeLow bool
+	handle    *os.File
+}
+
+// OpenGPIO opens the given line of a GPIO chip, such as "gpiochip0".
+//
+// The line is not claimed until power is switched for the first time, so
+// opening does not change the state of the board.
+func OpenGPIO(chipName string, line int, activeLow bool) (*GPIO, error) {
+	if line < 0 {
+		return nil, fmt.Errorf("invalid GPIO line %d", line)
+	}
+	if filepath.Base(chipName) == chipName {
+		chipName = filepath.Join("/dev", chipName)
+	}
+	chip, err := os.Open(chipName)
+	if err != nil {
+		return nil, err
+	}
+	return &GPIO{chip: chip, line: uint32(line), activeLow: activeLow}, nil
+}
+
+// PowerOn activates the GPIO line.
+func (gpio *GPIO) PowerOn() error {
+	return gpio.set(true)
+}
+
+// PowerOff deactivates the GPIO line.
+func (gpio *GPIO) PowerOff() error {
+	return gpio.set(false)
+}
+
+// Cycle deactivates the GPIO line, waits for a moment and activates it again.
+func (gpio *GPIO) Cycle() error {
+	if err := gpio.PowerOff(); err != nil {
+		return err
+	}
+	time.Sleep(cycleDelay)
+	return gpio.PowerOn()
+}
+
+// Close releases the GPIO line and closes the chip.
+//
+// The line usually keeps the last value, but this depends on the GPIO driver.
+func (gpio *GPIO) Close() error {
+	if gpio.handle != nil {
+		gpio.handle.Close()
+	}
+	return gpio.chip.Close()
+}
+
+func (gpio *GPIO) set(active bool) error {
+	var value uint8
+	if active {
+		value = 1
+	}
+	if gpio.handle == nil {
+		// Claim the line as an output, with the requested initial value.
+		req := gpioHandleRequest{flags: gpioHandleRequestOutput, lines: 1}
+		req.lineOffsets[0] = gpio.line
+		req.defaultValues[0] = value
+		if gpio.activeLow {
+			req.flags |= gpioHandleRequestLow
+		}
+		copy(req.consumerLabel[:], "oh-flash")
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, gpio.chip.Fd(), gpioGetLineHandleIoctl, uintptr(unsafe.Pointer(&req))); errno != 0 {
+			return fmt.Errorf("cannot request GPIO line %d: %w", gpio.line, errno)
+		}
+		gpio.handle = os.NewFile(uintptr(req.fd), fmt.Sprintf("%s:%d", gpio.chip.Name(), gpio.line))
+		return nil
+	}
+	var data gpioHandleData
+	data.values[0] = value
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, gpio.handle.Fd(), gpioSetLineValuesIoctl, uintptr(unsafe.Pointer(&data))); errno != 0 {
+		return fmt.Errorf("cannot set GPIO line %d: %w", gpio.line, errno)
+	}
+	return nil
+}
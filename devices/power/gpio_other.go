@@ -0,0 +1,54 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package power
+
+import (
+	"errors"
+)
+
+// GPIO controls power of the board with a GPIO line of the host.
+//
+// GPIO lines are only supported on Linux.
+type GPIO struct{}
+
+// OpenGPIO returns an error on this platform.
+func OpenGPIO(chipName string, line int, activeLow bool) (*GPIO, error) {
+	return nil, errors.New("GPIO lines are only supported on Linux")
+}
+
+// PowerOn does nothing.
+func (gpio *GPIO) PowerOn() error {
+	return nil
+}
+
+// PowerOff does nothing.
+func (gpio *GPIO) PowerOff() error {
+	return nil
+}
+
+// Cycle does nothing.
+func (gpio *GPIO) Cycle() error {
+	return nil
+}
+
+// Close does nothing.
+func (gpio *GPIO) Close() error {
+	return nil
+}
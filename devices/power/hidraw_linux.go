@@ -0,0 +1,90 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package power
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// hidDevice is a HID device opened through the Linux hidraw interface.
+type hidDevice struct {
+	file *os.File
+}
+
+// openHIDDevice opens the only hidraw device with the given USB identifiers.
+func openHIDDevice(vendor, product uint16) (*hidDevice, error) {
+	sysDirs, err := filepath.Glob("/sys/class/hidraw/hidraw*")
+	if err != nil {
+		return nil, err
+	}
+	hidID := fmt.Sprintf("HID_ID=0003:%08X:%08X", vendor, product)
+	names := make([]string, 0, 1)
+	for _, sysDir := range sysDirs {
+		uevent, err := ioutil.ReadFile(filepath.Join(sysDir, "device", "uevent"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(uevent), "\n") {
+			if strings.EqualFold(line, hidID) {
+				names = append(names, filepath.Join("/dev", filepath.Base(sysDir)))
+			}
+		}
+	}
+	if len(names) != 1 {
+		return nil, fmt.Errorf("cannot find HID device %04x:%04x, found %d candidates", vendor, product, len(names))
+	}
+	file, err := os.OpenFile(names[0], os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &hidDevice{file: file}, nil
+}
+
+// SetFeature sends a feature report to the device.
+//
+// The first byte of the report is the report number.
+func (dev *hidDevice) SetFeature(report []byte) error {
+	// HIDIOCSFEATURE(len) is _IOC(_IOC_WRITE|_IOC_READ, 'H', 0x06, len),
+	// computed in uintptr as the direction bits overflow int on 32-bit hosts.
+	req := uintptr(3)<<30 | uintptr(len(report))<<16 | uintptr('H')<<8 | 0x06
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.file.Fd(), req, uintptr(unsafe.Pointer(&report[0])))
+	if errno != 0 {
+		return fmt.Errorf("cannot set HID feature report: %w", errno)
+	}
+	return nil
+}
+
+// Write sends an output report to the device.
+//
+// The first byte of the report is the report number.
+func (dev *hidDevice) Write(report []byte) (int, error) {
+	return dev.file.Write(report)
+}
+
+// Close closes the device.
+func (dev *hidDevice) Close() error {
+	return dev.file.Close()
+}
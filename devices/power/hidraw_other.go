@@ -0,0 +1,44 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package power
+
+import (
+	"errors"
+)
+
+var errNoHID = errors.New("HID devices are only supported on Linux")
+
+type hidDevice struct{}
+
+func openHIDDevice(vendor, product uint16) (*hidDevice, error) {
+	return nil, errNoHID
+}
+
+func (dev *hidDevice) SetFeature(report []byte) error {
+	return errNoHID
+}
+
+func (dev *hidDevice) Write(report []byte) (int, error) {
+	return 0, errNoHID
+}
+
+func (dev *hidDevice) Close() error {
+	return nil
+}
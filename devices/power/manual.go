@@ -0,0 +1,75 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package power
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/zyga/oh-flash-tools/logging"
+)
+
+// Manual asks the user to control power of the board.
+//
+// Requests are sent to the logger and confirmations, ending with a newline,
+// are read from the input. The zero value discards the requests and does
+// not wait for confirmations.
+type Manual struct {
+	log   logging.Logger
+	input *bufio.Reader
+}
+
+// NewManual returns a controller asking the user for help through the given
+// logger and reading confirmations from the given input, such as os.Stdin.
+func NewManual(log logging.Logger, input io.Reader) *Manual {
+	return &Manual{log: log, input: bufio.NewReader(input)}
+}
+
+// PowerOn asks the user to power the board on.
+//
+// The request does not wait for confirmation, as the board starts booting
+// right away and its console needs attention.
+func (m *Manual) PowerOn() error {
+	logging.OrDiscard(m.log).Printf("NOTE: power the board on manually now\n")
+	return nil
+}
+
+// PowerOff asks the user to power the board off and waits for confirmation.
+func (m *Manual) PowerOff() error {
+	logging.OrDiscard(m.log).Printf("NOTE: power the board off manually and press Enter\n")
+	if m.input == nil {
+		return nil
+	}
+	if _, err := m.input.ReadString('\n'); err != nil {
+		return fmt.Errorf("cannot read confirmation: %w", err)
+	}
+	return nil
+}
+
+// Cycle asks the user to power-cycle the board.
+//
+// Just like PowerOn, the request does not wait for confirmation.
+func (m *Manual) Cycle() error {
+	logging.OrDiscard(m.log).Printf("NOTE: power-cycle the board manually now\n")
+	return nil
+}
+
+// Close does nothing.
+func (*Manual) Close() error {
+	return nil
+}
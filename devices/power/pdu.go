@@ -0,0 +1,270 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package power
+
+import (
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenPDU opens a networked power distribution unit described by an URL.
+//
+// URLs of the form snmp://community@host[:port] select SNMP control with
+// APC-compatible object identifiers. URLs with the http or https scheme are
+// treated as templates, see HTTPOutlet for details.
+func OpenPDU(address string, outlet int) (Controller, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse PDU address: %w", err)
+	}
+	switch u.Scheme {
+	case "snmp":
+		community := "private"
+		if u.User != nil {
+			community = u.User.Username()
+		}
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "161")
+		}
+		return OpenSNMPOutlet(host, community, outlet)
+	case "http", "https":
+		return &HTTPOutlet{URLTemplate: address, Outlet: outlet}, nil
+	default:
+		return nil, fmt.Errorf("unsupported PDU address scheme: %q", u.Scheme)
+	}
+}
+
+// APC rPDUOutletControlOutletCommand and its values.
+var apcOutletCommand = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 318, 1, 1, 12, 3, 3, 1, 1, 4}
+
+const (
+	apcImmediateOn  = 1
+	apcImmediateOff = 2
+)
+
+// SNMPOutlet controls an outlet of a networked PDU with SNMPv1 set requests.
+type SNMPOutlet struct {
+	conn      net.Conn
+	community string
+	outlet    int
+
+	// OID is the object identifier of the outlet table, without the outlet
+	// number. Defaults to rPDUOutletControlOutletCommand used by APC.
+	OID asn1.ObjectIdentifier
+	// OnValue and OffValue are the integers that are set to change the state
+	// of the outlet.
+	OnValue, OffValue int
+}
+
+// OpenSNMPOutlet returns an outlet of the PDU at the given UDP address.
+func OpenSNMPOutlet(address, community string, outlet int) (*SNMPOutlet, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &SNMPOutlet{
+		conn:      conn,
+		community: community,
+		outlet:    outlet,
+		OID:       apcOutletCommand,
+		OnValue:   apcImmediateOn,
+		OffValue:  apcImmediateOff,
+	}, nil
+}
+
+// PowerOn switches the outlet on.
+func (pdu *SNMPOutlet) PowerOn() error {
+	return pdu.set(pdu.OnValue)
+}
+
+// PowerOff switches the outlet off.
+func (pdu *SNMPOutlet) PowerOff() error {
+	return pdu.set(pdu.OffValue)
+}
+
+// Cycle switches the outlet off, waits for a moment and switches it on again.
+func (pdu *SNMPOutlet) Cycle() error {
+	if err := pdu.PowerOff(); err != nil {
+		return err
+	}
+	time.Sleep(cycleDelay)
+	return pdu.PowerOn()
+}
+
+// Close closes the UDP socket.
+func (pdu *SNMPOutlet) Close() error {
+	return pdu.conn.Close()
+}
+
+type snmpMessage struct {
+	Version   int
+	Community []byte
+	Data      asn1.RawValue
+}
+
+func (pdu *SNMPOutlet) set(value int) error {
+	var idBuf [4]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		return err
+	}
+	requestID := int(binary.BigEndian.Uint32(idBuf[:]) >> 1)
+	request, err := snmpSetRequest(pdu.community, requestID, append(append(asn1.ObjectIdentifier{}, pdu.OID...), pdu.outlet), value)
+	if err != nil {
+		return err
+	}
+	// SNMP runs over UDP, retransmit a few times before giving up.
+	const attempts = 3
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if _, err := pdu.conn.Write(request); err != nil {
+			return err
+		}
+		if err := pdu.conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			return err
+		}
+		var buf [1500]byte
+		n, err := pdu.conn.Read(buf[:])
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return checkSNMPResponse(buf[:n], requestID)
+	}
+	return fmt.Errorf("cannot set PDU outlet %d: %w", pdu.outlet, lastErr)
+}
+
+// snmpSetRequest encodes SNMPv1 SetRequest-PDU with a single integer binding.
+func snmpSetRequest(community string, requestID int, oid asn1.ObjectIdentifier, value int) ([]byte, error) {
+	name, err := asn1.Marshal(oid)
+	if err != nil {
+		return nil, err
+	}
+	val, err := asn1.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	binding, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: append(name, val...)})
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: binding})
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	for _, n := range []int{requestID, 0, 0} { // request-id, error-status, error-index
+		b, err := asn1.Marshal(n)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, b...)
+	}
+	body = append(body, bindings...)
+	const setRequestTag = 3
+	return asn1.Marshal(snmpMessage{
+		Version:   0, // SNMPv1
+		Community: []byte(community),
+		Data:      asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: setRequestTag, IsCompound: true, Bytes: body},
+	})
+}
+
+// checkSNMPResponse checks that GetResponse-PDU reports success.
+func checkSNMPResponse(response []byte, requestID int) error {
+	const getResponseTag = 2
+	var msg snmpMessage
+	if _, err := asn1.Unmarshal(response, &msg); err != nil {
+		return fmt.Errorf("cannot parse SNMP response: %w", err)
+	}
+	if msg.Data.Class != asn1.ClassContextSpecific || msg.Data.Tag != getResponseTag {
+		return fmt.Errorf("unexpected SNMP response type %d", msg.Data.Tag)
+	}
+	var id, errorStatus int
+	rest, err := asn1.Unmarshal(msg.Data.Bytes, &id)
+	if err != nil {
+		return fmt.Errorf("cannot parse SNMP response: %w", err)
+	}
+	if _, err := asn1.Unmarshal(rest, &errorStatus); err != nil {
+		return fmt.Errorf("cannot parse SNMP response: %w", err)
+	}
+	if id != requestID {
+		return fmt.Errorf("unexpected SNMP response to request %d", id)
+	}
+	if errorStatus != 0 {
+		return fmt.Errorf("SNMP set request failed with error status %d", errorStatus)
+	}
+	return nil
+}
+
+// HTTPOutlet controls an outlet of a networked PDU with HTTP requests.
+//
+// The URL template may contain the placeholders {outlet} and {state}, which
+// are replaced with the outlet number and with "on" or "off" respectively.
+// Credentials embedded in the URL are used for basic authentication.
+type HTTPOutlet struct {
+	URLTemplate string
+	Outlet      int
+}
+
+// PowerOn switches the outlet on.
+func (pdu *HTTPOutlet) PowerOn() error {
+	return pdu.get("on")
+}
+
+// PowerOff switches the outlet off.
+func (pdu *HTTPOutlet) PowerOff() error {
+	return pdu.get("off")
+}
+
+// Cycle switches the outlet off, waits for a moment and switches it on again.
+func (pdu *HTTPOutlet) Cycle() error {
+	if err := pdu.PowerOff(); err != nil {
+		return err
+	}
+	time.Sleep(cycleDelay)
+	return pdu.PowerOn()
+}
+
+// Close does nothing.
+func (pdu *HTTPOutlet) Close() error {
+	return nil
+}
+
+func (pdu *HTTPOutlet) get(state string) error {
+	replacer := strings.NewReplacer("{outlet}", strconv.Itoa(pdu.Outlet), "{state}", state)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(replacer.Replace(pdu.URLTemplate))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("cannot switch PDU outlet %d %s: %s", pdu.Outlet, state, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package power contains utilities for controlling power supply of boards.
+package power
+
+import (
+	"io"
+	"time"
+)
+
+// cycleDelay is the time the board is kept without power during a power cycle.
+const cycleDelay = time.Second
+
+// Controller controls power supply of a single board.
+type Controller interface {
+	// PowerOn enables power supply of the board.
+	PowerOn() error
+	// PowerOff disables power supply of the board.
+	PowerOff() error
+	// Cycle disables and then re-enables power supply of the board.
+	Cycle() error
+	io.Closer
+}
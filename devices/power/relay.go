@@ -0,0 +1,84 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package power
+
+import (
+	"time"
+)
+
+// USB relay boards sold as "USBRelay1", "USBRelay2", etc.
+const (
+	usbRelayVendor  = 0x16c0
+	usbRelayProduct = 0x05df
+)
+
+// USBRelay controls power of the board with a channel of an USB HID relay board.
+//
+// The board power supply should be wired through the normally open contacts
+// of the relay, so that energizing the relay powers the board on.
+type USBRelay struct {
+	dev     *hidDevice
+	channel int
+}
+
+// OpenUSBRelay opens the only USB relay board attached to the system.
+//
+// Channels are numbered starting with one.
+func OpenUSBRelay(channel int) (*USBRelay, error) {
+	dev, err := openHIDDevice(usbRelayVendor, usbRelayProduct)
+	if err != nil {
+		return nil, err
+	}
+	return &USBRelay{dev: dev, channel: channel}, nil
+}
+
+// PowerOn energizes the relay.
+func (relay *USBRelay) PowerOn() error {
+	return relay.set(true)
+}
+
+// PowerOff de-energizes the relay.
+func (relay *USBRelay) PowerOff() error {
+	return relay.set(false)
+}
+
+// Cycle de-energizes the relay, waits for a moment and energizes it again.
+func (relay *USBRelay) Cycle() error {
+	if err := relay.PowerOff(); err != nil {
+		return err
+	}
+	time.Sleep(cycleDelay)
+	return relay.PowerOn()
+}
+
+// Close closes the HID device representing the relay board.
+func (relay *USBRelay) Close() error {
+	return relay.dev.Close()
+}
+
+func (relay *USBRelay) set(on bool) error {
+	// The feature report starts with the report number, which is always zero.
+	// The command byte is 0xff to energize and 0xfd to de-energize a channel.
+	report := make([]byte, 9)
+	if on {
+		report[1] = 0xff
+	} else {
+		report[1] = 0xfd
+	}
+	report[2] = byte(relay.channel)
+	return relay.dev.SetFeature(report)
+}
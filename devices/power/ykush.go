@@ -0,0 +1,83 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package power
+
+import (
+	"fmt"
+	"time"
+)
+
+// YKUSH hubs made by Yepkit.
+const (
+	ykushVendor  = 0x04d8
+	ykushProduct = 0xf2f7
+)
+
+// YKUSH controls power of the board connected to a port of a YKUSH hub.
+type YKUSH struct {
+	dev  *hidDevice
+	port int
+}
+
+// OpenYKUSH opens the only YKUSH hub attached to the system.
+//
+// Downstream ports are numbered starting with one.
+func OpenYKUSH(port int) (*YKUSH, error) {
+	if port < 1 || port > 3 {
+		return nil, fmt.Errorf("invalid YKUSH port %d", port)
+	}
+	dev, err := openHIDDevice(ykushVendor, ykushProduct)
+	if err != nil {
+		return nil, err
+	}
+	return &YKUSH{dev: dev, port: port}, nil
+}
+
+// PowerOn enables power of the downstream port.
+func (hub *YKUSH) PowerOn() error {
+	return hub.command(0x10 | byte(hub.port))
+}
+
+// PowerOff disables power of the downstream port.
+func (hub *YKUSH) PowerOff() error {
+	return hub.command(0x00 | byte(hub.port))
+}
+
+// Cycle disables power of the downstream port, waits and enables it again.
+func (hub *YKUSH) Cycle() error {
+	if err := hub.PowerOff(); err != nil {
+		return err
+	}
+	time.Sleep(cycleDelay)
+	return hub.PowerOn()
+}
+
+// Close closes the HID device representing the hub.
+func (hub *YKUSH) Close() error {
+	return hub.dev.Close()
+}
+
+func (hub *YKUSH) command(cmd byte) error {
+	// The output report starts with the report number, which is always zero,
+	// followed by 64 bytes of data. Older firmware expects the command byte
+	// to be repeated.
+	report := make([]byte, 65)
+	report[1] = cmd
+	report[2] = cmd
+	_, err := hub.dev.Write(report)
+	return err
+}
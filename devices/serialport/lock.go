@@ -0,0 +1,96 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package serialport
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.bug.st/serial.v1"
+)
+
+// BusyError is returned when another process holds the lock of a port.
+type BusyError struct {
+	Port string
+	PID  int // zero if not known
+}
+
+func (e *BusyError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("serial port %s is busy", e.Port)
+	}
+	return fmt.Sprintf("serial port %s is busy, held by PID %d", e.Port, e.PID)
+}
+
+// lockDir returns the directory holding locks of serial ports.
+//
+// The directory is shared by all the users, so that they do not fight over
+// the same port either.
+func lockDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), "oh-flash-locks")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	_ = os.Chmod(dir, 0777|os.ModeSticky)
+	return dir, nil
+}
+
+// lockPath returns the location of the lock of the given port.
+func lockPath(portName string) (string, error) {
+	dir, err := lockDir()
+	if err != nil {
+		return "", err
+	}
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.TrimPrefix(portName, "/dev/"))
+	return filepath.Join(dir, name+".lock"), nil
+}
+
+// readPID returns the process identifier stored in a lock, or zero.
+func readPID(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+// lockedPort is a serial port releasing its lock once closed.
+type lockedPort struct {
+	serial.Port
+	unlock func() error
+}
+
+func (p *lockedPort) Close() error {
+	err := p.Port.Close()
+	if p.unlock != nil {
+		if unlockErr := p.unlock(); err == nil {
+			err = unlockErr
+		}
+		p.unlock = nil
+	}
+	return err
+}
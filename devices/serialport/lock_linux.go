@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package serialport
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// lockPort takes the lock of the port, failing if another process holds it.
+//
+// The lock is an flock on a file holding the PID of the owner, which the
+// kernel releases even if the owner crashes.
+func lockPort(portName string) (unlock func() error, err error) {
+	path, err := lockPath(portName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot lock serial port %s: %w", portName, err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("cannot lock serial port %s: %w", portName, err)
+	}
+	// Other users must be able to open the lock despite the umask.
+	_ = f.Chmod(0666)
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, &BusyError{Port: portName, PID: readPID(path)}
+		}
+		return nil, fmt.Errorf("cannot lock serial port %s: %w", portName, err)
+	}
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f.Close, nil
+}
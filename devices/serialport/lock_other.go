@@ -0,0 +1,50 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package serialport
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// lockPort takes the lock of the port, failing if another process holds it.
+//
+// The lock is a directory, created atomically, holding the PID of the
+// owner. A process that crashes leaves the directory behind, the error
+// tells where it is.
+func lockPort(portName string) (unlock func() error, err error) {
+	path, err := lockPath(portName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot lock serial port %s: %w", portName, err)
+	}
+	pidPath := filepath.Join(path, "pid")
+	if err := os.Mkdir(path, 0777); err != nil {
+		if os.IsExist(err) {
+			busy := &BusyError{Port: portName, PID: readPID(pidPath)}
+			return nil, fmt.Errorf("%w (remove %s if that process is gone)", busy, path)
+		}
+		return nil, fmt.Errorf("cannot lock serial port %s: %w", portName, err)
+	}
+	_ = ioutil.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())+"\n"), 0666)
+	return func() error { return os.RemoveAll(path) }, nil
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package serialport
+
+// openHint explains the most common reason for failing to open a port.
+const openHint = " (is the user allowed to access the port?)"
+
+// NormalizePortName returns the port name unchanged.
+//
+// Ports are device nodes, such as /dev/ttyUSB0, and their names are case sensitive.
+func NormalizePortName(portName string) string {
+	return portName
+}
@@ -0,0 +1,38 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package serialport
+
+import "strings"
+
+// openHint explains the most common reason for failing to open a port.
+const openHint = " (is the port used by another program?)"
+
+// NormalizePortName returns the name of a COM port as listed by Windows.
+//
+// Names are not case sensitive, so "com3" is turned into "COM3". The device
+// namespace prefix, as in `\\.\COM10`, is removed as it is added when the
+// port is opened.
+func NormalizePortName(portName string) string {
+	portName = strings.TrimPrefix(portName, `\\.\`)
+	if strings.HasPrefix(strings.ToUpper(portName), "COM") {
+		portName = strings.ToUpper(portName)
+	}
+	return portName
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package serialport contains helpers for finding and opening serial ports
+// consistently on all the supported platforms.
+package serialport
+
+import (
+	"fmt"
+	"strings"
+
+	"go.bug.st/serial.v1"
+	"go.bug.st/serial.v1/enumerator"
+)
+
+// NormalizeUSBID returns the USB vendor or product ID in canonical form.
+//
+// Platforms differ in how the IDs are reported, Windows uses upper case
+// hexadecimal digits while Linux uses lower case. The canonical form has four
+// lower case digits, without the 0x prefix.
+func NormalizeUSBID(id string) string {
+	id = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(id)), "0x")
+	for len(id) < 4 {
+		id = "0" + id
+	}
+	return id
+}
+
+// MatchUSB returns true if the port is an USB device with the given IDs.
+func MatchUSB(portInfo *enumerator.PortDetails, vid, pid string) bool {
+	return portInfo.IsUSB && NormalizeUSBID(portInfo.VID) == NormalizeUSBID(vid) && NormalizeUSBID(portInfo.PID) == NormalizeUSBID(pid)
+}
+
+// USBID returns the canonical "vid:pid" pair of the port, or an empty string
+// if the port is not an USB device.
+func USBID(portInfo *enumerator.PortDetails) string {
+	if !portInfo.IsUSB {
+		return ""
+	}
+	return NormalizeUSBID(portInfo.VID) + ":" + NormalizeUSBID(portInfo.PID)
+}
+
+// Open opens the serial port with the given name.
+//
+// The name is normalized first, see NormalizePortName. If the port does not
+// exist, the error lists the ports that do.
+//
+// The port is locked until closed, so that two programs using the same port
+// do not corrupt each other's data. A port locked by another process is
+// reported with BusyError.
+func Open(portName string, mode *serial.Mode) (serial.Port, error) {
+	portName = NormalizePortName(portName)
+	// The list is only used for better error messages, proceed without it.
+	if names, err := serial.GetPortsList(); err == nil && len(names) > 0 && !contains(names, portName) {
+		return nil, fmt.Errorf("cannot open serial port %s: no such port, available ports: %s", portName, strings.Join(names, ", "))
+	}
+	unlock, err := lockPort(portName)
+	if err != nil {
+		return nil, err
+	}
+	port, err := serial.Open(portName, mode)
+	if err != nil {
+		unlock()
+		return nil, fmt.Errorf("cannot open serial port %s: %w%s", portName, err, openHint)
+	}
+	return &lockedPort{Port: port, unlock: unlock}, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
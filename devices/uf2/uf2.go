@@ -0,0 +1,196 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package uf2 converts firmware to the UF2 format and copies it to the USB
+// mass-storage volumes of UF2 bootloaders, such as the one in the ROM of the
+// Raspberry Pi RP2040.
+//
+// The bootloader exposes a small FAT volume with an INFO_UF2.TXT file. Any
+// UF2 file copied to the volume is written to flash, block by block, after
+// which the device resets and the volume disappears.
+package uf2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Magic numbers of UF2 blocks.
+const (
+	magicStart0 = 0x0a324655
+	magicStart1 = 0x9e5d5157
+	magicEnd    = 0x0ab16f30
+)
+
+// flagFamilyID tells that the block carries the family identifier.
+const flagFamilyID = 0x2000
+
+// Sizes of UF2 blocks and of the data in each block.
+const (
+	BlockSize   = 512
+	PayloadSize = 256
+)
+
+// Families maps names of chip families to their UF2 identifiers.
+var Families = map[string]uint32{
+	"rp2040":   0xe48bff56,
+	"samd21":   0x68ed2b88,
+	"samd51":   0x55114460,
+	"nrf52840": 0xada52840,
+	"stm32f4":  0x57755a57,
+	"esp32s2":  0xbfdd4eee,
+}
+
+// ParseFamily returns the identifier of a family given by name or number.
+func ParseFamily(family string) (uint32, error) {
+	if id, ok := Families[strings.ToLower(family)]; ok {
+		return id, nil
+	}
+	id, err := strconv.ParseUint(family, 0, 32)
+	if err != nil {
+		names := make([]string, 0, len(Families))
+		for name := range Families {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("unknown UF2 family %q, use a number or one of: %s", family, strings.Join(names, ", "))
+	}
+	return uint32(id), nil
+}
+
+// IsUF2 returns true if the data starts with a UF2 block.
+func IsUF2(data []byte) bool {
+	return len(data) >= BlockSize &&
+		binary.LittleEndian.Uint32(data[0:]) == magicStart0 &&
+		binary.LittleEndian.Uint32(data[4:]) == magicStart1 &&
+		binary.LittleEndian.Uint32(data[BlockSize-4:]) == magicEnd
+}
+
+// Convert converts a binary image, to be written at the given address, to UF2
+// blocks of the given family.
+func Convert(data []byte, addr, family uint32) []byte {
+	numBlocks := (len(data) + PayloadSize - 1) / PayloadSize
+	out := make([]byte, numBlocks*BlockSize)
+	for i := 0; i < numBlocks; i++ {
+		block := out[i*BlockSize : (i+1)*BlockSize]
+		binary.LittleEndian.PutUint32(block[0:], magicStart0)
+		binary.LittleEndian.PutUint32(block[4:], magicStart1)
+		binary.LittleEndian.PutUint32(block[8:], flagFamilyID)
+		binary.LittleEndian.PutUint32(block[12:], addr+uint32(i*PayloadSize))
+		binary.LittleEndian.PutUint32(block[16:], PayloadSize)
+		binary.LittleEndian.PutUint32(block[20:], uint32(i))
+		binary.LittleEndian.PutUint32(block[24:], uint32(numBlocks))
+		binary.LittleEndian.PutUint32(block[28:], family)
+		// The rest of the last payload is left zeroed.
+		copy(block[32:32+PayloadSize], data[i*PayloadSize:])
+		binary.LittleEndian.PutUint32(block[BlockSize-4:], magicEnd)
+	}
+	return out
+}
+
+// infoFile is the file identifying volumes of UF2 bootloaders.
+const infoFile = "INFO_UF2.TXT"
+
+// Volume is a mounted volume of a UF2 bootloader.
+type Volume struct {
+	Path string
+	// Info holds the fields of INFO_UF2.TXT, such as Model and Board-ID.
+	Info map[string]string
+}
+
+// readVolume returns the volume at the given path, if it has INFO_UF2.TXT.
+func readVolume(path string) (Volume, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(path, infoFile))
+	if err != nil {
+		return Volume{}, false
+	}
+	vol := Volume{Path: path, Info: make(map[string]string)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, ':'); idx > 0 {
+			vol.Info[strings.TrimSpace(line[:idx])] = strings.TrimSpace(line[idx+1:])
+		}
+	}
+	return vol, true
+}
+
+// FindVolumes returns the mounted volumes of UF2 bootloaders.
+func FindVolumes() ([]Volume, error) {
+	paths, err := mountPoints()
+	if err != nil {
+		return nil, err
+	}
+	var vols []Volume
+	for _, path := range paths {
+		if vol, ok := readVolume(path); ok {
+			vols = append(vols, vol)
+		}
+	}
+	return vols, nil
+}
+
+// OpenVolume returns the volume at the given path.
+func OpenVolume(path string) (Volume, error) {
+	vol, ok := readVolume(path)
+	if !ok {
+		return Volume{}, fmt.Errorf("%s is not a UF2 bootloader volume, %s not found", path, infoFile)
+	}
+	return vol, nil
+}
+
+// Write copies UF2 data to the volume, which makes the bootloader flash it.
+//
+// The data is synced to the device before returning. The progress function,
+// if not nil, is called with the number of bytes written so far.
+func (vol Volume) Write(data []byte, progress func(done int)) error {
+	if !IsUF2(data) {
+		return fmt.Errorf("cannot write data to %s, not in UF2 format", vol.Path)
+	}
+	f, err := os.Create(filepath.Join(vol.Path, "FIRMWARE.UF2"))
+	if err != nil {
+		return err
+	}
+	// Writing whole blocks lets the bootloader flash them as they arrive.
+	const chunk = 64 * BlockSize
+	for done := 0; done < len(data); {
+		n := len(data) - done
+		if n > chunk {
+			n = chunk
+		}
+		if _, err := f.Write(data[done : done+n]); err != nil {
+			f.Close()
+			return err
+		}
+		done += n
+		if progress != nil {
+			progress(done)
+		}
+	}
+	// The device may reset as soon as the last block arrives, failing to sync
+	// or close the file once flashing is already done.
+	f.Sync()
+	f.Close()
+	return nil
+}
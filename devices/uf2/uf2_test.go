@@ -0,0 +1,156 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package uf2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	data := make([]byte, PayloadSize+44)
+	for i := range data {
+		data[i] = byte(i) | 1
+	}
+	out := Convert(data, 0x10000000, Families["rp2040"])
+	if len(out) != 2*BlockSize {
+		t.Fatalf("unexpected size of converted data: %d", len(out))
+	}
+	for i, tc := range []struct {
+		addr    uint32
+		payload []byte
+	}{
+		{0x10000000, data[:PayloadSize]},
+		{0x10000100, data[PayloadSize:]},
+	} {
+		block := out[i*BlockSize : (i+1)*BlockSize]
+		for _, field := range []struct {
+			name     string
+			offset   int
+			expected uint32
+		}{
+			{"first magic", 0, 0x0a324655},
+			{"second magic", 4, 0x9e5d5157},
+			{"flags", 8, 0x2000},
+			{"target address", 12, tc.addr},
+			{"payload size", 16, PayloadSize},
+			{"block number", 20, uint32(i)},
+			{"number of blocks", 24, 2},
+			{"family", 28, 0xe48bff56},
+			{"final magic", 508, 0x0ab16f30},
+		} {
+			if value := binary.LittleEndian.Uint32(block[field.offset:]); value != field.expected {
+				t.Fatalf("unexpected %s of block %d: %#x, expected %#x", field.name, i, value, field.expected)
+			}
+		}
+		// The data field of 476 bytes holds the payload, padded with zeros.
+		dataField := block[32 : BlockSize-4]
+		if len(dataField) != 476 {
+			t.Fatalf("unexpected size of data field: %d", len(dataField))
+		}
+		expected := make([]byte, 476)
+		copy(expected, tc.payload)
+		if !bytes.Equal(dataField, expected) {
+			t.Fatalf("unexpected data field of block %d: %x", i, dataField)
+		}
+	}
+	if !IsUF2(out) {
+		t.Fatalf("converted data not recognized as UF2")
+	}
+}
+
+func TestIsUF2(t *testing.T) {
+	block := Convert([]byte{1, 2, 3}, 0, 0)
+	corrupt := func(offset int) []byte {
+		b := append([]byte(nil), block...)
+		b[offset] ^= 0xff
+		return b
+	}
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		expected bool
+	}{
+		{"block", block, true},
+		{"short block", block[:BlockSize-1], false},
+		{"bad first magic", corrupt(0), false},
+		{"bad second magic", corrupt(4), false},
+		{"bad final magic", corrupt(BlockSize - 1), false},
+		{"binary", make([]byte, BlockSize), false},
+	} {
+		if IsUF2(tc.data) != tc.expected {
+			t.Fatalf("%s: expected IsUF2 to return %v", tc.name, tc.expected)
+		}
+	}
+}
+
+func TestParseFamily(t *testing.T) {
+	for _, tc := range []struct {
+		family   string
+		expected uint32
+		ok       bool
+	}{
+		{"rp2040", 0xe48bff56, true},
+		{"RP2040", 0xe48bff56, true},
+		{"0x57755a57", 0x57755a57, true},
+		{"1234", 1234, true},
+		{"0x100000000", 0, false},
+		{"esp8266", 0, false},
+	} {
+		id, err := ParseFamily(tc.family)
+		if (err == nil) != tc.ok || id != tc.expected {
+			t.Fatalf("unexpected family %q: %#x, %v", tc.family, id, err)
+		}
+	}
+}
+
+func TestOpenVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uf2")
+	if err != nil {
+		t.Fatalf("cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := OpenVolume(dir); err == nil {
+		t.Fatalf("expected volume without %s to be rejected", infoFile)
+	}
+	info := "UF2 Bootloader v3.0\r\nModel: Raspberry Pi RP2\r\nBoard-ID: RPI-RP2\r\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, infoFile), []byte(info), 0644); err != nil {
+		t.Fatalf("cannot write file: %v", err)
+	}
+	vol, err := OpenVolume(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(vol.Info) != 2 || vol.Info["Model"] != "Raspberry Pi RP2" || vol.Info["Board-ID"] != "RPI-RP2" {
+		t.Fatalf("unexpected volume information %q", vol.Info)
+	}
+	uf2 := Convert(make([]byte, 1000), 0x10000000, Families["rp2040"])
+	if err := vol.Write(uf2, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	written, err := ioutil.ReadFile(filepath.Join(dir, "FIRMWARE.UF2"))
+	if err != nil || !bytes.Equal(written, uf2) {
+		t.Fatalf("unexpected firmware written: %v", err)
+	}
+	if err := vol.Write(make([]byte, BlockSize), nil); err == nil {
+		t.Fatalf("expected data not in UF2 format to be rejected")
+	}
+}
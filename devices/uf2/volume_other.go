@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package uf2
+
+import (
+	"path/filepath"
+	"runtime"
+)
+
+// mountPoints returns places where removable volumes are mounted, the
+// volumes in /Volumes on macOS and drive letters on Windows.
+func mountPoints() ([]string, error) {
+	if runtime.GOOS == "windows" {
+		var paths []string
+		for letter := 'D'; letter <= 'Z'; letter++ {
+			paths = append(paths, string(letter)+`:\`)
+		}
+		return paths, nil
+	}
+	return filepath.Glob("/Volumes/*")
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package usb gives direct access to USB devices without kernel drivers,
+// such as boot ROMs and bootloaders waiting for commands.
+package usb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Request types of control transfers.
+const (
+	RequestIn        = 0x80 // device to host, the default is host to device
+	RequestClass     = 0x20
+	RequestInterface = 0x01
+)
+
+// ParseID parses USB identifiers given as vendor:product in hex, such as "0483:df11".
+func ParseID(id string) (vendor, product uint16, err error) {
+	idx := strings.IndexByte(id, ':')
+	if idx < 0 {
+		return 0, 0, fmt.Errorf("invalid USB identifier %q, expected vendor:product", id)
+	}
+	v, err1 := strconv.ParseUint(id[:idx], 16, 16)
+	p, err2 := strconv.ParseUint(id[idx+1:], 16, 16)
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("invalid USB identifier %q, expected vendor:product", id)
+	}
+	return uint16(v), uint16(p), nil
+}
+
+// Interface describes an alternate setting of an interface of a device.
+type Interface struct {
+	Number     int
+	AltSetting int
+	Class      uint8
+	SubClass   uint8
+	Protocol   uint8
+	NameIndex  uint8    // index of the string descriptor naming the setting
+	Endpoints  []uint8  // addresses of the endpoints
+	Extra      [][]byte // class specific descriptors following the interface
+}
+
+// Descriptor types.
+const (
+	descriptorInterface = 4
+	descriptorEndpoint  = 5
+)
+
+// parseInterfaces returns the interfaces found in the descriptors of a device.
+func parseInterfaces(desc []byte) []Interface {
+	var ifaces []Interface
+	for len(desc) >= 2 {
+		length := int(desc[0])
+		if length < 2 || length > len(desc) {
+			break
+		}
+		d := desc[:length]
+		desc = desc[length:]
+		switch {
+		case d[1] == descriptorInterface && length >= 9:
+			ifaces = append(ifaces, Interface{
+				Number:     int(d[2]),
+				AltSetting: int(d[3]),
+				Class:      d[5],
+				SubClass:   d[6],
+				Protocol:   d[7],
+				NameIndex:  d[8],
+			})
+		case d[1] == descriptorEndpoint && length >= 7:
+			if len(ifaces) > 0 {
+				last := &ifaces[len(ifaces)-1]
+				last.Endpoints = append(last.Endpoints, d[2])
+			}
+		case len(ifaces) > 0 && d[1] != descriptorEndpoint:
+			last := &ifaces[len(ifaces)-1]
+			last.Extra = append(last.Extra, d)
+		}
+	}
+	return ifaces
+}
+
+// Interfaces returns the interfaces of the active configuration.
+func (dev *Device) Interfaces() []Interface {
+	return parseInterfaces(dev.descriptors)
+}
+
+// String returns the string descriptor with the given index.
+func (dev *Device) String(index uint8) (string, error) {
+	if index == 0 {
+		return "", nil
+	}
+	buf := make([]byte, 255)
+	// GET_DESCRIPTOR of a string in US English.
+	n, err := dev.Control(RequestIn, 6, 0x0300|uint16(index), 0x0409, buf)
+	if err != nil {
+		return "", fmt.Errorf("cannot read USB string descriptor %d: %w", index, err)
+	}
+	if n < 2 || int(buf[0]) > n {
+		return "", fmt.Errorf("invalid USB string descriptor %d", index)
+	}
+	units := make([]uint16, 0, (int(buf[0])-2)/2)
+	for i := 2; i+1 < int(buf[0]); i += 2 {
+		units = append(units, uint16(buf[i])|uint16(buf[i+1])<<8)
+	}
+	return string(utf16.Decode(units)), nil
+}
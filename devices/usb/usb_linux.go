@@ -0,0 +1,212 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// defaultTimeout is the default timeout of transfers.
+const defaultTimeout = 10 * time.Second
+
+// Device is a USB device opened through the Linux usbfs interface.
+type Device struct {
+	file        *os.File
+	descriptors []byte
+	timeout     time.Duration
+}
+
+// Open opens the only device with the given USB identifiers.
+func Open(vendor, product uint16) (*Device, error) {
+	sysDirs, err := filepath.Glob("/sys/bus/usb/devices/*")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, 1)
+	for _, sysDir := range sysDirs {
+		if readNumber(filepath.Join(sysDir, "idVendor"), 16) != int64(vendor) || readNumber(filepath.Join(sysDir, "idProduct"), 16) != int64(product) {
+			continue
+		}
+		if name := deviceName(sysDir); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) != 1 {
+		return nil, fmt.Errorf("cannot find USB device %04x:%04x, found %d candidates", vendor, product, len(names))
+	}
+	return openName(names[0])
+}
+
+// OpenInterface opens the only device with an interface of the given class,
+// subclass and protocol.
+//
+// This finds devices speaking a protocol regardless of their vendor.
+func OpenInterface(class, subClass, protocol uint8) (*Device, error) {
+	// Interfaces are named after their device, as in 1-2:1.0 of device 1-2.
+	sysDirs, err := filepath.Glob("/sys/bus/usb/devices/*:*")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, 1)
+	for _, sysDir := range sysDirs {
+		if readNumber(filepath.Join(sysDir, "bInterfaceClass"), 16) != int64(class) ||
+			readNumber(filepath.Join(sysDir, "bInterfaceSubClass"), 16) != int64(subClass) ||
+			readNumber(filepath.Join(sysDir, "bInterfaceProtocol"), 16) != int64(protocol) {
+			continue
+		}
+		base := filepath.Base(sysDir)
+		if name := deviceName(filepath.Join(filepath.Dir(sysDir), base[:strings.IndexByte(base, ':')])); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) != 1 {
+		return nil, fmt.Errorf("cannot find USB device with interface %02x:%02x:%02x, found %d candidates", class, subClass, protocol, len(names))
+	}
+	return openName(names[0])
+}
+
+// deviceName returns the name of the usbfs device file of the device with
+// the given sysfs directory, or an empty string.
+func deviceName(sysDir string) string {
+	bus := readNumber(filepath.Join(sysDir, "busnum"), 10)
+	dev := readNumber(filepath.Join(sysDir, "devnum"), 10)
+	if bus < 0 || dev < 0 {
+		return ""
+	}
+	return fmt.Sprintf("/dev/bus/usb/%03d/%03d", bus, dev)
+}
+
+// openName opens the usbfs device file.
+func openName(name string) (*Device, error) {
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Reading the device file returns the device and configuration descriptors.
+	descriptors, err := ioutil.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Device{file: file, descriptors: descriptors, timeout: defaultTimeout}, nil
+}
+
+// WithTimeout returns the device with the given timeout of transfers.
+func (dev *Device) WithTimeout(timeout time.Duration) *Device {
+	dev.timeout = timeout
+	return dev
+}
+
+// readNumber reads a number from a sysfs file, returning -1 on failure.
+func readNumber(path string, base int) int64 {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(data)), base, 32)
+	if err != nil {
+		return -1
+	}
+	return value
+}
+
+func (dev *Device) ioctl(req uintptr, arg unsafe.Pointer) (int, error) {
+	n, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.file.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// ClaimInterface claims the interface for exclusive use.
+func (dev *Device) ClaimInterface(iface int) error {
+	n := uint32(iface)
+	// USBDEVFS_CLAIMINTERFACE is _IOR('U', 15, unsigned int)
+	if _, err := dev.ioctl(2<<30|4<<16|'U'<<8|15, unsafe.Pointer(&n)); err != nil {
+		return fmt.Errorf("cannot claim USB interface %d: %w", iface, err)
+	}
+	return nil
+}
+
+// SetAltSetting selects an alternate setting of a claimed interface.
+func (dev *Device) SetAltSetting(iface, alt int) error {
+	setting := struct{ iface, alt uint32 }{uint32(iface), uint32(alt)}
+	// USBDEVFS_SETINTERFACE is _IOR('U', 4, struct usbdevfs_setinterface)
+	if _, err := dev.ioctl(2<<30|8<<16|'U'<<8|4, unsafe.Pointer(&setting)); err != nil {
+		return fmt.Errorf("cannot select alternate setting %d of USB interface %d: %w", alt, iface, err)
+	}
+	return nil
+}
+
+// controlTransfer is struct usbdevfs_ctrltransfer.
+type controlTransfer struct {
+	requestType uint8
+	request     uint8
+	value       uint16
+	index       uint16
+	length      uint16
+	timeout     uint32
+	data        unsafe.Pointer
+}
+
+// Control performs a control transfer, returning the transferred length.
+//
+// The direction is given by RequestIn in the request type.
+func (dev *Device) Control(requestType, request uint8, value, index uint16, data []byte) (int, error) {
+	xfer := controlTransfer{requestType: requestType, request: request, value: value, index: index, length: uint16(len(data)), timeout: uint32(dev.timeout / time.Millisecond)}
+	if len(data) > 0 {
+		xfer.data = unsafe.Pointer(&data[0])
+	}
+	// USBDEVFS_CONTROL is _IOWR('U', 0, struct usbdevfs_ctrltransfer)
+	return dev.ioctl(3<<30|unsafe.Sizeof(xfer)<<16|'U'<<8|0, unsafe.Pointer(&xfer))
+}
+
+// bulkTransfer is struct usbdevfs_bulktransfer.
+type bulkTransfer struct {
+	endpoint uint32
+	length   uint32
+	timeout  uint32
+	data     unsafe.Pointer
+}
+
+// Bulk performs a bulk transfer, returning the transferred length.
+//
+// The direction is given by the endpoint address.
+func (dev *Device) Bulk(endpoint uint8, data []byte) (int, error) {
+	xfer := bulkTransfer{endpoint: uint32(endpoint), length: uint32(len(data)), timeout: uint32(dev.timeout / time.Millisecond)}
+	if len(data) > 0 {
+		xfer.data = unsafe.Pointer(&data[0])
+	}
+	// USBDEVFS_BULK is _IOWR('U', 2, struct usbdevfs_bulktransfer)
+	return dev.ioctl(3<<30|unsafe.Sizeof(xfer)<<16|'U'<<8|2, unsafe.Pointer(&xfer))
+}
+
+// Close closes the device, releasing claimed interfaces.
+func (dev *Device) Close() error {
+	return dev.file.Close()
+}
@@ -0,0 +1,66 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usb
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoUSB = errors.New("USB devices are only supported on Linux")
+
+// Device is a USB device, which cannot be opened on this system.
+type Device struct {
+	descriptors []byte
+}
+
+// Open returns an error, as direct access to USB devices is not supported.
+func Open(vendor, product uint16) (*Device, error) {
+	return nil, errNoUSB
+}
+
+// OpenInterface returns an error, as direct access to USB devices is not supported.
+func OpenInterface(class, subClass, protocol uint8) (*Device, error) {
+	return nil, errNoUSB
+}
+
+func (dev *Device) WithTimeout(timeout time.Duration) *Device {
+	return dev
+}
+
+func (dev *Device) ClaimInterface(iface int) error {
+	return errNoUSB
+}
+
+func (dev *Device) SetAltSetting(iface, alt int) error {
+	return errNoUSB
+}
+
+func (dev *Device) Control(requestType, request uint8, value, index uint16, data []byte) (int, error) {
+	return 0, errNoUSB
+}
+
+func (dev *Device) Bulk(endpoint uint8, data []byte) (int, error) {
+	return 0, errNoUSB
+}
+
+func (dev *Device) Close() error {
+	return nil
+}
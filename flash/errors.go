@@ -0,0 +1,78 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flash
+
+import "errors"
+
+// StageError is returned by Run when the function of the stage fails.
+//
+// Its message is that of the underlying error, so that reporting the
+// failure is unchanged, while callers can still tell which stage failed.
+type StageError struct {
+	Stage Stage
+	Err   error
+}
+
+// Error returns the message of the underlying error.
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// FailedStage returns the innermost stage that failed with the error, such
+// as the step of a flash plan rather than flashing as a whole.
+func FailedStage(err error) (stage Stage, ok bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if e, isStage := err.(*StageError); isStage {
+			stage, ok = e.Stage, true
+		}
+	}
+	return stage, ok
+}
+
+// kindError is an error of a known kind, with the message of its cause.
+type kindError struct {
+	cause error
+	kind  error
+}
+
+func (e *kindError) Error() string {
+	return e.cause.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.cause
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// WithKind returns an error reporting the cause, which errors.Is also
+// matches with the given kind, such as ubootshell.ErrAutobootMissed.
+//
+// This allows reacting to kinds of failures without losing their cause.
+func WithKind(cause, kind error) error {
+	if cause == nil {
+		return nil
+	}
+	return &kindError{cause: cause, kind: kind}
+}
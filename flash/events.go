@@ -0,0 +1,134 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package flash describes the stages of flashing a board and the events
+// emitted as they start, progress and end.
+//
+// Events are emitted by the flash engine in ubootshell, by boards and by
+// oh-flash itself, and consumed by the command line output, the timing
+// report and oh-flashd.
+package flash
+
+import (
+	"time"
+)
+
+// Kinds of stages, allowing stages of different runs to be compared.
+const (
+	PortStage      = "port"
+	ResetStage     = "reset"
+	InterruptStage = "interrupt"
+	CheckStage     = "check"
+	TransferStage  = "transfer"
+	EraseStage     = "erase"
+	WriteStage     = "write"
+	ReadStage      = "read"
+	FillStage      = "fill"
+	EnvStage       = "env"
+	BootStage      = "boot"
+	TestStage      = "test"
+	OtherStage     = "other"
+)
+
+// Stage is a stage of flashing, such as a power cycle or a file transfer.
+type Stage struct {
+	// Kind is one of the kinds of stages defined above.
+	Kind string `json:"kind"`
+	// Name describes the stage, for example naming the transferred file.
+	Name string `json:"name"`
+	// Bytes is the amount of data sent by transfer stages.
+	Bytes int64 `json:"bytes,omitempty"`
+}
+
+// Events is notified as stages of flashing start, progress and end.
+//
+// Methods are called from the code doing the work and should return quickly.
+type Events interface {
+	StageStarted(stage Stage)
+	// StageProgress reports the amount of work done, such as bytes sent,
+	// out of the total. It is only emitted by stages able to tell.
+	StageProgress(stage Stage, done, total int64)
+	StageCompleted(stage Stage, elapsed time.Duration)
+	StageFailed(stage Stage, elapsed time.Duration, err error)
+}
+
+// Run runs the function as the given stage, emitting events as it starts
+// and ends. Failures are returned as StageError.
+//
+// Events may be nil, in which case the function is just called. This allows
+// optional reporting without conditionals at each stage.
+func Run(events Events, stage Stage, fn func() error) error {
+	if events == nil {
+		if err := fn(); err != nil {
+			return &StageError{Stage: stage, Err: err}
+		}
+		return nil
+	}
+	events.StageStarted(stage)
+	start := time.Now()
+	err := fn()
+	if err != nil {
+		events.StageFailed(stage, time.Since(start), err)
+		return &StageError{Stage: stage, Err: err}
+	}
+	events.StageCompleted(stage, time.Since(start))
+	return nil
+}
+
+// Multi returns events forwarded to each of the given receivers in turn.
+//
+// Nil receivers are skipped. Nil is returned if no receiver is left.
+func Multi(events ...Events) Events {
+	var multi multiEvents
+	for _, e := range events {
+		if e != nil {
+			multi = append(multi, e)
+		}
+	}
+	switch len(multi) {
+	case 0:
+		return nil
+	case 1:
+		return multi[0]
+	}
+	return multi
+}
+
+type multiEvents []Events
+
+func (multi multiEvents) StageStarted(stage Stage) {
+	for _, e := range multi {
+		e.StageStarted(stage)
+	}
+}
+
+func (multi multiEvents) StageProgress(stage Stage, done, total int64) {
+	for _, e := range multi {
+		e.StageProgress(stage, done, total)
+	}
+}
+
+func (multi multiEvents) StageCompleted(stage Stage, elapsed time.Duration) {
+	for _, e := range multi {
+		e.StageCompleted(stage, elapsed)
+	}
+}
+
+func (multi multiEvents) StageFailed(stage Stage, elapsed time.Duration, err error) {
+	for _, e := range multi {
+		e.StageFailed(stage, elapsed, err)
+	}
+}
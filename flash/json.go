@@ -0,0 +1,106 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flash
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Types of events written by JSONWriter.
+const (
+	StartedEvent   = "started"
+	ProgressEvent  = "progress"
+	CompletedEvent = "completed"
+	FailedEvent    = "failed"
+)
+
+// Event is the JSON representation of a single event.
+type Event struct {
+	Time    time.Time     `json:"time"`
+	Type    string        `json:"type"`
+	Stage   Stage         `json:"stage"`
+	Done    int64         `json:"done,omitempty"`
+	Total   int64         `json:"total,omitempty"`
+	Elapsed time.Duration `json:"elapsed_ns,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// progressInterval limits how often progress of a stage is written.
+const progressInterval = 500 * time.Millisecond
+
+// JSONWriter writes events as JSON objects, one per line.
+//
+// Progress is written at most twice a second, and once more when complete,
+// as transfers report progress after every block.
+type JSONWriter struct {
+	mu           sync.Mutex
+	enc          *json.Encoder
+	lastProgress time.Time
+}
+
+// NewJSONWriter returns events written to the given writer.
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{enc: json.NewEncoder(w)}
+}
+
+func (jw *JSONWriter) write(event Event) {
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	event.Time = time.Now()
+	if event.Type == ProgressEvent {
+		if event.Done < event.Total && event.Time.Sub(jw.lastProgress) < progressInterval {
+			return
+		}
+		jw.lastProgress = event.Time
+	}
+	// Events are advisory, failing to write them must not fail flashing.
+	_ = jw.enc.Encode(&event)
+}
+
+func (jw *JSONWriter) StageStarted(stage Stage) {
+	jw.write(Event{Type: StartedEvent, Stage: stage})
+}
+
+func (jw *JSONWriter) StageProgress(stage Stage, done, total int64) {
+	jw.write(Event{Type: ProgressEvent, Stage: stage, Done: done, Total: total})
+}
+
+func (jw *JSONWriter) StageCompleted(stage Stage, elapsed time.Duration) {
+	jw.write(Event{Type: CompletedEvent, Stage: stage, Elapsed: elapsed})
+}
+
+func (jw *JSONWriter) StageFailed(stage Stage, elapsed time.Duration, err error) {
+	jw.write(Event{Type: FailedEvent, Stage: stage, Elapsed: elapsed, Error: err.Error()})
+}
+
+// ParseEvent parses a single line written by JSONWriter.
+func ParseEvent(line []byte) (Event, error) {
+	var event Event
+	if err := json.Unmarshal(line, &event); err != nil {
+		return event, fmt.Errorf("cannot decode event: %w", err)
+	}
+	switch event.Type {
+	case StartedEvent, ProgressEvent, CompletedEvent, FailedEvent:
+		return event, nil
+	default:
+		return event, fmt.Errorf("unknown type of event: %q", event.Type)
+	}
+}
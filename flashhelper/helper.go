@@ -0,0 +1,133 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package flashhelper flashes boards from the Linux userspace of a flashing
+// helper, a small kernel with an initramfs booted from memory by u-boot.
+//
+// This is an alternative to flashing from the u-boot shell, for boards where
+// that is slow or restricted. Images are written with flashcp, to MTD
+// partitions of SPI flash, or with dd, to partitions of eMMC. They reach the
+// helper over its serial console, received with rz from lrzsz, or over the
+// network, downloaded with wget from a server run by oh-flash.
+package flashhelper
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/ioextra"
+)
+
+// Target is a partition written by the helper.
+type Target struct {
+	// Name is the name of the image, such as kernel.
+	Name string
+	// Path is the image on the host. Images ending with .gz, .xz or .lzma
+	// are decompressed.
+	Path string
+	// Device is the device node written, such as /dev/mtd1.
+	Device string
+	// Partition is the name of the GPT partition written, resolved to a
+	// device node by the helper, when Device is empty.
+	Partition string
+	// MTD is set for MTD devices, which are erased and written with flashcp,
+	// instead of dd.
+	MTD bool
+}
+
+// Transport brings images into the helper and writes them.
+type Transport interface {
+	// Write writes the image of the target to the given device node.
+	Write(shell *Shell, target Target, device string) error
+}
+
+// Helper writes images from the shell of a booted flashing helper.
+type Helper struct {
+	shell     *Shell
+	transport Transport
+	events    flash.Events
+}
+
+// New returns a helper using the shell and bringing images with the transport.
+func New(shell *Shell, transport Transport) *Helper {
+	return &Helper{shell: shell, transport: transport}
+}
+
+// WithEvents returns a helper reporting writing each image as a stage.
+func (helper *Helper) WithEvents(events flash.Events) *Helper {
+	helper.events = events
+	return helper
+}
+
+// Flash writes the targets one after another and waits for the data to
+// reach storage.
+func (helper *Helper) Flash(targets []Target) error {
+	for _, target := range targets {
+		target := target
+		stage := flash.Stage{Kind: flash.WriteStage, Name: fmt.Sprintf("write %s from flashing helper", target.Name)}
+		if size, err := ioextra.DecompressedSize(target.Path); err == nil {
+			stage.Bytes = size
+		}
+		if err := flash.Run(helper.events, stage, func() error { return helper.write(target) }); err != nil {
+			return err
+		}
+	}
+	_, err := helper.shell.Run("sync")
+	return err
+}
+
+// Reboot reboots the board, which then starts the flashed system.
+func (helper *Helper) Reboot() error {
+	return helper.shell.Send("reboot -f")
+}
+
+func (helper *Helper) write(target Target) error {
+	device, err := helper.device(target)
+	if err != nil {
+		return err
+	}
+	return helper.transport.Write(helper.shell, target, device)
+}
+
+// partitionName matches names of partitions safe to use in shell commands.
+var partitionName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// device returns the device node of the target.
+func (helper *Helper) device(target Target) (string, error) {
+	if target.Device != "" {
+		return target.Device, nil
+	}
+	if !partitionName.MatchString(target.Partition) {
+		return "", fmt.Errorf("cannot write %s: invalid partition name %q", target.Name, target.Partition)
+	}
+	output, err := helper.shell.Run(fmt.Sprintf("grep -l '^PARTNAME=%s$' /sys/class/block/*/uevent", target.Partition))
+	if err != nil {
+		return "", fmt.Errorf("cannot find partition %s in flashing helper: %w", target.Partition, err)
+	}
+	uevent := strings.TrimSpace(strings.SplitN(output, "\n", 2)[0])
+	return "/dev/" + path.Base(path.Dir(uevent)), nil
+}
+
+// writeCommand returns the command writing the file to the device.
+func writeCommand(file string, target Target, device string) string {
+	if target.MTD {
+		return fmt.Sprintf("flashcp %s %s", file, device)
+	}
+	return fmt.Sprintf("dd if=%s of=%s bs=1M conv=fsync", file, device)
+}
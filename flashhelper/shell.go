@@ -0,0 +1,160 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flashhelper
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/logging"
+)
+
+// DefaultPrompt is the prompt of a busybox shell running as root.
+const DefaultPrompt = "# "
+
+// statusMarker precedes the exit status printed after each command.
+//
+// The command echoes it as "@@"status, so that the echo does not match.
+const statusMarker = "@@status="
+
+// Shell runs commands in the shell of the helper, over its console.
+type Shell struct {
+	stream  io.ReadWriter
+	expect  *ioextra.ExpectEngine
+	prompt  []byte
+	timeout time.Duration
+	log     logging.Logger
+}
+
+// NewShell returns a shell talking to the helper over the given stream.
+//
+// The stream should time out reads periodically, for example when wrapped
+// with ioextra.NewTimeoutReadWriteCloser, so that timeouts are enforced.
+func NewShell(stream io.ReadWriter) *Shell {
+	return &Shell{
+		stream:  stream,
+		expect:  ioextra.NewExpectEngine(stream).WithWriter(stream),
+		prompt:  []byte(DefaultPrompt),
+		timeout: 5 * time.Minute,
+		log:     logging.Discard,
+	}
+}
+
+// WithPrompt returns a shell waiting for the given prompt.
+func (shell *Shell) WithPrompt(prompt string) *Shell {
+	shell.prompt = []byte(prompt)
+	return shell
+}
+
+// WithTimeout returns a shell allowing the given time for each command.
+//
+// Commands write whole partitions, the timeout must allow for that.
+func (shell *Shell) WithTimeout(timeout time.Duration) *Shell {
+	shell.timeout = timeout
+	return shell
+}
+
+// WithLogger returns a shell logging the commands it runs.
+func (shell *Shell) WithLogger(log logging.Logger) *Shell {
+	shell.log = logging.OrDiscard(log)
+	return shell
+}
+
+// WaitForPrompt waits for the helper to boot into its shell.
+func (shell *Shell) WaitForPrompt(timeout time.Duration) error {
+	shell.expect.SetDeadline(time.Now().Add(timeout))
+	defer shell.expect.SetDeadline(time.Time{})
+	if err := shell.expect.DiscardUntil(shell.prompt); err != nil {
+		return fmt.Errorf("cannot find shell prompt of flashing helper: %w", err)
+	}
+	// The prompt may have been printed before the console was quiet, make
+	// sure the shell is ready for commands.
+	if _, err := shell.Run("true"); err != nil {
+		return fmt.Errorf("cannot use shell of flashing helper: %w", err)
+	}
+	return nil
+}
+
+// Run runs the command and returns its output.
+//
+// The command fails unless its exit status is zero.
+func (shell *Shell) Run(cmd string) (string, error) {
+	if err := shell.Start(cmd); err != nil {
+		return "", err
+	}
+	return shell.Wait()
+}
+
+// Start runs the command without waiting for it to complete.
+//
+// This allows talking to the command over Stream, for example to send it a
+// file. Wait must be called afterwards.
+func (shell *Shell) Start(cmd string) error {
+	shell.log.Printf("Execute in helper: %s\n", cmd)
+	return shell.expect.SendLine(fmt.Sprintf(`%s; echo "@@"status=$?`, cmd))
+}
+
+// Wait waits for the command given to Start to complete and returns its output.
+func (shell *Shell) Wait() (string, error) {
+	shell.expect.SetDeadline(time.Now().Add(shell.timeout))
+	defer shell.expect.SetDeadline(time.Time{})
+	output, err := shell.expect.CollectUntil([]byte(statusMarker))
+	if err != nil {
+		return "", fmt.Errorf("cannot find end of command in flashing helper: %w", err)
+	}
+	line, err := shell.expect.CollectUntil([]byte("\n"))
+	if err != nil {
+		return "", err
+	}
+	if err := shell.expect.DiscardUntil(shell.prompt); err != nil {
+		return "", err
+	}
+	// The output starts with the echo of the command, skip it.
+	if idx := bytes.IndexByte(output, '\n'); idx >= 0 {
+		output = output[idx+1:]
+	}
+	text := strings.TrimSpace(string(output))
+	status, err := strconv.Atoi(strings.TrimSpace(string(line)))
+	if err != nil {
+		return text, fmt.Errorf("cannot read exit status of command: %q", line)
+	}
+	if status != 0 {
+		return text, fmt.Errorf("command failed with exit status %d: %s", status, text)
+	}
+	return text, nil
+}
+
+// Send writes the text to the shell without waiting for anything, for
+// example to reboot the helper.
+func (shell *Shell) Send(text string) error {
+	shell.log.Printf("Execute in helper: %s\n", text)
+	return shell.expect.SendLine(text)
+}
+
+// Stream returns the console of the helper, for talking to commands given
+// to Start. Data already buffered by the shell is read first.
+func (shell *Shell) Stream() io.ReadWriter {
+	return struct {
+		io.Reader
+		io.Writer
+	}{shell.expect, shell.stream}
+}
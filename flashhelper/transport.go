@@ -0,0 +1,158 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flashhelper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// Serial sends images over the console of the helper with ZMODEM, received
+// by rz into a directory, usually a tmpfs, before writing them.
+//
+// The directory must have room for the largest image.
+type Serial struct {
+	ctx      context.Context
+	dir      string
+	observer ubootshell.TransferObserver
+}
+
+// NewSerial returns a transport receiving images into the given directory.
+//
+// Transfers are aborted when the context is cancelled.
+func NewSerial(ctx context.Context, dir string) *Serial {
+	return &Serial{ctx: ctx, dir: dir}
+}
+
+// WithObserver returns a transport reporting progress of transfers.
+func (s *Serial) WithObserver(observer ubootshell.TransferObserver) *Serial {
+	s.observer = observer
+	return s
+}
+
+// Write sends the image to the helper and writes it to the device.
+func (s *Serial) Write(shell *Shell, target Target, device string) error {
+	r, size, err := ioextra.OpenDecompressed(target.Path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := shell.Start(fmt.Sprintf("cd %s && rz -y", s.dir)); err != nil {
+		return err
+	}
+	err = ubootshell.NewZModemSender().Send(s.ctx, shell.Stream(), target.Name, r, size, s.observer)
+	if err != nil {
+		return flash.WithKind(fmt.Errorf("cannot send %s to flashing helper: %w", target.Name, err), ubootshell.ErrTransferFailed)
+	}
+	if _, err := shell.Wait(); err != nil {
+		return flash.WithKind(fmt.Errorf("cannot receive %s in flashing helper: %w", target.Name, err), ubootshell.ErrTransferFailed)
+	}
+	file := path.Join(s.dir, target.Name)
+	_, err = shell.Run(writeCommand(file, target, device))
+	if _, rmErr := shell.Run("rm -f " + file); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// Network serves images over HTTP, downloaded by the helper with wget.
+//
+// Images are streamed to block devices. MTD devices are written with
+// flashcp, which needs a file, so their images are downloaded to /tmp first.
+type Network struct {
+	url      string
+	listener net.Listener
+	server   *http.Server
+
+	mu    sync.Mutex
+	files map[string]string // paths of images, by name
+}
+
+// ServeNetwork starts serving images on the listen address, such as :8080,
+// to be downloaded by the helper from the base URL, such as
+// http://192.168.1.10:8080, reaching the same server.
+func ServeNetwork(listenAddr, baseURL string) (*Network, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	n := &Network{
+		url:      strings.TrimSuffix(baseURL, "/"),
+		listener: listener,
+		files:    make(map[string]string),
+	}
+	n.server = &http.Server{Handler: n}
+	go n.server.Serve(listener)
+	return n, nil
+}
+
+// Close stops serving images.
+func (n *Network) Close() error {
+	return n.server.Close()
+}
+
+// ServeHTTP sends the image of the given name, decompressed.
+func (n *Network) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	name, ok := n.files[strings.TrimPrefix(r.URL.Path, "/")]
+	n.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f, size, err := ioextra.OpenDecompressed(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	_, _ = io.Copy(w, f)
+}
+
+// Write makes the image available to the helper, which downloads it and
+// writes it to the device.
+func (n *Network) Write(shell *Shell, target Target, device string) error {
+	n.mu.Lock()
+	n.files[target.Name] = target.Path
+	n.mu.Unlock()
+	url := n.url + "/" + target.Name
+	if !target.MTD {
+		_, err := shell.Run(fmt.Sprintf("set -o pipefail; wget -q -O - %s | dd of=%s bs=1M conv=fsync", url, device))
+		return err
+	}
+	file := path.Join("/tmp", target.Name)
+	if _, err := shell.Run(fmt.Sprintf("wget -q -O %s %s", file, url)); err != nil {
+		return flash.WithKind(fmt.Errorf("cannot download %s to flashing helper: %w", target.Name, err), ubootshell.ErrTransferFailed)
+	}
+	_, err := shell.Run(writeCommand(file, target, device))
+	if _, rmErr := shell.Run("rm -f " + file); err == nil {
+		err = rmErr
+	}
+	return err
+}
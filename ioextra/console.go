@@ -0,0 +1,172 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ioextra
+
+import (
+	"io"
+	"sync"
+)
+
+// maxBacklog is the amount of data kept for a reader falling behind.
+//
+// Older data is dropped, so that a console nobody reads for a long time
+// does not use up memory.
+const maxBacklog = 1 << 20
+
+// ConsoleMux reads a stream in the background and broadcasts the data to
+// any number of readers.
+//
+// Data keeps arriving while nobody is looking, for example while the user
+// power-cycles the board, and is kept until read. Additional readers,
+// returned by Tap, see a copy of everything read from then on, which allows
+// logging the console in the background. Reading from the mux itself is the
+// main reader, writes go straight to the wrapped stream.
+type ConsoleMux struct {
+	wrapped io.ReadWriteCloser
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	main *ConsoleTap
+	taps []*ConsoleTap
+	err  error // error which stopped reading the wrapped stream
+}
+
+// ConsoleTap is a reader of a ConsoleMux.
+type ConsoleTap struct {
+	mux    *ConsoleMux
+	buf    []byte
+	closed bool
+}
+
+// NewConsoleMux returns a mux reading the wrapped stream until it fails,
+// usually because it is closed.
+func NewConsoleMux(wrapped io.ReadWriteCloser) *ConsoleMux {
+	mux := &ConsoleMux{wrapped: wrapped}
+	mux.cond = sync.NewCond(&mux.mu)
+	mux.main = &ConsoleTap{mux: mux}
+	mux.taps = []*ConsoleTap{mux.main}
+	go mux.pump()
+	return mux
+}
+
+// pump reads the wrapped stream and hands the data to all the readers.
+func (mux *ConsoleMux) pump() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := mux.wrapped.Read(buf)
+		mux.mu.Lock()
+		for _, tap := range mux.taps {
+			tap.buf = append(tap.buf, buf[:n]...)
+			if extra := len(tap.buf) - maxBacklog; extra > 0 {
+				tap.buf = tap.buf[extra:]
+			}
+		}
+		if err != nil {
+			mux.err = err
+		}
+		mux.cond.Broadcast()
+		mux.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Tap returns a new reader seeing data read from now on.
+//
+// The reader must be closed once no longer used, data is kept for it until
+// then.
+func (mux *ConsoleMux) Tap() *ConsoleTap {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	tap := &ConsoleTap{mux: mux}
+	mux.taps = append(mux.taps, tap)
+	return tap
+}
+
+// Read reads data as the main reader, waiting until some arrives.
+func (mux *ConsoleMux) Read(p []byte) (int, error) {
+	return mux.main.Read(p)
+}
+
+// Write writes data to the wrapped stream.
+func (mux *ConsoleMux) Write(p []byte) (int, error) {
+	return mux.wrapped.Write(p)
+}
+
+// Close closes the wrapped stream, which stops reading it.
+func (mux *ConsoleMux) Close() error {
+	return mux.wrapped.Close()
+}
+
+// Read reads data kept for the reader, waiting until some arrives.
+//
+// Once the reader is closed, the remaining data is returned, followed by
+// io.EOF. Once the wrapped stream fails, the remaining data is returned,
+// followed by the error.
+func (tap *ConsoleTap) Read(p []byte) (int, error) {
+	mux := tap.mux
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	for len(tap.buf) == 0 && !tap.closed && mux.err == nil {
+		mux.cond.Wait()
+	}
+	if len(tap.buf) > 0 {
+		n := copy(p, tap.buf)
+		tap.buf = tap.buf[n:]
+		return n, nil
+	}
+	if tap.closed {
+		return 0, io.EOF
+	}
+	return 0, mux.err
+}
+
+// Close stops collecting data for the reader.
+func (tap *ConsoleTap) Close() error {
+	mux := tap.mux
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	tap.closed = true
+	for i, other := range mux.taps {
+		if other == tap {
+			mux.taps = append(mux.taps[:i], mux.taps[i+1:]...)
+			break
+		}
+	}
+	mux.cond.Broadcast()
+	return nil
+}
+
+// LogUnattended copies data arriving from now on to the writer, until the
+// returned function is called.
+//
+// This shows what the console printed while nobody was looking, such as
+// early boot messages or a kernel crash during a power cycle. The data is
+// still kept for the main reader. Errors writing the log are ignored.
+func (mux *ConsoleMux) LogUnattended(w io.Writer) (stop func()) {
+	tap := mux.Tap()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(w, tap)
+	}()
+	return func() {
+		tap.Close()
+		<-done
+	}
+}
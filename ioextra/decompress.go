@@ -0,0 +1,221 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ioextra
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// OpenDecompressed opens a file for reading, decompressing it on the fly if
+// the name ends with .gz, .xz or .lzma, and returns the size of the data read.
+//
+// Gzip files are decompressed in-process, xz and lzma files with the xz
+// program, which must be installed. Other files are read as they are.
+func OpenDecompressed(path string) (io.ReadCloser, int64, error) {
+	size, err := DecompressedSize(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		gz, err := gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			f.Close()
+			return nil, 0, fmt.Errorf("cannot decompress %s: %w", path, err)
+		}
+		return &gzipReader{Reader: gz, file: f}, size, nil
+	case strings.HasSuffix(path, ".xz"), strings.HasSuffix(path, ".lzma"):
+		r, err := startXZ(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		return r, size, nil
+	default:
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		return f, size, nil
+	}
+}
+
+// DecompressedSize returns the size of the file after decompression, see
+// OpenDecompressed.
+//
+// The size of gzip files is stored in the trailer, modulo 4GB, and is only
+// correct for files with a single member. The size of xz files is listed by
+// the xz program. The size of lzma files is stored in the header, unless
+// they were compressed as a stream and must be decompressed to find it.
+func DecompressedSize(path string) (int64, error) {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return gzipSize(path)
+	case strings.HasSuffix(path, ".xz"):
+		return xzSize(path)
+	case strings.HasSuffix(path, ".lzma"):
+		return lzmaSize(path)
+	default:
+		fi, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+}
+
+type gzipReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *gzipReader) Close() error {
+	err := r.Reader.Close()
+	if err2 := r.file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// gzipSize returns the size stored in the trailer of a gzip file.
+func gzipSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var trailer [4]byte
+	if _, err := f.Seek(-int64(len(trailer)), io.SeekEnd); err != nil {
+		return 0, fmt.Errorf("cannot read size of %s: %w", path, err)
+	}
+	if _, err := io.ReadFull(f, trailer[:]); err != nil {
+		return 0, fmt.Errorf("cannot read size of %s: %w", path, err)
+	}
+	return int64(binary.LittleEndian.Uint32(trailer[:])), nil
+}
+
+// lzmaSize returns the size stored in the header of an lzma file.
+//
+// The header has five bytes of properties followed by the size, all ones if
+// the size is unknown.
+func lzmaSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var header [13]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return 0, fmt.Errorf("cannot read size of %s: %w", path, err)
+	}
+	size := binary.LittleEndian.Uint64(header[5:])
+	if size != ^uint64(0) {
+		return int64(size), nil
+	}
+	r, err := startXZ(path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(ioutil.Discard, r)
+}
+
+// xzSize returns the size of an xz file after decompression.
+func xzSize(path string) (int64, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("xz", "--robot", "--list", path)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("cannot list %s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	// The totals line has the uncompressed size in the fifth column.
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if fields[0] == "totals" && len(fields) > 4 {
+			return strconv.ParseInt(fields[4], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("cannot find size of %s in the output of xz", path)
+}
+
+// xzReader reads the output of the xz program decompressing a file.
+type xzReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	done   bool
+	err    error
+}
+
+func startXZ(path string) (*xzReader, error) {
+	r := &xzReader{cmd: exec.Command("xz", "--decompress", "--stdout", path)}
+	r.cmd.Stderr = &r.stderr
+	stdout, err := r.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	r.stdout = stdout
+	if err := r.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot decompress %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// Read reads decompressed data, failures of xz are reported at the end.
+func (r *xzReader) Read(p []byte) (int, error) {
+	n, err := r.stdout.Read(p)
+	if err == io.EOF {
+		if werr := r.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Close stops xz, if the data was not read entirely.
+func (r *xzReader) Close() error {
+	if !r.done {
+		r.cmd.Process.Kill()
+		r.wait()
+		return nil
+	}
+	return r.err
+}
+
+func (r *xzReader) wait() error {
+	if !r.done {
+		r.done = true
+		if err := r.cmd.Wait(); err != nil {
+			r.err = fmt.Errorf("cannot decompress %s: %w: %s", r.cmd.Args[len(r.cmd.Args)-1], err, strings.TrimSpace(r.stderr.String()))
+		}
+	}
+	return r.err
+}
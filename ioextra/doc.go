@@ -15,4 +15,12 @@ limitations under the License.
 */
 
 // Package ioextra contains additional I/O utilities.
+//
+// Streams of a serial port are typically read by one goroutine, while
+// another writes, logs the console in the background or gives up waiting
+// when the context is cancelled. Unless documented otherwise, the wrappers
+// in this package may be read from and written to concurrently, by one
+// reader and one writer, and closed at any time to unblock both. Recorders
+// and preview renderers are called one at a time. ConsoleMux, IOPreview and
+// ExpectEngine give further guarantees, see their documentation.
 package ioextra
@@ -1,3 +1,6 @@
+//go:build !windows
+// +build !windows
+
 /*
 Copyright 2020 Huawei Inc.
 
@@ -29,6 +32,8 @@ type eintr struct {
 // NewRestartingReadWriteCloser provides a ReadWriteCloser handling EINTR.
 //
 // This type helps with https://github.com/golang/go/issues/38033
+// On Windows, where system calls are not interrupted, the stream is returned
+// unchanged.
 func NewRestartingReadWriteCloser(wrapped io.ReadWriteCloser) io.ReadWriteCloser {
 	return &eintr{wrapped: wrapped}
 }
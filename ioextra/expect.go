@@ -19,12 +19,60 @@ package ioextra
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"regexp"
+	"sync"
+	"time"
 )
 
+// contextSize is the number of recently received bytes reported in errors.
+const contextSize = 256
+
 // ExpectEngine allow to look for patterns in stream input.
+//
+// Given a writer, it also sends lines, such as commands answering the
+// patterns. Given a transcript recorder, it records the data sent and the
+// data consumed by each call, whether matched or discarded.
+//
+// ExpectEngine may be used from several goroutines. Each call consumes the
+// input on its own, calls made at the same time take turns. SetDeadline may
+// be called at any time, also to abort a call waiting for data.
 type ExpectEngine struct {
-	reader *bufio.Reader
+	mu      sync.Mutex // held by calls consuming the input, protects the fields below
+	reader  *bufio.Reader
+	pending []byte // data read but not consumed by a regular expression match
+	recent  []byte // recently received data, for error messages
+
+	writer     io.Writer
+	transcript Recorder
+	consumed   []byte // data consumed by the current call, for the transcript
+
+	deadlineMu sync.Mutex
+	deadline   time.Time
+}
+
+// MatchError is returned when the expected data does not arrive.
+//
+// The error carries the data received most recently, which usually explains
+// why the expected data did not arrive.
+type MatchError struct {
+	Received []byte
+	Err      error
+}
+
+// Error returns the underlying error together with the received data.
+func (e *MatchError) Error() string {
+	if len(e.Received) == 0 {
+		return fmt.Sprintf("%v, nothing was received", e.Err)
+	}
+	return fmt.Sprintf("%v, last received: %q", e.Err, e.Received)
+}
+
+// Unwrap returns the underlying error.
+func (e *MatchError) Unwrap() error {
+	return e.Err
 }
 
 // NewExpectEngine returns an expect engine reading from a given reader.
@@ -34,47 +82,264 @@ func NewExpectEngine(reader io.Reader) *ExpectEngine {
 	}
 }
 
+// WithWriter returns an engine sending lines to the given writer, usually the
+// other side of the stream it reads.
+func (expect *ExpectEngine) WithWriter(w io.Writer) *ExpectEngine {
+	expect.writer = w
+	return expect
+}
+
+// WithTranscript returns an engine recording the data it sends and consumes.
+//
+// Incoming data is recorded once per call, as consumed by that call. Data
+// read ahead but not consumed yet is recorded by the call consuming it.
+// Failure to record does not affect sending or matching.
+func (expect *ExpectEngine) WithTranscript(transcript Recorder) *ExpectEngine {
+	expect.transcript = transcript
+	return expect
+}
+
+// SendLine sends the text followed by a newline, in a single write.
+func (expect *ExpectEngine) SendLine(s string) error {
+	if expect.writer == nil {
+		return fmt.Errorf("cannot send %q, expect engine has no writer", s)
+	}
+	line := []byte(s + "\n")
+	n, err := expect.writer.Write(line)
+	if n > 0 && expect.transcript != nil {
+		expect.transcript.Record(time.Now(), Outgoing, line[:n])
+	}
+	return err
+}
+
+// Expect returns data read until the pattern arrives, failing with
+// ErrTimeout if it does not arrive within the given time.
+//
+// The deadline set with SetDeadline applies again afterwards.
+func (expect *ExpectEngine) Expect(pattern []byte, timeout time.Duration) ([]byte, error) {
+	defer expect.SetDeadline(expect.currentDeadline())
+	expect.SetDeadline(time.Now().Add(timeout))
+	return expect.CollectUntil(pattern)
+}
+
+// SetDeadline sets the time after which reading fails with ErrTimeout.
+//
+// The deadline is checked whenever data arrives and whenever the underlying
+// reader times out. Wrap the stream with NewTimeoutReadWriteCloser to bound
+// blocking reads of a silent stream. The zero value disables the deadline.
+func (expect *ExpectEngine) SetDeadline(deadline time.Time) {
+	expect.deadlineMu.Lock()
+	defer expect.deadlineMu.Unlock()
+	expect.deadline = deadline
+}
+
+// currentDeadline returns the deadline set with SetDeadline.
+func (expect *ExpectEngine) currentDeadline() time.Time {
+	expect.deadlineMu.Lock()
+	defer expect.deadlineMu.Unlock()
+	return expect.deadline
+}
+
 // CollectUntil buffers and returns data read until the expected bytes arrive.
 //
 // The return value does not repeat the expected bytes.
 func (expect *ExpectEngine) CollectUntil(expected []byte) ([]byte, error) {
+	expect.mu.Lock()
+	defer expect.mu.Unlock()
+	defer expect.recordConsumed()
+	_, data, err := expect.scan(true, expected)
+	return data, err
+}
+
+// DiscardUntil skips data read until the expected bytes arrive.
+func (expect *ExpectEngine) DiscardUntil(expected []byte) error {
+	expect.mu.Lock()
+	defer expect.mu.Unlock()
+	defer expect.recordConsumed()
+	_, _, err := expect.scan(false, expected)
+	return err
+}
+
+// ExpectAny reads data until any of the patterns arrives.
+//
+// The index of the pattern that arrived first is returned, together with the
+// data read before it. If two patterns end at the same byte, the one listed
+// first wins.
+func (expect *ExpectEngine) ExpectAny(patterns ...[]byte) (index int, data []byte, err error) {
+	expect.mu.Lock()
+	defer expect.mu.Unlock()
+	defer expect.recordConsumed()
+	return expect.scan(true, patterns...)
+}
+
+// ExpectRegexp reads data until it matches the given regular expression.
+//
+// The data read before the match is returned, together with the match and
+// its sub-matches, as returned by regexp.Regexp.FindSubmatch. Data following
+// the match is kept for subsequent calls.
+//
+// Matching is attempted at the end of each line and whenever no more data
+// is buffered. Patterns that can match a prefix of the text they describe,
+// such as `\d+`, should be terminated explicitly.
+func (expect *ExpectEngine) ExpectRegexp(re *regexp.Regexp) (data []byte, match [][]byte, err error) {
+	expect.mu.Lock()
+	defer expect.mu.Unlock()
+	defer expect.recordConsumed()
 	var buf bytes.Buffer
-	i := 0
 	for {
-		if i == len(expected) {
-			collected := buf.Bytes()
-			return collected[:len(collected)-len(expected)], nil
-		}
-		b, err := expect.reader.ReadByte()
+		b, err := expect.readByte()
 		if err != nil {
-			return nil, err
+			return nil, nil, expect.matchError(err)
 		}
 		buf.WriteByte(b) // error is always nil
-		if i < len(expected) && expected[i] == b {
-			i++
-		} else if i > 0 {
-			i = 0
-			expect.reader.UnreadByte()
+		if b != '\n' && (len(expect.pending) > 0 || expect.reader.Buffered() > 0) {
+			continue
+		}
+		collected := buf.Bytes()
+		loc := re.FindSubmatchIndex(collected)
+		if loc == nil {
+			continue
+		}
+		match = make([][]byte, len(loc)/2)
+		for i := range match {
+			if loc[2*i] >= 0 {
+				match[i] = append([]byte(nil), collected[loc[2*i]:loc[2*i+1]]...)
+			}
 		}
+		rest := collected[loc[1]:]
+		expect.pending = append(append([]byte(nil), rest...), expect.pending...)
+		if expect.transcript != nil {
+			expect.consumed = expect.consumed[:len(expect.consumed)-len(rest)]
+		}
+		return collected[:loc[0]], match, nil
 	}
 }
 
-// DiscardUntil skips data read until the expected bytes arrive.
-func (expect *ExpectEngine) DiscardUntil(expected []byte) error {
-	i := 0
+// ReadByte reads a single byte.
+//
+// This allows mixing pattern matching with reading binary responses.
+func (expect *ExpectEngine) ReadByte() (byte, error) {
+	expect.mu.Lock()
+	defer expect.mu.Unlock()
+	defer expect.recordConsumed()
+	return expect.readByte()
+}
+
+func (expect *ExpectEngine) readByte() (byte, error) {
+	b, err := expect.nextByte()
+	if err == nil && expect.transcript != nil {
+		expect.consumed = append(expect.consumed, b)
+	}
+	return b, err
+}
+
+// recordConsumed records the data consumed by the current call.
+func (expect *ExpectEngine) recordConsumed() {
+	if len(expect.consumed) > 0 {
+		expect.transcript.Record(time.Now(), Incoming, expect.consumed)
+		expect.consumed = expect.consumed[:0]
+	}
+}
+
+func (expect *ExpectEngine) nextByte() (byte, error) {
+	if len(expect.pending) > 0 {
+		b := expect.pending[0]
+		expect.pending = expect.pending[1:]
+		return b, nil
+	}
 	for {
-		if i == len(expected) {
-			return nil
+		deadline := expect.currentDeadline()
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return 0, ErrTimeout
 		}
 		b, err := expect.reader.ReadByte()
 		if err != nil {
-			return err
+			// With a deadline set, the timeouts of the stream only serve
+			// to check the deadline periodically.
+			var timeout interface{ Timeout() bool }
+			if !deadline.IsZero() && errors.As(err, &timeout) && timeout.Timeout() {
+				continue
+			}
+			return 0, err
+		}
+		expect.recent = append(expect.recent, b)
+		if len(expect.recent) > 2*contextSize {
+			expect.recent = append(expect.recent[:0], expect.recent[len(expect.recent)-contextSize:]...)
+		}
+		return b, nil
+	}
+}
+
+// Read reads data without looking for any patterns.
+//
+// Read blocks until at least one byte is available, just like ReadByte.
+func (expect *ExpectEngine) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	expect.mu.Lock()
+	defer expect.mu.Unlock()
+	defer expect.recordConsumed()
+	b, err := expect.readByte()
+	if err != nil {
+		return 0, err
+	}
+	p[0] = b
+	n = 1
+	for n < len(p) && (len(expect.pending) > 0 || expect.reader.Buffered() > 0) {
+		if p[n], err = expect.readByte(); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// matchError returns MatchError with recently received data.
+func (expect *ExpectEngine) matchError(err error) error {
+	received := expect.recent
+	if len(received) > contextSize {
+		received = received[len(received)-contextSize:]
+	}
+	return &MatchError{Received: append([]byte(nil), received...), Err: err}
+}
+
+// scan reads data until one of the patterns arrives.
+//
+// All the data is kept in memory only if collect is true, otherwise only
+// enough data to detect the patterns is retained.
+//
+// The patterns are compared with the end of the data after each byte, so a
+// failed partial match never needs to back up: patterns with repeated
+// prefixes, such as "ababc" arriving in "abababc", are found just like any
+// other. This is the only matcher, u-boot shells and other devices use it
+// through ExpectEngine.
+func (expect *ExpectEngine) scan(collect bool, patterns ...[]byte) (int, []byte, error) {
+	longest := 0
+	for _, pattern := range patterns {
+		if len(pattern) > longest {
+			longest = len(pattern)
+		}
+	}
+	var buf []byte
+	for {
+		for i, pattern := range patterns {
+			if bytes.HasSuffix(buf, pattern) {
+				if !collect {
+					return i, nil, nil
+				}
+				return i, buf[:len(buf)-len(pattern)], nil
+			}
+		}
+		b, err := expect.readByte()
+		if err != nil {
+			return -1, nil, expect.matchError(err)
 		}
-		if i < len(expected) && expected[i] == b {
-			i++
-		} else if i > 0 {
-			i = 0
-			expect.reader.UnreadByte()
+		if !collect && len(buf) >= longest && longest > 0 {
+			// Slide the window, keeping only the tail that may still match.
+			copy(buf, buf[1:])
+			buf = buf[:len(buf)-1]
 		}
+		buf = append(buf, b)
 	}
 }
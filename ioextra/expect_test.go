@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ioextra
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDiscardUntilOverlappingPrefix(t *testing.T) {
+	expect := NewExpectEngine(strings.NewReader("abababc!"))
+	if err := expect.DiscardUntil([]byte("ababc")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := expect.ReadByte()
+	if err != nil || b != '!' {
+		t.Fatalf("expected '!' after the match, got %q, %v", b, err)
+	}
+}
+
+func TestCollectUntilOverlappingPrefix(t *testing.T) {
+	expect := NewExpectEngine(strings.NewReader("xabababc!"))
+	data, err := expect.CollectUntil([]byte("ababc"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != "xab" {
+		t.Fatalf("expected data before the match to be %q, got %q", "xab", data)
+	}
+	b, err := expect.ReadByte()
+	if err != nil || b != '!' {
+		t.Fatalf("expected '!' after the match, got %q, %v", b, err)
+	}
+}
+
+func TestExpectAnyOverlappingPrefix(t *testing.T) {
+	expect := NewExpectEngine(strings.NewReader("aaababababc"))
+	index, data, err := expect.ExpectAny([]byte("ababc"), []byte("aab"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if index != 1 || string(data) != "a" {
+		t.Fatalf("expected pattern 1 after %q, got %d after %q", "a", index, data)
+	}
+	index, data, err = expect.ExpectAny([]byte("ababc"), []byte("aab"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if index != 0 || string(data) != "ab" {
+		t.Fatalf("expected pattern 0 after %q, got %d after %q", "ab", index, data)
+	}
+}
+
+func TestExpectAnySameEnd(t *testing.T) {
+	expect := NewExpectEngine(strings.NewReader("abababc"))
+	index, data, err := expect.ExpectAny([]byte("bc"), []byte("ababc"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if index != 0 || string(data) != "ababa" {
+		t.Fatalf("expected pattern 0 after %q, got %d after %q", "ababa", index, data)
+	}
+}
+
+func TestDiscardUntilMissing(t *testing.T) {
+	expect := NewExpectEngine(strings.NewReader("ababab"))
+	err := expect.DiscardUntil([]byte("ababc"))
+	var matchErr *MatchError
+	if !errors.As(err, &matchErr) {
+		t.Fatalf("expected MatchError, got %v", err)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected error to wrap io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ioextra
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Pacing describes how to slow down writes.
+//
+// Some USB to serial adapters drop bytes when data arrives in large bursts.
+// Writing smaller chunks, with pauses or at a limited rate, trades speed for
+// reliability.
+type Pacing struct {
+	// ChunkSize is the maximum number of bytes written at once, zero
+	// writes all the data at once.
+	ChunkSize int
+	// Delay is the pause after writing each chunk.
+	Delay time.Duration
+	// Rate is the maximum average rate of writing, in bytes per second,
+	// zero is unlimited.
+	Rate int
+}
+
+// Enabled returns true if writes are slowed down at all.
+func (pacing Pacing) Enabled() bool {
+	return pacing.Delay > 0 || pacing.Rate > 0
+}
+
+type paced struct {
+	io.ReadWriteCloser
+	pacing Pacing
+
+	mu   sync.Mutex
+	next time.Time // when the next chunk may be written
+}
+
+// NewPacedReadWriteCloser provides a ReadWriteCloser writing data in chunks,
+// pausing between them as described by the pacing.
+//
+// Reads are passed through unchanged.
+func NewPacedReadWriteCloser(wrapped io.ReadWriteCloser, pacing Pacing) io.ReadWriteCloser {
+	return &paced{ReadWriteCloser: wrapped, pacing: pacing}
+}
+
+// Write writes data to the wrapped stream, one chunk at a time.
+func (rwc *paced) Write(p []byte) (n int, err error) {
+	rwc.mu.Lock()
+	defer rwc.mu.Unlock()
+
+	for n < len(p) {
+		chunk := p[n:]
+		if size := rwc.pacing.ChunkSize; size > 0 && len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		if wait := time.Until(rwc.next); wait > 0 {
+			time.Sleep(wait)
+		}
+		start := time.Now()
+		m, err := rwc.ReadWriteCloser.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		rwc.next = time.Now().Add(rwc.pacing.Delay)
+		if rwc.pacing.Rate > 0 {
+			// The chunk is sent at the given rate if the next one waits this long.
+			limited := start.Add(time.Duration(m) * time.Second / time.Duration(rwc.pacing.Rate))
+			if limited.After(rwc.next) {
+				rwc.next = limited
+			}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ioextra
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// pcapng block types, link type and option codes.
+const (
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngInterface       = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+	pcapngLinkTypeUser0   = 147
+	pcapngOptEndOfOpt     = 0
+	pcapngOptIfName       = 2
+	pcapngOptEpbFlags     = 2
+	pcapngFlagInbound     = 1
+	pcapngFlagOutbound    = 2
+	pcapngTimestampPerSec = 1000000 // default if_tsresol is microseconds
+)
+
+// PcapNG records stream traffic in the pcapng format understood by Wireshark.
+//
+// Each read or write is stored as a separate packet of the USER0 link type,
+// with the direction stored in the packet flags. Wireshark can be told to
+// decode the packets with a specific dissector in the DLT_USER preferences.
+type PcapNG struct {
+	w       io.Writer
+	started bool
+}
+
+// NewPcapNG returns a recorder writing pcapng data to the given writer.
+func NewPcapNG(w io.Writer) *PcapNG {
+	return &PcapNG{w: w}
+}
+
+// Record writes a single packet.
+//
+// The section header and interface description are written before the first
+// packet.
+func (pcap *PcapNG) Record(t time.Time, dir Direction, data []byte) error {
+	if !pcap.started {
+		if err := pcap.writeHeader(); err != nil {
+			return err
+		}
+		pcap.started = true
+	}
+	var body bytes.Buffer
+	ts := uint64(t.UnixNano() / (int64(time.Second) / pcapngTimestampPerSec))
+	writeLE(&body, uint32(0)) // interface ID
+	writeLE(&body, uint32(ts>>32))
+	writeLE(&body, uint32(ts))
+	writeLE(&body, uint32(len(data))) // captured length
+	writeLE(&body, uint32(len(data))) // original length
+	body.Write(data)
+	pad(&body)
+	flags := uint32(pcapngFlagInbound)
+	if dir == Outgoing {
+		flags = pcapngFlagOutbound
+	}
+	writeLE(&body, uint16(pcapngOptEpbFlags))
+	writeLE(&body, uint16(4))
+	writeLE(&body, flags)
+	writeLE(&body, uint16(pcapngOptEndOfOpt))
+	writeLE(&body, uint16(0))
+	return pcap.writeBlock(pcapngEnhancedPacket, body.Bytes())
+}
+
+func (pcap *PcapNG) writeHeader() error {
+	var shb bytes.Buffer
+	writeLE(&shb, uint32(pcapngByteOrderMagic))
+	writeLE(&shb, uint16(1)) // major version
+	writeLE(&shb, uint16(0)) // minor version
+	writeLE(&shb, int64(-1)) // section length is not known
+	if err := pcap.writeBlock(pcapngSectionHeader, shb.Bytes()); err != nil {
+		return err
+	}
+	var idb bytes.Buffer
+	const ifName = "serial"
+	writeLE(&idb, uint16(pcapngLinkTypeUser0))
+	writeLE(&idb, uint16(0)) // reserved
+	writeLE(&idb, uint32(0)) // no snapshot length limit
+	writeLE(&idb, uint16(pcapngOptIfName))
+	writeLE(&idb, uint16(len(ifName)))
+	idb.WriteString(ifName)
+	pad(&idb)
+	writeLE(&idb, uint16(pcapngOptEndOfOpt))
+	writeLE(&idb, uint16(0))
+	return pcap.writeBlock(pcapngInterface, idb.Bytes())
+}
+
+// writeBlock writes a block with the given type and body.
+//
+// The body must be padded to a multiple of four bytes.
+func (pcap *PcapNG) writeBlock(blockType uint32, body []byte) error {
+	var block bytes.Buffer
+	totalLength := uint32(len(body) + 12)
+	writeLE(&block, blockType)
+	writeLE(&block, totalLength)
+	block.Write(body)
+	writeLE(&block, totalLength)
+	if _, err := pcap.w.Write(block.Bytes()); err != nil {
+		return fmt.Errorf("cannot record pcapng block: %w", err)
+	}
+	return nil
+}
+
+func writeLE(buf *bytes.Buffer, value interface{}) {
+	_ = binary.Write(buf, binary.LittleEndian, value) // buffer writes panic on failure
+}
+
+// pad pads the buffer with zeros to a multiple of four bytes.
+func pad(buf *bytes.Buffer) {
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+}
@@ -20,35 +20,115 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"os"
+	"sync"
+	"time"
 )
 
 // IOPreview is a ReadWriteCloser which previews serial I/O in a readable manner
+//
+// Data going either way is split into lines, or passed as-is with line
+// buffering disabled, and given to a renderer as events.
+//
+// IOPreview may be read from and written to concurrently, its other methods
+// may be called at any time. Events are rendered with an internal lock held,
+// one at a time, so renderers need no locking of their own.
 type IOPreview struct {
 	wrapped    io.ReadWriteCloser
+	m          sync.Mutex // protects all the fields below
+	renderer   PreviewRenderer
 	inDisplay  bytes.Buffer
 	outDisplay bytes.Buffer
-	inPrompt   string
-	outPrompt  string
 	disabled   bool
 	immediate  bool
 }
 
+// PreviewEvent is a line of previewed data or, with line buffering
+// disabled, whatever was transferred at once.
+type PreviewEvent struct {
+	Direction Direction
+	Data      []byte
+	Time      time.Time // when the last byte was transferred
+	Immediate bool      // not split into lines, such as data of a file transfer
+}
+
+// PreviewRenderer displays data seen by IOPreview.
+//
+// Events are rendered one at a time, data is not retained after Render
+// returns.
+type PreviewRenderer interface {
+	Render(event PreviewEvent)
+}
+
+// PreviewMode selects how previewed data is rendered.
+type PreviewMode int
+
+const (
+	// DefaultPreview renders lines as quoted text and immediate data in hex.
+	DefaultPreview PreviewMode = iota
+	// TextPreview renders all data as quoted text.
+	TextPreview
+	// HexPreview renders all data in hex.
+	HexPreview
+	// BothPreview renders all data both as quoted text and in hex.
+	BothPreview
+	// DumpPreview renders all data like hexdump -C, with offsets and
+	// printable characters next to the hex.
+	DumpPreview
+)
+
+// String returns the name of the preview mode.
+func (mode PreviewMode) String() string {
+	switch mode {
+	case DefaultPreview:
+		return "default"
+	case TextPreview:
+		return "text"
+	case HexPreview:
+		return "hex"
+	case BothPreview:
+		return "both"
+	case DumpPreview:
+		return "dump"
+	default:
+		return fmt.Sprintf("invalid (%d)", int(mode))
+	}
+}
+
 // NewIOPreview returns a ReadWriteCloser that shows serial port traffic.
 func NewIOPreview(wrapped io.ReadWriteCloser) *IOPreview {
+	return NewIOPreviewTo(wrapped, os.Stdout)
+}
+
+// NewIOPreviewTo returns a ReadWriteCloser that shows serial port traffic on the given writer.
+//
+// Errors writing to the output are ignored, they do not affect the real IO.
+func NewIOPreviewTo(wrapped io.ReadWriteCloser, output io.Writer) *IOPreview {
 	return &IOPreview{
-		wrapped:   wrapped,
-		inPrompt:  "   <<<",
-		outPrompt: "   >>>",
+		wrapped:  wrapped,
+		renderer: NewTextRenderer(output),
 	}
 }
 
+// WithRenderer returns a preview displaying data with the given renderer.
+func (preview *IOPreview) WithRenderer(renderer PreviewRenderer) *IOPreview {
+	preview.m.Lock()
+	defer preview.m.Unlock()
+	preview.renderer = renderer
+	return preview
+}
+
 // DisablePreview disables buffering and display of transmitted data.
 func (preview *IOPreview) DisablePreview() {
+	preview.m.Lock()
+	defer preview.m.Unlock()
 	preview.disabled = true
 }
 
 // EnablePreview enables buffering and display of transmitted data.
 func (preview *IOPreview) EnablePreview() {
+	preview.m.Lock()
+	defer preview.m.Unlock()
 	preview.disabled = false
 }
 
@@ -56,6 +136,8 @@ func (preview *IOPreview) EnablePreview() {
 //
 // Buffering only affects the preview stream, not the real IO.
 func (preview *IOPreview) DisableLineBuffering() {
+	preview.m.Lock()
+	defer preview.m.Unlock()
 	preview.immediate = true
 }
 
@@ -63,25 +145,33 @@ func (preview *IOPreview) DisableLineBuffering() {
 //
 // Buffering only affects the preview stream, not the real IO.
 func (preview *IOPreview) EnableLineBuffering() {
+	preview.m.Lock()
+	defer preview.m.Unlock()
 	preview.immediate = false
 }
 
 func (preview *IOPreview) Read(p []byte) (n int, err error) {
 	n, err = preview.wrapped.Read(p)
-	// fmt.Printf("read %d bytes: %q\n", n, p[:n])
-	if n > 0 && !preview.disabled {
-		preview.inDisplay.Write(p[:n]) // buffer writes panic on failure
-		display(&preview.inDisplay, preview.inPrompt, preview.immediate)
+	if n > 0 {
+		preview.m.Lock()
+		defer preview.m.Unlock()
+		if !preview.disabled {
+			preview.inDisplay.Write(p[:n]) // buffer writes panic on failure
+			preview.display(&preview.inDisplay, Incoming, preview.immediate)
+		}
 	}
 	return n, err
 }
 
 func (preview *IOPreview) Write(p []byte) (n int, err error) {
 	n, err = preview.wrapped.Write(p)
-	// fmt.Printf("wrote %d bytes: %q\n", n, p[:n])
-	if n > 0 && !preview.disabled {
-		preview.outDisplay.Write(p[:n]) // buffer writes panic on failure
-		display(&preview.outDisplay, preview.outPrompt, preview.immediate)
+	if n > 0 {
+		preview.m.Lock()
+		defer preview.m.Unlock()
+		if !preview.disabled {
+			preview.outDisplay.Write(p[:n]) // buffer writes panic on failure
+			preview.display(&preview.outDisplay, Outgoing, preview.immediate)
+		}
 	}
 	return n, err
 }
@@ -90,34 +180,31 @@ func (preview *IOPreview) Write(p []byte) (n int, err error) {
 //
 // Close implements io.Closer
 func (preview *IOPreview) Close() error {
-	display(&preview.outDisplay, preview.outPrompt, true)
+	preview.m.Lock()
+	defer preview.m.Unlock()
+	preview.display(&preview.outDisplay, Outgoing, true)
 	preview.outDisplay.Reset()
-	display(&preview.inDisplay, preview.inPrompt, true)
+	preview.display(&preview.inDisplay, Incoming, true)
 	preview.inDisplay.Reset()
 	return nil
 }
 
-func display(buf *bytes.Buffer, prompt string, immediate bool) {
+func (preview *IOPreview) display(buf *bytes.Buffer, dir Direction, immediate bool) {
+	now := time.Now()
 	if immediate {
 		blob := buf.Bytes()
-		fmt.Printf("%s % #x\n", prompt, blob)
-		buf.Reset()
-	} else {
-		var line []byte
-		var err error
-		for {
-			line, err = buf.ReadBytes('\n')
-			if err != nil {
-				if err != io.EOF {
-					fmt.Printf("display error: %v\n", err)
-				}
-				break
-			}
-			fmt.Printf("%s %q\n", prompt, line)
+		if len(blob) > 0 {
+			preview.renderer.Render(PreviewEvent{Direction: dir, Data: blob, Time: now, Immediate: true})
 		}
-		if len(line) > 0 {
-			// In non-immediate mode buffer it for the next time.
-			*buf = *bytes.NewBuffer(line)
+		buf.Reset()
+		return
+	}
+	for {
+		idx := bytes.IndexByte(buf.Bytes(), '\n')
+		if idx < 0 {
+			// Incomplete lines are kept for the next time.
+			break
 		}
+		preview.renderer.Render(PreviewEvent{Direction: dir, Data: buf.Next(idx + 1), Time: now})
 	}
 }
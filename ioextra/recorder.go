@@ -0,0 +1,109 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ioextra
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Direction indicates whether data was received or sent.
+type Direction int
+
+const (
+	// Incoming indicates data received from the other side.
+	Incoming Direction = iota
+	// Outgoing indicates data sent to the other side.
+	Outgoing
+)
+
+// String returns a description of the direction.
+func (d Direction) String() string {
+	if d == Incoming {
+		return "incoming"
+	}
+	return "outgoing"
+}
+
+// Marker returns the marker of the direction used in previews and transcripts.
+func (d Direction) Marker() string {
+	if d == Incoming {
+		return "<<<"
+	}
+	return ">>>"
+}
+
+// Recorder is the interface for recording traffic of a stream.
+type Recorder interface {
+	Record(t time.Time, dir Direction, data []byte) error
+}
+
+type recording struct {
+	wrapped   io.ReadWriteCloser
+	recorders []Recorder
+	mu        sync.Mutex
+	err       error
+}
+
+// NewRecordingReadWriteCloser returns a ReadWriteCloser passing all the
+// transferred data to the given recorders.
+//
+// Failure to record does not affect the transferred data. The first error
+// returned by any of the recorders is returned by Close instead.
+func NewRecordingReadWriteCloser(wrapped io.ReadWriteCloser, recorders ...Recorder) io.ReadWriteCloser {
+	return &recording{wrapped: wrapped, recorders: recorders}
+}
+
+// Read reads data from the wrapped stream and records it.
+func (rec *recording) Read(p []byte) (n int, err error) {
+	n, err = rec.wrapped.Read(p)
+	if n > 0 {
+		rec.record(Incoming, p[:n])
+	}
+	return n, err
+}
+
+// Write writes data to the wrapped stream and records it.
+func (rec *recording) Write(p []byte) (n int, err error) {
+	n, err = rec.wrapped.Write(p)
+	if n > 0 {
+		rec.record(Outgoing, p[:n])
+	}
+	return n, err
+}
+
+// Close closes the wrapped stream.
+func (rec *recording) Close() error {
+	if err := rec.wrapped.Close(); err != nil {
+		return err
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.err
+}
+
+func (rec *recording) record(dir Direction, data []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	t := time.Now()
+	for _, recorder := range rec.recorders {
+		if err := recorder.Record(t, dir, data); err != nil && rec.err == nil {
+			rec.err = err
+		}
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ioextra
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// previewForms returns whether the event is rendered as text, in hex, both
+// or as a dump.
+func previewForms(event PreviewEvent, mode PreviewMode) (asText, asHex, asDump bool) {
+	if mode == DefaultPreview {
+		mode = TextPreview
+		if event.Immediate {
+			mode = HexPreview
+		}
+	}
+	return mode == TextPreview || mode == BothPreview, mode == HexPreview || mode == BothPreview, mode == DumpPreview
+}
+
+// dumpLines returns rows of 16 bytes of data, with offsets from the start of
+// the data and printable characters, as shown by hexdump -C.
+func dumpLines(data []byte) []string {
+	return strings.Split(strings.TrimSuffix(hex.Dump(data), "\n"), "\n")
+}
+
+// timestamp returns the prefix of rendered lines, the time of the event
+// since the start, if set.
+func timestamp(event PreviewEvent, start time.Time) string {
+	if start.IsZero() {
+		return "   "
+	}
+	return fmt.Sprintf("%10.3f ", event.Time.Sub(start).Seconds())
+}
+
+// TextRenderer renders previewed data as quoted text, in hex or both,
+// prefixed with its direction.
+type TextRenderer struct {
+	output io.Writer
+	mode   PreviewMode
+	start  time.Time
+}
+
+// NewTextRenderer returns a renderer writing to the given writer.
+func NewTextRenderer(output io.Writer) *TextRenderer {
+	return &TextRenderer{output: output}
+}
+
+// WithMode returns a renderer rendering data in the given mode.
+func (r *TextRenderer) WithMode(mode PreviewMode) *TextRenderer {
+	r.mode = mode
+	return r
+}
+
+// WithTimestamps returns a renderer prefixing lines with the time since the
+// start, in seconds.
+func (r *TextRenderer) WithTimestamps(start time.Time) *TextRenderer {
+	r.start = start
+	return r
+}
+
+// Render implements PreviewRenderer.
+func (r *TextRenderer) Render(event PreviewEvent) {
+	asText, asHex, asDump := previewForms(event, r.mode)
+	if asText {
+		fmt.Fprintf(r.output, "%s%s %q\n", timestamp(event, r.start), event.Direction.Marker(), event.Data)
+	}
+	if asHex {
+		fmt.Fprintf(r.output, "%s%s % #x\n", timestamp(event, r.start), event.Direction.Marker(), event.Data)
+	}
+	if asDump {
+		for _, line := range dumpLines(event.Data) {
+			fmt.Fprintf(r.output, "%s%s %s\n", timestamp(event, r.start), event.Direction.Marker(), line)
+		}
+	}
+}
+
+// ANSI escape sequences used by ColorRenderer.
+const (
+	ansiReset     = "\033[0m"
+	ansiGreen     = "\033[32m"
+	ansiYellow    = "\033[33m"
+	ansiInverse   = "\033[7m"
+	ansiNoInverse = "\033[27m"
+)
+
+// colors of each direction.
+var colors = map[Direction]string{
+	Incoming: ansiGreen,
+	Outgoing: ansiYellow,
+}
+
+// ColorRenderer renders previewed data like TextRenderer, with ANSI colors:
+// incoming data in green, outgoing data in yellow and control bytes, such as
+// carriage returns or escape sequences of terminals, in inverse video.
+type ColorRenderer struct {
+	output io.Writer
+	mode   PreviewMode
+	start  time.Time
+}
+
+// NewColorRenderer returns a renderer writing to the given terminal.
+func NewColorRenderer(output io.Writer) *ColorRenderer {
+	return &ColorRenderer{output: output}
+}
+
+// WithMode returns a renderer rendering data in the given mode.
+func (r *ColorRenderer) WithMode(mode PreviewMode) *ColorRenderer {
+	r.mode = mode
+	return r
+}
+
+// WithTimestamps returns a renderer prefixing lines with the time since the
+// start, in seconds.
+func (r *ColorRenderer) WithTimestamps(start time.Time) *ColorRenderer {
+	r.start = start
+	return r
+}
+
+// Render implements PreviewRenderer.
+func (r *ColorRenderer) Render(event PreviewEvent) {
+	asText, asHex, asDump := previewForms(event, r.mode)
+	if asText {
+		fmt.Fprintf(r.output, "%s%s%s %s%s\n", colors[event.Direction], timestamp(event, r.start), event.Direction.Marker(), quoteHighlighted(event.Data), ansiReset)
+	}
+	if asHex {
+		fmt.Fprintf(r.output, "%s%s%s %s%s\n", colors[event.Direction], timestamp(event, r.start), event.Direction.Marker(), hexHighlighted(event.Data), ansiReset)
+	}
+	if asDump {
+		for _, line := range dumpLines(event.Data) {
+			fmt.Fprintf(r.output, "%s%s%s %s%s\n", colors[event.Direction], timestamp(event, r.start), event.Direction.Marker(), line, ansiReset)
+		}
+	}
+}
+
+// highlight shows text in inverse video.
+func highlight(sb *strings.Builder, text string) {
+	sb.WriteString(ansiInverse)
+	sb.WriteString(text)
+	sb.WriteString(ansiNoInverse)
+}
+
+// quoteHighlighted quotes data like %q, highlighting escaped control bytes
+// and invalid UTF-8.
+func quoteHighlighted(data []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		switch {
+		case r == utf8.RuneError && size == 1:
+			highlight(&sb, fmt.Sprintf(`\x%02x`, data[0]))
+		case r == '"' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case unicode.IsPrint(r):
+			sb.WriteRune(r)
+		default:
+			quoted := strconv.QuoteRune(r)
+			highlight(&sb, quoted[1:len(quoted)-1])
+		}
+		data = data[size:]
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// hexHighlighted formats data like % #x, highlighting control bytes.
+func hexHighlighted(data []byte) string {
+	var sb strings.Builder
+	for i, b := range data {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		if b < 0x20 || b == 0x7f {
+			highlight(&sb, fmt.Sprintf("%#02x", b))
+		} else {
+			fmt.Fprintf(&sb, "%#02x", b)
+		}
+	}
+	return sb.String()
+}
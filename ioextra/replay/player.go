@@ -0,0 +1,131 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/zyga/oh-flash-tools/ioextra"
+)
+
+// Player is a ReadWriteCloser replaying the board side of a recorded session.
+//
+// Incoming events of the transcript are returned by Read, in order, but only
+// after all the outgoing events preceding them were written. Written data must
+// match the outgoing events exactly, although it may be split differently.
+// Timestamps and notes are ignored, data is replayed as fast as it is consumed.
+type Player struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	events []Event
+	err    error // mismatch detected by Write
+	closed bool
+}
+
+// NewPlayer returns a player replaying the given events.
+func NewPlayer(events []Event) *Player {
+	player := &Player{}
+	// Copy the events, as they are consumed during the replay.
+	for _, ev := range events {
+		if len(ev.Data) > 0 {
+			player.events = append(player.events, Event{Time: ev.Time, Dir: ev.Dir, Data: append([]byte(nil), ev.Data...)})
+		}
+	}
+	player.cond = sync.NewCond(&player.mu)
+	return player
+}
+
+// Read returns the next incoming data of the transcript.
+//
+// Read blocks until the preceding outgoing data is written. At the end of the
+// transcript Read returns io.EOF.
+func (player *Player) Read(p []byte) (int, error) {
+	player.mu.Lock()
+	defer player.mu.Unlock()
+	for {
+		switch {
+		case player.err != nil:
+			return 0, player.err
+		case player.closed:
+			return 0, io.ErrClosedPipe
+		case len(player.events) == 0:
+			return 0, io.EOF
+		case player.events[0].Dir == ioextra.Incoming:
+			ev := &player.events[0]
+			n := copy(p, ev.Data)
+			ev.Data = ev.Data[n:]
+			if len(ev.Data) == 0 {
+				player.events = player.events[1:]
+			}
+			return n, nil
+		}
+		player.cond.Wait()
+	}
+}
+
+// Write checks that the data matches the next outgoing data of the transcript.
+func (player *Player) Write(p []byte) (int, error) {
+	player.mu.Lock()
+	defer player.mu.Unlock()
+	defer player.cond.Broadcast()
+	if player.err != nil {
+		return 0, player.err
+	}
+	if player.closed {
+		return 0, io.ErrClosedPipe
+	}
+	for n := 0; n < len(p); {
+		if len(player.events) == 0 || player.events[0].Dir != ioextra.Outgoing {
+			player.err = fmt.Errorf("cannot replay transcript: unexpected write of %q", p[n:])
+			return n, player.err
+		}
+		ev := &player.events[0]
+		m := len(p) - n
+		if m > len(ev.Data) {
+			m = len(ev.Data)
+		}
+		if !bytes.Equal(p[n:n+m], ev.Data[:m]) {
+			player.err = fmt.Errorf("cannot replay transcript: expected write of %q, got %q", ev.Data, p[n:])
+			return n, player.err
+		}
+		ev.Data = ev.Data[m:]
+		if len(ev.Data) == 0 {
+			player.events = player.events[1:]
+		}
+		n += m
+	}
+	return len(p), nil
+}
+
+// Close stops the replay, unblocking pending reads.
+func (player *Player) Close() error {
+	player.mu.Lock()
+	defer player.mu.Unlock()
+	player.closed = true
+	player.cond.Broadcast()
+	return nil
+}
+
+// Done returns true if the whole transcript was replayed.
+func (player *Player) Done() bool {
+	player.mu.Lock()
+	defer player.mu.Unlock()
+	return len(player.events) == 0
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/zyga/oh-flash-tools/ioextra/replay"
+	"github.com/zyga/oh-flash-tools/ubootshell"
+)
+
+// session is a transcript of interrupting auto-boot, reading and setting a variable.
+//
+// Notes are not replayed.
+const session = `2020-10-15T12:30:00.100000Z === "interrupt auto-boot"
+2020-10-15T12:30:00.120000Z <<< "\r\n\r\nU-Boot 2016.11 (Jun 24 2020 - 10:05:31 +0800)\r\n\r\n"
+2020-10-15T12:30:00.500000Z <<< "Hit any key to stop autoboot:  3 "
+2020-10-15T12:30:00.510000Z >>> "\n"
+2020-10-15T12:30:00.520000Z <<< "\b\b\b 0 \r\nhisilicon # "
+2020-10-15T12:30:00.530000Z >>> "\n"
+2020-10-15T12:30:00.540000Z <<< "\r\nhisilicon # "
+2020-10-15T12:30:00.600000Z >>> "printenv bootcmd"
+2020-10-15T12:30:00.610000Z <<< "printenv bootcmd"
+2020-10-15T12:30:00.620000Z >>> "\n"
+2020-10-15T12:30:00.630000Z <<< "\r\nbootcmd=sf probe 0; sf read 0x42000000 0x100000 0x600000; bootm 0x42000000\r\nhisilicon # "
+2020-10-15T12:30:00.700000Z >>> "setenv bootdelay '0'"
+2020-10-15T12:30:00.710000Z <<< "setenv bootdelay '0'"
+2020-10-15T12:30:00.720000Z >>> "\n"
+2020-10-15T12:30:00.730000Z <<< "\r\nhisilicon # "
+`
+
+// replaySession runs the session recorded in the transcript.
+func replaySession(t *testing.T, transcript string) *replay.Player {
+	t.Helper()
+	events, err := replay.ReadTranscript(strings.NewReader(transcript))
+	if err != nil {
+		t.Fatalf("cannot read transcript: %v", err)
+	}
+	player := replay.NewPlayer(events)
+	t.Cleanup(func() { player.Close() })
+	uboot := ubootshell.NewUBootShell(context.Background(), player)
+	if err := uboot.InterruptBoot(); err != nil {
+		t.Fatalf("cannot interrupt boot: %v", err)
+	}
+	if err := uboot.ProbePrompt(); err != nil {
+		t.Fatalf("cannot detect prompt: %v", err)
+	}
+	output, err := uboot.Command("printenv bootcmd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "bootcmd=sf probe 0; sf read 0x42000000 0x100000 0x600000; bootm 0x42000000\r\n"
+	if output != expected {
+		t.Fatalf("expected output %q, got %q", expected, output)
+	}
+	if err := uboot.SetEnv("bootdelay", "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return player
+}
+
+func TestReplaySession(t *testing.T) {
+	player := replaySession(t, session)
+	if !player.Done() {
+		t.Fatalf("transcript was not replayed completely")
+	}
+}
+
+func TestReplayTimestampsOutOfOrder(t *testing.T) {
+	// Events are replayed in the order of the lines, timestamps are only
+	// informative and may go backwards, for example after a clock change.
+	lines := strings.Split(session, "\n")
+	lines[5] = strings.Replace(lines[5], "2020-10-15T12:30:00.530000Z", "2020-10-15T12:29:00Z", 1)
+	lines[7] = strings.Replace(lines[7], "2020-10-15T12:30:00.600000Z", "2019-01-01T00:00:00Z", 1)
+	player := replaySession(t, strings.Join(lines, "\n"))
+	if !player.Done() {
+		t.Fatalf("transcript was not replayed completely")
+	}
+}
+
+func TestReplayTruncatedLine(t *testing.T) {
+	// The last line was cut in the middle of the quoted data.
+	transcript := session[:strings.LastIndex(session, "hisilicon # ")]
+	_, err := replay.ReadTranscript(strings.NewReader(transcript))
+	if err == nil || !strings.Contains(err.Error(), "cannot parse transcript line 15") {
+		t.Fatalf("expected error about line 15, got %v", err)
+	}
+}
+
+func TestReplayTruncatedSession(t *testing.T) {
+	// The recording stopped before u-boot printed the output of printenv.
+	lines := strings.Split(session, "\n")
+	events, err := replay.ReadTranscript(strings.NewReader(strings.Join(lines[:10], "\n")))
+	if err != nil {
+		t.Fatalf("cannot read transcript: %v", err)
+	}
+	player := replay.NewPlayer(events)
+	defer player.Close()
+	uboot := ubootshell.NewUBootShell(context.Background(), player)
+	if err := uboot.InterruptBoot(); err != nil {
+		t.Fatalf("cannot interrupt boot: %v", err)
+	}
+	if err := uboot.ProbePrompt(); err != nil {
+		t.Fatalf("cannot detect prompt: %v", err)
+	}
+	_, err = uboot.Command("printenv bootcmd")
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected end of transcript, got %v", err)
+	}
+	if !player.Done() {
+		t.Fatalf("transcript was not replayed completely")
+	}
+}
+
+func TestReplayUnexpectedCommand(t *testing.T) {
+	events, err := replay.ReadTranscript(strings.NewReader(session))
+	if err != nil {
+		t.Fatalf("cannot read transcript: %v", err)
+	}
+	player := replay.NewPlayer(events)
+	defer player.Close()
+	uboot := ubootshell.NewUBootShell(context.Background(), player)
+	if err := uboot.InterruptBoot(); err != nil {
+		t.Fatalf("cannot interrupt boot: %v", err)
+	}
+	if err := uboot.ProbePrompt(); err != nil {
+		t.Fatalf("cannot detect prompt: %v", err)
+	}
+	_, err = uboot.Command("printenv bootargs")
+	if err == nil || !strings.Contains(err.Error(), "cannot replay transcript") {
+		t.Fatalf("expected replay mismatch, got %v", err)
+	}
+	if player.Done() {
+		t.Fatalf("transcript should not be replayed completely")
+	}
+}
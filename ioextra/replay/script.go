@@ -0,0 +1,159 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Script is a ReadWriteCloser simulating a simple u-boot shell.
+//
+// The shell prints the auto-boot banner, if any, and waits for a key. It then
+// shows the prompt, echoes typed characters and answers each command with the
+// output registered with Handle. Ctrl-C cancels the typed line, just like in
+// u-boot.
+type Script struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	output   bytes.Buffer // data waiting to be read
+	prompt   string
+	handlers map[string]string
+	line     []byte
+	autoboot bool // waiting for a key to stop auto-boot
+	closed   bool
+	commands []string
+}
+
+// NewScript returns a simulated shell with the given prompt.
+//
+// The prompt is shown right away, see WithBanner for simulating auto-boot.
+func NewScript(prompt string) *Script {
+	script := &Script{prompt: prompt, handlers: make(map[string]string)}
+	script.cond = sync.NewCond(&script.mu)
+	script.output.WriteString(prompt)
+	return script
+}
+
+// WithBanner returns a shell printing the given auto-boot banner first.
+//
+// The prompt is only shown once a key is pressed.
+func (script *Script) WithBanner(banner string) *Script {
+	script.mu.Lock()
+	defer script.mu.Unlock()
+	script.output.Reset()
+	script.output.WriteString(banner)
+	script.output.WriteString(":  3 ")
+	script.autoboot = true
+	return script
+}
+
+// Handle registers the output of the given command.
+//
+// Lines of the output should be terminated with "\r\n", as u-boot does.
+// Commands without output must be registered as well, unknown commands are
+// rejected just like u-boot does.
+func (script *Script) Handle(cmd, output string) *Script {
+	script.mu.Lock()
+	defer script.mu.Unlock()
+	script.handlers[cmd] = output
+	return script
+}
+
+// Commands returns the commands executed so far.
+func (script *Script) Commands() []string {
+	script.mu.Lock()
+	defer script.mu.Unlock()
+	return append([]string(nil), script.commands...)
+}
+
+// Read returns the output of the shell, blocking until some is available.
+func (script *Script) Read(p []byte) (int, error) {
+	script.mu.Lock()
+	defer script.mu.Unlock()
+	for script.output.Len() == 0 {
+		if script.closed {
+			return 0, io.EOF
+		}
+		script.cond.Wait()
+	}
+	return script.output.Read(p)
+}
+
+// Write types the given data into the shell.
+func (script *Script) Write(p []byte) (int, error) {
+	script.mu.Lock()
+	defer script.mu.Unlock()
+	defer script.cond.Broadcast()
+	if script.closed {
+		return 0, io.ErrClosedPipe
+	}
+	for _, b := range p {
+		script.typeByte(b)
+	}
+	return len(p), nil
+}
+
+// Close shuts the shell down, pending reads return io.EOF.
+func (script *Script) Close() error {
+	script.mu.Lock()
+	defer script.mu.Unlock()
+	script.closed = true
+	script.cond.Broadcast()
+	return nil
+}
+
+func (script *Script) typeByte(b byte) {
+	if script.autoboot {
+		// Any key stops auto-boot, the key itself is discarded.
+		script.autoboot = false
+		script.output.WriteString("\b\b\b 0 \r\n")
+		script.output.WriteString(script.prompt)
+		return
+	}
+	switch b {
+	case '\r', '\n':
+		script.output.WriteString("\r\n")
+		script.execute(string(script.line))
+		script.line = script.line[:0]
+		script.output.WriteString(script.prompt)
+	case 0x03:
+		script.output.WriteString("<INTERRUPT>\r\n")
+		script.line = script.line[:0]
+		script.output.WriteString(script.prompt)
+	default:
+		script.output.WriteByte(b)
+		script.line = append(script.line, b)
+	}
+}
+
+func (script *Script) execute(cmd string) {
+	cmd = strings.TrimSpace(cmd)
+	if cmd == "" {
+		return
+	}
+	script.commands = append(script.commands, cmd)
+	if output, ok := script.handlers[cmd]; ok {
+		script.output.WriteString(output)
+		return
+	}
+	name := strings.Fields(cmd)[0]
+	script.output.WriteString(fmt.Sprintf("Unknown command '%s' - try 'help'\r\n", name))
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/ioextra"
+)
+
+// Event is a single read or write recorded in a transcript, or a note.
+type Event struct {
+	Time time.Time
+	Dir  ioextra.Direction
+	Data []byte
+	Note string // written with Transcript.Note, such events have no data
+}
+
+// ReadTranscript reads events recorded by ioextra.Transcript.
+func ReadTranscript(r io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("cannot parse transcript line %d: expected timestamp, direction and data", lineno)
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse transcript line %d: %w", lineno, err)
+		}
+		text, err := strconv.Unquote(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse transcript line %d: %w", lineno, err)
+		}
+		var dir ioextra.Direction
+		switch fields[1] {
+		case ioextra.NoteMarker:
+			events = append(events, Event{Time: t, Note: text})
+			continue
+		case ioextra.Incoming.Marker():
+			dir = ioextra.Incoming
+		case ioextra.Outgoing.Marker():
+			dir = ioextra.Outgoing
+		default:
+			return nil, fmt.Errorf("cannot parse transcript line %d: unknown direction %q", lineno, fields[1])
+		}
+		events = append(events, Event{Time: t, Dir: dir, Data: []byte(text)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read transcript: %w", err)
+	}
+	return events, nil
+}
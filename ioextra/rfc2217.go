@@ -0,0 +1,300 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ioextra
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// dialTimeout bounds the time spent connecting to a remote serial port.
+const dialTimeout = 10 * time.Second
+
+// IsNetworkSerial returns true if the name is an address of a remote serial port.
+func IsNetworkSerial(name string) bool {
+	u, err := url.Parse(name)
+	return err == nil && (u.Scheme == "tcp" || u.Scheme == "rfc2217") && u.Host != ""
+}
+
+// DialSerial connects to a serial port exposed over the network.
+//
+// Addresses of the form tcp://host:port connect to ports exposed as raw TCP
+// streams, for example by ser2net. The settings of such ports are configured
+// on the remote host. Addresses of the form rfc2217://host:port connect to
+// ports exposed with the telnet com port control option. The port is then
+// configured to use the given baud rate, eight data bits, no parity and one
+// stop bit.
+func DialSerial(address string, baudRate int) (io.ReadWriteCloser, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to serial port %s: %w", address, err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		return conn, nil
+	case "rfc2217":
+		port := NewRFC2217Port(conn)
+		if err := port.negotiate(baudRate); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot configure serial port %s: %w", address, err)
+		}
+		return port, nil
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("cannot connect to serial port %s: unsupported scheme %q", address, u.Scheme)
+	}
+}
+
+// Telnet commands and options used by RFC 2217.
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+
+	optionBinary  = 0
+	optionSGA     = 3
+	optionComPort = 44
+
+	comPortSetBaudRate = 1
+	comPortSetDataSize = 2
+	comPortSetParity   = 3
+	comPortSetStopSize = 4
+
+	comPortParityNone = 1
+	comPortStopSize1  = 1
+)
+
+// RFC2217Port is a serial port exposed over telnet with the com port control option.
+//
+// Telnet commands are removed from the data that is read and bytes equal to
+// the telnet command marker are escaped in the data that is written.
+type RFC2217Port struct {
+	conn     io.ReadWriteCloser
+	writeMu  sync.Mutex
+	announce map[[2]byte]bool // negotiation already sent
+	baudRate int
+
+	// state of the telnet protocol decoder
+	state  int
+	verb   byte
+	subneg []byte
+}
+
+// States of the telnet decoder.
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSubneg
+	telnetSubnegIAC
+)
+
+// NewRFC2217Port returns a port talking telnet over the given connection.
+func NewRFC2217Port(conn io.ReadWriteCloser) *RFC2217Port {
+	return &RFC2217Port{conn: conn, announce: make(map[[2]byte]bool)}
+}
+
+// negotiate enables binary transmission and com port control and configures the port.
+func (port *RFC2217Port) negotiate(baudRate int) error {
+	for _, neg := range [][2]byte{
+		{telnetWILL, optionBinary}, {telnetDO, optionBinary},
+		{telnetWILL, optionSGA}, {telnetDO, optionSGA},
+		{telnetWILL, optionComPort},
+	} {
+		if err := port.sendNegotiation(neg[0], neg[1]); err != nil {
+			return err
+		}
+	}
+	if err := port.SetBaudRate(baudRate); err != nil {
+		return err
+	}
+	if err := port.sendComPort(comPortSetDataSize, 8); err != nil {
+		return err
+	}
+	if err := port.sendComPort(comPortSetParity, comPortParityNone); err != nil {
+		return err
+	}
+	return port.sendComPort(comPortSetStopSize, comPortStopSize1)
+}
+
+// BaudRate returns the baud rate requested most recently.
+func (port *RFC2217Port) BaudRate() int {
+	return port.baudRate
+}
+
+// SetBaudRate asks the remote host to change the baud rate of the port.
+func (port *RFC2217Port) SetBaudRate(baudRate int) error {
+	var value [4]byte
+	binary.BigEndian.PutUint32(value[:], uint32(baudRate))
+	if err := port.sendComPort(comPortSetBaudRate, value[:]...); err != nil {
+		return err
+	}
+	port.baudRate = baudRate
+	return nil
+}
+
+// Read reads data from the port, handling telnet commands sent by the remote host.
+func (port *RFC2217Port) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	raw := make([]byte, len(p))
+	for {
+		n, err := port.conn.Read(raw)
+		m := 0
+		for _, b := range raw[:n] {
+			data, ok, werr := port.decode(b)
+			if werr != nil && err == nil {
+				err = werr
+			}
+			if ok {
+				p[m] = data
+				m++
+			}
+		}
+		if m > 0 || err != nil {
+			return m, err
+		}
+	}
+}
+
+// decode advances the telnet decoder, returning data bytes.
+func (port *RFC2217Port) decode(b byte) (data byte, ok bool, err error) {
+	switch port.state {
+	case telnetData:
+		if b == telnetIAC {
+			port.state = telnetCommand
+			return 0, false, nil
+		}
+		return b, true, nil
+	case telnetCommand:
+		port.state = telnetData
+		switch b {
+		case telnetIAC:
+			return b, true, nil
+		case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+			port.verb = b
+			port.state = telnetOption
+		case telnetSB:
+			port.subneg = port.subneg[:0]
+			port.state = telnetSubneg
+		}
+		return 0, false, nil
+	case telnetOption:
+		port.state = telnetData
+		return 0, false, port.answer(port.verb, b)
+	case telnetSubneg:
+		if b == telnetIAC {
+			port.state = telnetSubnegIAC
+		} else {
+			port.subneg = append(port.subneg, b)
+		}
+		return 0, false, nil
+	case telnetSubnegIAC:
+		if b == telnetSE {
+			// Notifications and confirmations of com port settings are ignored.
+			port.state = telnetData
+		} else {
+			port.subneg = append(port.subneg, b)
+			port.state = telnetSubneg
+		}
+		return 0, false, nil
+	}
+	return 0, false, nil
+}
+
+// answer responds to option negotiation of the remote host.
+func (port *RFC2217Port) answer(verb, option byte) error {
+	supported := option == optionBinary || option == optionSGA || option == optionComPort
+	switch verb {
+	case telnetDO:
+		if supported {
+			return port.sendNegotiation(telnetWILL, option)
+		}
+		return port.sendNegotiation(telnetWONT, option)
+	case telnetWILL:
+		if supported && option != optionComPort {
+			return port.sendNegotiation(telnetDO, option)
+		}
+		return port.sendNegotiation(telnetDONT, option)
+	}
+	return nil
+}
+
+// sendNegotiation sends an option negotiation, unless it was already sent.
+func (port *RFC2217Port) sendNegotiation(verb, option byte) error {
+	port.writeMu.Lock()
+	defer port.writeMu.Unlock()
+	if port.announce[[2]byte{verb, option}] {
+		return nil
+	}
+	port.announce[[2]byte{verb, option}] = true
+	_, err := port.conn.Write([]byte{telnetIAC, verb, option})
+	return err
+}
+
+// sendComPort sends a com port control command.
+func (port *RFC2217Port) sendComPort(cmd byte, value ...byte) error {
+	buf := []byte{telnetIAC, telnetSB, optionComPort, cmd}
+	buf = append(buf, escapeIAC(value)...)
+	buf = append(buf, telnetIAC, telnetSE)
+	port.writeMu.Lock()
+	defer port.writeMu.Unlock()
+	_, err := port.conn.Write(buf)
+	return err
+}
+
+// Write writes data to the port, escaping the telnet command marker.
+func (port *RFC2217Port) Write(p []byte) (int, error) {
+	port.writeMu.Lock()
+	defer port.writeMu.Unlock()
+	if _, err := port.conn.Write(escapeIAC(p)); err != nil {
+		// The number of escaped bytes written does not translate to p.
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the connection.
+func (port *RFC2217Port) Close() error {
+	return port.conn.Close()
+}
+
+// escapeIAC doubles each byte equal to the telnet command marker.
+func escapeIAC(data []byte) []byte {
+	escaped := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b == telnetIAC {
+			escaped = append(escaped, telnetIAC)
+		}
+		escaped = append(escaped, b)
+	}
+	return escaped
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ioextra
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned when a read or write does not complete in time.
+//
+// The error has a Timeout method returning true, just like network errors.
+var ErrTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "i/o timeout" }
+func (timeoutError) Timeout() bool { return true }
+
+type ioResult struct {
+	buf []byte
+	n   int
+	err error
+}
+
+type timeout struct {
+	wrapped      io.ReadWriteCloser
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	readMu      sync.Mutex
+	pendingRead chan ioResult // read in progress, if any
+	readBuf     []byte        // data read but not yet returned
+	readErr     error         // error to return once readBuf is drained
+
+	writeMu      sync.Mutex
+	pendingWrite chan ioResult // write in progress, if any
+}
+
+// NewTimeoutReadWriteCloser provides a ReadWriteCloser with bounded blocking.
+//
+// Reads and writes that do not complete in the given time return ErrTimeout.
+// Zero timeout disables the corresponding limit.
+//
+// The wrapped stream is used by helper goroutines, so that a timed out read
+// or write keeps going in the background. Data read after a read timed out
+// is returned by the next read. Data of a write that timed out may still be
+// written, before any subsequent writes. Helper goroutines finish once the
+// wrapped stream is closed.
+func NewTimeoutReadWriteCloser(wrapped io.ReadWriteCloser, readTimeout, writeTimeout time.Duration) io.ReadWriteCloser {
+	return &timeout{
+		wrapped:      wrapped,
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// Read reads data from the wrapped stream, waiting at most the read timeout.
+func (rwc *timeout) Read(p []byte) (n int, err error) {
+	rwc.readMu.Lock()
+	defer rwc.readMu.Unlock()
+
+	if len(rwc.readBuf) > 0 {
+		n = copy(p, rwc.readBuf)
+		rwc.readBuf = rwc.readBuf[n:]
+		if len(rwc.readBuf) == 0 {
+			err, rwc.readErr = rwc.readErr, nil
+		}
+		return n, err
+	}
+	if rwc.readTimeout <= 0 && rwc.pendingRead == nil {
+		return rwc.wrapped.Read(p)
+	}
+	if rwc.pendingRead == nil {
+		// Read at least as much as bufio.Reader would.
+		size := len(p)
+		if size < 4096 {
+			size = 4096
+		}
+		buf := make([]byte, size)
+		ch := make(chan ioResult, 1)
+		go func() {
+			n, err := rwc.wrapped.Read(buf)
+			ch <- ioResult{buf: buf[:n], n: n, err: err}
+		}()
+		rwc.pendingRead = ch
+	}
+	var expired <-chan time.Time
+	if rwc.readTimeout > 0 {
+		timer := time.NewTimer(rwc.readTimeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case res := <-rwc.pendingRead:
+		rwc.pendingRead = nil
+		n = copy(p, res.buf)
+		if n < len(res.buf) {
+			rwc.readBuf = res.buf[n:]
+			rwc.readErr = res.err
+			return n, nil
+		}
+		return n, res.err
+	case <-expired:
+		return 0, ErrTimeout
+	}
+}
+
+// Write writes data to the wrapped stream, waiting at most the write timeout.
+func (rwc *timeout) Write(p []byte) (n int, err error) {
+	rwc.writeMu.Lock()
+	defer rwc.writeMu.Unlock()
+
+	if rwc.writeTimeout <= 0 && rwc.pendingWrite == nil {
+		return rwc.wrapped.Write(p)
+	}
+	var expired <-chan time.Time
+	if rwc.writeTimeout > 0 {
+		timer := time.NewTimer(rwc.writeTimeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	// Writes must not be reordered, wait for the write that timed out.
+	if rwc.pendingWrite != nil {
+		select {
+		case <-rwc.pendingWrite:
+			rwc.pendingWrite = nil
+		case <-expired:
+			return 0, ErrTimeout
+		}
+	}
+	buf := append([]byte(nil), p...)
+	ch := make(chan ioResult, 1)
+	go func() {
+		n, err := rwc.wrapped.Write(buf)
+		ch <- ioResult{n: n, err: err}
+	}()
+	select {
+	case res := <-ch:
+		return res.n, res.err
+	case <-expired:
+		rwc.pendingWrite = ch
+		return 0, ErrTimeout
+	}
+}
+
+// Close closes the wrapped stream.
+func (rwc *timeout) Close() error {
+	return rwc.wrapped.Close()
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ioextra
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transcript records stream traffic in a human readable form.
+//
+// Each read or write is recorded as a single line with a timestamp, a
+// direction marker and the data as a quoted Go string, for example:
+//
+//	2020-10-15T12:30:01.123456Z <<< "U-Boot 2020.01\r\n"
+//
+// Incoming data is marked with "<<<" and outgoing data with ">>>", just
+// like in the preview. Lines marked with "===" hold a quoted note, such as
+// the name of a stage of flashing starting at that time:
+//
+//	2020-10-15T12:30:02.500000Z === "interrupt auto-boot"
+//
+// Notes may be written concurrently with the data.
+type Transcript struct {
+	mu  sync.Mutex
+	log io.Writer
+}
+
+// NoteMarker is the marker of notes in transcripts.
+const NoteMarker = "==="
+
+// NewTranscript returns a recorder writing a transcript to the given log.
+func NewTranscript(log io.Writer) *Transcript {
+	return &Transcript{log: log}
+}
+
+// Record writes a single line of the transcript.
+func (tr *Transcript) Record(t time.Time, dir Direction, data []byte) error {
+	return tr.writeLine(t, dir.Marker(), string(data))
+}
+
+// Note writes a note, such as the name of the stage starting at that time.
+func (tr *Transcript) Note(t time.Time, note string) error {
+	return tr.writeLine(t, NoteMarker, note)
+}
+
+func (tr *Transcript) writeLine(t time.Time, marker, text string) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	timestamp := t.UTC().Format(time.RFC3339Nano)
+	if _, err := fmt.Fprintf(tr.log, "%s %s %s\n", timestamp, marker, strconv.Quote(text)); err != nil {
+		return fmt.Errorf("cannot record transcript: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging lets library code report what it is doing without
+// printing anything by itself.
+//
+// Types that report progress, such as ubootshell.UBootShell, accept a Logger
+// and discard all the messages by default. Command line tools use Stdout.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Logger receives messages describing progress.
+//
+// Messages end with a newline. The standard *log.Logger implements it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// Discard drops all the messages.
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Printf(format string, args ...interface{}) {}
+
+// Stdout writes messages to the standard output.
+var Stdout Logger = New(os.Stdout)
+
+// New returns a logger writing messages to the given writer, as they are.
+func New(w io.Writer) Logger {
+	return &writer{w: w}
+}
+
+type writer struct {
+	w io.Writer
+}
+
+func (log *writer) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(log.w, format, args...)
+}
+
+// OrDiscard returns the logger, or Discard if it is nil.
+//
+// It allows zero values of types with an optional logger field to be useful.
+func OrDiscard(log Logger) Logger {
+	if log == nil {
+		return Discard
+	}
+	return log
+}
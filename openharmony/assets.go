@@ -17,10 +17,180 @@ limitations under the License.
 // Package openharmony contains definitions common to open harmony.
 package openharmony
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
 // Assets describes build artefacts of an open harmony system.
+//
+// Boards use different sets of assets. Small systems, such as hi3518ev300,
+// have a bootloader, kernel, root and user file systems. Standard systems,
+// such as rk3568, have u-boot, a boot image and system, vendor and user data
+// file systems. Both may have a device tree blob. Images of any other
+// partitions, such as trusted firmware, are kept in Images, by the name of
+// the partition.
 type Assets struct {
 	BootLoaderPath string // "uboot.bin"
 	KernelPath     string // "OHOS_Image.bin"
+	DTBPath        string // "board.dtb"
 	RootfsPath     string // "rootfs.img"
 	UserfsPath     string // "userfs.img"
+	UBootPath      string // "uboot.img"
+	BootLinuxPath  string // "boot_linux.img"
+	SystemPath     string // "system.img"
+	VendorPath     string // "vendor.img"
+	UserdataPath   string // "userdata.img"
+
+	Images map[string]string // other partitions, such as "trust"
+}
+
+// Names of the assets, as used by Path and Select.
+const (
+	BootLoader = "bootloader"
+	Kernel     = "kernel"
+	DTB        = "dtb"
+	Rootfs     = "rootfs"
+	Userfs     = "userfs"
+	UBoot      = "uboot"
+	BootLinux  = "boot_linux"
+	System     = "system"
+	Vendor     = "vendor"
+	Userdata   = "userdata"
+)
+
+// AssetNames lists the names of all the assets, in the order of flashing.
+var AssetNames = []string{BootLoader, Kernel, DTB, Rootfs, Userfs, UBoot, BootLinux, System, Vendor, Userdata}
+
+// Path returns a pointer to the path of the named asset, or nil if the
+// name is not one of AssetNames. Use Get and Set for assets of any name.
+func (assets *Assets) Path(name string) *string {
+	switch name {
+	case BootLoader:
+		return &assets.BootLoaderPath
+	case Kernel:
+		return &assets.KernelPath
+	case DTB:
+		return &assets.DTBPath
+	case Rootfs:
+		return &assets.RootfsPath
+	case Userfs:
+		return &assets.UserfsPath
+	case UBoot:
+		return &assets.UBootPath
+	case BootLinux:
+		return &assets.BootLinuxPath
+	case System:
+		return &assets.SystemPath
+	case Vendor:
+		return &assets.VendorPath
+	case Userdata:
+		return &assets.UserdataPath
+	}
+	return nil
+}
+
+// Get returns the path of the named asset, or an empty string if not set.
+func (assets *Assets) Get(name string) string {
+	if path := assets.Path(name); path != nil {
+		return *path
+	}
+	return assets.Images[name]
+}
+
+// Set sets the path of the named asset.
+//
+// Assets not listed in AssetNames are stored in Images, an empty path removes
+// them.
+func (assets *Assets) Set(name, path string) {
+	if p := assets.Path(name); p != nil {
+		*p = path
+		return
+	}
+	if path == "" {
+		delete(assets.Images, name)
+		return
+	}
+	if assets.Images == nil {
+		assets.Images = make(map[string]string)
+	}
+	assets.Images[name] = path
+}
+
+// Names returns AssetNames followed by the sorted names of other images.
+func (assets *Assets) Names() []string {
+	names := append([]string(nil), AssetNames...)
+	var other []string
+	for name := range assets.Images {
+		if assets.Path(name) == nil {
+			other = append(other, name)
+		}
+	}
+	sort.Strings(other)
+	return append(names, other...)
+}
+
+// Empty returns true if no asset is set.
+func (assets *Assets) Empty() bool {
+	for _, name := range assets.Names() {
+		if assets.Get(name) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone returns a copy of the assets, which does not share Images.
+func (assets *Assets) Clone() *Assets {
+	clone := *assets
+	clone.Images = nil
+	for name, path := range assets.Images {
+		clone.Set(name, path)
+	}
+	return &clone
+}
+
+// Merge fills assets that are not set with those of the other set.
+func (assets *Assets) Merge(other *Assets) {
+	for _, name := range other.Names() {
+		if assets.Get(name) == "" {
+			assets.Set(name, other.Get(name))
+		}
+	}
+}
+
+// Select clears paths of the assets that should not be flashed.
+//
+// If only is not empty, all the assets it does not name are cleared. Assets
+// named in skip are cleared as well. Unknown names, and assets named in only
+// but without a path, are reported as errors. Names of images in Images are
+// known.
+func (assets *Assets) Select(only, skip []string) error {
+	names := assets.Names()
+	for _, name := range append(append([]string(nil), only...), skip...) {
+		if !contains(names, name) {
+			return fmt.Errorf("unknown image %q, expected one of %s", name, strings.Join(names, ", "))
+		}
+	}
+	for _, name := range only {
+		if assets.Get(name) == "" {
+			return fmt.Errorf("cannot flash only %s, no %s image given", name, name)
+		}
+	}
+	for _, name := range names {
+		if (len(only) > 0 && !contains(only, name)) || contains(skip, name) {
+			assets.Set(name, "")
+		}
+	}
+	return nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,171 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openharmony
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/logging"
+)
+
+// bundlePatterns describe names of images found in bundles.
+//
+// Images are matched by name, regardless of the directory they are in, as
+// HiSilicon bundles keep them in a directory named after the board.
+var bundlePatterns = []struct {
+	pattern string
+	field   func(*Assets) *string
+}{
+	{"u-boot*.bin", func(a *Assets) *string { return &a.BootLoaderPath }},
+	{"OHOS_Image.bin", func(a *Assets) *string { return &a.KernelPath }},
+	{"*.dtb", func(a *Assets) *string { return &a.DTBPath }},
+	{"rootfs*.img", func(a *Assets) *string { return &a.RootfsPath }},
+	{"userfs*.img", func(a *Assets) *string { return &a.UserfsPath }},
+	{"uboot.img", func(a *Assets) *string { return &a.UBootPath }},
+	{"boot_linux.img", func(a *Assets) *string { return &a.BootLinuxPath }},
+	{"system.img", func(a *Assets) *string { return &a.SystemPath }},
+	{"vendor.img", func(a *Assets) *string { return &a.VendorPath }},
+	{"userdata.img", func(a *Assets) *string { return &a.UserdataPath }},
+}
+
+// ExtractBundle extracts images from an archive into the given directory.
+//
+// Tar archives, optionally compressed with gzip, and zip archives are
+// supported. Returned assets point to the extracted images. Images missing
+// from the bundle are left empty. Extracted images are reported to the
+// logger, which may be nil.
+func ExtractBundle(bundlePath, dir string, log logging.Logger) (*Assets, error) {
+	log = logging.OrDiscard(log)
+	var assets Assets
+	extract := func(name string, r io.Reader) error {
+		target := bundleTarget(&assets, name)
+		if target == nil {
+			return nil
+		}
+		if *target != "" {
+			return fmt.Errorf("cannot extract %s: bundle contains more than one %s image", bundlePath, path.Base(name))
+		}
+		*target = filepath.Join(dir, path.Base(name))
+		log.Printf("Extracting %s\n", name)
+		return extractFile(*target, r)
+	}
+	var err error
+	switch {
+	case strings.HasSuffix(bundlePath, ".zip"):
+		err = walkZip(bundlePath, extract)
+	case strings.HasSuffix(bundlePath, ".tar.gz"), strings.HasSuffix(bundlePath, ".tgz"):
+		err = walkTar(bundlePath, true, extract)
+	case strings.HasSuffix(bundlePath, ".tar"):
+		err = walkTar(bundlePath, false, extract)
+	default:
+		return nil, fmt.Errorf("cannot extract %s: unsupported archive type", bundlePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if assets.Empty() {
+		return nil, fmt.Errorf("cannot find any images in %s", bundlePath)
+	}
+	return &assets, nil
+}
+
+// bundleTarget returns the asset field corresponding to the archive member.
+func bundleTarget(assets *Assets, name string) *string {
+	base := path.Base(name)
+	for _, p := range bundlePatterns {
+		if ok, _ := path.Match(p.pattern, base); ok {
+			return p.field(assets)
+		}
+	}
+	return nil
+}
+
+func walkTar(bundlePath string, compressed bool, fn func(name string, r io.Reader) error) error {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("cannot decompress %s: %w", bundlePath, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %w", bundlePath, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func walkZip(bundlePath string, fn func(name string, r io.Reader) error) error {
+	zr, err := zip.OpenReader(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %w", bundlePath, err)
+		}
+		err = fn(zf.Name, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(name string, r io.Reader) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
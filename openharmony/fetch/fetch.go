@@ -0,0 +1,171 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fetch downloads build artefacts to a local cache.
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/logging"
+)
+
+// IsURL returns true if the given asset location is a http or https URL.
+func IsURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// Cache is a directory with downloaded files.
+type Cache struct {
+	dir string
+	log logging.Logger
+}
+
+// NewCache returns a cache storing files in the given directory.
+func NewCache(dir string) *Cache {
+	return &Cache{dir: dir, log: logging.Discard}
+}
+
+// WithLogger returns a cache reporting downloads to the given logger.
+func (c *Cache) WithLogger(log logging.Logger) *Cache {
+	c.log = logging.OrDiscard(log)
+	return c
+}
+
+// DefaultCache returns a cache in the user cache directory.
+func DefaultCache() (*Cache, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return NewCache(filepath.Join(dir, "oh-flash")), nil
+}
+
+// Fetch downloads the file at the given URL and returns its local path.
+//
+// When the expected SHA-256 digest, in hex, is given, a previously downloaded
+// file is used if it is intact, and a new download is checked against it.
+// Without the digest the file is always downloaded again, as the content
+// behind the URL may have changed.
+//
+// Interrupted downloads are resumed, if the server supports range requests.
+func (c *Cache) Fetch(rawURL, digest string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return "", err
+	}
+	// Different URLs may end with the same name.
+	key := sha256.Sum256([]byte(rawURL))
+	name := filepath.Join(c.dir, hex.EncodeToString(key[:8])+"-"+path.Base(u.Path))
+	if digest != "" {
+		if actual, err := fileDigest(name); err == nil && strings.EqualFold(actual, digest) {
+			c.log.Printf("Using cached %s\n", name)
+			return name, nil
+		}
+	}
+	partial := name + ".part"
+	if err := c.download(rawURL, partial); err != nil {
+		return "", err
+	}
+	if digest != "" {
+		actual, err := fileDigest(partial)
+		if err != nil {
+			return "", err
+		}
+		if !strings.EqualFold(actual, digest) {
+			// Start from scratch next time.
+			os.Remove(partial)
+			return "", fmt.Errorf("%s has SHA-256 %s, expected %s", rawURL, actual, digest)
+		}
+	}
+	if err := os.Rename(partial, name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// download appends the content of the URL to the partially downloaded file.
+func (c *Cache) download(rawURL, partial string) error {
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		c.log.Printf("Resuming download of %s at %d bytes\n", rawURL, offset)
+	case http.StatusOK:
+		// The server sends everything, drop what we had.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		c.log.Printf("Downloading %s\n", rawURL)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The file was already downloaded completely.
+		return nil
+	default:
+		return fmt.Errorf("cannot download %s: %s", rawURL, resp.Status)
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return fmt.Errorf("cannot download %s: %w", rawURL, err)
+	}
+	return f.Close()
+}
+
+// fileDigest returns the SHA-256 digest of the given file, in hex.
+func fileDigest(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
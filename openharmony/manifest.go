@@ -0,0 +1,173 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openharmony
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/flash"
+)
+
+// Manifest describes a complete image set for a board.
+//
+// Manifests are stored as JSON, for example:
+//
+//	{
+//	    "board": "hi3518ev300",
+//	    "bootloader": {"path": "u-boot-hi3518ev300.bin", "sha256": "..."},
+//	    "kernel": {"path": "OHOS_Image.bin", "sha256": "..."},
+//	    "dtb": {"path": "board.dtb"},
+//	    "rootfs": {"path": "rootfs.img"},
+//	    "userfs": {"path": "userfs.img"},
+//	    "images": {"trust": {"path": "trust.img"}}
+//	}
+//
+// All the assets are optional. Relative paths are relative to the directory
+// containing the manifest. Assets may also be given as URLs.
+type Manifest struct {
+	Board      string         `json:"board"`
+	BootLoader *ManifestAsset `json:"bootloader,omitempty"`
+	Kernel     *ManifestAsset `json:"kernel,omitempty"`
+	DTB        *ManifestAsset `json:"dtb,omitempty"`
+	Rootfs     *ManifestAsset `json:"rootfs,omitempty"`
+	Userfs     *ManifestAsset `json:"userfs,omitempty"`
+	UBoot      *ManifestAsset `json:"uboot,omitempty"`
+	BootLinux  *ManifestAsset `json:"boot_linux,omitempty"`
+	System     *ManifestAsset `json:"system,omitempty"`
+	Vendor     *ManifestAsset `json:"vendor,omitempty"`
+	Userdata   *ManifestAsset `json:"userdata,omitempty"`
+	// Images are images of other partitions, by the name of the partition.
+	Images map[string]*ManifestAsset `json:"images,omitempty"`
+}
+
+// ManifestAsset describes a single asset listed in a manifest.
+type ManifestAsset struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256,omitempty"` // expected digest, in hex
+}
+
+// LoadManifest reads a manifest from the given file.
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest %s: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	for _, asset := range m.Entries() {
+		if asset.Path == "" {
+			return nil, fmt.Errorf("cannot parse manifest %s: asset without path", path)
+		}
+		if !filepath.IsAbs(asset.Path) && !strings.Contains(asset.Path, "://") {
+			asset.Path = filepath.Join(dir, asset.Path)
+		}
+	}
+	return &m, nil
+}
+
+// Entries returns the assets present in the manifest.
+func (m *Manifest) Entries() []*ManifestAsset {
+	var assets []*ManifestAsset
+	for _, asset := range []*ManifestAsset{m.BootLoader, m.Kernel, m.DTB, m.Rootfs, m.Userfs, m.UBoot, m.BootLinux, m.System, m.Vendor, m.Userdata} {
+		if asset != nil {
+			assets = append(assets, asset)
+		}
+	}
+	names := make([]string, 0, len(m.Images))
+	for name := range m.Images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if asset := m.Images[name]; asset != nil {
+			assets = append(assets, asset)
+		}
+	}
+	return assets
+}
+
+// Assets returns paths of the assets listed in the manifest.
+func (m *Manifest) Assets() *Assets {
+	path := func(asset *ManifestAsset) string {
+		if asset == nil {
+			return ""
+		}
+		return asset.Path
+	}
+	assets := &Assets{
+		BootLoaderPath: path(m.BootLoader),
+		KernelPath:     path(m.Kernel),
+		DTBPath:        path(m.DTB),
+		RootfsPath:     path(m.Rootfs),
+		UserfsPath:     path(m.Userfs),
+		UBootPath:      path(m.UBoot),
+		BootLinuxPath:  path(m.BootLinux),
+		SystemPath:     path(m.System),
+		VendorPath:     path(m.Vendor),
+		UserdataPath:   path(m.Userdata),
+	}
+	for name, asset := range m.Images {
+		assets.Set(name, path(asset))
+	}
+	return assets
+}
+
+// Verify checks the digests of all the assets with known digests.
+func (m *Manifest) Verify() error {
+	for _, asset := range m.Entries() {
+		if asset.SHA256 == "" {
+			continue
+		}
+		digest, err := fileSHA256(asset.Path)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(digest, asset.SHA256) {
+			return flash.WithKind(fmt.Errorf("%s has SHA-256 %s, expected %s", asset.Path, digest, asset.SHA256), ErrVerificationFailed)
+		}
+	}
+	return nil
+}
+
+// fileSHA256 returns the SHA-256 digest of the given file, in hex.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openharmony
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/flash"
+)
+
+// ErrVerificationFailed is matched by errors of images or signatures that do
+// not match, as opposed to failures to read them.
+var ErrVerificationFailed = errors.New("verification failed")
+
+// Checksums maps names of files to their SHA-256 digests, in hex.
+type Checksums map[string]string
+
+// ReadChecksums reads checksums in the format used by sha256sum.
+//
+// Each line holds the digest and the name of the file, separated by two
+// spaces, or by a space and an asterisk for files hashed in binary mode.
+func ReadChecksums(reader io.Reader) (Checksums, error) {
+	checksums := make(Checksums)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.IndexByte(line, ' ')
+		if idx != 64 || len(line) < idx+3 || (line[idx+1] != ' ' && line[idx+1] != '*') {
+			return nil, fmt.Errorf("invalid checksum line: %q", line)
+		}
+		checksums[filepath.Base(line[idx+2:])] = strings.ToLower(line[:idx])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return checksums, nil
+}
+
+// Verify checks that all the assets have checksums and that they match.
+//
+// Assets are looked up by file name, without the directory.
+func Verify(assets *Assets, checksums Checksums) error {
+	for _, asset := range assets.Names() {
+		name := assets.Get(asset)
+		if name == "" {
+			continue
+		}
+		expected, ok := checksums[filepath.Base(name)]
+		if !ok {
+			return flash.WithKind(fmt.Errorf("cannot verify %s: no checksum for %s", name, filepath.Base(name)), ErrVerificationFailed)
+		}
+		digest, err := fileSHA256(name)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(digest, expected) {
+			return flash.WithKind(fmt.Errorf("%s has SHA-256 %s, expected %s", name, digest, expected), ErrVerificationFailed)
+		}
+	}
+	return nil
+}
+
+// VerifySignature checks the detached signature of the given file.
+//
+// Signatures ending with .minisig are checked with minisign, using the given
+// public key file. Other signatures are checked with gpg, using the keys in
+// the keyring of the user, or the given keyring file.
+func VerifySignature(name, signature, key string) error {
+	var cmd *exec.Cmd
+	if strings.HasSuffix(signature, ".minisig") {
+		if key == "" {
+			return fmt.Errorf("cannot verify %s: minisign public key is required", signature)
+		}
+		cmd = exec.Command("minisign", "-V", "-q", "-m", name, "-x", signature, "-p", key)
+	} else {
+		args := []string{"--verify"}
+		if key != "" {
+			args = append(args, "--no-default-keyring", "--keyring", key)
+		}
+		cmd = exec.Command("gpg", append(args, signature, name)...)
+	}
+	// The output explains why verification failed, it is not needed otherwise.
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return flash.WithKind(fmt.Errorf("cannot verify signature %s of %s: %w\n%s", signature, name, err, bytes.TrimSpace(output)), ErrVerificationFailed)
+	}
+	return nil
+}
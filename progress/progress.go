@@ -0,0 +1,140 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package progress contains a progress bar for long running transfers.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// barWidth is the number of characters in the bar itself.
+	barWidth = 30
+	// redrawInterval limits how often the bar is drawn on a terminal.
+	redrawInterval = 100 * time.Millisecond
+	// logInterval limits how often progress is logged when not on a terminal.
+	logInterval = 5 * time.Second
+)
+
+// Bar shows progress of a transfer.
+//
+// On a terminal the bar is redrawn in place, together with percentage,
+// transfer rate and estimated time left. Otherwise progress is logged as
+// separate lines, at most every few seconds.
+type Bar struct {
+	out      io.Writer
+	terminal bool
+
+	name      string
+	total     int64
+	done      int64
+	rate      float64
+	remaining time.Duration
+
+	start    time.Time
+	lastDraw time.Time
+}
+
+// NewBar returns a progress bar writing to the given file.
+//
+// The file is checked to see if it is a terminal.
+func NewBar(out *os.File) *Bar {
+	return &Bar{out: out, terminal: IsTerminal(out)}
+}
+
+// IsTerminal returns true if the file is a character device.
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Start begins showing progress of a transfer of the given size.
+func (bar *Bar) Start(name string, total int64) {
+	bar.name = name
+	bar.total = total
+	bar.done = 0
+	bar.rate = 0
+	bar.remaining = 0
+	bar.start = time.Now()
+	bar.lastDraw = time.Time{}
+	if !bar.terminal {
+		fmt.Fprintf(bar.out, "%s: sending %d bytes\n", bar.name, bar.total)
+	}
+}
+
+// SetRate sets the transfer rate, in bytes per second, and the time left.
+//
+// The values are shown on the next update.
+func (bar *Bar) SetRate(rate float64, remaining time.Duration) {
+	bar.rate = rate
+	bar.remaining = remaining
+}
+
+// Update sets the amount of data transferred so far.
+func (bar *Bar) Update(done int64) {
+	bar.done = done
+	now := time.Now()
+	if bar.terminal && now.Sub(bar.lastDraw) >= redrawInterval {
+		bar.draw()
+		bar.lastDraw = now
+	}
+	if !bar.terminal && now.Sub(bar.lastDraw) >= logInterval {
+		fmt.Fprintf(bar.out, "%s: %s\n", bar.name, bar.summary())
+		bar.lastDraw = now
+	}
+}
+
+// Finish completes the transfer.
+func (bar *Bar) Finish() {
+	elapsed := time.Since(bar.start).Round(time.Second)
+	if bar.terminal {
+		bar.draw()
+		fmt.Fprintf(bar.out, "\n")
+		return
+	}
+	fmt.Fprintf(bar.out, "%s: sent %d bytes in %s\n", bar.name, bar.done, elapsed)
+}
+
+// draw redraws the bar in place.
+func (bar *Bar) draw() {
+	filled := barWidth
+	if bar.total > 0 {
+		filled = int(bar.done * barWidth / bar.total)
+	}
+	if filled > barWidth {
+		filled = barWidth
+	}
+	fmt.Fprintf(bar.out, "\x1b[2K%s [%s%s] %s\r", bar.name,
+		strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), bar.summary())
+}
+
+// summary describes the progress with percentage, rate and time left.
+func (bar *Bar) summary() string {
+	percent := 100.0
+	if bar.total > 0 {
+		percent = float64(bar.done) * 100 / float64(bar.total)
+	}
+	text := fmt.Sprintf("%3.0f%%", percent)
+	if bar.rate > 0 {
+		text += fmt.Sprintf(" %.1f KB/s, %s left", bar.rate/1024, bar.remaining.Round(time.Second))
+	}
+	return text
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package provision hands out values personalizing each unit flashed on a
+// production line, such as serial numbers, MAC addresses or calibration data.
+//
+// Values come from a CSV file, with one row per unit, and from sequences,
+// such as consecutive MAC addresses. What was handed out is remembered in a
+// state file, so that no value is used twice, even across restarts.
+package provision
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Value is a named value of a unit.
+type Value struct {
+	Name  string
+	Value string
+}
+
+// Unit lists the values of one unit, columns of the CSV file first, in
+// order, followed by sequences.
+type Unit []Value
+
+// Sequence generates a value for each unit, counting up from the start.
+type Sequence struct {
+	Name   string
+	Start  uint64
+	Format string // format of the counter, such as SN%06d, empty for MAC addresses
+}
+
+// maxMAC is the largest MAC address.
+const maxMAC = 1<<48 - 1
+
+// ParseSequence parses a sequence given as name=start or name=start:format,
+// such as serial#=1000:SN%06d, or as name=mac:address, such as
+// ethaddr=mac:02:00:00:00:00:01.
+func ParseSequence(spec string) (*Sequence, error) {
+	idx := strings.IndexByte(spec, '=')
+	if idx <= 0 {
+		return nil, fmt.Errorf("expected name=start, name=start:format or name=mac:address")
+	}
+	seq := &Sequence{Name: spec[:idx]}
+	value := spec[idx+1:]
+	if strings.HasPrefix(value, "mac:") {
+		addr, err := parseMAC(strings.TrimPrefix(value, "mac:"))
+		if err != nil {
+			return nil, err
+		}
+		seq.Start = addr
+		return seq, nil
+	}
+	startText, format := value, "%d"
+	if idx := strings.IndexByte(value, ':'); idx >= 0 {
+		startText, format = value[:idx], value[idx+1:]
+	}
+	start, err := strconv.ParseUint(startText, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start of sequence %s: %q", seq.Name, startText)
+	}
+	if strings.Count(format, "%") != 1 {
+		return nil, fmt.Errorf("format of sequence %s must hold exactly one verb, such as %%06d", seq.Name)
+	}
+	seq.Start, seq.Format = start, format
+	return seq, nil
+}
+
+// Value returns the value for the given counter.
+func (seq *Sequence) Value(n uint64) (string, error) {
+	if seq.Format != "" {
+		return fmt.Sprintf(seq.Format, n), nil
+	}
+	if n > maxMAC {
+		return "", fmt.Errorf("sequence %s ran out of MAC addresses", seq.Name)
+	}
+	return formatMAC(n), nil
+}
+
+func parseMAC(text string) (uint64, error) {
+	parts := strings.Split(text, ":")
+	if len(parts) != 6 {
+		return 0, fmt.Errorf("invalid MAC address: %q", text)
+	}
+	var addr uint64
+	for _, part := range parts {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || len(part) != 2 {
+			return 0, fmt.Errorf("invalid MAC address: %q", text)
+		}
+		addr = addr<<8 | b
+	}
+	return addr, nil
+}
+
+func formatMAC(addr uint64) string {
+	parts := make([]string, 6)
+	for i := range parts {
+		parts[i] = fmt.Sprintf("%02x", byte(addr>>(8*(5-i))))
+	}
+	return strings.Join(parts, ":")
+}
+
+// state is what was handed out so far.
+type state struct {
+	NextRow  int               `json:"next-row"`
+	Counters map[string]uint64 `json:"counters"` // next value of each sequence
+}
+
+// Allocator hands out values for successive units.
+type Allocator struct {
+	statePath string
+	state     state
+	csvPath   string
+	header    []string
+	rows      [][]string
+	sequences []*Sequence
+}
+
+// NewAllocator returns an allocator remembering what was handed out in the
+// given file, which is created if missing.
+func NewAllocator(statePath string) (*Allocator, error) {
+	alloc := &Allocator{statePath: statePath}
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &alloc.state); err != nil {
+			return nil, fmt.Errorf("cannot read %s: %w", statePath, err)
+		}
+	}
+	if alloc.state.Counters == nil {
+		alloc.state.Counters = make(map[string]uint64)
+	}
+	return alloc, nil
+}
+
+// LoadCSV reads values of the units from a CSV file.
+//
+// The first row names the values, each of the following rows holds the
+// values of one unit. Rows are handed out in order, empty cells are left
+// out.
+func (alloc *Allocator) LoadCSV(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("cannot read %s: no header row", path)
+	}
+	alloc.csvPath, alloc.header, alloc.rows = path, records[0], records[1:]
+	return nil
+}
+
+// AddSequence adds a sequence generating a value for each unit.
+func (alloc *Allocator) AddSequence(seq *Sequence) {
+	alloc.sequences = append(alloc.sequences, seq)
+}
+
+// CSVDir returns the directory of the CSV file, relative paths of files in
+// the CSV file are relative to it.
+func (alloc *Allocator) CSVDir() string {
+	return filepath.Dir(alloc.csvPath)
+}
+
+// Next hands out the values of the next unit and remembers that.
+//
+// Values are never handed out again, even if flashing the unit fails.
+func (alloc *Allocator) Next() (Unit, error) {
+	var unit Unit
+	next := alloc.state
+	next.Counters = make(map[string]uint64, len(alloc.state.Counters))
+	for name, n := range alloc.state.Counters {
+		next.Counters[name] = n
+	}
+	if alloc.header != nil {
+		if next.NextRow >= len(alloc.rows) {
+			return nil, fmt.Errorf("all %d units of %s are used", len(alloc.rows), alloc.csvPath)
+		}
+		row := alloc.rows[next.NextRow]
+		for i, name := range alloc.header {
+			if i < len(row) && row[i] != "" {
+				unit = append(unit, Value{Name: name, Value: row[i]})
+			}
+		}
+		next.NextRow++
+	}
+	for _, seq := range alloc.sequences {
+		n, ok := next.Counters[seq.Name]
+		if !ok || n < seq.Start {
+			n = seq.Start
+		}
+		value, err := seq.Value(n)
+		if err != nil {
+			return nil, err
+		}
+		unit = append(unit, Value{Name: seq.Name, Value: value})
+		next.Counters[seq.Name] = n + 1
+	}
+	if err := saveState(alloc.statePath, next); err != nil {
+		return nil, err
+	}
+	alloc.state = next
+	return unit, nil
+}
+
+// saveState replaces the state file, so that it is never left half-written.
+func saveState(path string, s state) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
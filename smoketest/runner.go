@@ -0,0 +1,210 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smoketest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/ioextra"
+)
+
+// Default prompts of the OpenHarmony shell and of the login program.
+const (
+	DefaultPrompt         = "OHOS # "
+	DefaultLoginPrompt    = "login:"
+	DefaultPasswordPrompt = "Password:"
+)
+
+// Runner runs tests in the shell of a booted system.
+type Runner struct {
+	expect  *ioextra.ExpectEngine
+	prompt  []byte
+	timeout time.Duration
+
+	user, password              string
+	loginPrompt, passwordPrompt []byte
+}
+
+// NewRunner returns a runner talking to the shell over the given stream.
+//
+// The stream should time out reads periodically, for example when wrapped
+// with ioextra.NewTimeoutReadWriteCloser, so that the timeout of each step
+// is enforced.
+func NewRunner(stream io.ReadWriter) *Runner {
+	return &Runner{
+		expect:         ioextra.NewExpectEngine(stream).WithWriter(stream),
+		prompt:         []byte(DefaultPrompt),
+		timeout:        30 * time.Second,
+		loginPrompt:    []byte(DefaultLoginPrompt),
+		passwordPrompt: []byte(DefaultPasswordPrompt),
+	}
+}
+
+// WithPrompt returns a runner waiting for the given shell prompt.
+func (runner *Runner) WithPrompt(prompt string) *Runner {
+	runner.prompt = []byte(prompt)
+	return runner
+}
+
+// WithTimeout returns a runner allowing the given time for each step.
+func (runner *Runner) WithTimeout(timeout time.Duration) *Runner {
+	runner.timeout = timeout
+	return runner
+}
+
+// WithLogin returns a runner logging in with the given credentials.
+//
+// Without credentials, the shell is assumed to be available right away.
+func (runner *Runner) WithLogin(user, password string) *Runner {
+	runner.user = user
+	runner.password = password
+	return runner
+}
+
+// Login waits for the shell prompt, logging in first if credentials were given.
+func (runner *Runner) Login() error {
+	runner.expect.SetDeadline(time.Now().Add(runner.timeout))
+	defer runner.expect.SetDeadline(time.Time{})
+	if err := runner.expect.SendLine(""); err != nil {
+		return err
+	}
+	if runner.user != "" {
+		if err := runner.expect.DiscardUntil(runner.loginPrompt); err != nil {
+			return fmt.Errorf("cannot find login prompt: %w", err)
+		}
+		if err := runner.expect.SendLine(runner.user); err != nil {
+			return err
+		}
+		if err := runner.expect.DiscardUntil(runner.passwordPrompt); err != nil {
+			return fmt.Errorf("cannot find password prompt: %w", err)
+		}
+		if err := runner.expect.SendLine(runner.password); err != nil {
+			return err
+		}
+	}
+	if err := runner.expect.DiscardUntil(runner.prompt); err != nil {
+		return fmt.Errorf("cannot find shell prompt: %w", err)
+	}
+	return nil
+}
+
+// Result is the outcome of a single test.
+type Result struct {
+	Test   Test
+	Output string
+	// Missing lists the expected text absent from the output.
+	Missing []string
+	// Err is set if the command could not be run at all.
+	Err error
+}
+
+// Passed returns true if the command was run and its output was as expected.
+func (result *Result) Passed() bool {
+	return result.Err == nil && len(result.Missing) == 0
+}
+
+// Run runs the test and returns its result.
+func (runner *Runner) Run(t Test) Result {
+	result := Result{Test: t}
+	runner.expect.SetDeadline(time.Now().Add(runner.timeout))
+	defer runner.expect.SetDeadline(time.Time{})
+	if result.Err = runner.expect.SendLine(t.Command); result.Err != nil {
+		return result
+	}
+	output, err := runner.expect.CollectUntil(runner.prompt)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	// The output starts with the echo of the command, skip it.
+	if idx := bytes.IndexByte(output, '\n'); idx >= 0 {
+		output = output[idx+1:]
+	}
+	result.Output = string(output)
+	for _, expected := range t.Expect {
+		if !strings.Contains(result.Output, expected) {
+			result.Missing = append(result.Missing, expected)
+		}
+	}
+	return result
+}
+
+// Report is the outcome of all the tests.
+type Report struct {
+	Results []Result
+}
+
+// RunAll runs the tests one after another.
+//
+// Failing tests do not stop the run, so that the report is complete, but a
+// test that cannot be run at all, for example as the shell stopped
+// responding, does.
+func (runner *Runner) RunAll(tests []Test) *Report {
+	report := &Report{}
+	for _, t := range tests {
+		result := runner.Run(t)
+		report.Results = append(report.Results, result)
+		if result.Err != nil {
+			break
+		}
+	}
+	return report
+}
+
+// Failed returns the number of tests that did not pass.
+func (report *Report) Failed() int {
+	failed := 0
+	for i := range report.Results {
+		if !report.Results[i].Passed() {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Write writes a human readable report.
+//
+// Output of failed tests is included, to help finding out what went wrong.
+func (report *Report) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for i := range report.Results {
+		result := &report.Results[i]
+		status := "PASS"
+		if !result.Passed() {
+			status = "FAIL"
+		}
+		fmt.Fprintf(bw, "%s line %d: %s\n", status, result.Test.Line, result.Test.Command)
+		if result.Err != nil {
+			fmt.Fprintf(bw, "    error: %v\n", result.Err)
+		}
+		for _, missing := range result.Missing {
+			fmt.Fprintf(bw, "    missing: %q\n", missing)
+		}
+		if !result.Passed() && result.Output != "" {
+			for _, line := range strings.Split(strings.TrimRight(result.Output, "\r\n"), "\n") {
+				fmt.Fprintf(bw, "    | %s\n", strings.TrimRight(line, "\r"))
+			}
+		}
+	}
+	fmt.Fprintf(bw, "%d of %d tests passed\n", len(report.Results)-report.Failed(), len(report.Results))
+	return bw.Flush()
+}
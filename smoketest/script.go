@@ -0,0 +1,71 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package smoketest runs commands in the shell of a booted system over the
+// serial console and checks their output.
+package smoketest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Test is a single command and the text expected in its output.
+type Test struct {
+	Command string
+	Expect  []string
+	// Line is the line of the script where the test starts.
+	Line int
+}
+
+// ReadScript reads tests from a script.
+//
+// Each line starting with "$ " is a command. The following lines starting
+// with "> " list text that must be present in the output of the command.
+// Empty lines and lines starting with "#" are ignored. For example:
+//
+//	# The kernel is up.
+//	$ uname -a
+//	> Linux
+//	$ ls /system/bin
+//	> foundation
+func ReadScript(r io.Reader) ([]Test, error) {
+	var tests []Test
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.TrimSpace(line) == "", strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "$ "):
+			tests = append(tests, Test{Command: strings.TrimSpace(line[2:]), Line: lineno})
+		case strings.HasPrefix(line, "> "):
+			if len(tests) == 0 {
+				return nil, fmt.Errorf("cannot parse script line %d: expected output before the first command", lineno)
+			}
+			t := &tests[len(tests)-1]
+			t.Expect = append(t.Expect, line[2:])
+		default:
+			return nil, fmt.Errorf("cannot parse script line %d: expected a command or expected output: %q", lineno, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read script: %w", err)
+	}
+	return tests, nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package timing measures how long the stages of flashing take.
+package timing
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/flash"
+)
+
+// Stage is a measured stage, such as a power cycle or a file transfer.
+type Stage struct {
+	flash.Stage
+	Duration time.Duration `json:"duration_ns"`
+	Failed   bool          `json:"failed,omitempty"`
+}
+
+// Throughput returns the rate of data transfer in bytes per second.
+func (stage *Stage) Throughput() float64 {
+	if stage.Duration <= 0 {
+		return 0
+	}
+	return float64(stage.Bytes) / stage.Duration.Seconds()
+}
+
+// Report collects durations of stages.
+//
+// Report implements flash.Events, stages are recorded as they end.
+// All the methods can be called on a nil report, which measures nothing.
+type Report struct {
+	Stages []Stage
+	start  time.Time
+	total  time.Duration // set for reports read with ReadJSON
+}
+
+// NewReport returns an empty report, measuring total time from now.
+func NewReport() *Report {
+	return &Report{start: time.Now()}
+}
+
+func (report *Report) StageStarted(stage flash.Stage) {}
+
+func (report *Report) StageProgress(stage flash.Stage, done, total int64) {}
+
+func (report *Report) StageCompleted(stage flash.Stage, elapsed time.Duration) {
+	if report != nil {
+		report.Stages = append(report.Stages, Stage{Stage: stage, Duration: elapsed})
+	}
+}
+
+func (report *Report) StageFailed(stage flash.Stage, elapsed time.Duration, err error) {
+	if report != nil {
+		report.Stages = append(report.Stages, Stage{Stage: stage, Duration: elapsed, Failed: true})
+	}
+}
+
+// Failed returns the stage that failed, if any.
+func (report *Report) Failed() (Stage, bool) {
+	if report != nil {
+		for _, stage := range report.Stages {
+			if stage.Failed {
+				return stage, true
+			}
+		}
+	}
+	return Stage{}, false
+}
+
+// Total returns the time elapsed since the report was created.
+func (report *Report) Total() time.Duration {
+	if report == nil {
+		return 0
+	}
+	if report.total != 0 {
+		return report.total
+	}
+	return time.Since(report.start)
+}
+
+// Write writes a table with the duration of each stage and the total time.
+//
+// Time not attributed to any stage, such as spent on probing the board, is
+// shown separately so that the table adds up.
+func (report *Report) Write(w io.Writer) error {
+	if report == nil {
+		return nil
+	}
+	bw := bufio.NewWriter(w)
+	total := report.Total()
+	measured := time.Duration(0)
+	for _, stage := range report.Stages {
+		status := ""
+		if stage.Bytes > 0 && stage.Duration > 0 {
+			status = fmt.Sprintf(" (%.1f KiB/s)", stage.Throughput()/1024)
+		}
+		if stage.Failed {
+			status = " (failed)"
+		}
+		fmt.Fprintf(bw, "%10s  %s%s\n", round(stage.Duration), stage.Name, status)
+		measured += stage.Duration
+	}
+	if other := total - measured; other > 0 {
+		fmt.Fprintf(bw, "%10s  other\n", round(other))
+	}
+	fmt.Fprintf(bw, "%10s  total\n", round(total))
+	return bw.Flush()
+}
+
+// round returns the duration with precision suitable for humans.
+func round(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(100 * time.Millisecond)
+}
+
+// WriteJSON writes the report as JSON, for tracking across runs.
+func (report *Report) WriteJSON(w io.Writer) error {
+	if report == nil {
+		return nil
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(&reportJSON{report.start, report.Stages, report.Total()})
+}
+
+// ReadJSON reads a report written by WriteJSON.
+func ReadJSON(r io.Reader) (*Report, error) {
+	var data reportJSON
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, fmt.Errorf("cannot decode timing report: %w", err)
+	}
+	return &Report{Stages: data.Stages, start: data.Start, total: data.Total}, nil
+}
+
+// reportJSON is the JSON representation of a report.
+type reportJSON struct {
+	Start  time.Time     `json:"start"`
+	Stages []Stage       `json:"stages"`
+	Total  time.Duration `json:"total_ns"`
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"fmt"
+	"time"
+)
+
+// BaudRateSetter changes the baud rate of the local end of the serial line.
+type BaudRateSetter interface {
+	BaudRate() int
+	SetBaudRate(baudRate int) error
+}
+
+// baudRateSettle is the time given to u-boot to re-program the serial port.
+//
+// U-boot waits 50ms before and after changing the baud rate.
+const baudRateSettle = 200 * time.Millisecond
+
+// WithTransferBaudRate returns a shell transferring files at the given baud rate.
+//
+// LoadFile switches both u-boot and the local serial port to the given rate
+// for the duration of the transfer. Zero baud rate disables switching.
+func (uboot *UBootShell) WithTransferBaudRate(baudRate int, setter BaudRateSetter) *UBootShell {
+	uboot.transferBaudRate = baudRate
+	uboot.baudRateSetter = setter
+	return uboot
+}
+
+// SwitchBaudRate changes the baud rate used by u-boot and the local serial port.
+//
+// Setting the baudrate variable makes u-boot announce the new rate and wait
+// for the enter key, typed at the new rate, before showing the prompt again.
+func (uboot *UBootShell) SwitchBaudRate(baudRate int) error {
+	if uboot.baudRateSetter == nil {
+		return fmt.Errorf("cannot switch baud rate, serial port does not support it")
+	}
+	if err := uboot.sendCmd(fmt.Sprintf("setenv baudrate %d", baudRate)); err != nil {
+		return err
+	}
+	if err := uboot.expect.DiscardUntil([]byte("press ENTER ...")); err != nil {
+		return fmt.Errorf("cannot switch u-boot to %d bps: %w", baudRate, err)
+	}
+	time.Sleep(baudRateSettle)
+	if err := uboot.baudRateSetter.SetBaudRate(baudRate); err != nil {
+		return err
+	}
+	if err := uboot.writer.WriteByte('\r'); err != nil {
+		return err
+	}
+	if err := uboot.writer.Flush(); err != nil {
+		return err
+	}
+	if err := uboot.expect.DiscardUntil(uboot.prompt); err != nil {
+		return fmt.Errorf("cannot find u-boot shell prompt at %d bps: %w", baudRate, err)
+	}
+	uboot.log.Printf("Switched serial line to %d bps\n", baudRate)
+	return nil
+}
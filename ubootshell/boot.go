@@ -0,0 +1,108 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// BootCheck describes how to recognize that a board booted successfully.
+type BootCheck struct {
+	// Banner is printed by the booted system, for example the kernel
+	// banner, a login prompt or a shell prompt.
+	Banner string
+	// Timeout bounds the time from reset until the banner is printed.
+	Timeout time.Duration
+	// Command is optionally run in the shell of the booted system. The
+	// banner must be the shell prompt, as it marks the end of the output.
+	Command string
+	// Expect must be present in the output of the command.
+	Expect string
+}
+
+// StartApplication runs the standalone application loaded into memory at the
+// given address, such as a LiteOS kernel, with the go command.
+//
+// The shell cannot be used afterwards, the console belongs to the
+// application. Use CheckBoot to wait for it to boot.
+func (uboot *UBootShell) StartApplication(addr uint64) error {
+	return uboot.specialCmd(fmt.Sprintf("go %#x", addr), "## Starting application at")
+}
+
+// BootImage boots the kernel image loaded into memory at the given address,
+// in any format known to the bootm command, such as a FIT image.
+//
+// Just like with StartApplication, the shell cannot be used afterwards.
+func (uboot *UBootShell) BootImage(addr uint64) error {
+	return uboot.BootConfiguration(addr, "")
+}
+
+// BootConfiguration boots the FIT image loaded into memory at the given
+// address, with the named configuration of kernel, device tree and ramdisk.
+// The default configuration of the image is booted if the name is empty.
+func (uboot *UBootShell) BootConfiguration(addr uint64, config string) error {
+	return uboot.specialCmd(BootmCommand(addr, config), "## Booting")
+}
+
+// BootmCommand returns the bootm command booting the image at the given
+// address, selecting the named configuration of a FIT image, if any. Use it
+// in bootcmd to boot images read from storage.
+func BootmCommand(addr uint64, config string) string {
+	if config == "" {
+		return fmt.Sprintf("bootm %#x", addr)
+	}
+	return fmt.Sprintf("bootm %#x#%s", addr, config)
+}
+
+// CheckBoot waits for the board to boot after Reset, or after starting a
+// kernel loaded into memory.
+//
+// The banner must appear within the timeout. If a command is given, it is
+// then run and its output must contain the expected text, also within the
+// timeout.
+func (uboot *UBootShell) CheckBoot(check BootCheck) error {
+	uboot.expect.SetDeadline(time.Now().Add(check.Timeout))
+	defer uboot.expect.SetDeadline(time.Time{})
+	uboot.log.Printf("Waiting for the board to boot\n")
+	if err := uboot.expect.DiscardUntil([]byte(check.Banner)); err != nil {
+		return fmt.Errorf("cannot find boot banner %q: %w", check.Banner, err)
+	}
+	if check.Command == "" {
+		return nil
+	}
+	uboot.log.Printf("Execute in booted system: %s\n", check.Command)
+	if _, err := fmt.Fprintf(uboot.writer, "%s\n", check.Command); err != nil {
+		return err
+	}
+	if err := uboot.writer.Flush(); err != nil {
+		return err
+	}
+	output, err := uboot.expect.CollectUntil([]byte(check.Banner))
+	if err != nil {
+		return fmt.Errorf("cannot run %q in booted system: %w", check.Command, err)
+	}
+	// The output starts with the echo of the command, skip it.
+	if idx := bytes.Index(output, []byte(check.Command)); idx >= 0 {
+		output = output[idx+len(check.Command):]
+	}
+	if !bytes.Contains(output, []byte(check.Expect)) {
+		return fmt.Errorf("output of %q does not contain %q: %q", check.Command, check.Expect, output)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Capabilities is the set of commands supported by u-boot.
+//
+// Vendor builds of u-boot are often stripped down, lacking commands such as
+// loadz, nand or mmc. Boards and the file transfer code consult the
+// capabilities to adapt, or to fail early with a clear message.
+type Capabilities struct {
+	commands map[string]string // command name to its short description
+}
+
+// helpLineRegexp matches a line of the output of help, such as
+// "loady   - load binary file over serial line (ymodem mode)".
+var helpLineRegexp = regexp.MustCompile(`^([A-Za-z0-9_.?]+)\s+- (.*)$`)
+
+// ParseHelp returns the capabilities listed in the output of help.
+func ParseHelp(output string) *Capabilities {
+	caps := &Capabilities{commands: make(map[string]string)}
+	for _, line := range strings.Split(output, "\n") {
+		if match := helpLineRegexp.FindStringSubmatch(strings.TrimRight(line, "\r")); match != nil {
+			caps.commands[match[1]] = match[2]
+		}
+	}
+	return caps
+}
+
+// Has returns true if u-boot has the given command.
+func (caps *Capabilities) Has(command string) bool {
+	_, ok := caps.commands[command]
+	return ok
+}
+
+// Commands returns the names of all the commands, sorted.
+func (caps *Capabilities) Commands() []string {
+	names := make([]string, 0, len(caps.commands))
+	for name := range caps.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ErrNoHelp is returned by Capabilities if u-boot does not list its commands.
+var ErrNoHelp = errors.New("u-boot does not list its commands")
+
+// Capabilities runs help and returns the commands supported by u-boot.
+//
+// The result is cached, as the commands do not change while u-boot runs.
+// ErrNoHelp is returned if the help command is missing as well.
+func (uboot *UBootShell) Capabilities() (*Capabilities, error) {
+	if uboot.caps != nil {
+		return uboot.caps, nil
+	}
+	output, err := uboot.Command("help")
+	if err != nil {
+		return nil, err
+	}
+	caps := ParseHelp(output)
+	if len(caps.commands) == 0 {
+		return nil, ErrNoHelp
+	}
+	uboot.caps = caps
+	return caps, nil
+}
+
+// RequireCommands returns an error if any of the commands is not supported.
+//
+// If u-boot does not list its commands, they are assumed to be present.
+func (uboot *UBootShell) RequireCommands(commands ...string) error {
+	caps, err := uboot.Capabilities()
+	if errors.Is(err, ErrNoHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, cmd := range commands {
+		if !caps.Has(cmd) {
+			missing = append(missing, cmd)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("u-boot lacks required commands: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/ioextra"
+)
+
+// decompressCommand returns the u-boot command decompressing the file, given
+// its name, or an empty string.
+//
+// The lzmadec command expects the legacy .lzma format, not xz.
+func decompressCommand(fileName string) string {
+	switch {
+	case strings.HasSuffix(fileName, ".gz"):
+		return "unzip"
+	case strings.HasSuffix(fileName, ".lzma"):
+		return "lzmadec"
+	default:
+		return ""
+	}
+}
+
+// uncompressedSizeRegexp matches the size printed by unzip and lzmadec.
+var uncompressedSizeRegexp = regexp.MustCompile(`Uncompressed size: (\d+)`)
+
+// LoadFileDecompressed copies a compressed file to device memory at
+// scratchAddr and decompresses it with u-boot to the given address.
+//
+// Only the compressed data is sent over the serial line, which is much faster
+// for images with a lot of free space, such as file systems. Files compressed
+// with gzip are decompressed with unzip, files compressed with lzma with
+// lzmadec. Other files, or files u-boot cannot decompress, are sent with
+// LoadFile instead. The scratch area must not overlap the decompressed data.
+func (uboot *UBootShell) LoadFileDecompressed(addr, scratchAddr uint64, fileName string) error {
+	cmd := decompressCommand(fileName)
+	if cmd == "" {
+		return uboot.LoadFile(addr, fileName)
+	}
+	if err := uboot.RequireCommands(cmd); err != nil {
+		uboot.log.Printf("Decompressing %s before sending it, %s\n", fileName, err)
+		return uboot.LoadFile(addr, fileName)
+	}
+	size, err := ioextra.DecompressedSize(fileName)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := uboot.LoadData(scratchAddr, fileName, file, fi.Size()); err != nil {
+		return err
+	}
+	output, err := uboot.regularCmd(fmt.Sprintf("%s %#x %#x %#x", cmd, scratchAddr, addr, size))
+	if err != nil {
+		return err
+	}
+	match := uncompressedSizeRegexp.FindStringSubmatch(output)
+	if match == nil {
+		return fmt.Errorf("cannot decompress %s with %s: %s", fileName, cmd, strings.TrimSpace(output))
+	}
+	if n, _ := strconv.ParseInt(match[1], 10, 64); n != size {
+		return fmt.Errorf("cannot decompress %s with %s, got %d bytes instead of %d", fileName, cmd, n, size)
+	}
+	return nil
+}
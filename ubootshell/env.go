@@ -0,0 +1,166 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Env is a snapshot of u-boot environment variables.
+type Env map[string]string
+
+// PrintEnv returns all the variables of the u-boot environment.
+func (uboot *UBootShell) PrintEnv() (Env, error) {
+	output, err := uboot.regularCmd("printenv")
+	if err != nil {
+		return nil, err
+	}
+	env, err := ReadEnv(strings.NewReader(output))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse printenv output: %w", err)
+	}
+	return env, nil
+}
+
+// DeleteEnv removes u-boot environment variable.
+func (uboot *UBootShell) DeleteEnv(key string) error {
+	if err := checkEnv(key, ""); err != nil {
+		return err
+	}
+	return setEnvCmd(uboot, fmt.Sprintf("setenv %s", key))
+}
+
+// envFailures are parts of lines printed by setenv when u-boot refuses to
+// change a variable, such as `## Error: Can't overwrite "ethaddr"` or
+// `## Error inserting "ethaddr" variable, errno=1`. Lines are compared in
+// lower case.
+var envFailures = []string{"## error", "can't", "unknown command", "usage:"}
+
+// setEnvCmd runs a command changing the environment.
+//
+// Successful setenv commands are silent, refused ones print an error and
+// return to the prompt.
+func setEnvCmd(uboot *UBootShell, cmd string) error {
+	output, err := uboot.regularCmd(cmd)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(output, "\n") {
+		lower := strings.ToLower(line)
+		for _, failure := range envFailures {
+			if strings.Contains(lower, failure) {
+				return fmt.Errorf("%s failed: %s", cmd, strings.TrimSpace(line))
+			}
+		}
+	}
+	return nil
+}
+
+// preservedEnv returns true for variables that RestoreEnv leaves alone.
+//
+// U-boot refuses to change the MAC addresses and the serial number once they
+// are set, while the console variables describe the line we talk over.
+func preservedEnv(key string) bool {
+	switch key {
+	case "serial#", "baudrate", "stdin", "stdout", "stderr":
+		return true
+	}
+	return strings.HasPrefix(key, "eth") && strings.HasSuffix(key, "addr")
+}
+
+// RestoreEnv makes the u-boot environment identical to the given snapshot.
+//
+// Variables absent from the snapshot are removed, variables with different
+// values are updated. MAC addresses, the serial number and the console
+// variables are kept as they are. The environment is then written to
+// persistent storage.
+func (uboot *UBootShell) RestoreEnv(env Env) error {
+	current, err := uboot.PrintEnv()
+	if err != nil {
+		return err
+	}
+	for _, key := range current.Keys() {
+		if _, ok := env[key]; ok || preservedEnv(key) {
+			continue
+		}
+		if err := uboot.DeleteEnv(key); err != nil {
+			return err
+		}
+	}
+	for _, key := range env.Keys() {
+		if value, ok := current[key]; (ok && value == env[key]) || preservedEnv(key) {
+			continue
+		}
+		if err := uboot.SetEnv(key, env[key]); err != nil {
+			return err
+		}
+	}
+	return uboot.SaveEnv()
+}
+
+// ReadEnv reads environment in the format used by printenv.
+//
+// Each variable is stored in a "key=value" line. Empty lines and the
+// "Environment size" summary printed by u-boot are ignored.
+func ReadEnv(reader io.Reader) (Env, error) {
+	env := make(Env)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "Environment size:") {
+			continue
+		}
+		idx := strings.IndexByte(line, '=')
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid environment line: %q", line)
+		}
+		env[line[:idx]] = line[idx+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// WriteTo writes the environment in the format used by printenv.
+//
+// Variables are sorted by name, just like u-boot does it.
+func (env Env) WriteTo(writer io.Writer) (int64, error) {
+	var total int64
+	for _, key := range env.Keys() {
+		n, err := fmt.Fprintf(writer, "%s=%s\n", key, env[key])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Keys returns the sorted names of all the variables.
+func (env Env) Keys() []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
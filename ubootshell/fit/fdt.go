@@ -0,0 +1,272 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Structure of flattened device trees, as defined by the devicetree
+// specification.
+const (
+	fdtMagic          = 0xd00dfeed
+	fdtVersion        = 17
+	fdtLastCompatible = 16
+	fdtHeaderSize     = 40
+
+	fdtBeginNode = 1
+	fdtEndNode   = 2
+	fdtProp      = 3
+	fdtNop       = 4
+	fdtEnd       = 9
+)
+
+// node is a node of a device tree.
+type node struct {
+	name     string
+	props    []property
+	children []*node
+}
+
+// property is a property of a device tree node, with its raw value.
+type property struct {
+	name  string
+	value []byte
+}
+
+// child appends a new child node with the given name.
+func (n *node) child(name string) *node {
+	c := &node{name: name}
+	n.children = append(n.children, c)
+	return c
+}
+
+// lookup returns the child node with the given name, or nil.
+func (n *node) lookup(name string) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// prop returns the value of the property with the given name, or nil.
+func (n *node) prop(name string) []byte {
+	for _, p := range n.props {
+		if p.name == name {
+			return p.value
+		}
+	}
+	return nil
+}
+
+// setBytes appends a property with a raw value.
+func (n *node) setBytes(name string, value []byte) {
+	n.props = append(n.props, property{name: name, value: value})
+}
+
+// setString appends a property with a NUL-terminated string value.
+func (n *node) setString(name, value string) {
+	n.setBytes(name, append([]byte(value), 0))
+}
+
+// setCells appends a property with a value of big-endian 32-bit cells.
+func (n *node) setCells(name string, cells ...uint32) {
+	value := make([]byte, 4*len(cells))
+	for i, cell := range cells {
+		binary.BigEndian.PutUint32(value[4*i:], cell)
+	}
+	n.setBytes(name, value)
+}
+
+// stringProp returns the value of a string property, without the NUL
+// terminator.
+func (n *node) stringProp(name string) (string, bool) {
+	value := n.prop(name)
+	if len(value) == 0 || value[len(value)-1] != 0 {
+		return "", false
+	}
+	return string(value[:len(value)-1]), true
+}
+
+// encodeFDT returns the flattened device tree with the given root node.
+func encodeFDT(root *node) []byte {
+	var structure, strs bytes.Buffer
+	nameOffsets := make(map[string]uint32)
+	token := func(t uint32) {
+		binary.Write(&structure, binary.BigEndian, t)
+	}
+	pad := func() {
+		for structure.Len()%4 != 0 {
+			structure.WriteByte(0)
+		}
+	}
+	var encode func(n *node)
+	encode = func(n *node) {
+		token(fdtBeginNode)
+		structure.WriteString(n.name)
+		structure.WriteByte(0)
+		pad()
+		for _, p := range n.props {
+			off, ok := nameOffsets[p.name]
+			if !ok {
+				off = uint32(strs.Len())
+				nameOffsets[p.name] = off
+				strs.WriteString(p.name)
+				strs.WriteByte(0)
+			}
+			token(fdtProp)
+			token(uint32(len(p.value)))
+			token(off)
+			structure.Write(p.value)
+			pad()
+		}
+		for _, c := range n.children {
+			encode(c)
+		}
+		token(fdtEndNode)
+	}
+	encode(root)
+	token(fdtEnd)
+
+	// The header is followed by an empty memory reservation map, the
+	// structure block and the strings block.
+	const rsvmapOffset = fdtHeaderSize
+	const rsvmapSize = 16
+	structOffset := rsvmapOffset + rsvmapSize
+	stringsOffset := structOffset + structure.Len()
+	totalSize := stringsOffset + strs.Len()
+	blob := make([]byte, totalSize)
+	for i, v := range []uint32{
+		fdtMagic,
+		uint32(totalSize),
+		uint32(structOffset),
+		uint32(stringsOffset),
+		rsvmapOffset,
+		fdtVersion,
+		fdtLastCompatible,
+		0, // boot CPU
+		uint32(strs.Len()),
+		uint32(structure.Len()),
+	} {
+		binary.BigEndian.PutUint32(blob[4*i:], v)
+	}
+	copy(blob[structOffset:], structure.Bytes())
+	copy(blob[stringsOffset:], strs.Bytes())
+	return blob
+}
+
+var errNotFDT = errors.New("not a flattened device tree")
+
+// decodeFDT parses a flattened device tree and returns its root node.
+//
+// Property values refer to the memory of the blob.
+func decodeFDT(blob []byte) (*node, error) {
+	if len(blob) < fdtHeaderSize || binary.BigEndian.Uint32(blob) != fdtMagic {
+		return nil, errNotFDT
+	}
+	header := func(i int) int { return int(binary.BigEndian.Uint32(blob[4*i:])) }
+	totalSize, structOffset, stringsOffset := header(1), header(2), header(3)
+	if header(6) > fdtVersion {
+		return nil, fmt.Errorf("unsupported device tree version %d", header(6))
+	}
+	stringsSize, structSize := header(8), header(9)
+	if totalSize > len(blob) || structOffset > totalSize || structSize > totalSize-structOffset ||
+		stringsOffset > totalSize || stringsSize > totalSize-stringsOffset {
+		return nil, fmt.Errorf("truncated device tree")
+	}
+	structure := blob[structOffset : structOffset+structSize]
+	strs := blob[stringsOffset : stringsOffset+stringsSize]
+
+	errCorrupted := fmt.Errorf("corrupted device tree")
+	pos := 0
+	u32 := func() (int, bool) {
+		if pos+4 > len(structure) {
+			return 0, false
+		}
+		v := binary.BigEndian.Uint32(structure[pos:])
+		pos += 4
+		return int(v), true
+	}
+	cstring := func(b []byte, at int) (string, bool) {
+		if at < 0 || at >= len(b) {
+			return "", false
+		}
+		end := bytes.IndexByte(b[at:], 0)
+		if end < 0 {
+			return "", false
+		}
+		return string(b[at : at+end]), true
+	}
+	align := func() { pos = (pos + 3) &^ 3 }
+
+	var root *node
+	var stack []*node
+	for {
+		t, ok := u32()
+		if !ok {
+			return nil, errCorrupted
+		}
+		switch t {
+		case fdtBeginNode:
+			name, ok := cstring(structure, pos)
+			if !ok {
+				return nil, errCorrupted
+			}
+			pos += len(name) + 1
+			align()
+			n := &node{name: name}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			} else {
+				return nil, errCorrupted
+			}
+			stack = append(stack, n)
+		case fdtEndNode:
+			if len(stack) == 0 {
+				return nil, errCorrupted
+			}
+			stack = stack[:len(stack)-1]
+		case fdtProp:
+			size, ok1 := u32()
+			nameOffset, ok2 := u32()
+			name, ok3 := cstring(strs, nameOffset)
+			if !ok1 || !ok2 || !ok3 || len(stack) == 0 || size > len(structure)-pos {
+				return nil, errCorrupted
+			}
+			n := stack[len(stack)-1]
+			n.setBytes(name, structure[pos:pos+size])
+			pos += size
+			align()
+		case fdtNop:
+		case fdtEnd:
+			if root == nil || len(stack) != 0 {
+				return nil, errCorrupted
+			}
+			return root, nil
+		default:
+			return nil, errCorrupted
+		}
+	}
+}
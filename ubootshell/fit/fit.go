@@ -0,0 +1,385 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fit builds Flattened Image Tree (FIT) images, the format of images
+// of the u-boot bootm command bundling kernels, device trees and initial
+// ramdisks, with configurations selecting which of them to boot.
+//
+// Images are written as the binary blob loaded by u-boot, known as .itb, or
+// as the source understood by the mkimage tool of u-boot, known as .its.
+// Signatures are not supported, only hashes verified by u-boot while booting.
+package fit
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/ioextra"
+)
+
+// Types of components, as known to u-boot.
+const (
+	Kernel  = "kernel"
+	FlatDT  = "flat_dt"
+	Ramdisk = "ramdisk"
+)
+
+// Hash algorithms of components, as known to u-boot.
+const (
+	CRC32  = "crc32"
+	SHA1   = "sha1"
+	SHA256 = "sha256"
+)
+
+// Component is an image bundled in a FIT image, such as a kernel.
+type Component struct {
+	Name        string // unique name, such as "kernel-1"
+	Description string
+	Type        string // Kernel, FlatDT or Ramdisk
+	Arch        string // such as "arm" or "arm64"
+	OS          string // such as "linux"
+	Compression string // such as "gzip", "none" if empty
+	Path        string // file with the content of the component
+	Hash        string // hash verified by u-boot, none if empty
+	// Load and Entry are the addresses of the component in memory. They
+	// are written for kernels, and for other components if not zero.
+	Load, Entry uint64
+}
+
+// Configuration is a choice of components to boot.
+type Configuration struct {
+	Name        string // unique name, such as "conf-1"
+	Description string
+	Kernel      string // name of the kernel component
+	FDT         string // name of the device tree component, if any
+	Ramdisk     string // name of the ramdisk component, if any
+}
+
+// Image describes a FIT image.
+type Image struct {
+	Description    string
+	Components     []Component
+	Configurations []Configuration
+	// Default is the name of the configuration booted when none is
+	// selected, the first configuration if empty.
+	Default string
+	// Timestamp is the time of creation of the image, the current time
+	// if zero.
+	Timestamp time.Time
+}
+
+// Check returns an error if the image is inconsistent, for example if a
+// configuration refers to a missing component.
+func (img *Image) Check() error {
+	types := make(map[string]string)
+	for _, comp := range img.Components {
+		if comp.Name == "" {
+			return fmt.Errorf("FIT component without a name")
+		}
+		if _, ok := types[comp.Name]; ok {
+			return fmt.Errorf("duplicate FIT component %q", comp.Name)
+		}
+		types[comp.Name] = comp.Type
+		if comp.Type == "" {
+			return fmt.Errorf("FIT component %q without a type", comp.Name)
+		}
+		if comp.Path == "" {
+			return fmt.Errorf("FIT component %q without a file", comp.Name)
+		}
+		if comp.Type == Kernel && (comp.Arch == "" || comp.OS == "") {
+			return fmt.Errorf("FIT kernel %q without an architecture or operating system", comp.Name)
+		}
+		if _, err := newHash(comp.Hash); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for _, conf := range img.Configurations {
+		if conf.Name == "" {
+			return fmt.Errorf("FIT configuration without a name")
+		}
+		if names[conf.Name] {
+			return fmt.Errorf("duplicate FIT configuration %q", conf.Name)
+		}
+		names[conf.Name] = true
+		if conf.Kernel == "" {
+			return fmt.Errorf("FIT configuration %q without a kernel", conf.Name)
+		}
+		for _, ref := range []struct{ name, typ string }{
+			{conf.Kernel, Kernel}, {conf.FDT, FlatDT}, {conf.Ramdisk, Ramdisk},
+		} {
+			if ref.name != "" && types[ref.name] != ref.typ {
+				return fmt.Errorf("FIT configuration %q refers to %q, which is not a %s component", conf.Name, ref.name, ref.typ)
+			}
+		}
+	}
+	if img.Default != "" && !names[img.Default] {
+		return fmt.Errorf("default FIT configuration %q does not exist", img.Default)
+	}
+	return nil
+}
+
+func (img *Image) defaultConfiguration() string {
+	if img.Default == "" && len(img.Configurations) > 0 {
+		return img.Configurations[0].Name
+	}
+	return img.Default
+}
+
+// addressCells returns the number of cells of load and entry addresses,
+// two if any of them does not fit in 32 bits.
+func (img *Image) addressCells() int {
+	for _, comp := range img.Components {
+		if comp.Load > 0xffffffff || comp.Entry > 0xffffffff {
+			return 2
+		}
+	}
+	return 1
+}
+
+func addressCells(addr uint64, n int) []uint32 {
+	if n == 2 {
+		return []uint32{uint32(addr >> 32), uint32(addr)}
+	}
+	return []uint32{uint32(addr)}
+}
+
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case "":
+		return nil, nil
+	case CRC32:
+		return crc32.NewIEEE(), nil
+	case SHA1:
+		return sha1.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported FIT hash algorithm %q, expected %s, %s or %s", algo, CRC32, SHA1, SHA256)
+}
+
+func (comp *Component) compression() string {
+	if comp.Compression == "" {
+		return "none"
+	}
+	return comp.Compression
+}
+
+func (comp *Component) hasAddresses() bool {
+	return comp.Type == Kernel || comp.Load != 0 || comp.Entry != 0
+}
+
+// WriteBlob writes the image in the binary format loaded by u-boot, with the
+// content of all the components.
+func (img *Image) WriteBlob(w io.Writer) error {
+	if err := img.Check(); err != nil {
+		return err
+	}
+	cells := img.addressCells()
+	timestamp := img.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	root := &node{}
+	root.setString("description", img.Description)
+	root.setCells("timestamp", uint32(timestamp.Unix()))
+	root.setCells("#address-cells", uint32(cells))
+	images := root.child("images")
+	for _, comp := range img.Components {
+		data, err := ioutil.ReadFile(comp.Path)
+		if err != nil {
+			return err
+		}
+		n := images.child(comp.Name)
+		if comp.Description != "" {
+			n.setString("description", comp.Description)
+		}
+		n.setBytes("data", data)
+		n.setString("type", comp.Type)
+		if comp.Arch != "" {
+			n.setString("arch", comp.Arch)
+		}
+		if comp.OS != "" {
+			n.setString("os", comp.OS)
+		}
+		n.setString("compression", comp.compression())
+		if comp.hasAddresses() {
+			n.setCells("load", addressCells(comp.Load, cells)...)
+			n.setCells("entry", addressCells(comp.Entry, cells)...)
+		}
+		if h, _ := newHash(comp.Hash); h != nil {
+			h.Write(data)
+			hn := n.child("hash-1")
+			hn.setBytes("value", h.Sum(nil))
+			hn.setString("algo", comp.Hash)
+		}
+	}
+	img.addConfigurations(root.child("configurations"))
+	_, err := w.Write(encodeFDT(root))
+	return err
+}
+
+func (img *Image) addConfigurations(confs *node) {
+	if def := img.defaultConfiguration(); def != "" {
+		confs.setString("default", def)
+	}
+	for _, conf := range img.Configurations {
+		n := confs.child(conf.Name)
+		if conf.Description != "" {
+			n.setString("description", conf.Description)
+		}
+		n.setString("kernel", conf.Kernel)
+		if conf.FDT != "" {
+			n.setString("fdt", conf.FDT)
+		}
+		if conf.Ramdisk != "" {
+			n.setString("ramdisk", conf.Ramdisk)
+		}
+	}
+}
+
+// WriteSource writes the image source for mkimage -f. The components are
+// included from their files, by path as given.
+func (img *Image) WriteSource(w io.Writer) error {
+	if err := img.Check(); err != nil {
+		return err
+	}
+	cells := img.addressCells()
+	var b strings.Builder
+	fmt.Fprintf(&b, "/dts-v1/;\n\n/ {\n")
+	fmt.Fprintf(&b, "\tdescription = %s;\n", quote(img.Description))
+	fmt.Fprintf(&b, "\t#address-cells = <%d>;\n\n\timages {\n", cells)
+	for i, comp := range img.Components {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "\t\t%s {\n", comp.Name)
+		if comp.Description != "" {
+			fmt.Fprintf(&b, "\t\t\tdescription = %s;\n", quote(comp.Description))
+		}
+		fmt.Fprintf(&b, "\t\t\tdata = /incbin/(%s);\n", quote(comp.Path))
+		fmt.Fprintf(&b, "\t\t\ttype = %s;\n", quote(comp.Type))
+		if comp.Arch != "" {
+			fmt.Fprintf(&b, "\t\t\tarch = %s;\n", quote(comp.Arch))
+		}
+		if comp.OS != "" {
+			fmt.Fprintf(&b, "\t\t\tos = %s;\n", quote(comp.OS))
+		}
+		fmt.Fprintf(&b, "\t\t\tcompression = %s;\n", quote(comp.compression()))
+		if comp.hasAddresses() {
+			fmt.Fprintf(&b, "\t\t\tload = %s;\n", cellsSource(addressCells(comp.Load, cells)))
+			fmt.Fprintf(&b, "\t\t\tentry = %s;\n", cellsSource(addressCells(comp.Entry, cells)))
+		}
+		if comp.Hash != "" {
+			fmt.Fprintf(&b, "\t\t\thash-1 {\n\t\t\t\talgo = %s;\n\t\t\t};\n", quote(comp.Hash))
+		}
+		b.WriteString("\t\t};\n")
+	}
+	b.WriteString("\t};\n\n\tconfigurations {\n")
+	if def := img.defaultConfiguration(); def != "" {
+		fmt.Fprintf(&b, "\t\tdefault = %s;\n", quote(def))
+	}
+	for _, conf := range img.Configurations {
+		fmt.Fprintf(&b, "\n\t\t%s {\n", conf.Name)
+		if conf.Description != "" {
+			fmt.Fprintf(&b, "\t\t\tdescription = %s;\n", quote(conf.Description))
+		}
+		fmt.Fprintf(&b, "\t\t\tkernel = %s;\n", quote(conf.Kernel))
+		if conf.FDT != "" {
+			fmt.Fprintf(&b, "\t\t\tfdt = %s;\n", quote(conf.FDT))
+		}
+		if conf.Ramdisk != "" {
+			fmt.Fprintf(&b, "\t\t\tramdisk = %s;\n", quote(conf.Ramdisk))
+		}
+		b.WriteString("\t\t};\n")
+	}
+	b.WriteString("\t};\n};\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// quote returns a string literal of the device tree source format.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func cellsSource(cells []uint32) string {
+	parts := make([]string, len(cells))
+	for i, cell := range cells {
+		parts[i] = fmt.Sprintf("%#x", cell)
+	}
+	return "<" + strings.Join(parts, " ") + ">"
+}
+
+// IsFIT returns true if the data starts like a FIT image, or any other
+// flattened device tree.
+func IsFIT(data []byte) bool {
+	return len(data) >= 4 && binary.BigEndian.Uint32(data) == fdtMagic
+}
+
+// Configurations returns the names of the configurations of a FIT image, in
+// the order of the image, and the name of the default one.
+func Configurations(blob []byte) (names []string, def string, err error) {
+	root, err := decodeFDT(blob)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot read FIT image: %w", err)
+	}
+	confs := root.lookup("configurations")
+	if confs == nil {
+		return nil, "", nil
+	}
+	for _, c := range confs.children {
+		names = append(names, c.name)
+	}
+	def, _ = confs.stringProp("default")
+	return names, def, nil
+}
+
+// CheckConfiguration returns an error unless the FIT image in the given file
+// has the named configuration. The file may be compressed, see
+// ioextra.OpenDecompressed.
+func CheckConfiguration(path, name string) error {
+	r, _, err := ioextra.OpenDecompressed(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if !IsFIT(blob) {
+		return fmt.Errorf("cannot select configuration %q, %s is not a FIT image", name, path)
+	}
+	names, _, err := Configurations(blob)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, n := range names {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("FIT image %s has no configuration %q, expected one of %s", path, name, strings.Join(names, ", "))
+}
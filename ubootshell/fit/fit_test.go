@@ -0,0 +1,148 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// fdtBuilder writes the structure block of a device tree by hand.
+type fdtBuilder struct {
+	bytes.Buffer
+}
+
+func (b *fdtBuilder) words(words ...uint32) {
+	for _, w := range words {
+		binary.Write(&b.Buffer, binary.BigEndian, w)
+	}
+}
+
+// padded writes the data followed by zeros up to a multiple of four bytes.
+func (b *fdtBuilder) padded(data string) {
+	b.WriteString(data)
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+}
+
+func (b *fdtBuilder) beginNode(name string) {
+	b.words(fdtBeginNode)
+	b.padded(name + "\x00")
+}
+
+func (b *fdtBuilder) prop(nameOffset uint32, value string) {
+	b.words(fdtProp, uint32(len(value)), nameOffset)
+	b.padded(value)
+}
+
+func TestWriteBlobGolden(t *testing.T) {
+	f, err := ioutil.TempFile("", "fit")
+	if err != nil {
+		t.Fatalf("cannot create file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	// Five bytes of data need padding in the structure block.
+	if _, err := f.WriteString("abcde"); err != nil {
+		t.Fatalf("cannot write file: %v", err)
+	}
+	f.Close()
+	img := &Image{
+		Description: "test",
+		Timestamp:   time.Unix(0x5f000000, 0),
+		Components: []Component{{
+			Name:  "kernel-1",
+			Type:  Kernel,
+			Arch:  "arm",
+			OS:    "linux",
+			Path:  f.Name(),
+			Hash:  CRC32,
+			Load:  0x80008000,
+			Entry: 0x80008000,
+		}},
+		Configurations: []Configuration{{Name: "conf-1", Kernel: "kernel-1"}},
+	}
+	var blob bytes.Buffer
+	if err := img.WriteBlob(&blob); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	const strs = "description\x00timestamp\x00#address-cells\x00data\x00type\x00arch\x00os\x00" +
+		"compression\x00load\x00entry\x00value\x00algo\x00default\x00kernel\x00"
+	var structure fdtBuilder
+	structure.beginNode("")
+	structure.prop(0, "test\x00")
+	structure.prop(12, "\x5f\x00\x00\x00")
+	structure.prop(22, "\x00\x00\x00\x01")
+	structure.beginNode("images")
+	structure.beginNode("kernel-1")
+	structure.prop(37, "abcde")
+	structure.prop(42, "kernel\x00")
+	structure.prop(47, "arm\x00")
+	structure.prop(52, "linux\x00")
+	structure.prop(55, "none\x00")
+	structure.prop(67, "\x80\x00\x80\x00")
+	structure.prop(72, "\x80\x00\x80\x00")
+	structure.beginNode("hash-1")
+	structure.prop(78, "\x85\x87\xd8\x65")
+	structure.prop(84, "crc32\x00")
+	structure.words(fdtEndNode, fdtEndNode, fdtEndNode)
+	structure.beginNode("configurations")
+	structure.prop(89, "conf-1\x00")
+	structure.beginNode("conf-1")
+	structure.prop(97, "kernel-1\x00")
+	structure.words(fdtEndNode, fdtEndNode, fdtEndNode, fdtEnd)
+
+	// The header and the empty memory reservation map precede the structure block.
+	const structOffset = 40 + 16
+	stringsOffset := structOffset + structure.Len()
+	var expected fdtBuilder
+	expected.words(
+		fdtMagic,
+		uint32(stringsOffset+len(strs)),
+		structOffset,
+		uint32(stringsOffset),
+		40,
+		17,
+		16,
+		0,
+		uint32(len(strs)),
+		uint32(structure.Len()),
+	)
+	expected.Write(make([]byte, 16))
+	expected.Write(structure.Bytes())
+	expected.WriteString(strs)
+
+	if !bytes.Equal(blob.Bytes(), expected.Bytes()) {
+		t.Fatalf("unexpected FIT image:\n%x\nexpected:\n%x", blob.Bytes(), expected.Bytes())
+	}
+	if structOffset%8 != 0 || stringsOffset%4 != 0 {
+		t.Fatalf("misaligned blocks")
+	}
+
+	names, def, err := Configurations(blob.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(names) != 1 || names[0] != "conf-1" || def != "conf-1" {
+		t.Fatalf("unexpected configurations %q, default %q", names, def)
+	}
+}
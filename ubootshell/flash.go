@@ -0,0 +1,79 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// FlashInfo describes the SPI flash chip detected by u-boot.
+type FlashInfo struct {
+	// Model is the name of the chip, as reported by u-boot.
+	Model string
+	// Size is the total size of the chip, in bytes.
+	Size uint64
+}
+
+var (
+	// sfProbeRegexp matches the message of stock u-boot, for example:
+	// "SF: Detected w25q128 with page size 256 Bytes, erase size 64 KiB, total 16 MiB"
+	sfProbeRegexp = regexp.MustCompile(`SF: Detected (\S+) with .*total (\d+) (Bytes|KiB|MiB|GiB)`)
+	// hifmcProbeRegexp matches the message of HiSilicon u-boot, for example:
+	// `Block:64KB Chip:16MB Name:"W25Q128(B/F)V"`
+	hifmcProbeRegexp = regexp.MustCompile(`Chip:(\d+)(B|KB|MB|GB) Name:"([^"]*)"`)
+)
+
+// sizeUnits maps units used by u-boot to their size in bytes.
+var sizeUnits = map[string]uint64{
+	"B": 1, "Bytes": 1,
+	"KB": 1 << 10, "KiB": 1 << 10,
+	"MB": 1 << 20, "MiB": 1 << 20,
+	"GB": 1 << 30, "GiB": 1 << 30,
+}
+
+// ParseFlashInfo returns information about the flash chip described in the output of sf probe.
+func ParseFlashInfo(output string) (FlashInfo, error) {
+	var model, size, unit string
+	if match := sfProbeRegexp.FindStringSubmatch(output); match != nil {
+		model, size, unit = match[1], match[2], match[3]
+	} else if match := hifmcProbeRegexp.FindStringSubmatch(output); match != nil {
+		model, size, unit = match[3], match[1], match[2]
+	} else {
+		return FlashInfo{}, fmt.Errorf("cannot find flash chip in %q", output)
+	}
+	n, err := strconv.ParseUint(size, 10, 64)
+	if err != nil {
+		return FlashInfo{}, fmt.Errorf("cannot parse flash size %q: %w", size, err)
+	}
+	return FlashInfo{Model: model, Size: n * sizeUnits[unit]}, nil
+}
+
+// ProbeFlash initializes the SPI flash and returns information about the chip.
+func (uboot *UBootShell) ProbeFlash() (FlashInfo, error) {
+	output, err := uboot.regularCmd("sf probe 0")
+	if err != nil {
+		return FlashInfo{}, err
+	}
+	info, err := ParseFlashInfo(output)
+	if err != nil {
+		return FlashInfo{}, err
+	}
+	uboot.log.Printf("Detected %s flash chip, %d bytes\n", info.Model, info.Size)
+	return info, nil
+}
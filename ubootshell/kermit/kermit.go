@@ -0,0 +1,177 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kermit contains implementation of the sending side of the Kermit
+// protocol, as understood by the loadb command of u-boot.
+//
+// Only the basic protocol is implemented: short packets with single
+// character checksums and control character prefixing. Each packet is
+// acknowledged before the next one is sent.
+package kermit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Transfer encapsulates state of a kermit file transfer.
+type Transfer struct {
+	reader io.Reader
+	name   string
+	size   int64
+
+	retryCount int
+	observer   Observer
+
+	seq int // sequence number of the next packet
+}
+
+// NewTransfer returns a transfer object for sending data from the given reader.
+//
+// The reader must provide at least size bytes of data.
+func NewTransfer(reader io.Reader, name string, size int64) *Transfer {
+	return &Transfer{reader: reader, name: name, size: size}
+}
+
+// NewTransferFromFile returns a transfer object for sending the given file.
+func NewTransferFromFile(file *os.File) (*Transfer, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return NewTransfer(file, file.Name(), fileInfo.Size()), nil
+}
+
+// WithRetryCount returns a transfer with the given number of retry attempts.
+func (tr *Transfer) WithRetryCount(retryCount int) *Transfer {
+	tr.retryCount = retryCount
+	return tr
+}
+
+// Observer is the interface for observing file transfers.
+type Observer interface {
+	Start(file string, size int64)
+	Progress(bytesSent, bytesTotal int64)
+	Finish()
+}
+
+// WithObserver returns a transfer with an observer that is notified of progress.
+func (tr *Transfer) WithObserver(observer Observer) *Transfer {
+	tr.observer = observer
+	return tr
+}
+
+// SendTo completes the file transfer using the kermit protocol.
+//
+// The transfer is aborted when the context is cancelled, which is checked
+// before each packet.
+func (tr *Transfer) SendTo(ctx context.Context, stream io.ReadWriter) (err error) {
+	defer func() {
+		// If we fail, tell the other side to abort.
+		if err != nil {
+			_ = writePacket(stream, tr.seq, packetError, []byte("transfer aborted"))
+		}
+	}()
+	tr.seq = 0
+	// Send-Init parameters: maximum packet length, timeout, no padding,
+	// end of line and the control prefix.
+	params := []byte{tochar(maxLen), tochar(10), tochar(0), 0x40, tochar(eol), qctl}
+	if err := tr.exchange(ctx, stream, packetSendInit, params); err != nil {
+		return fmt.Errorf("cannot initialize session: %w", err)
+	}
+	if err := tr.exchange(ctx, stream, packetFileHeader, encode([]byte(filepath.Base(tr.name)), maxData)); err != nil {
+		return fmt.Errorf("cannot send file info: %w", err)
+	}
+	if err := tr.sendFileData(ctx, stream); err != nil {
+		return fmt.Errorf("cannot send file data: %w", err)
+	}
+	if err := tr.exchange(ctx, stream, packetEOF, nil); err != nil {
+		return fmt.Errorf("cannot end file: %w", err)
+	}
+	if err := tr.exchange(ctx, stream, packetBreak, nil); err != nil {
+		return fmt.Errorf("cannot end session: %w", err)
+	}
+	return nil
+}
+
+func (tr *Transfer) sendFileData(ctx context.Context, stream io.ReadWriter) error {
+	if tr.observer != nil {
+		tr.observer.Start(tr.name, tr.size)
+	}
+	// Encoding at most doubles the size of data.
+	buf := make([]byte, maxData)
+	var pending []byte
+	var bytesSent int64
+	for bytesSent < tr.size {
+		if len(pending) < maxData {
+			n := int64(len(buf))
+			if remaining := tr.size - bytesSent - int64(len(pending)); remaining < n {
+				n = remaining
+			}
+			if _, err := io.ReadFull(tr.reader, buf[:n]); err != nil {
+				return err
+			}
+			pending = append(pending, buf[:n]...)
+		}
+		data := encode(pending, maxData)
+		consumed := decodedLen(data)
+		if err := tr.exchange(ctx, stream, packetData, data); err != nil {
+			return err
+		}
+		pending = pending[consumed:]
+		bytesSent += int64(consumed)
+		if tr.observer != nil {
+			tr.observer.Progress(bytesSent, tr.size)
+		}
+	}
+	if tr.observer != nil {
+		tr.observer.Finish()
+	}
+	return nil
+}
+
+// exchange sends a packet and waits for its acknowledgment, sending it
+// again when the receiver reports an error.
+func (tr *Transfer) exchange(ctx context.Context, stream io.ReadWriter, kind byte, data []byte) error {
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := writePacket(stream, tr.seq, kind, data); err != nil {
+			return err
+		}
+		reply, err := readPacket(stream)
+		if err != nil {
+			return err
+		}
+		switch {
+		case reply.kind == packetAck && reply.seq == tr.seq%64:
+			tr.seq++
+			return nil
+		case reply.kind == packetError:
+			return fmt.Errorf("transfer aborted by recipient: %s", reply.data)
+		case reply.kind == packetAck, reply.kind == packetNak, reply.kind == packetInvalid:
+			if attempt >= tr.retryCount {
+				return fmt.Errorf("too many failed attempts")
+			}
+		default:
+			return fmt.Errorf("unexpected packet of type %q", reply.kind)
+		}
+	}
+}
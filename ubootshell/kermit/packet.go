@@ -0,0 +1,156 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kermit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Packet types used by the sender and the receiver.
+const (
+	packetSendInit   = 'S'
+	packetFileHeader = 'F'
+	packetData       = 'D'
+	packetEOF        = 'Z'
+	packetBreak      = 'B'
+	packetAck        = 'Y'
+	packetNak        = 'N'
+	packetError      = 'E'
+	// packetInvalid marks received packets with a wrong checksum.
+	packetInvalid = 0
+)
+
+const (
+	mark = 0x01 // starts each packet
+	eol  = '\r' // ends each packet
+	qctl = '#'  // prefixes control characters
+
+	// maxLen is the longest packet, counted from the sequence number.
+	maxLen = 94
+	// maxData is the most data in a packet, once encoded.
+	maxData = maxLen - 3
+)
+
+// tochar makes a small number printable.
+func tochar(x int) byte {
+	return byte(x + 32)
+}
+
+// unchar is the inverse of tochar.
+func unchar(c byte) int {
+	return int(c) - 32
+}
+
+// checksum computes the single character block check of the given bytes.
+func checksum(data []byte) byte {
+	sum := 0
+	for _, b := range data {
+		sum += int(b)
+	}
+	return tochar((sum + (sum&0xc0)>>6) & 0x3f)
+}
+
+// encode prefixes control characters of the data, returning at most limit
+// bytes of encoded data.
+func encode(data []byte, limit int) []byte {
+	var buf bytes.Buffer
+	for _, b := range data {
+		c := b & 0x7f
+		switch {
+		case c < 32 || c == 127:
+			if buf.Len()+2 > limit {
+				return buf.Bytes()
+			}
+			buf.WriteByte(qctl)
+			buf.WriteByte(b ^ 0x40)
+		case c == qctl:
+			if buf.Len()+2 > limit {
+				return buf.Bytes()
+			}
+			buf.WriteByte(qctl)
+			buf.WriteByte(b)
+		default:
+			if buf.Len()+1 > limit {
+				return buf.Bytes()
+			}
+			buf.WriteByte(b)
+		}
+	}
+	return buf.Bytes()
+}
+
+// decodedLen returns the number of bytes represented by encoded data.
+func decodedLen(data []byte) int {
+	n := 0
+	for i := 0; i < len(data); i++ {
+		if data[i] == qctl {
+			i++
+		}
+		n++
+	}
+	return n
+}
+
+// writePacket sends a packet with the given sequence number, type and data.
+func writePacket(w io.Writer, seq int, kind byte, data []byte) error {
+	var buf bytes.Buffer
+	buf.WriteByte(mark)
+	buf.WriteByte(tochar(len(data) + 3))
+	buf.WriteByte(tochar(seq % 64))
+	buf.WriteByte(kind)
+	buf.Write(data)
+	buf.WriteByte(checksum(buf.Bytes()[1:]))
+	buf.WriteByte(eol)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// packet is a packet sent by the receiver.
+type packet struct {
+	seq  int
+	kind byte
+	data []byte
+}
+
+// readPacket reads the next packet, skipping anything before its mark.
+//
+// Packets with a wrong checksum are returned with the invalid type.
+func readPacket(r io.Reader) (packet, error) {
+	b := make([]byte, 1)
+	for b[0] != mark {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return packet{}, err
+		}
+	}
+	if _, err := io.ReadFull(r, b); err != nil {
+		return packet{}, err
+	}
+	n := unchar(b[0])
+	if n < 3 {
+		return packet{}, fmt.Errorf("invalid packet length %d", n)
+	}
+	rest := make([]byte, n)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return packet{}, err
+	}
+	if checksum(append([]byte{b[0]}, rest[:n-1]...)) != rest[n-1] {
+		return packet{kind: packetInvalid}, nil
+	}
+	return packet{seq: unchar(rest[0]), kind: rest[1], data: rest[2 : n-1]}, nil
+}
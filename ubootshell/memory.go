@@ -0,0 +1,223 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AccessWidth denotes the size of a single memory access.
+type AccessWidth int
+
+const (
+	// ByteAccess reads and writes memory one byte at a time.
+	ByteAccess AccessWidth = 1
+	// WordAccess reads and writes memory in 16 bit units.
+	WordAccess AccessWidth = 2
+	// LongAccess reads and writes memory in 32 bit units.
+	LongAccess AccessWidth = 4
+)
+
+// String returns a description of the access width.
+func (w AccessWidth) String() string {
+	switch w {
+	case ByteAccess:
+		return "byte"
+	case WordAccess:
+		return "word"
+	case LongAccess:
+		return "long"
+	default:
+		return fmt.Sprintf("invalid (%d)", int(w))
+	}
+}
+
+// check returns an error if the access width is not supported by u-boot.
+func (w AccessWidth) check() error {
+	switch w {
+	case ByteAccess, WordAccess, LongAccess:
+		return nil
+	default:
+		return fmt.Errorf("invalid memory access width %d", int(w))
+	}
+}
+
+// suffix returns the suffix of md and mw commands for the given width.
+func (w AccessWidth) suffix() string {
+	switch w {
+	case ByteAccess:
+		return "b"
+	case WordAccess:
+		return "w"
+	case LongAccess:
+		return "l"
+	default:
+		panic(fmt.Sprintf("invalid memory access width %d", int(w)))
+	}
+}
+
+// widestAccess returns the widest access suitable for the given region.
+func widestAccess(addr, size uint64) AccessWidth {
+	for _, w := range []AccessWidth{LongAccess, WordAccess} {
+		if addr%uint64(w) == 0 && size%uint64(w) == 0 {
+			return w
+		}
+	}
+	return ByteAccess
+}
+
+// ReadMemory reads device memory using the md command.
+//
+// The widest access permitted by the alignment of the region is used, as
+// wider accesses transfer less text over the serial line. The hexadecimal
+// dump printed by u-boot is parsed back to binary form. This is slow, each
+// byte costs four to five characters on the serial line.
+func (uboot *UBootShell) ReadMemory(addr, size uint64) ([]byte, error) {
+	return uboot.ReadMemoryWidth(addr, size, widestAccess(addr, size))
+}
+
+// ReadMemoryWidth reads device memory using accesses of the given width.
+//
+// Words and longs are converted to bytes in little-endian order, which is the
+// native order of supported devices.
+func (uboot *UBootShell) ReadMemoryWidth(addr, size uint64, width AccessWidth) ([]byte, error) {
+	if err := width.check(); err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	if size%uint64(width) != 0 {
+		return nil, fmt.Errorf("cannot read %d bytes using %s access", size, width)
+	}
+	// The count given to md is expressed in units, not bytes.
+	count := size / uint64(width)
+	output, err := uboot.regularCmd(fmt.Sprintf("md.%s %#x %#x", width.suffix(), addr, count))
+	if err != nil {
+		return nil, err
+	}
+	data, err := parseMemoryDump(output, addr, width)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) != size {
+		return nil, fmt.Errorf("cannot read memory at %#x: expected %d bytes, got %d", addr, size, len(data))
+	}
+	return data, nil
+}
+
+// WriteMemory writes device memory using the mw command.
+//
+// The widest access permitted by the alignment of the region is used. Each
+// unit costs one command, except for runs of identical values, which are
+// written with a single command.
+func (uboot *UBootShell) WriteMemory(addr uint64, data []byte) error {
+	return uboot.WriteMemoryWidth(addr, data, widestAccess(addr, uint64(len(data))))
+}
+
+// WriteMemoryWidth writes device memory using accesses of the given width.
+//
+// Bytes are combined to words and longs in little-endian order.
+func (uboot *UBootShell) WriteMemoryWidth(addr uint64, data []byte, width AccessWidth) error {
+	if err := width.check(); err != nil {
+		return err
+	}
+	if len(data)%int(width) != 0 {
+		return fmt.Errorf("cannot write %d bytes using %s access", len(data), width)
+	}
+	values := make([]uint32, 0, len(data)/int(width))
+	for i := 0; i < len(data); i += int(width) {
+		switch width {
+		case ByteAccess:
+			values = append(values, uint32(data[i]))
+		case WordAccess:
+			values = append(values, uint32(binary.LittleEndian.Uint16(data[i:])))
+		case LongAccess:
+			values = append(values, binary.LittleEndian.Uint32(data[i:]))
+		}
+	}
+	for i := 0; i < len(values); {
+		// Find a run of identical values.
+		j := i + 1
+		for j < len(values) && values[j] == values[i] {
+			j++
+		}
+		cmd := fmt.Sprintf("mw.%s %#x %#x", width.suffix(), addr+uint64(i*int(width)), values[i])
+		if j-i > 1 {
+			cmd += fmt.Sprintf(" %#x", j-i)
+		}
+		if _, err := uboot.regularCmd(cmd); err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+// parseMemoryDump parses output of md starting at a given address.
+//
+// Each line looks like "41000000: 27 05 19 56 ...    '..V...", that is, an
+// address, up to sixteen bytes worth of hexadecimal units and an ASCII
+// preview, which is ignored.
+func parseMemoryDump(output string, addr uint64, width AccessWidth) ([]byte, error) {
+	var data []byte
+	digits := 2 * int(width)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx < 0 {
+			return nil, fmt.Errorf("cannot parse memory dump line: %q", line)
+		}
+		lineAddr, err := strconv.ParseUint(line[:idx], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse memory dump address: %q", line)
+		}
+		if expected := addr + uint64(len(data)); lineAddr != expected {
+			return nil, fmt.Errorf("unexpected memory dump address %#x, expected %#x", lineAddr, expected)
+		}
+		rest := line[idx+1:]
+		// Each unit is a space followed by hex digits. The ASCII preview is
+		// separated by more than one space.
+		for len(rest) > digits && rest[0] == ' ' && rest[1] != ' ' {
+			value, err := strconv.ParseUint(rest[1:1+digits], 16, 8*int(width))
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse memory dump value: %q", line)
+			}
+			switch width {
+			case ByteAccess:
+				data = append(data, byte(value))
+			case WordAccess:
+				data = append(data, byte(value), byte(value>>8))
+			case LongAccess:
+				data = append(data, byte(value), byte(value>>8), byte(value>>16), byte(value>>24))
+			}
+			rest = rest[1+digits:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseMemoryDump(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		output   string
+		width    AccessWidth
+		expected string
+	}{{
+		name:     "bytes",
+		output:   "00001000: 41 42 43 44 45 46 47 48 49 4a 4b 4c 4d 4e 4f 50    ABCDEFGHIJKLMNOP\r\n",
+		width:    ByteAccess,
+		expected: "ABCDEFGHIJKLMNOP",
+	}, {
+		// The preview looks like more units, but follows more than one space.
+		name:     "hex-like preview",
+		output:   "00001000: 61 62 63 64 65 66 30 31 32 33 34 35 36 37 38 39    abcdef0123456789\r\n",
+		width:    ByteAccess,
+		expected: "abcdef0123456789",
+	}, {
+		// U-boot pads partial lines, so that previews are aligned.
+		name: "partial last line",
+		output: "00001000: 30 31 32 33 34 35 36 37 38 39 61 62 63 64 65 66    0123456789abcdef\r\n" +
+			"00001010: 61 62 63                                           abc\r\n",
+		width:    ByteAccess,
+		expected: "0123456789abcdefabc",
+	}, {
+		name:     "partial line without padding",
+		output:   "00001000: 61 62    ab\r\n",
+		width:    ByteAccess,
+		expected: "ab",
+	}, {
+		// Units are printed in the byte order of the device, the preview
+		// shows memory in the order of addresses.
+		name:     "little-endian words",
+		output:   "00001000: 4241 4443 4645 4847 4a49 4c4b 4e4d 504f    ABCDEFGHIJKLMNOP\r\n",
+		width:    WordAccess,
+		expected: "ABCDEFGHIJKLMNOP",
+	}, {
+		name:     "little-endian longs",
+		output:   "00001000: 44434241 48474645    ABCDEFGH\r\n",
+		width:    LongAccess,
+		expected: "ABCDEFGH",
+	}, {
+		name:     "empty lines",
+		output:   "\r\n00001000: 0201    ..\r\n\r\n",
+		width:    WordAccess,
+		expected: "\x01\x02",
+	}} {
+		data, err := parseMemoryDump(tc.output, 0x1000, tc.width)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if !bytes.Equal(data, []byte(tc.expected)) {
+			t.Fatalf("%s: unexpected data %q, expected %q", tc.name, data, tc.expected)
+		}
+	}
+}
+
+func TestParseMemoryDumpErrors(t *testing.T) {
+	for _, tc := range []struct {
+		output   string
+		expected string
+	}{
+		{"Unknown command 'md.x' - try 'help'\r\n", `cannot parse memory dump line: "Unknown command 'md.x' - try 'help'"`},
+		{"0000100g: 41    A\r\n", `cannot parse memory dump address: "0000100g: 41    A"`},
+		{"00001010: 41    A\r\n", "unexpected memory dump address 0x1010, expected 0x1000"},
+		{"00001000: 41 42    AB\r\n00001004: 43    C\r\n", "unexpected memory dump address 0x1004, expected 0x1002"},
+		{"00001000: 4x    A\r\n", `cannot parse memory dump value: "00001000: 4x    A"`},
+	} {
+		_, err := parseMemoryDump(tc.output, 0x1000, ByteAccess)
+		if err == nil || err.Error() != tc.expected {
+			t.Fatalf("unexpected error parsing %q: %v", tc.output, err)
+		}
+	}
+}
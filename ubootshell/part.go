@@ -0,0 +1,84 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Partition is a partition of a block device, found in its partition table.
+type Partition struct {
+	Name         string
+	Offset, Size uint64 // in bytes
+}
+
+// partBlockSize is the size of the blocks counted by the part command.
+const partBlockSize = 512
+
+// FindPartition looks up a partition of a block device by name.
+//
+// The interface and device number are those of u-boot, for example "mmc" and
+// 0 for the first eMMC. The partition table, such as GPT, is read by the part
+// command, which stores the location in temporary environment variables.
+func (uboot *UBootShell) FindPartition(iface string, dev int, name string) (Partition, error) {
+	const startVar, sizeVar = "oh_part_start", "oh_part_size"
+	for _, cmd := range []string{
+		fmt.Sprintf("setenv %s; setenv %s", startVar, sizeVar),
+		fmt.Sprintf("part start %s %d %s %s", iface, dev, name, startVar),
+		fmt.Sprintf("part size %s %d %s %s", iface, dev, name, sizeVar),
+	} {
+		if _, err := uboot.regularCmd(cmd); err != nil {
+			return Partition{}, err
+		}
+	}
+	output, err := uboot.regularCmd(fmt.Sprintf("printenv %s %s", startVar, sizeVar))
+	if err != nil {
+		return Partition{}, err
+	}
+	if _, err := uboot.regularCmd(fmt.Sprintf("setenv %s; setenv %s", startVar, sizeVar)); err != nil {
+		return Partition{}, err
+	}
+	part := Partition{Name: name}
+	for _, v := range []struct {
+		key   string
+		value *uint64
+	}{{startVar, &part.Offset}, {sizeVar, &part.Size}} {
+		value, ok := envValue(output, v.key)
+		if !ok {
+			return Partition{}, fmt.Errorf("cannot find %s partition on %s %d", name, iface, dev)
+		}
+		blocks, err := strconv.ParseUint(value, 16, 64)
+		if err != nil {
+			return Partition{}, fmt.Errorf("cannot parse location of %s partition: %w", name, err)
+		}
+		*v.value = blocks * partBlockSize
+	}
+	return part, nil
+}
+
+// envValue returns the value of a variable in the output of printenv.
+func envValue(output, key string) (string, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, key+"=") {
+			return line[len(key)+1:], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,387 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/zyga/oh-flash-tools/flash"
+	"github.com/zyga/oh-flash-tools/ioextra"
+)
+
+// ErrFlashWriteFailed is matched by errors of u-boot commands erasing or
+// writing storage which report a failure, such as "Written: ERROR", as
+// opposed to failures of the serial line or of loading the data to memory.
+var ErrFlashWriteFailed = errors.New("cannot write storage")
+
+// Step is a single step of a flash plan.
+type Step interface {
+	// String describes what the step does, for example for a dry-run.
+	String() string
+	// Run performs the step using the given shell.
+	Run(uboot *UBootShell) error
+}
+
+// FlashPlan is a sequence of steps that flash a board.
+//
+// Boards describe how they are flashed by building a plan, which is then
+// executed by Execute. Plans can also be printed without touching the board.
+type FlashPlan struct {
+	Steps []Step
+
+	started int // number of steps started by Execute
+}
+
+// NewFlashPlan returns an empty flash plan.
+func NewFlashPlan() *FlashPlan {
+	return &FlashPlan{}
+}
+
+// Add appends arbitrary steps to the plan.
+func (plan *FlashPlan) Add(steps ...Step) *FlashPlan {
+	plan.Steps = append(plan.Steps, steps...)
+	return plan
+}
+
+// Fill appends a step filling memory with the given byte value.
+func (plan *FlashPlan) Fill(memAddr, size uint64, value byte) *FlashPlan {
+	return plan.Add(&fillStep{memAddr: memAddr, size: size, value: value})
+}
+
+// LoadFile appends a step sending a file to memory, see UBootShell.LoadFile.
+func (plan *FlashPlan) LoadFile(memAddr uint64, fileName string) *FlashPlan {
+	return plan.Add(&loadFileStep{memAddr: memAddr, fileName: fileName})
+}
+
+// LoadFileRange appends a step sending a part of a file to memory, see
+// UBootShell.LoadFileRange.
+func (plan *FlashPlan) LoadFileRange(memAddr uint64, fileName string, offset, size uint64) *FlashPlan {
+	return plan.Add(&loadFileRangeStep{memAddr: memAddr, fileName: fileName, offset: offset, size: size})
+}
+
+// LoadFileDecompressed appends a step sending a compressed file to memory and
+// decompressing it with u-boot, see UBootShell.LoadFileDecompressed.
+func (plan *FlashPlan) LoadFileDecompressed(memAddr, scratchAddr uint64, fileName string) *FlashPlan {
+	return plan.Add(&loadFileDecompressedStep{memAddr: memAddr, scratchAddr: scratchAddr, fileName: fileName})
+}
+
+// Erase appends a step erasing a region of storage.
+func (plan *FlashPlan) Erase(storage Storage, offset, size uint64) *FlashPlan {
+	return plan.Add(&eraseStep{storage: storage, offset: offset, size: size})
+}
+
+// Write appends a step writing memory to a region of storage.
+func (plan *FlashPlan) Write(storage Storage, memAddr, offset, size uint64) *FlashPlan {
+	return plan.Add(&writeStep{storage: storage, memAddr: memAddr, offset: offset, size: size})
+}
+
+// Update appends a step writing memory to a region of storage, skipping the
+// erase blocks already holding the data, see UpdatableStorage.
+//
+// The region does not need to be erased first.
+func (plan *FlashPlan) Update(storage UpdatableStorage, memAddr, offset, size uint64) *FlashPlan {
+	return plan.Add(&updateStep{storage: storage, memAddr: memAddr, offset: offset, size: size})
+}
+
+// SetEnv appends a step setting an environment variable, see UBootShell.SetEnv.
+func (plan *FlashPlan) SetEnv(key, value string) *FlashPlan {
+	return plan.Add(&setEnvStep{key: key, value: value})
+}
+
+// SaveEnv appends a step writing the environment to persistent storage.
+func (plan *FlashPlan) SaveEnv() *FlashPlan {
+	return plan.Add(&saveEnvStep{})
+}
+
+// Reset appends a step resetting the board.
+func (plan *FlashPlan) Reset() *FlashPlan {
+	return plan.Add(&resetStep{})
+}
+
+// StartApplication appends a step starting the application in memory, see
+// UBootShell.StartApplication.
+func (plan *FlashPlan) StartApplication(memAddr uint64) *FlashPlan {
+	return plan.Add(&startApplicationStep{memAddr: memAddr})
+}
+
+// BootImage appends a step booting the kernel image in memory, see
+// UBootShell.BootImage.
+func (plan *FlashPlan) BootImage(memAddr uint64) *FlashPlan {
+	return plan.Add(&bootImageStep{memAddr: memAddr})
+}
+
+// BootConfiguration appends a step booting the FIT image in memory with the
+// named configuration, see UBootShell.BootConfiguration.
+func (plan *FlashPlan) BootConfiguration(memAddr uint64, config string) *FlashPlan {
+	return plan.Add(&bootImageStep{memAddr: memAddr, config: config})
+}
+
+// WithEvents returns a shell notifying the receiver as steps of executed
+// flash plans start, progress and end.
+//
+// Each step is a separate stage, file transfers also report progress.
+func (uboot *UBootShell) WithEvents(events flash.Events) *UBootShell {
+	uboot.events = events
+	return uboot
+}
+
+// Events returns the receiver of events of the shell, for boards to report
+// their own stages. It is nil unless set with WithEvents.
+func (uboot *UBootShell) Events() flash.Events {
+	return uboot.events
+}
+
+// Execute runs all the steps of the plan, stopping at the first failure.
+func (plan *FlashPlan) Execute(uboot *UBootShell) error {
+	for i, step := range plan.Steps {
+		// Steps are not interrupted half-way, as erasing or writing flash
+		// can take a while and is best left to complete.
+		if err := uboot.ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted before %s (step %d of %d): %w", step, i+1, len(plan.Steps), err)
+		}
+		plan.started = i + 1
+		uboot.stage = stepStage(step)
+		err := flash.Run(uboot.events, uboot.stage, func() error { return step.Run(uboot) })
+		uboot.stage = flash.Stage{}
+		if err != nil {
+			return fmt.Errorf("cannot %s (step %d of %d): %w", step, i+1, len(plan.Steps), err)
+		}
+	}
+	return nil
+}
+
+// Region is a region of storage.
+type Region struct {
+	Storage      Storage
+	Offset, Size uint64
+}
+
+// Modified returns the regions of storage that may have been changed by
+// steps started by Execute.
+//
+// This allows telling which partitions need to be flashed again after an
+// interrupted or failed execution.
+func (plan *FlashPlan) Modified() []Region {
+	var regions []Region
+	for _, step := range plan.Steps[:plan.started] {
+		switch step := step.(type) {
+		case *eraseStep:
+			regions = append(regions, Region{Storage: step.storage, Offset: step.offset, Size: step.size})
+		case *writeStep:
+			regions = append(regions, Region{Storage: step.storage, Offset: step.offset, Size: step.size})
+		case *updateStep:
+			regions = append(regions, Region{Storage: step.storage, Offset: step.offset, Size: step.size})
+		}
+	}
+	return regions
+}
+
+// stepStage describes the step for events.
+func stepStage(step Step) flash.Stage {
+	stage := flash.Stage{Name: step.String()}
+	switch step := step.(type) {
+	case *fillStep:
+		stage.Kind = flash.FillStage
+	case *loadFileStep:
+		stage.Kind = flash.TransferStage
+		if size, err := ioextra.DecompressedSize(step.fileName); err == nil {
+			stage.Bytes = size
+		}
+	case *loadFileRangeStep:
+		stage.Kind = flash.TransferStage
+		stage.Bytes = int64(step.size)
+	case *loadFileDecompressedStep:
+		// Progress of the transfer is reported in bytes of compressed data.
+		stage.Kind = flash.TransferStage
+		if fi, err := os.Stat(step.fileName); err == nil {
+			stage.Bytes = fi.Size()
+		}
+	case *sendFileStep:
+		stage.Kind = flash.TransferStage
+		if size, err := ioextra.DecompressedSize(step.fileName); err == nil {
+			stage.Bytes = size
+		}
+	case *eraseStep:
+		stage.Kind = flash.EraseStage
+	case *writeStep, *updateStep:
+		stage.Kind = flash.WriteStage
+	case *setEnvStep, *saveEnvStep:
+		stage.Kind = flash.EnvStage
+	case *resetStep:
+		stage.Kind = flash.ResetStage
+	case *startApplicationStep, *bootImageStep:
+		stage.Kind = flash.BootStage
+	default:
+		stage.Kind = flash.OtherStage
+	}
+	return stage
+}
+
+type fillStep struct {
+	memAddr, size uint64
+	value         byte
+}
+
+func (step *fillStep) String() string {
+	return fmt.Sprintf("fill %#x bytes of memory at %#x with %#02x", step.size, step.memAddr, step.value)
+}
+
+func (step *fillStep) Run(uboot *UBootShell) error {
+	_, err := uboot.regularCmd(fmt.Sprintf("mw.b %#x %#02x %#x", step.memAddr, step.value, step.size))
+	return err
+}
+
+type loadFileStep struct {
+	memAddr  uint64
+	fileName string
+}
+
+func (step *loadFileStep) String() string {
+	return fmt.Sprintf("load %s to memory at %#x", step.fileName, step.memAddr)
+}
+
+func (step *loadFileStep) Run(uboot *UBootShell) error {
+	return uboot.LoadFile(step.memAddr, step.fileName)
+}
+
+type loadFileRangeStep struct {
+	memAddr      uint64
+	fileName     string
+	offset, size uint64
+}
+
+func (step *loadFileRangeStep) String() string {
+	return fmt.Sprintf("load %#x bytes at %#x of %s to memory at %#x", step.size, step.offset, step.fileName, step.memAddr)
+}
+
+func (step *loadFileRangeStep) Run(uboot *UBootShell) error {
+	return uboot.LoadFileRange(step.memAddr, step.fileName, step.offset, step.size)
+}
+
+type loadFileDecompressedStep struct {
+	memAddr, scratchAddr uint64
+	fileName             string
+}
+
+func (step *loadFileDecompressedStep) String() string {
+	return fmt.Sprintf("load %s to memory at %#x, decompressing it with u-boot", step.fileName, step.memAddr)
+}
+
+func (step *loadFileDecompressedStep) Run(uboot *UBootShell) error {
+	return uboot.LoadFileDecompressed(step.memAddr, step.scratchAddr, step.fileName)
+}
+
+type eraseStep struct {
+	storage      Storage
+	offset, size uint64
+}
+
+func (step *eraseStep) String() string {
+	return fmt.Sprintf("erase %#x bytes of storage at %#x", step.size, step.offset)
+}
+
+func (step *eraseStep) Run(uboot *UBootShell) error {
+	return step.storage.Erase(step.offset, step.size)
+}
+
+type writeStep struct {
+	storage               Storage
+	memAddr, offset, size uint64
+}
+
+func (step *writeStep) String() string {
+	return fmt.Sprintf("write %#x bytes of memory at %#x to storage at %#x", step.size, step.memAddr, step.offset)
+}
+
+func (step *writeStep) Run(uboot *UBootShell) error {
+	return step.storage.Write(step.memAddr, step.offset, step.size)
+}
+
+type updateStep struct {
+	storage               UpdatableStorage
+	memAddr, offset, size uint64
+}
+
+func (step *updateStep) String() string {
+	return fmt.Sprintf("update %#x bytes of storage at %#x with memory at %#x", step.size, step.offset, step.memAddr)
+}
+
+func (step *updateStep) Run(uboot *UBootShell) error {
+	return step.storage.Update(step.memAddr, step.offset, step.size)
+}
+
+type setEnvStep struct {
+	key, value string
+}
+
+func (step *setEnvStep) String() string {
+	return fmt.Sprintf("set %s to %q", step.key, step.value)
+}
+
+func (step *setEnvStep) Run(uboot *UBootShell) error {
+	return uboot.SetEnv(step.key, step.value)
+}
+
+type saveEnvStep struct{}
+
+func (step *saveEnvStep) String() string {
+	return "save environment"
+}
+
+func (step *saveEnvStep) Run(uboot *UBootShell) error {
+	return uboot.SaveEnv()
+}
+
+type resetStep struct{}
+
+func (step *resetStep) String() string {
+	return "reset the board"
+}
+
+func (step *resetStep) Run(uboot *UBootShell) error {
+	return uboot.Reset()
+}
+
+type startApplicationStep struct {
+	memAddr uint64
+}
+
+func (step *startApplicationStep) String() string {
+	return fmt.Sprintf("start application at %#x", step.memAddr)
+}
+
+func (step *startApplicationStep) Run(uboot *UBootShell) error {
+	return uboot.StartApplication(step.memAddr)
+}
+
+type bootImageStep struct {
+	memAddr uint64
+	config  string
+}
+
+func (step *bootImageStep) String() string {
+	if step.config != "" {
+		return fmt.Sprintf("boot configuration %s of FIT image at %#x", step.config, step.memAddr)
+	}
+	return fmt.Sprintf("boot kernel image at %#x", step.memAddr)
+}
+
+func (step *bootImageStep) Run(uboot *UBootShell) error {
+	return uboot.BootConfiguration(step.memAddr, step.config)
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Quote returns the value quoted for the u-boot hush shell.
+//
+// The value is enclosed in single quotes, so that semicolons, spaces and
+// variable references lose their special meaning. Single quotes cannot appear
+// inside single-quoted text, so they are closed, escaped and re-opened, relying
+// on the shell to join adjacent words.
+func Quote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// QuoteExpanding returns the value quoted for the u-boot hush shell, allowing
+// variable references to be expanded.
+//
+// The value is enclosed in double quotes. Double quotes, backslashes and
+// backticks are escaped, dollar signs are left alone.
+func QuoteExpanding(value string) string {
+	var sb strings.Builder
+	sb.Grow(len(value) + 2)
+	sb.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '"', '\\', '`':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// checkEnv checks that an environment variable can be set over the shell.
+func checkEnv(key, value string) error {
+	if key == "" || strings.ContainsAny(key, "= \t\r\n'\"\\$;") {
+		return fmt.Errorf("invalid u-boot variable name: %q", key)
+	}
+	// The shell reads commands line by line.
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("cannot set u-boot variable %s: value contains a line break", key)
+	}
+	return nil
+}
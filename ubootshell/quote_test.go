@@ -0,0 +1,78 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import "testing"
+
+func TestQuote(t *testing.T) {
+	for _, tc := range []struct {
+		value, quoted string
+	}{
+		{"", `''`},
+		{"run bootcmd_mmc; boot", `'run bootcmd_mmc; boot'`},
+		{"${bootargs} quiet", `'${bootargs} quiet'`},
+		{"it's", `'it'\''s'`},
+		{"'", `''\'''`},
+	} {
+		if quoted := Quote(tc.value); quoted != tc.quoted {
+			t.Errorf("Quote(%q) = %s, expected %s", tc.value, quoted, tc.quoted)
+		}
+	}
+}
+
+func TestQuoteExpanding(t *testing.T) {
+	for _, tc := range []struct {
+		value, quoted string
+	}{
+		{"", `""`},
+		{"run bootcmd_mmc; boot", `"run bootcmd_mmc; boot"`},
+		{"${bootargs} quiet", `"${bootargs} quiet"`},
+		{"it's", `"it's"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`a\b`, `"a\\b"`},
+		{"`cmd`", "\"\\`cmd\\`\""},
+	} {
+		if quoted := QuoteExpanding(tc.value); quoted != tc.quoted {
+			t.Errorf("QuoteExpanding(%q) = %s, expected %s", tc.value, quoted, tc.quoted)
+		}
+	}
+}
+
+func TestCheckEnv(t *testing.T) {
+	for _, tc := range []struct {
+		key, value string
+		valid      bool
+	}{
+		{"bootcmd", "run bootcmd_mmc; boot", true},
+		{"bootargs", "console=${console} root='/dev/mmcblk0p2'", true},
+		{"", "value", false},
+		{"boot cmd", "value", false},
+		{"boot;cmd", "value", false},
+		{"${bootcmd}", "value", false},
+		{"it's", "value", false},
+		{"bootcmd", "run a\nrun b", false},
+		{"bootcmd", "run a\r", false},
+	} {
+		err := checkEnv(tc.key, tc.value)
+		if tc.valid && err != nil {
+			t.Errorf("checkEnv(%q, %q) returned unexpected error: %v", tc.key, tc.value, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("checkEnv(%q, %q) did not return an error", tc.key, tc.value)
+		}
+	}
+}
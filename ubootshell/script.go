@@ -0,0 +1,174 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadScript reads a file with u-boot commands and returns a plan running them.
+//
+// Each line is a command, typed after the prompt re-appears. Empty lines and
+// lines starting with "#" are ignored. Lines starting with "@" are
+// directives:
+//
+//	@sendfile PATH  sends the file after the command on the previous
+//	                line, such as "loady 0x41000000", starts receiving
+//	                it, with the protocol of loady, loadx, loadz or loadb
+//	@reset          resets the board, which does not return to the prompt
+//	@expect TEXT    fails unless the output of the command on the previous
+//	                line contains the text, such as a vendor command
+//	                reporting success
+//
+// Relative paths are relative to the directory of the script.
+func LoadScript(path string) (*FlashPlan, error) {
+	return LoadTemplate(path, nil)
+}
+
+// LoadTemplate reads a script like LoadScript, first replacing placeholders,
+// such as {{kernel}}, with the given values.
+//
+// This allows one script to work with files, or sizes of files, chosen on
+// the command line. Placeholders without a value are an error, placeholders
+// in comments are left alone.
+func LoadTemplate(path string, vars map[string]string) (*FlashPlan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	plan := NewFlashPlan()
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line, err = expandPlaceholders(line, vars); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineno, err)
+		}
+		if !strings.HasPrefix(line, "@") {
+			plan.Add(&commandStep{cmd: line})
+			continue
+		}
+		fields := strings.Fields(line)
+		switch {
+		case fields[0] == "@sendfile" && len(fields) == 2:
+			var prev *commandStep
+			if n := len(plan.Steps); n > 0 {
+				prev, _ = plan.Steps[n-1].(*commandStep)
+			}
+			if prev == nil {
+				return nil, fmt.Errorf("%s:%d: @sendfile must follow a command receiving the file", path, lineno)
+			}
+			fileName := fields[1]
+			if !filepath.IsAbs(fileName) {
+				fileName = filepath.Join(filepath.Dir(path), fileName)
+			}
+			plan.Steps[len(plan.Steps)-1] = &sendFileStep{cmd: prev.cmd, fileName: fileName}
+		case fields[0] == "@reset" && len(fields) == 1:
+			plan.Reset()
+		case fields[0] == "@expect" && len(fields) > 1:
+			var prev *commandStep
+			if n := len(plan.Steps); n > 0 {
+				prev, _ = plan.Steps[n-1].(*commandStep)
+			}
+			if prev == nil {
+				return nil, fmt.Errorf("%s:%d: @expect must follow a command", path, lineno)
+			}
+			prev.expect = append(prev.expect, strings.TrimSpace(strings.TrimPrefix(line, "@expect")))
+		default:
+			return nil, fmt.Errorf("%s:%d: unsupported directive: %q", path, lineno, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// expandPlaceholders replaces placeholders in a line of a script.
+func expandPlaceholders(line string, vars map[string]string) (string, error) {
+	var sb strings.Builder
+	for {
+		start := strings.Index(line, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(line[start:], "}}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated placeholder: %q", line[start:])
+		}
+		name := strings.TrimSpace(line[start+2 : start+end])
+		value, ok := vars[name]
+		if !ok {
+			return "", fmt.Errorf("no value of placeholder {{%s}}", name)
+		}
+		sb.WriteString(line[:start])
+		sb.WriteString(value)
+		line = line[start+end+2:]
+	}
+	sb.WriteString(line)
+	return sb.String(), nil
+}
+
+type commandStep struct {
+	cmd    string
+	expect []string // texts required in the output
+}
+
+func (step *commandStep) String() string {
+	return fmt.Sprintf("run %q", step.cmd)
+}
+
+func (step *commandStep) Run(uboot *UBootShell) error {
+	output, err := uboot.Command(step.cmd)
+	if err != nil {
+		return err
+	}
+	uboot.log.Printf("%s", output)
+	for _, text := range step.expect {
+		if !strings.Contains(output, text) {
+			return fmt.Errorf("output does not contain %q", text)
+		}
+	}
+	return nil
+}
+
+type sendFileStep struct {
+	cmd      string
+	fileName string
+}
+
+func (step *sendFileStep) String() string {
+	return fmt.Sprintf("run %q and send %s", step.cmd, step.fileName)
+}
+
+func (step *sendFileStep) Run(uboot *UBootShell) error {
+	if err := uboot.SpecialCommand(step.cmd, readyForBinary); err != nil {
+		return err
+	}
+	// The rest of the line announcing the transfer precedes the data.
+	if err := uboot.expect.DiscardUntil([]byte("\n")); err != nil {
+		return err
+	}
+	return uboot.sendFile(step.fileName, uboot.senderForCommand(step.cmd))
+}
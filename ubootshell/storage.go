@@ -0,0 +1,318 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/flash"
+)
+
+// Storage is persistent memory of the board, accessed through u-boot commands.
+//
+// Data is always transferred between storage and a region of RAM. Offsets and
+// sizes are expressed in bytes, regardless of the storage technology.
+type Storage interface {
+	// Erase erases size bytes of storage starting at offset.
+	Erase(offset, size uint64) error
+	// Write copies size bytes from memory at memAddr to storage at offset.
+	Write(memAddr, offset, size uint64) error
+	// Read copies size bytes from storage at offset to memory at memAddr.
+	Read(memAddr, offset, size uint64) error
+}
+
+// AlignedStorage is storage written in units larger than a single byte.
+//
+// Writes of other sizes are either rejected by u-boot or extended to the next
+// unit with whatever follows the data in memory.
+type AlignedStorage interface {
+	Storage
+	// WriteAlignment returns the size of the unit of writing, in bytes.
+	WriteAlignment() uint64
+}
+
+// WriteAlignment returns the size of the unit of writing to the storage, one
+// byte unless the storage implements AlignedStorage.
+func WriteAlignment(storage Storage) uint64 {
+	if aligned, ok := storage.(AlignedStorage); ok && aligned.WriteAlignment() > 0 {
+		return aligned.WriteAlignment()
+	}
+	return 1
+}
+
+// UpdatableStorage is storage able to skip parts already holding the data.
+type UpdatableStorage interface {
+	Storage
+	// Update copies size bytes from memory at memAddr to storage at offset,
+	// erasing and writing only the erase blocks with different content.
+	Update(memAddr, offset, size uint64) error
+}
+
+// storageFailures are parts of lines printed by u-boot commands accessing
+// storage when they fail, such as "SF: 4096 bytes @ 0x0 Written: ERROR",
+// "blocks written: ERROR", "Erase/Write failed" or a NAND "error". Lines
+// are compared in lower case.
+var storageFailures = []string{"error", "failed", "unknown command", "usage:", "not multiple of", "no spi flash selected", "no such device"}
+
+// checkStorageOutput returns an error if the output of a command accessing
+// storage reports a failure.
+//
+// U-boot prints the prompt after failed commands just like after successful
+// ones, so the output is the only way of telling them apart.
+func checkStorageOutput(cmd, output string) error {
+	for _, line := range strings.Split(output, "\n") {
+		lower := strings.ToLower(line)
+		for _, failure := range storageFailures {
+			if strings.Contains(lower, failure) {
+				return fmt.Errorf("%s failed: %s", cmd, strings.TrimSpace(line))
+			}
+		}
+	}
+	return nil
+}
+
+// readCmd runs a command reading storage, see checkStorageOutput.
+func readCmd(uboot *UBootShell, cmd string) error {
+	output, err := uboot.regularCmd(cmd)
+	if err != nil {
+		return err
+	}
+	return checkStorageOutput(cmd, output)
+}
+
+// writeCmd runs a command erasing or writing storage, see
+// checkStorageOutput. Failures reported by u-boot are matched by
+// ErrFlashWriteFailed, unlike failures of the serial line.
+func writeCmd(uboot *UBootShell, cmd string) (string, error) {
+	output, err := uboot.regularCmd(cmd)
+	if err != nil {
+		return "", err
+	}
+	return output, flash.WithKind(checkStorageOutput(cmd, output), ErrFlashWriteFailed)
+}
+
+// spiFlashPageSize is the size of the pages of SPI NOR flash.
+const spiFlashPageSize = 256
+
+// SPIFlash is SPI NOR flash, accessed with the sf command.
+//
+// The flash must be initialized with ProbeFlash first.
+type SPIFlash struct {
+	uboot *UBootShell
+}
+
+// NewSPIFlash returns SPI NOR flash storage accessed through the given shell.
+func NewSPIFlash(uboot *UBootShell) *SPIFlash {
+	return &SPIFlash{uboot: uboot}
+}
+
+// WriteAlignment returns the page size of SPI flash.
+func (flash *SPIFlash) WriteAlignment() uint64 {
+	return spiFlashPageSize
+}
+
+// Erase erases SPI flash with sf erase.
+func (flash *SPIFlash) Erase(offset, size uint64) error {
+	_, err := writeCmd(flash.uboot, fmt.Sprintf("sf erase %#x %#x", offset, size))
+	return err
+}
+
+// Write programs SPI flash with sf write.
+func (flash *SPIFlash) Write(memAddr, offset, size uint64) error {
+	_, err := writeCmd(flash.uboot, fmt.Sprintf("sf write %#x %#x %#x", memAddr, offset, size))
+	return err
+}
+
+// Update programs SPI flash with sf update.
+//
+// U-boot reads each erase block first and skips blocks already holding the
+// data, which is much faster than erasing and saves wear of the flash. The
+// offset must be a multiple of the erase block size.
+func (flash *SPIFlash) Update(memAddr, offset, size uint64) error {
+	output, err := writeCmd(flash.uboot, fmt.Sprintf("sf update %#x %#x %#x", memAddr, offset, size))
+	if err != nil {
+		return err
+	}
+	flash.uboot.log.Printf("%s", output)
+	return nil
+}
+
+// Read reads SPI flash with sf read.
+func (flash *SPIFlash) Read(memAddr, offset, size uint64) error {
+	return readCmd(flash.uboot, fmt.Sprintf("sf read %#x %#x %#x", memAddr, offset, size))
+}
+
+// NANDFlash is raw NAND flash, accessed with the nand command.
+type NANDFlash struct {
+	uboot    *UBootShell
+	yaffs    bool
+	pageSize uint64
+	oobSize  uint64
+}
+
+// NewNANDFlash returns NAND flash storage accessed through the given shell.
+//
+// The flash is assumed to have 2KB pages with 64 bytes of out-of-band data,
+// see WithPageSize.
+func NewNANDFlash(uboot *UBootShell) *NANDFlash {
+	return &NANDFlash{uboot: uboot, pageSize: 2048, oobSize: 64}
+}
+
+// WithPageSize returns NAND flash with pages of the given size, followed by
+// oobSize bytes of out-of-band data.
+func (flash *NANDFlash) WithPageSize(pageSize, oobSize uint64) *NANDFlash {
+	flash.pageSize = pageSize
+	flash.oobSize = oobSize
+	return flash
+}
+
+// WithYAFFS returns NAND flash written with nand write.yaffs.
+//
+// YAFFS images carry the out-of-band data of each page, which is written
+// along with the page itself. HiSilicon builds of u-boot support this mode.
+func (flash *NANDFlash) WithYAFFS(yaffs bool) *NANDFlash {
+	flash.yaffs = yaffs
+	return flash
+}
+
+// WriteAlignment returns the page size of NAND flash.
+//
+// YAFFS images carry out-of-band data, each page of the image is larger
+// than a page of flash.
+func (flash *NANDFlash) WriteAlignment() uint64 {
+	if flash.yaffs {
+		return flash.pageSize + flash.oobSize
+	}
+	return flash.pageSize
+}
+
+// Erase erases NAND flash with nand erase.
+func (flash *NANDFlash) Erase(offset, size uint64) error {
+	_, err := writeCmd(flash.uboot, fmt.Sprintf("nand erase %#x %#x", offset, size))
+	return err
+}
+
+// Write programs NAND flash with nand write or nand write.yaffs.
+//
+// Bad blocks are skipped by u-boot, so the data may end up further away
+// from the offset than its size.
+func (flash *NANDFlash) Write(memAddr, offset, size uint64) error {
+	cmd := "nand write"
+	if flash.yaffs {
+		cmd = "nand write.yaffs"
+	}
+	_, err := writeCmd(flash.uboot, fmt.Sprintf("%s %#x %#x %#x", cmd, memAddr, offset, size))
+	return err
+}
+
+// Read reads NAND flash with nand read.
+func (flash *NANDFlash) Read(memAddr, offset, size uint64) error {
+	return readCmd(flash.uboot, fmt.Sprintf("nand read %#x %#x %#x", memAddr, offset, size))
+}
+
+// mmcBlockSize is the size of the blocks of eMMC and SD cards.
+const mmcBlockSize = 512
+
+// MMC is an eMMC chip or an SD card, accessed with the mmc command.
+//
+// The mmc command counts blocks rather than bytes. Offsets must be multiples
+// of the block size, sizes are rounded up to the next block, except when
+// erasing. The device is selected with mmc dev before it is first used.
+type MMC struct {
+	uboot    *UBootShell
+	dev      int
+	hwPart   int // -1 keeps the current hardware partition
+	selected bool
+}
+
+// NewMMC returns eMMC or SD card storage accessed through the given shell.
+//
+// Devices are numbered by u-boot, see the output of mmc list.
+func NewMMC(uboot *UBootShell, dev int) *MMC {
+	return &MMC{uboot: uboot, dev: dev, hwPart: -1}
+}
+
+// WithHardwarePartition returns storage on the given hardware partition of eMMC.
+//
+// Partition 0 is the user area, 1 and 2 are the boot partitions.
+func (mmc *MMC) WithHardwarePartition(hwPart int) *MMC {
+	mmc.hwPart = hwPart
+	mmc.selected = false
+	return mmc
+}
+
+// WriteAlignment returns the block size of the card.
+func (mmc *MMC) WriteAlignment() uint64 {
+	return mmcBlockSize
+}
+
+// Erase erases blocks with mmc erase.
+//
+// Both offset and size must be multiples of the block size.
+func (mmc *MMC) Erase(offset, size uint64) error {
+	if size%mmcBlockSize != 0 {
+		return fmt.Errorf("cannot erase %#x bytes of mmc, size is not a multiple of %d byte blocks", size, mmcBlockSize)
+	}
+	blk, cnt, err := mmc.blocks(offset, size)
+	if err != nil {
+		return err
+	}
+	_, err = writeCmd(mmc.uboot, fmt.Sprintf("mmc erase %#x %#x", blk, cnt))
+	return err
+}
+
+// Write writes blocks with mmc write.
+//
+// The data in memory following the last byte is written to fill the last block.
+func (mmc *MMC) Write(memAddr, offset, size uint64) error {
+	blk, cnt, err := mmc.blocks(offset, size)
+	if err != nil {
+		return err
+	}
+	_, err = writeCmd(mmc.uboot, fmt.Sprintf("mmc write %#x %#x %#x", memAddr, blk, cnt))
+	return err
+}
+
+// Read reads blocks with mmc read.
+//
+// The remainder of the last block is stored in memory following the last byte.
+func (mmc *MMC) Read(memAddr, offset, size uint64) error {
+	blk, cnt, err := mmc.blocks(offset, size)
+	if err != nil {
+		return err
+	}
+	return readCmd(mmc.uboot, fmt.Sprintf("mmc read %#x %#x %#x", memAddr, blk, cnt))
+}
+
+// blocks selects the device and converts a byte range to a block range.
+func (mmc *MMC) blocks(offset, size uint64) (blk, cnt uint64, err error) {
+	if offset%mmcBlockSize != 0 {
+		return 0, 0, fmt.Errorf("cannot access mmc at %#x, offset is not a multiple of %d byte blocks", offset, mmcBlockSize)
+	}
+	if !mmc.selected {
+		cmd := fmt.Sprintf("mmc dev %d", mmc.dev)
+		if mmc.hwPart >= 0 {
+			cmd = fmt.Sprintf("mmc dev %d %d", mmc.dev, mmc.hwPart)
+		}
+		if err := readCmd(mmc.uboot, cmd); err != nil {
+			return 0, 0, err
+		}
+		mmc.selected = true
+	}
+	return offset / mmcBlockSize, (size + mmcBlockSize - 1) / mmcBlockSize, nil
+}
@@ -0,0 +1,318 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/ubootshell/kermit"
+	"github.com/zyga/oh-flash-tools/ubootshell/ymodem"
+	"github.com/zyga/oh-flash-tools/ubootshell/zmodem"
+)
+
+// FileSender sends files to u-boot with a particular transfer protocol.
+type FileSender interface {
+	// Protocol returns the name of the protocol, as announced by u-boot
+	// once ready to receive.
+	Protocol() string
+	// Command returns the u-boot command receiving a file at the given address.
+	Command(addr uint64) string
+	// Send sends size bytes read from the reader to u-boot, which is
+	// already running the command, as a file with the given name.
+	//
+	// The observer may be nil. Sending stops when the context is cancelled,
+	// if the protocol allows it.
+	Send(ctx context.Context, stream io.ReadWriter, name string, r io.Reader, size int64, observer TransferObserver) error
+}
+
+// YModemSender sends files with YMODEM, using the loady command.
+//
+// In the streaming mode, data blocks are sent without waiting for
+// acknowledgment if the receiver asks for YMODEM-G.
+type YModemSender struct {
+	BlockKind  ymodem.BlockKind
+	Mode       ymodem.Mode
+	RetryCount int
+}
+
+// NewYModemSender returns a sender using 1KiB blocks and retrying failed blocks.
+func NewYModemSender() *YModemSender {
+	return &YModemSender{BlockKind: ymodem.LargeBlock, RetryCount: 10}
+}
+
+func (sender *YModemSender) Protocol() string { return "ymodem" }
+
+func (sender *YModemSender) Command(addr uint64) string { return fmt.Sprintf("loady %#x", addr) }
+
+func (sender *YModemSender) Send(ctx context.Context, stream io.ReadWriter, name string, r io.Reader, size int64, observer TransferObserver) error {
+	tr := ymodem.NewTransfer(r, name, size).WithBlockKind(sender.BlockKind).WithMode(sender.Mode).WithObserver(observer).WithRetryCount(sender.RetryCount)
+	return tr.SendTo(ctx, stream)
+}
+
+// XModemSender sends files with XMODEM, using the loadx command.
+//
+// The last block is padded, so the size of the file in memory is rounded up.
+type XModemSender struct {
+	BlockKind  ymodem.BlockKind
+	RetryCount int
+}
+
+// NewXModemSender returns a sender using 1KiB blocks and retrying failed blocks.
+func NewXModemSender() *XModemSender {
+	return &XModemSender{BlockKind: ymodem.LargeBlock, RetryCount: 10}
+}
+
+func (sender *XModemSender) Protocol() string { return "xmodem" }
+
+func (sender *XModemSender) Command(addr uint64) string { return fmt.Sprintf("loadx %#x", addr) }
+
+func (sender *XModemSender) Send(ctx context.Context, stream io.ReadWriter, name string, r io.Reader, size int64, observer TransferObserver) error {
+	tr := ymodem.NewTransfer(r, name, size).WithXModem().WithBlockKind(sender.BlockKind).WithObserver(observer).WithRetryCount(sender.RetryCount)
+	return tr.SendTo(ctx, stream)
+}
+
+// ZModemSender sends files with ZMODEM, using the loadz command.
+//
+// Transfers cannot be cancelled half-way.
+type ZModemSender struct {
+	RetryCount int
+}
+
+// NewZModemSender returns a sender retrying lost data.
+func NewZModemSender() *ZModemSender {
+	return &ZModemSender{RetryCount: 10}
+}
+
+func (sender *ZModemSender) Protocol() string { return "zmodem" }
+
+func (sender *ZModemSender) Command(addr uint64) string { return fmt.Sprintf("loadz %#x", addr) }
+
+func (sender *ZModemSender) Send(ctx context.Context, stream io.ReadWriter, name string, r io.Reader, size int64, observer TransferObserver) error {
+	// The receiver may ask for data again, from any position.
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		rs = bytes.NewReader(data)
+	}
+	tr := zmodem.NewTransferFromReader(rs, name, size)
+	return tr.WithObserver(observer).WithRetryCount(sender.RetryCount).SendTo(stream)
+}
+
+// KermitSender sends files with Kermit, using the loadb command.
+//
+// Kermit is slow, as packets are short, but it is available in most builds
+// of u-boot and works over links that are not 8-bit clean.
+type KermitSender struct {
+	RetryCount int
+}
+
+// NewKermitSender returns a sender retrying failed packets.
+func NewKermitSender() *KermitSender {
+	return &KermitSender{RetryCount: 10}
+}
+
+func (sender *KermitSender) Protocol() string { return "kermit" }
+
+func (sender *KermitSender) Command(addr uint64) string { return fmt.Sprintf("loadb %#x", addr) }
+
+func (sender *KermitSender) Send(ctx context.Context, stream io.ReadWriter, name string, r io.Reader, size int64, observer TransferObserver) error {
+	tr := kermit.NewTransfer(r, name, size)
+	return tr.WithObserver(observer).WithRetryCount(sender.RetryCount).SendTo(ctx, stream)
+}
+
+// TransferProtocols lists the names accepted by NewFileSender.
+var TransferProtocols = []string{"ymodem", "xmodem", "zmodem", "kermit"}
+
+// NewFileSender returns a sender with default settings for the named protocol.
+func NewFileSender(protocol string) (FileSender, error) {
+	switch protocol {
+	case "ymodem":
+		return NewYModemSender(), nil
+	case "xmodem":
+		return NewXModemSender(), nil
+	case "zmodem":
+		return NewZModemSender(), nil
+	case "kermit":
+		return NewKermitSender(), nil
+	default:
+		return nil, fmt.Errorf("unsupported transfer protocol: %q", protocol)
+	}
+}
+
+// commandName returns the name of the u-boot command used by the sender.
+func commandName(sender FileSender) string {
+	return strings.Fields(sender.Command(0))[0]
+}
+
+// WithFileSender returns a shell sending files with the given sender.
+//
+// By default, or when the sender is nil, zmodem is used if u-boot supports
+// it and ymodem otherwise.
+func (uboot *UBootShell) WithFileSender(sender FileSender) *UBootShell {
+	uboot.sender = sender
+	return uboot
+}
+
+// fileSender returns the sender used by LoadFile.
+//
+// Support for zmodem is optional, check if the loadz command is known. If
+// u-boot does not list its commands, ymodem is assumed to be available.
+// Explicitly selected senders are checked to be supported as well.
+func (uboot *UBootShell) fileSender() (FileSender, error) {
+	caps, err := uboot.Capabilities()
+	if err != nil && !errors.Is(err, ErrNoHelp) {
+		return nil, err
+	}
+	if uboot.sender != nil {
+		if err == nil && !caps.Has(commandName(uboot.sender)) {
+			return nil, fmt.Errorf("u-boot does not support %s, needed for %s transfers", commandName(uboot.sender), uboot.sender.Protocol())
+		}
+		return uboot.sender, nil
+	}
+	switch {
+	case errors.Is(err, ErrNoHelp):
+		uboot.sender = NewYModemSender()
+	case caps.Has("loadz"):
+		uboot.sender = NewZModemSender()
+	case caps.Has("loady"):
+		uboot.sender = NewYModemSender()
+	default:
+		return nil, fmt.Errorf("u-boot supports neither loadz nor loady, cannot send files")
+	}
+	uboot.log.Printf("Using %s for file transfers\n", uboot.sender.Protocol())
+	return uboot.sender, nil
+}
+
+// senderForCommand returns the sender matching the given u-boot command.
+//
+// This allows scripts to send files with any of the supported commands.
+// The shell's own sender, or ymodem, is used for other commands.
+func (uboot *UBootShell) senderForCommand(cmd string) FileSender {
+	if fields := strings.Fields(cmd); len(fields) > 0 {
+		if uboot.sender != nil && commandName(uboot.sender) == fields[0] {
+			return uboot.sender
+		}
+		for _, protocol := range TransferProtocols {
+			sender, _ := NewFileSender(protocol)
+			if commandName(sender) == fields[0] {
+				return sender
+			}
+		}
+	}
+	if uboot.sender != nil {
+		return uboot.sender
+	}
+	return NewYModemSender()
+}
+
+// readyForBinary is printed by the load commands before receiving data.
+const readyForBinary = "## Ready for binary"
+
+// LoadFile copies a file to device memory at the given address.
+//
+// The file is sent with the file sender of the shell, see WithFileSender.
+// When a transfer baud rate is set, the transfer happens at that rate and the
+// original rate is restored afterwards. Files ending with .gz or .xz are
+// decompressed on the fly.
+func (uboot *UBootShell) LoadFile(addr uint64, fileName string) error {
+	file, size, err := openFile(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return uboot.LoadData(addr, fileName, file, size)
+}
+
+// LoadFileRange copies size bytes of a file, starting at the given offset, to
+// device memory at the given address.
+//
+// This allows loading files larger than the memory of the board in parts.
+// Compressed files are decompressed, just like with LoadFile, and the offset
+// refers to the decompressed data.
+func (uboot *UBootShell) LoadFileRange(addr uint64, fileName string, offset, size uint64) error {
+	r, fileSize, err := openFile(fileName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if offset > uint64(fileSize) || size > uint64(fileSize)-offset {
+		return fmt.Errorf("cannot load %#x bytes at %#x of %s, it has only %#x bytes", size, offset, fileName, fileSize)
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err = seeker.Seek(int64(offset), io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, r, int64(offset))
+	}
+	if err != nil {
+		return err
+	}
+	return uboot.LoadData(addr, fileName, io.LimitReader(r, int64(size)), int64(size))
+}
+
+// LoadData copies size bytes read from the reader to device memory at the
+// given address, just like LoadFile.
+//
+// This allows sending data prepared in memory, such as an environment image,
+// without a temporary file. The name is announced to u-boot by protocols
+// supporting it.
+func (uboot *UBootShell) LoadData(addr uint64, name string, r io.Reader, size int64) (err error) {
+	sender, err := uboot.fileSender()
+	if err != nil {
+		return err
+	}
+	if uboot.transferBaudRate != 0 {
+		if uboot.baudRateSetter == nil {
+			return fmt.Errorf("cannot switch baud rate, serial port does not support it")
+		}
+		baudRate := uboot.baudRateSetter.BaudRate()
+		if err := uboot.SwitchBaudRate(uboot.transferBaudRate); err != nil {
+			return err
+		}
+		defer func() {
+			if restoreErr := uboot.SwitchBaudRate(baudRate); restoreErr != nil && err == nil {
+				err = restoreErr
+			}
+		}()
+	}
+	ready := fmt.Sprintf("%s (%s) download to ", readyForBinary, sender.Protocol())
+	if err := uboot.SpecialCommand(sender.Command(addr), ready); err != nil {
+		return err
+	}
+	// The rest of the line, with the address and baud rate, precedes the data.
+	if err := uboot.expect.DiscardUntil([]byte("\n")); err != nil {
+		return err
+	}
+	return uboot.sendData(name, r, size, sender)
+}
+
+// openFile opens the file and returns its size.
+//
+// Files compressed with gzip or xz are decompressed while they are sent,
+// see ioextra.OpenDecompressed.
+func openFile(fileName string) (io.ReadCloser, int64, error) {
+	return ioextra.OpenDecompressed(fileName)
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import "fmt"
+
+// bootPoll is sent repeatedly by boot ROMs and SPL waiting for a file.
+//
+// Two consecutive polls are expected, so that a 'C' in messages printed
+// before the transfer starts is not mistaken for one.
+var bootPoll = []byte("CC")
+
+// SendBootFile sends a file to a boot ROM or SPL loading the next stage
+// over the serial port, such as the ROM of TI AM335x in UART boot mode.
+//
+// Unlike SendFile, no command is typed and no prompt is expected once the
+// file is sent, the stage loaded that way starts running instead. The
+// receiver is expected to be polling for the file with the protocol of the
+// sender, usually xmodem for boot ROMs and ymodem for SPL.
+func (uboot *UBootShell) SendBootFile(fileName string, sender FileSender) error {
+	if err := uboot.expect.DiscardUntil(bootPoll); err != nil {
+		return fmt.Errorf("cannot find boot stage waiting for %s: %w", fileName, err)
+	}
+	file, size, err := openFile(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return uboot.transfer(fileName, file, size, sender)
+}
@@ -20,44 +20,173 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/zyga/oh-flash-tools/flash"
 	"github.com/zyga/oh-flash-tools/ioextra"
+	"github.com/zyga/oh-flash-tools/logging"
+	"github.com/zyga/oh-flash-tools/progress"
 	"github.com/zyga/oh-flash-tools/ubootshell/ymodem"
 )
 
 // UBootShell allow interaction with u-boot shell environment.
 type UBootShell struct {
 	rwc    io.ReadWriteCloser
-	reader *bufio.Reader
+	expect *ioextra.ExpectEngine
 	writer *bufio.Writer
 	prompt []byte // prompt of a particular build
+
+	retryCount      int
+	turnaround      time.Duration // pause after the prompt, before typing
+	charDelay       time.Duration // pause between typed characters
+	charEcho        bool          // check the echo of each typed character
+	autobootBanners [][]byte
+	interruptKeys   []byte
+	interruptRepeat bool
+
+	transferBaudRate int
+	baudRateSetter   BaudRateSetter
+	sender           FileSender
+
+	strictVersion bool
+	caps          *Capabilities // cached result of Capabilities
+
+	events flash.Events // notified about flash plan steps
+	stage  flash.Stage  // step being executed, for progress events
+
+	ctx context.Context // cancels file transfers
+
+	log      logging.Logger
+	observer TransferObserver
 }
 
+// DefaultAutobootBanner is the message printed by stock u-boot before auto-boot.
+const DefaultAutobootBanner = "Hit any key to stop autoboot"
+
+// DefaultInterruptKeys are sent to stock u-boot to stop auto-boot.
+const DefaultInterruptKeys = "\n"
+
+// ErrAutobootMissed is matched by errors of InterruptBoot not seeing the
+// auto-boot message or not stopping auto-boot in time.
+var ErrAutobootMissed = errors.New("u-boot auto-boot not interrupted")
+
+// ErrTransferFailed is matched by errors of sending files, with any protocol.
+// Failures of data blocks of XMODEM and YMODEM are ymodem.TransferError.
+var ErrTransferFailed = ymodem.ErrTransferFailed
+
 // NewUBootShell returns an UBootShell over the given serial port.
 // The given context can be used to control maximum duration of the negotiation process.
 func NewUBootShell(ctx context.Context, rwc io.ReadWriteCloser) *UBootShell {
+	expect := ioextra.NewExpectEngine(rwc)
+	if deadline, ok := ctx.Deadline(); ok {
+		expect.SetDeadline(deadline)
+	}
 	return &UBootShell{
-		rwc:    rwc,
-		reader: bufio.NewReader(rwc),
-		writer: bufio.NewWriter(rwc),
+		ctx:             context.Background(),
+		rwc:             rwc,
+		expect:          expect,
+		writer:          bufio.NewWriter(rwc),
+		autobootBanners: [][]byte{[]byte(DefaultAutobootBanner)},
+		interruptKeys:   []byte(DefaultInterruptKeys),
+		log:             logging.Discard,
+	}
+}
+
+// WithRetryCount returns a shell retrying commands the given number of times.
+//
+// Commands are retried when the echo does not match the command that was
+// sent, or when it does not arrive before the underlying stream times out.
+// Retries are safe, as the command is only submitted after the echo matches.
+func (uboot *UBootShell) WithRetryCount(retryCount int) *UBootShell {
+	uboot.retryCount = retryCount
+	return uboot
+}
+
+// WithTurnaroundDelay returns a shell pausing before typing each command and
+// between typed characters.
+//
+// Some boards with software UART FIFOs drop the first characters of commands
+// sent right after the prompt, or of characters sent back to back, which
+// makes the echo mismatch. Zero delays, the default, disable pausing.
+func (uboot *UBootShell) WithTurnaroundDelay(turnaround, charDelay time.Duration) *UBootShell {
+	uboot.turnaround = turnaround
+	uboot.charDelay = charDelay
+	return uboot
+}
+
+// WithCharacterEcho returns a shell typing commands one character at a time
+// and checking the echo of each character.
+//
+// Characters echoed wrong are erased with backspace and typed again, up to
+// the retry count, instead of retrying the whole command. This helps on noisy
+// connections, where long commands are rarely echoed without errors.
+func (uboot *UBootShell) WithCharacterEcho(charEcho bool) *UBootShell {
+	uboot.charEcho = charEcho
+	return uboot
+}
+
+// WithContext returns a shell aborting file transfers when the context is cancelled.
+//
+// Cancelled transfers are aborted on the receiving side as well, so that
+// u-boot returns to the shell instead of waiting for more data.
+func (uboot *UBootShell) WithContext(ctx context.Context) *UBootShell {
+	uboot.ctx = ctx
+	return uboot
+}
+
+// WithAutobootBanners returns a shell waiting for any of the given auto-boot messages.
+//
+// Vendor builds of u-boot often replace the stock "Hit any key to stop
+// autoboot" message with their own text.
+func (uboot *UBootShell) WithAutobootBanners(banners ...string) *UBootShell {
+	uboot.autobootBanners = make([][]byte, 0, len(banners))
+	for _, banner := range banners {
+		uboot.autobootBanners = append(uboot.autobootBanners, []byte(banner))
 	}
+	return uboot
+}
+
+// WithInterruptKeys returns a shell sending the given keys to stop auto-boot.
+//
+// Some builds of u-boot only stop auto-boot after a specific key sequence,
+// for example Ctrl-C or a password, is received.
+func (uboot *UBootShell) WithInterruptKeys(keys string) *UBootShell {
+	uboot.interruptKeys = []byte(keys)
+	return uboot
+}
+
+// WithRepeatedInterrupt returns a shell using InterruptBootWith to stop auto-boot.
+//
+// This is required by builds of u-boot which only stop auto-boot when a
+// secret keyword is typed during the count-down.
+func (uboot *UBootShell) WithRepeatedInterrupt(repeat bool) *UBootShell {
+	uboot.interruptRepeat = repeat
+	return uboot
 }
 
-// InterruptBoot waits for the message "Hit any key to stop autoboot" and sends a newline.
+// InterruptBoot waits for the auto-boot message and sends the interrupt keys.
+//
+// By default the message is "Hit any key to stop autoboot" and the key is a
+// newline, see WithAutobootBanners and WithInterruptKeys.
 func (uboot *UBootShell) InterruptBoot() error {
-	fmt.Printf("Waiting for u-boot auto-boot prompt\n")
+	if uboot.interruptRepeat {
+		return uboot.InterruptBootWith(uboot.interruptKeys)
+	}
+	uboot.log.Printf("Waiting for u-boot auto-boot prompt\n")
 
 	// Scan input until u-boot announces auto-boot.
-	if err := uboot.discardUntil([]byte("Hit any key to stop autoboot")); err != nil {
-		return fmt.Errorf("cannot find u-boot autoboot message")
+	if _, _, err := uboot.expect.ExpectAny(uboot.autobootBanners...); err != nil {
+		return flash.WithKind(fmt.Errorf("cannot find u-boot autoboot message: %w", err), ErrAutobootMissed)
 	}
-	fmt.Printf("Interrupting Boot Process\n")
+	uboot.log.Printf("Interrupting Boot Process\n")
 
 	// Interrupt auto-boot process.
-	if _, err := fmt.Fprintf(uboot.writer, "\n"); err != nil {
+	if _, err := uboot.writer.Write(uboot.interruptKeys); err != nil {
 		return err
 	}
 	if err := uboot.writer.Flush(); err != nil {
@@ -66,15 +195,58 @@ func (uboot *UBootShell) InterruptBoot() error {
 	// Wait until we get a shell prompt. Note that u-boot is still writing
 	// auto-boot counter, so we need to completely drain that before starting
 	// prompt detection.
-	if err := uboot.discardUntil([]byte("\n")); err != nil {
-		return fmt.Errorf("cannot find u-boot shell prompt")
+	if err := uboot.expect.DiscardUntil([]byte("\n")); err != nil {
+		return fmt.Errorf("cannot find u-boot shell prompt: %w", err)
+	}
+	return nil
+}
+
+const (
+	// interruptInterval is the delay between repetitions of the interrupt sequence.
+	interruptInterval = 50 * time.Millisecond
+	// interruptWindow is the duration of repeating the interrupt sequence.
+	interruptWindow = 2 * time.Second
+)
+
+// InterruptBootWith waits for the auto-boot message and repeatedly sends the
+// given sequence during the count-down window.
+//
+// Keywords are not echoed while u-boot waits for them, so the sequence is
+// sent for the whole window, after which Ctrl-C is sent to discard the text
+// typed into the shell. The <INTERRUPT> message confirms that the shell is
+// ready.
+func (uboot *UBootShell) InterruptBootWith(sequence []byte) error {
+	uboot.log.Printf("Waiting for u-boot auto-boot prompt\n")
+	if _, _, err := uboot.expect.ExpectAny(uboot.autobootBanners...); err != nil {
+		return flash.WithKind(fmt.Errorf("cannot find u-boot autoboot message: %w", err), ErrAutobootMissed)
+	}
+	uboot.log.Printf("Interrupting Boot Process with %q\n", sequence)
+	for start := time.Now(); time.Since(start) < interruptWindow; time.Sleep(interruptInterval) {
+		if _, err := uboot.writer.Write(sequence); err != nil {
+			return err
+		}
+		if err := uboot.writer.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := uboot.writer.WriteByte(ctrlC); err != nil {
+		return err
+	}
+	if err := uboot.writer.Flush(); err != nil {
+		return err
+	}
+	if err := uboot.expect.DiscardUntil([]byte("<INTERRUPT>")); err != nil {
+		return flash.WithKind(fmt.Errorf("cannot interrupt u-boot with %q: %w", sequence, err), ErrAutobootMissed)
+	}
+	if err := uboot.expect.DiscardUntil([]byte("\n")); err != nil {
+		return fmt.Errorf("cannot find u-boot shell prompt: %w", err)
 	}
 	return nil
 }
 
 // ProbePrompt probes u-boot shell prompt.
 func (uboot *UBootShell) ProbePrompt() error {
-	fmt.Printf("Sending newline to see u-boot prompt\n")
+	uboot.log.Printf("Sending newline to see u-boot prompt\n")
 	var prompt []byte
 	for i := 0; i < 3; i++ {
 		// Send a newline and detect the complete prompt.
@@ -84,9 +256,9 @@ func (uboot *UBootShell) ProbePrompt() error {
 		if err := uboot.writer.Flush(); err != nil {
 			return err
 		}
-		line, err := uboot.reader.ReadBytes('\n')
+		line, err := uboot.expect.CollectUntil([]byte("\n"))
 		if err != nil {
-			return err
+			return fmt.Errorf("cannot auto-discover u-boot prompt: %w", err)
 		}
 		prompt = bytes.TrimRight(line, "\r\n")
 		if len(prompt) != 0 {
@@ -96,8 +268,16 @@ func (uboot *UBootShell) ProbePrompt() error {
 	if len(prompt) == 0 {
 		return fmt.Errorf("cannot auto-discover u-boot prompt")
 	}
-	fmt.Printf("Auto-discovered u-boot prompt as %q\n", prompt)
+	uboot.log.Printf("Auto-discovered u-boot prompt as %q\n", prompt)
 	uboot.prompt = prompt
+	// The newline we sent is followed by another prompt. Consume it so that
+	// the echo of the next command is the first thing we read.
+	if err := uboot.expect.DiscardUntil(prompt); err != nil {
+		return err
+	}
+	// Negotiation is over, commands are only limited by stream timeouts.
+	// Storage and transfer commands may run silently for minutes.
+	uboot.expect.SetDeadline(time.Time{})
 	return nil
 }
 
@@ -108,7 +288,7 @@ func (uboot *UBootShell) Command(cmd string) (string, error) {
 
 // WaitForPrompt discards output until prompt re-appears.
 func (uboot *UBootShell) WaitForPrompt() error {
-	return uboot.discardUntil(uboot.prompt)
+	return uboot.expect.DiscardUntil(uboot.prompt)
 }
 
 // SpecialCommand sends the given text to u-boot prompt and waits for special reponse.
@@ -122,12 +302,25 @@ func (uboot *UBootShell) Reset() error {
 }
 
 // SetEnv sets u-boot environment variable.
+//
+// The value is stored verbatim. References to other variables, such as
+// ${bootargs} in bootcmd, are not expanded until the variable is used.
 func (uboot *UBootShell) SetEnv(key, value string) error {
-	// TODO: escape values correctly
-	if _, err := uboot.regularCmd(fmt.Sprintf(`setenv %s "%s"`, key, value)); err != nil {
+	if err := checkEnv(key, value); err != nil {
 		return err
 	}
-	return nil
+	return setEnvCmd(uboot, fmt.Sprintf("setenv %s %s", key, Quote(value)))
+}
+
+// SetEnvExpanded sets u-boot environment variable after expanding references.
+//
+// Variable references are expanded by the shell at the time the variable is
+// set, using the values currently present in the environment.
+func (uboot *UBootShell) SetEnvExpanded(key, value string) error {
+	if err := checkEnv(key, value); err != nil {
+		return err
+	}
+	return setEnvCmd(uboot, fmt.Sprintf("setenv %s %s", key, QuoteExpanding(value)))
 }
 
 // SaveEnv writes u-boot environment to persistent storage.
@@ -139,21 +332,10 @@ func (uboot *UBootShell) SaveEnv() error {
 }
 
 func (uboot *UBootShell) regularCmd(cmd string) (string, error) {
-	if len(uboot.prompt) == 0 {
-		panic("cannot send command without knowing u-boot prompt")
-	}
-	fmt.Printf("Execute in uboot: %s\n", cmd)
-	if _, err := fmt.Fprintf(uboot.writer, "%s\n", cmd); err != nil {
+	if err := uboot.sendCmd(cmd); err != nil {
 		return "", err
 	}
-	if err := uboot.writer.Flush(); err != nil {
-		return "", err
-	}
-	echo := []byte(cmd + "\r\n")
-	if err := uboot.discardUntil(echo); err != nil {
-		return "", err
-	}
-	output, err := uboot.collectUntil(uboot.prompt)
+	output, err := uboot.expect.CollectUntil(uboot.prompt)
 	if err != nil {
 		return "", err
 	}
@@ -161,108 +343,314 @@ func (uboot *UBootShell) regularCmd(cmd string) (string, error) {
 }
 
 func (uboot *UBootShell) specialCmd(cmd, after string) error {
+	if err := uboot.sendCmd(cmd); err != nil {
+		return err
+	}
+	if err := uboot.expect.DiscardUntil([]byte(after)); err != nil {
+		return err
+	}
+	return nil
+}
+
+var errEchoMismatch = errors.New("command echo mismatch")
+
+// ctrlC cancels the line typed into u-boot shell.
+const ctrlC = 0x03
+
+// sendCmd types the command, verifies the echo and submits it with a newline.
+//
+// When the echo does not match, or does not arrive in time, the typed line is
+// cancelled with Ctrl-C and, once the prompt re-appears, typed again.
+func (uboot *UBootShell) sendCmd(cmd string) error {
 	if len(uboot.prompt) == 0 {
 		panic("cannot send command without knowing u-boot prompt")
 	}
-	fmt.Printf("Execute in uboot: %s\n", cmd)
-	if _, err := fmt.Fprintf(uboot.writer, "%s\n", cmd); err != nil {
+	uboot.log.Printf("Execute in uboot: %s\n", cmd)
+	for attempt := 0; ; attempt++ {
+		err := uboot.typeCmd(cmd)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errEchoMismatch) && !isTimeout(err) {
+			return err
+		}
+		if attempt >= uboot.retryCount {
+			return fmt.Errorf("cannot execute %q: %w", cmd, err)
+		}
+		uboot.log.Printf("Retrying command after error: %v\n", err)
+		if err := uboot.resync(); err != nil {
+			return err
+		}
+	}
+	time.Sleep(uboot.charDelay)
+	if _, err := fmt.Fprintf(uboot.writer, "\n"); err != nil {
 		return err
 	}
 	if err := uboot.writer.Flush(); err != nil {
 		return err
 	}
-	echo := []byte(cmd + "\r\n")
-	if err := uboot.discardUntil(echo); err != nil {
-		return err
+	return uboot.expect.DiscardUntil([]byte("\r\n"))
+}
+
+// typeCmd sends the command without the trailing newline and reads the echo.
+func (uboot *UBootShell) typeCmd(cmd string) error {
+	time.Sleep(uboot.turnaround)
+	if uboot.charEcho {
+		return uboot.typeCmdEchoed(cmd)
+	}
+	if uboot.charDelay > 0 {
+		for i := 0; i < len(cmd); i++ {
+			if i > 0 {
+				time.Sleep(uboot.charDelay)
+			}
+			if err := uboot.writer.WriteByte(cmd[i]); err != nil {
+				return err
+			}
+			if err := uboot.writer.Flush(); err != nil {
+				return err
+			}
+		}
+	} else {
+		if _, err := uboot.writer.WriteString(cmd); err != nil {
+			return err
+		}
+		if err := uboot.writer.Flush(); err != nil {
+			return err
+		}
 	}
-	if err := uboot.discardUntil([]byte(after)); err != nil {
+	echo := make([]byte, len(cmd))
+	if _, err := io.ReadFull(uboot.expect, echo); err != nil {
 		return err
 	}
+	if !bytes.Equal(echo, []byte(cmd)) {
+		return fmt.Errorf("%w: sent %q, received %q", errEchoMismatch, cmd, echo)
+	}
 	return nil
 }
 
-func (uboot *UBootShell) collectUntil(expected []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	i := 0
-	for {
-		if i == len(expected) {
-			collected := buf.Bytes()
-			return collected[:len(collected)-len(expected)], nil
+// typeCmdEchoed sends the command one character at a time, without the
+// trailing newline, reading the echo of each character.
+func (uboot *UBootShell) typeCmdEchoed(cmd string) error {
+	echo := make([]byte, 1)
+	retries := 0
+	for i := 0; i < len(cmd); {
+		if i > 0 {
+			time.Sleep(uboot.charDelay)
 		}
-		b, err := uboot.reader.ReadByte()
-		if err != nil {
-			return nil, err
+		if err := uboot.writer.WriteByte(cmd[i]); err != nil {
+			return err
+		}
+		if err := uboot.writer.Flush(); err != nil {
+			return err
 		}
-		buf.WriteByte(b) // error is always nil
-		if i < len(expected) && expected[i] == b {
+		if _, err := io.ReadFull(uboot.expect, echo); err != nil {
+			return err
+		}
+		if echo[0] == cmd[i] {
 			i++
-		} else {
-			i = 0
+			retries = 0
+			continue
 		}
-	}
-}
-
-func (uboot *UBootShell) discardUntil(expected []byte) error {
-	i := 0
-	for {
-		if i == len(expected) {
-			return nil
+		if retries >= uboot.retryCount {
+			return fmt.Errorf("%w: sent %q at offset %d, received %q", errEchoMismatch, cmd[i], i, echo[0])
 		}
-		b, err := uboot.reader.ReadByte()
-		if err != nil {
+		retries++
+		uboot.log.Printf("Typing %q again, echoed as %q\n", cmd[i], echo[0])
+		// Erase the character received by u-boot, whatever it was.
+		if err := uboot.writer.WriteByte('\b'); err != nil {
 			return err
 		}
-		if i < len(expected) && expected[i] == b {
-			// fmt.Printf("following expected %q\n", b)
-			i++
-		} else if i > 0 {
-			// fmt.Printf("re-setting after unexpected %q\n", b)
-			i = 0
-			uboot.reader.UnreadByte()
-		} else {
-			// fmt.Printf("skipping unmatched %q\n", b)
+		if err := uboot.writer.Flush(); err != nil {
+			return err
 		}
+		if err := uboot.expect.DiscardUntil([]byte("\b \b")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resync cancels the partially typed line and waits for the prompt.
+func (uboot *UBootShell) resync() error {
+	if err := uboot.writer.WriteByte(ctrlC); err != nil {
+		return err
 	}
+	if err := uboot.writer.Flush(); err != nil {
+		return err
+	}
+	return uboot.expect.DiscardUntil(uboot.prompt)
+}
+
+// isTimeout returns true if the error indicates an expired deadline.
+func isTimeout(err error) bool {
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// WithLogger returns a shell reporting what it does to the given logger.
+//
+// By default nothing is reported.
+func (uboot *UBootShell) WithLogger(log logging.Logger) *UBootShell {
+	uboot.log = logging.OrDiscard(log)
+	return uboot
+}
+
+// Logger returns the logger of the shell, for code working with the shell
+// to report what it does in the same way.
+func (uboot *UBootShell) Logger() logging.Logger {
+	return uboot.log
+}
+
+// TransferObserver is notified about progress of file transfers.
+//
+// Observers implementing ymodem.StatsObserver are also told about
+// throughput of YMODEM transfers.
+type TransferObserver interface {
+	Start(name string, size int64)
+	Progress(bytesSent, bytesTotal int64)
+	Finish()
 }
 
-// XXX: this belongs in a different layer.
-type transferObserver struct{}
+// WithTransferObserver returns a shell notifying the observer about file transfers.
+//
+// By default progress is not reported.
+func (uboot *UBootShell) WithTransferObserver(observer TransferObserver) *UBootShell {
+	uboot.observer = observer
+	return uboot
+}
+
+// ProgressBar is a transfer observer showing progress with a progress bar.
+type ProgressBar struct {
+	bar *progress.Bar
+}
+
+// NewProgressBar returns a transfer observer drawing a progress bar in the given file.
+func NewProgressBar(out *os.File) *ProgressBar {
+	return &ProgressBar{bar: progress.NewBar(out)}
+}
 
-func (*transferObserver) Start(name string, size int64) {
-	fmt.Printf("Sending file %q (%d bytes)\n", name, size)
+func (obs *ProgressBar) Start(name string, size int64) {
+	obs.bar.Start(filepath.Base(name), size)
 }
-func (*transferObserver) Progress(bytesSent, bytesTotal int64) {
-	fmt.Printf("\x1b[2KSent %d of %d bytes\r", bytesSent, bytesTotal)
+func (obs *ProgressBar) Progress(bytesSent, bytesTotal int64) {
+	obs.bar.Update(bytesSent)
 }
-func (*transferObserver) Finish() {
-	fmt.Printf("\n")
+func (obs *ProgressBar) Stats(bytesSent, bytesTotal int64, stats ymodem.Stats) {
+	obs.bar.SetRate(stats.AverageRate, stats.Remaining)
+}
+func (obs *ProgressBar) Finish() {
+	obs.bar.Finish()
+}
+
+// stageObserver passes progress of a file transfer to the events of the
+// shell, as well as to the transfer observer, if any.
+type stageObserver struct {
+	next   TransferObserver
+	events flash.Events
+	stage  flash.Stage
 }
 
-// SendFile sends a file using the ymodem protocol.
+func (obs *stageObserver) Start(name string, size int64) {
+	if obs.next != nil {
+		obs.next.Start(name, size)
+	}
+}
+func (obs *stageObserver) Progress(bytesSent, bytesTotal int64) {
+	if obs.next != nil {
+		obs.next.Progress(bytesSent, bytesTotal)
+	}
+	obs.events.StageProgress(obs.stage, bytesSent, bytesTotal)
+}
+func (obs *stageObserver) Stats(bytesSent, bytesTotal int64, stats ymodem.Stats) {
+	if next, ok := obs.next.(ymodem.StatsObserver); ok {
+		next.Stats(bytesSent, bytesTotal, stats)
+	}
+}
+func (obs *stageObserver) Finish() {
+	if obs.next != nil {
+		obs.next.Finish()
+	}
+}
+
+// transferObserver returns the observer of a file transfer.
+//
+// Progress is reported as events only for transfers done by flash plan
+// steps, as other transfers are not stages.
+func (uboot *UBootShell) transferObserver() TransferObserver {
+	if uboot.events == nil || uboot.stage == (flash.Stage{}) {
+		return uboot.observer
+	}
+	return &stageObserver{next: uboot.observer, events: uboot.events, stage: uboot.stage}
+}
+
+// SendFile sends a file using the file sender of the shell, ymodem by default.
 //
 // U-boot must be already in an appropriate receive mode. You must use
-// SpecialCommand to enter such mode yourself.
+// SpecialCommand to enter such mode yourself. Files ending with .gz or .xz
+// are decompressed on the fly.
 func (uboot *UBootShell) SendFile(fileName string) error {
-	file, err := os.Open(fileName)
+	return uboot.sendFile(fileName, uboot.senderOrDefault())
+}
+
+// SendData sends size bytes read from the reader as a file with the given
+// name, just like SendFile.
+//
+// This allows sending data prepared in memory without a temporary file.
+func (uboot *UBootShell) SendData(name string, r io.Reader, size int64) error {
+	return uboot.sendData(name, r, size, uboot.senderOrDefault())
+}
+
+// senderOrDefault returns the file sender of the shell, or ymodem if none
+// was selected.
+func (uboot *UBootShell) senderOrDefault() FileSender {
+	if uboot.sender == nil {
+		return NewYModemSender()
+	}
+	return uboot.sender
+}
+
+// transferStream returns the stream used for file transfers.
+//
+// Data is read through the expect engine, as it may have buffered the
+// first bytes sent by the receiver.
+func (uboot *UBootShell) transferStream() io.ReadWriter {
+	return struct {
+		io.Reader
+		io.Writer
+	}{uboot.expect, uboot.rwc}
+}
+
+// Console returns the serial stream, for talking to the system booted
+// after Reset.
+//
+// Data already buffered by the shell is read first.
+func (uboot *UBootShell) Console() io.ReadWriter {
+	return uboot.transferStream()
+}
+
+func (uboot *UBootShell) sendFile(fileName string, sender FileSender) error {
+	file, size, err := openFile(fileName)
 	if err != nil {
 		return err
 	}
-	tr, err := ymodem.NewTransfer(file)
-	if err != nil {
+	defer file.Close()
+	return uboot.sendData(fileName, file, size, sender)
+}
+
+func (uboot *UBootShell) sendData(name string, r io.Reader, size int64, sender FileSender) error {
+	if err := uboot.transfer(name, r, size, sender); err != nil {
 		return err
 	}
-	tr = tr.WithBlockKind(ymodem.LargeBlock).WithObserver(&transferObserver{}).WithRetryCount(10)
+	return uboot.WaitForPrompt()
+}
+
+// transfer sends the data with the sender, without waiting for the prompt.
+func (uboot *UBootShell) transfer(name string, r io.Reader, size int64, sender FileSender) error {
 	if preview, ok := uboot.rwc.(*ioextra.IOPreview); ok {
 		preview.DisableLineBuffering()
 		preview.DisablePreview()
 		defer preview.EnableLineBuffering()
 		defer preview.EnablePreview()
 	}
-	if err := tr.SendTo(uboot.rwc); err != nil {
-		return err
-	}
-	if err := uboot.WaitForPrompt(); err != nil {
-		return err
-	}
-	return nil
+	return flash.WithKind(sender.Send(uboot.ctx, uboot.transferStream(), name, r, size, uboot.transferObserver()), ErrTransferFailed)
 }
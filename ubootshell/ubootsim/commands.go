@@ -0,0 +1,554 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootsim
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// errHalt stops the shell, for example when control is passed to the kernel.
+var errHalt = errors.New("u-boot is no longer running")
+
+// ctrlC cancels the line typed into the shell.
+const ctrlC = 0x03
+
+func (sim *UBoot) printf(format string, args ...interface{}) {
+	fmt.Fprintf(sim.out, format, args...)
+}
+
+// shell reads and executes commands until the board is reset.
+func (sim *UBoot) shell() (reset bool, err error) {
+	for {
+		sim.printf("%s", sim.prompt)
+		line, err := sim.readLine()
+		if err != nil {
+			return false, err
+		}
+		cmds, err := splitCommands(line, sim.Env())
+		if err != nil {
+			sim.printf("syntax error: %v\r\n", err)
+			continue
+		}
+		for _, args := range cmds {
+			sim.mu.Lock()
+			sim.commands = append(sim.commands, strings.Join(args, " "))
+			sim.mu.Unlock()
+			reset, err := sim.execute(args)
+			if err == errHalt {
+				return false, nil
+			}
+			if err != nil || reset {
+				return reset, err
+			}
+		}
+	}
+}
+
+// readLine reads a line, echoing typed characters.
+//
+// Ctrl-C discards the line, which is reported as empty.
+func (sim *UBoot) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := sim.in.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '\r', '\n':
+			sim.printf("\r\n")
+			return string(line), nil
+		case ctrlC:
+			sim.printf("<INTERRUPT>\r\n")
+			return "", nil
+		case '\b', 0x7f:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				sim.printf("\b \b")
+			}
+		default:
+			line = append(line, b)
+			sim.printf("%c", b)
+		}
+	}
+}
+
+// execute runs a single command.
+func (sim *UBoot) execute(args []string) (reset bool, err error) {
+	switch name := args[0]; {
+	case name == "version":
+		sim.printf("\r\nU-Boot %s\r\n\r\n", sim.version)
+	case name == "getinfo" && len(args) == 2 && args[1] == "version":
+		sim.printf("version: U-Boot %s\r\n", sim.version)
+	case name == "help":
+		sim.help(args[1:])
+	case name == "printenv":
+		sim.printEnv(args[1:])
+	case name == "setenv":
+		return false, sim.setEnv(args[1:])
+	case name == "saveenv":
+		sim.mu.Lock()
+		sim.savedEnv = copyEnv(sim.env)
+		sim.mu.Unlock()
+		sim.printf("Saving Environment to SPI Flash...\r\nErasing SPI flash...Writing to SPI flash...done\r\n")
+	case strings.HasPrefix(name, "mw"):
+		sim.memoryWrite(name, args[1:])
+	case strings.HasPrefix(name, "md"):
+		sim.memoryDisplay(name, args[1:])
+	case name == "sf":
+		sim.spiFlash(args[1:])
+	case name == "mmc":
+		sim.mmcCommand(args[1:])
+	case name == "part":
+		sim.part(args[1:])
+	case name == "unzip":
+		sim.unzip(args[1:])
+	case name == "loady":
+		return false, sim.load(name, "ymodem", args[1:], sim.receive)
+	case name == "loadx":
+		return false, sim.load(name, "xmodem", args[1:], sim.receiveX)
+	case name == "loadb":
+		return false, sim.load(name, "kermit", args[1:], sim.receiveKermit)
+	case name == "reset":
+		sim.printf("resetting ...\r\n")
+		return true, nil
+	case name == "go" || name == "bootm":
+		sim.printf("## Starting application ...\r\n")
+		return false, errHalt
+	default:
+		sim.unknownCommand(name)
+	}
+	return false, nil
+}
+
+// knownCommands are described by help.
+var knownCommands = map[string]string{
+	"getinfo":  "print hardware information",
+	"go":       "start application at address 'addr'",
+	"help":     "print command description/usage",
+	"loadb":    "load binary file over serial line (kermit mode)",
+	"loadx":    "load binary file over serial line (xmodem mode)",
+	"loady":    "load binary file over serial line (ymodem mode)",
+	"md":       "memory display",
+	"mmc":      "MMC sub system",
+	"mw":       "memory write (fill)",
+	"part":     "disk partition related commands",
+	"printenv": "print environment variables",
+	"reset":    "Perform RESET of the CPU",
+	"saveenv":  "save environment variables to persistent storage",
+	"setenv":   "set environment variables",
+	"sf":       "SPI flash sub-system",
+	"unzip":    "unzip a memory region",
+	"version":  "print monitor, compiler and linker version",
+}
+
+func (sim *UBoot) unknownCommand(name string) {
+	sim.printf("Unknown command '%s' - try 'help'\r\n", name)
+}
+
+func (sim *UBoot) help(names []string) {
+	if len(names) == 0 {
+		for _, name := range sortedKeys(knownCommands) {
+			sim.printf("%-10s- %s\r\n", name, knownCommands[name])
+		}
+		return
+	}
+	for _, name := range names {
+		usage, ok := knownCommands[name]
+		if !ok {
+			sim.printf("Unknown command '%s' - try 'help' without arguments for list of all known commands\r\n\r\n", name)
+			continue
+		}
+		sim.printf("%s - %s\r\n", name, usage)
+	}
+}
+
+func (sim *UBoot) printEnv(names []string) {
+	env := sim.Env()
+	if len(names) == 0 {
+		size := 0
+		for _, key := range sortedKeys(env) {
+			sim.printf("%s=%s\r\n", key, env[key])
+			size += len(key) + len(env[key]) + 2
+		}
+		sim.printf("\r\nEnvironment size: %d/65532 bytes\r\n", size)
+		return
+	}
+	for _, name := range names {
+		value, ok := env[name]
+		if !ok {
+			sim.printf("## Error: \"%s\" not defined\r\n", name)
+			continue
+		}
+		sim.printf("%s=%s\r\n", name, value)
+	}
+}
+
+func (sim *UBoot) setEnv(args []string) error {
+	if len(args) == 0 {
+		sim.printf("Usage:\r\nsetenv name value ...\r\n")
+		return nil
+	}
+	key, value := args[0], strings.Join(args[1:], " ")
+	if _, ok := sim.Env()[key]; ok && writeOnce(key) {
+		if len(args) == 1 {
+			sim.printf("## Error: Can't delete \"%s\"\r\n", key)
+		} else {
+			sim.printf("## Error: Can't overwrite \"%s\"\r\n## Error inserting \"%s\" variable, errno=1\r\n", key, key)
+		}
+		return nil
+	}
+	if key == "baudrate" && value != "" {
+		rate, err := strconv.Atoi(value)
+		if err != nil {
+			sim.printf("## Baudrate %s bps not supported\r\n", value)
+			return nil
+		}
+		sim.printf("## Switch baudrate to %d bps and press ENTER ...\r\n", rate)
+		// The new rate takes effect once the user confirms.
+		for {
+			b, err := sim.in.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b == '\r' || b == '\n' {
+				break
+			}
+		}
+		sim.mu.Lock()
+		sim.baudRates = append(sim.baudRates, rate)
+		sim.mu.Unlock()
+	}
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if len(args) == 1 {
+		delete(sim.env, key)
+	} else {
+		sim.env[key] = value
+	}
+	return nil
+}
+
+// writeOnce returns true for variables that cannot be changed once set.
+//
+// Like stock u-boot, those are the MAC addresses and the serial number.
+func writeOnce(key string) bool {
+	return key == "serial#" || strings.HasPrefix(key, "eth") && strings.HasSuffix(key, "addr")
+}
+
+// parseNumbers parses hexadecimal arguments, with or without the 0x prefix.
+func parseNumbers(args []string) ([]uint64, error) {
+	values := make([]uint64, 0, len(args))
+	for _, arg := range args {
+		value, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(arg), "0x"), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// accessWidth returns the width of memory access selected by the command suffix.
+func accessWidth(name string) (int, bool) {
+	switch {
+	case strings.HasSuffix(name, ".b"):
+		return 1, true
+	case strings.HasSuffix(name, ".w"):
+		return 2, true
+	case strings.HasSuffix(name, ".l"), !strings.Contains(name, "."):
+		return 4, true
+	default:
+		return 0, false
+	}
+}
+
+func (sim *UBoot) memoryWrite(name string, args []string) {
+	width, ok := accessWidth(name)
+	values, err := parseNumbers(args)
+	if !ok || err != nil || len(values) < 2 || len(values) > 3 {
+		sim.printf("Usage:\r\nmw [.b, .w, .l] address value [count]\r\n")
+		return
+	}
+	addr, value, count := values[0], values[1], uint64(1)
+	if len(values) == 3 {
+		count = values[2]
+	}
+	unit := make([]byte, width)
+	for i := range unit {
+		unit[i] = byte(value >> (8 * i))
+	}
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	for i := uint64(0); i < count; i++ {
+		sim.mem.write(addr+i*uint64(width), unit)
+	}
+}
+
+func (sim *UBoot) memoryDisplay(name string, args []string) {
+	width, ok := accessWidth(name)
+	values, err := parseNumbers(args)
+	if !ok || err != nil || len(values) < 1 || len(values) > 2 {
+		sim.printf("Usage:\r\nmd [.b, .w, .l] address [# of objects]\r\n")
+		return
+	}
+	addr, count := values[0], uint64(0x40)
+	if len(values) == 2 {
+		count = values[1]
+	}
+	data := sim.Memory(addr, count*uint64(width))
+	for offset := 0; offset < len(data); offset += 16 {
+		line := data[offset:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%08x:", addr+uint64(offset))
+		for i := 0; i < len(line); i += width {
+			var value uint64
+			for j := width - 1; j >= 0; j-- {
+				value = value<<8 | uint64(line[i+j])
+			}
+			fmt.Fprintf(&sb, " %0*x", 2*width, value)
+		}
+		sb.WriteString("    ")
+		for _, b := range line {
+			if b < 0x20 || b > 0x7e {
+				b = '.'
+			}
+			sb.WriteByte(b)
+		}
+		sim.printf("%s\r\n", sb.String())
+	}
+}
+
+// flashEraseSize is the size of the erase block of simulated SPI flash.
+const flashEraseSize = 0x10000
+
+func (sim *UBoot) spiFlash(args []string) {
+	if len(args) == 0 {
+		sim.printf("Usage:\r\nsf probe [[bus:]cs] [hz] [mode]\r\n")
+		return
+	}
+	if args[0] == "probe" {
+		sim.mu.Lock()
+		sim.probed = true
+		size := len(sim.flash)
+		sim.mu.Unlock()
+		sim.printf("SF: Detected w25q128 with page size 256 Bytes, erase size 64 KiB, total %d MiB\r\n", size>>20)
+		return
+	}
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if !sim.probed {
+		sim.printf("No SPI flash selected. Please run `sf probe'\r\n")
+		return
+	}
+	values, err := parseNumbers(args[1:])
+	if err != nil {
+		sim.printf("Usage:\r\nsf %s addr offset|partition len\r\n", args[0])
+		return
+	}
+	flashSize := uint64(len(sim.flash))
+	switch {
+	case args[0] == "erase" && len(values) == 2:
+		offset, size := values[0], values[1]
+		if offset%flashEraseSize != 0 || size%flashEraseSize != 0 {
+			sim.printf("SF: Erase offset/length not multiple of erase size\r\n")
+			return
+		}
+		if offset > flashSize || size > flashSize-offset {
+			sim.printf("ERROR: attempting erase past flash size (%#x)\r\n", flashSize)
+			return
+		}
+		for i := offset; i < offset+size; i++ {
+			sim.flash[i] = 0xff
+		}
+		sim.printf("SF: %d bytes @ %#x Erased: OK\r\n", size, offset)
+	case (args[0] == "write" || args[0] == "read") && len(values) == 3:
+		addr, offset, size := values[0], values[1], values[2]
+		if offset > flashSize || size > flashSize-offset {
+			sim.printf("ERROR: attempting %s past flash size (%#x)\r\n", args[0], flashSize)
+			return
+		}
+		if args[0] == "write" {
+			sim.printf("device 0 offset %#x, size %#x\r\n", offset, size)
+			// Programming can only clear bits, just like real NOR flash.
+			for i, b := range sim.mem.read(addr, size) {
+				sim.flash[offset+uint64(i)] &= b
+			}
+			sim.printf("SF: %d bytes @ %#x Written: OK\r\n", size, offset)
+		} else {
+			sim.printf("device 0 offset %#x, size %#x\r\n", offset, size)
+			sim.mem.write(addr, sim.flash[offset:offset+size])
+			sim.printf("SF: %d bytes @ %#x Read: OK\r\n", size, offset)
+		}
+	case args[0] == "update" && len(values) == 3:
+		addr, offset, size := values[0], values[1], values[2]
+		if offset > flashSize || size > flashSize-offset {
+			sim.printf("ERROR: attempting update past flash size (%#x)\r\n", flashSize)
+			return
+		}
+		// Changed blocks are erased, which fails for partial blocks.
+		if offset%flashEraseSize != 0 || size%flashEraseSize != 0 {
+			sim.printf("SF: Erase offset/length not multiple of erase size\r\n")
+			return
+		}
+		sim.printf("device 0 offset %#x, size %#x\r\n", offset, size)
+		data := sim.mem.read(addr, size)
+		var written, skipped int
+		for start := 0; start < len(data); start += flashEraseSize {
+			block := sim.flash[offset+uint64(start) : offset+uint64(start+flashEraseSize)]
+			if bytes.Equal(block, data[start:start+flashEraseSize]) {
+				skipped += flashEraseSize
+				continue
+			}
+			copy(block, data[start:start+flashEraseSize])
+			written += flashEraseSize
+		}
+		sim.printf("%d bytes written, %d bytes skipped in 0.0s, speed 0 B/s\r\n", written, skipped)
+	default:
+		sim.printf("Usage:\r\nsf %s addr offset|partition len\r\n", args[0])
+	}
+}
+
+// unzip decompresses gzip data in memory.
+func (sim *UBoot) unzip(args []string) {
+	values, err := parseNumbers(args)
+	if err != nil || len(values) < 2 || len(values) > 3 {
+		sim.printf("Usage:\r\nunzip srcaddr dstaddr [dstsize]\r\n")
+		return
+	}
+	limit := uint64(math.MaxUint32)
+	if len(values) == 3 {
+		limit = values[2]
+	}
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	gz, err := gzip.NewReader(sim.mem.reader(values[0]))
+	if err != nil {
+		sim.printf("Error: Bad gzipped data\r\n")
+		return
+	}
+	gz.Multistream(false)
+	data, err := ioutil.ReadAll(io.LimitReader(gz, int64(limit)+1))
+	if err != nil || uint64(len(data)) > limit {
+		sim.printf("Error: inflate() returned -5\r\n")
+		return
+	}
+	sim.mem.write(values[1], data)
+	sim.env["filesize"] = fmt.Sprintf("%x", len(data))
+	sim.printf("Uncompressed size: %d = 0x%X\r\n", len(data), len(data))
+}
+
+// splitCommands splits a line into commands and their arguments.
+//
+// This is a small subset of the hush shell: commands are separated with
+// semicolons, words with white space. Single quotes preserve the text
+// literally, double quotes allow references to variables, such as $name or
+// ${name}, which are expanded using the given environment.
+func splitCommands(line string, env map[string]string) ([][]string, error) {
+	var cmds [][]string
+	var args []string
+	var word strings.Builder
+	inWord := false
+	endWord := func() {
+		if inWord {
+			args = append(args, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func() {
+		endWord()
+		if len(args) > 0 {
+			cmds = append(cmds, args)
+			args = nil
+		}
+	}
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\\' && i+1 < len(line) && (quote == 0 || strings.IndexByte("\"\\`$", line[i+1]) >= 0):
+			i++
+			word.WriteByte(line[i])
+			inWord = true
+		case c == '$':
+			name, n := variableName(line[i+1:])
+			if name == "" {
+				word.WriteByte(c)
+			} else {
+				word.WriteString(env[name])
+				i += n
+			}
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ';':
+			endCommand()
+		case c == ' ' || c == '\t':
+			endWord()
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	endCommand()
+	return cmds, nil
+}
+
+// variableName returns the name of the variable referenced at the start of
+// the text, following the dollar sign, and the length of the reference.
+func variableName(text string) (string, int) {
+	if strings.HasPrefix(text, "{") {
+		end := strings.IndexByte(text, '}')
+		if end < 0 {
+			return "", 0
+		}
+		return text[1:end], end + 1
+	}
+	n := 0
+	for n < len(text) && (text[n] == '_' || text[n] >= 'a' && text[n] <= 'z' || text[n] >= 'A' && text[n] <= 'Z' || text[n] >= '0' && text[n] <= '9') {
+		n++
+	}
+	return text[:n], n
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootsim
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Characters framing Kermit packets.
+const (
+	kermitMark = 0x01
+	kermitEOL  = '\r'
+)
+
+// receiveKermit runs the receiving side of a Kermit transfer, as loadb does.
+//
+// Packets with a wrong checksum are answered with NAK, the file name is
+// ignored and the session ends with the break packet.
+func (sim *UBoot) receiveKermit() (File, error) {
+	var file File
+	var data bytes.Buffer
+	quote := byte('#')
+	for block := 0; ; {
+		seq, kind, payload, ok, err := sim.readKermitPacket()
+		if err != nil {
+			return file, err
+		}
+		if !ok || sim.reject(block) {
+			sim.writeKermitPacket(seq, 'N', nil)
+			continue
+		}
+		switch kind {
+		case 'S':
+			if len(payload) >= 6 {
+				quote = payload[5]
+			}
+			// Reply with the same parameters.
+			sim.writeKermitPacket(seq, 'Y', payload)
+			continue
+		case 'F', 'Z':
+		case 'D':
+			for i := 0; i < len(payload); i++ {
+				b := payload[i]
+				if b == quote && i+1 < len(payload) {
+					i++
+					b = payload[i]
+					if b&0x60 == 0x40 || b&0x7f == 0x3f {
+						b ^= 0x40
+					}
+				}
+				data.WriteByte(b)
+			}
+		case 'B':
+			sim.writeKermitPacket(seq, 'Y', nil)
+			file.Data = data.Bytes()
+			return file, nil
+		case 'E':
+			return file, errCancelled
+		default:
+			sim.writeKermitPacket(seq, 'E', []byte("unexpected packet"))
+			return file, fmt.Errorf("unexpected kermit packet %q", kind)
+		}
+		sim.writeKermitPacket(seq, 'Y', nil)
+		block++
+	}
+}
+
+// readKermitPacket reads the next packet, skipping anything before its mark.
+func (sim *UBoot) readKermitPacket() (seq int, kind byte, payload []byte, ok bool, err error) {
+	var b byte
+	for b != kermitMark {
+		if b, err = sim.in.ReadByte(); err != nil {
+			return 0, 0, nil, false, err
+		}
+	}
+	if b, err = sim.in.ReadByte(); err != nil {
+		return 0, 0, nil, false, err
+	}
+	n := int(b) - 32
+	if n < 3 {
+		return 0, 0, nil, false, nil
+	}
+	packet := make([]byte, n+1)
+	packet[0] = b
+	for i := 1; i <= n; i++ {
+		if packet[i], err = sim.in.ReadByte(); err != nil {
+			return 0, 0, nil, false, err
+		}
+	}
+	if eol, err := sim.in.ReadByte(); err != nil || eol != kermitEOL {
+		return 0, 0, nil, false, err
+	}
+	ok = kermitChecksum(packet[:n]) == packet[n]
+	return int(packet[1]) - 32, packet[2], packet[3:n], ok, nil
+}
+
+// writeKermitPacket sends a packet to the host.
+func (sim *UBoot) writeKermitPacket(seq int, kind byte, payload []byte) {
+	packet := []byte{byte(len(payload) + 3 + 32), byte(seq%64 + 32), kind}
+	packet = append(packet, payload...)
+	packet = append(packet, kermitChecksum(packet))
+	sim.out.Write(append(append([]byte{kermitMark}, packet...), kermitEOL))
+}
+
+// kermitChecksum computes the single character block check of a packet.
+func kermitChecksum(data []byte) byte {
+	sum := 0
+	for _, b := range data {
+		sum += int(b)
+	}
+	return byte((sum+(sum&0xc0)>>6)&0x3f + 32)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootsim
+
+import "io"
+
+// pageSize is the granularity of memory allocation.
+const pageSize = 4096
+
+// memory is sparse, byte addressable memory.
+//
+// Memory that was never written reads as zero.
+type memory struct {
+	pages map[uint64]*[pageSize]byte
+}
+
+func newMemory() *memory {
+	return &memory{pages: make(map[uint64]*[pageSize]byte)}
+}
+
+func (mem *memory) read(addr, size uint64) []byte {
+	data := make([]byte, size)
+	for i := uint64(0); i < size; i++ {
+		if page, ok := mem.pages[(addr+i)/pageSize]; ok {
+			data[i] = page[(addr+i)%pageSize]
+		}
+	}
+	return data
+}
+
+func (mem *memory) write(addr uint64, data []byte) {
+	for i, b := range data {
+		a := addr + uint64(i)
+		page, ok := mem.pages[a/pageSize]
+		if !ok {
+			page = new([pageSize]byte)
+			mem.pages[a/pageSize] = page
+		}
+		page[a%pageSize] = b
+	}
+}
+
+// clear zeroes a region of memory, releasing whole pages.
+func (mem *memory) clear(addr, size uint64) {
+	for a := addr; a < addr+size; {
+		if a%pageSize == 0 && addr+size-a >= pageSize {
+			delete(mem.pages, a/pageSize)
+			a += pageSize
+			continue
+		}
+		if page, ok := mem.pages[a/pageSize]; ok {
+			page[a%pageSize] = 0
+		}
+		a++
+	}
+}
+
+// reader returns a reader of memory starting at the given address.
+func (mem *memory) reader(addr uint64) io.Reader {
+	return &memoryReader{mem: mem, addr: addr}
+}
+
+// memoryReader reads memory sequentially, it never ends.
+type memoryReader struct {
+	mem  *memory
+	addr uint64
+}
+
+func (r *memoryReader) Read(p []byte) (int, error) {
+	n := copy(p, r.mem.read(r.addr, uint64(len(p))))
+	r.addr += uint64(n)
+	return n, nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootsim
+
+import "strconv"
+
+// MMCPartition is a partition of simulated eMMC.
+type MMCPartition struct {
+	Name        string
+	Start, Size uint64 // in 512 byte blocks
+}
+
+// mmcBlockSize is the size of the blocks of simulated eMMC.
+const mmcBlockSize = 512
+
+// mmcCommand runs the mmc command, on the only eMMC device.
+func (sim *UBoot) mmcCommand(args []string) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if sim.mmc == nil {
+		sim.printf("No MMC device available\r\n")
+		return
+	}
+	if len(args) == 0 {
+		sim.printf("Usage:\r\nmmc dev [dev] [part]\r\n")
+		return
+	}
+	if args[0] == "dev" {
+		if len(args) > 1 && args[1] != "0" {
+			sim.printf("Card did not respond to voltage select!\r\n")
+			return
+		}
+		sim.mmcDev = true
+		sim.printf("switch to partitions #0, OK\r\nmmc0(part 0) is current device\r\n")
+		return
+	}
+	if !sim.mmcDev {
+		sim.printf("No MMC card found\r\n")
+		return
+	}
+	values, err := parseNumbers(args[1:])
+	if err != nil {
+		sim.printf("Usage:\r\nmmc %s addr blk# cnt\r\n", args[0])
+		return
+	}
+	blocks := sim.mmcSize / mmcBlockSize
+	switch {
+	case args[0] == "erase" && len(values) == 2:
+		blk, cnt := values[0], values[1]
+		sim.printf("\r\nMMC erase: dev # 0, block # %d, count %d ... ", blk, cnt)
+		if blk > blocks || cnt > blocks-blk {
+			sim.printf("0 blocks erased: ERROR\r\n")
+			return
+		}
+		sim.mmc.clear(blk*mmcBlockSize, cnt*mmcBlockSize)
+		sim.printf("%d blocks erased: OK\r\n", cnt)
+	case (args[0] == "write" || args[0] == "read") && len(values) == 3:
+		addr, blk, cnt := values[0], values[1], values[2]
+		done := "read"
+		if args[0] == "write" {
+			done = "written"
+		}
+		sim.printf("\r\nMMC %s: dev # 0, block # %d, count %d ... ", args[0], blk, cnt)
+		if blk > blocks || cnt > blocks-blk {
+			sim.printf("0 blocks %s: ERROR\r\n", done)
+			return
+		}
+		if args[0] == "write" {
+			sim.mmc.write(blk*mmcBlockSize, sim.mem.read(addr, cnt*mmcBlockSize))
+		} else {
+			sim.mem.write(addr, sim.mmc.read(blk*mmcBlockSize, cnt*mmcBlockSize))
+		}
+		sim.printf("%d blocks %s: OK\r\n", cnt, done)
+	default:
+		sim.printf("Usage:\r\nmmc %s addr blk# cnt\r\n", args[0])
+	}
+}
+
+// part runs the part command, storing the location of partitions in
+// hexadecimal blocks, like u-boot does. Unknown partitions fail silently.
+func (sim *UBoot) part(args []string) {
+	if len(args) != 5 || (args[0] != "start" && args[0] != "size") {
+		sim.printf("Usage:\r\npart start <interface> <dev> <part> <varname>\r\npart size <interface> <dev> <part> <varname>\r\n")
+		return
+	}
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if args[1] != "mmc" || args[2] != "0" || sim.mmc == nil {
+		sim.printf("** Bad device %s %s **\r\n", args[1], args[2])
+		return
+	}
+	for _, part := range sim.mmcParts {
+		if part.Name != args[3] {
+			continue
+		}
+		value := part.Start
+		if args[0] == "size" {
+			value = part.Size
+		}
+		sim.env[args[4]] = strconv.FormatUint(value, 16)
+		return
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootsim
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// queue is a buffered, blocking byte stream between the simulator and the host.
+type queue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newQueue() *queue {
+	q := &queue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Read blocks until data is available or the queue is closed.
+func (q *queue) Read(p []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.buf.Len() == 0 {
+		if q.closed {
+			return 0, io.EOF
+		}
+		q.cond.Wait()
+	}
+	return q.buf.Read(p)
+}
+
+// ReadByte reads a single byte, blocking like Read.
+func (q *queue) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := q.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Write appends data to the queue, it never blocks.
+func (q *queue) Write(p []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, io.ErrClosedPipe
+	}
+	q.cond.Broadcast()
+	return q.buf.Write(p)
+}
+
+// Close wakes up pending reads, which return io.EOF once the queue is drained.
+func (q *queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ubootsim contains a simulated u-boot for exercising UBootShell and
+// board logic without hardware.
+//
+// The simulator prints the auto-boot banner, offers a shell with the most
+// common commands, keeps an environment, memory and SPI flash, and receives
+// files with loady, loadx and loadb, validating each YMODEM and XMODEM block,
+// or Kermit packet, just like u-boot does.
+package ubootsim
+
+import (
+	"sort"
+	"sync"
+)
+
+// File describes a file received with loady, loadx or loadb.
+type File struct {
+	Name string
+	Addr uint64
+	Data []byte
+}
+
+// UBoot is a ReadWriteCloser simulating u-boot on the other end of a serial line.
+//
+// The simulation starts with the first read or write.
+type UBoot struct {
+	in   *queue // typed by the host
+	out  *queue // printed by u-boot
+	once sync.Once
+	done chan struct{}
+
+	mu        sync.Mutex // protects the fields below
+	prompt    string
+	banner    string
+	version   string
+	env       map[string]string
+	savedEnv  map[string]string
+	mem       *memory
+	flash     []byte
+	probed    bool
+	mmc       *memory
+	mmcSize   uint64
+	mmcParts  []MMCPartition
+	mmcDev    bool
+	rejected  map[int]bool
+	files     []File
+	commands  []string
+	baudRates []int
+}
+
+// DefaultFlashSize is the size of simulated SPI flash.
+const DefaultFlashSize = 16 << 20
+
+// New returns a simulated u-boot with stock banner and empty environment.
+func New() *UBoot {
+	sim := &UBoot{
+		in:       newQueue(),
+		out:      newQueue(),
+		done:     make(chan struct{}),
+		prompt:   "hisilicon # ",
+		banner:   "Hit any key to stop autoboot",
+		version:  "2016.11 (Jun 24 2020 - 10:05:31 +0800)",
+		env:      make(map[string]string),
+		savedEnv: make(map[string]string),
+		mem:      newMemory(),
+		rejected: make(map[int]bool),
+	}
+	return sim.WithFlashSize(DefaultFlashSize)
+}
+
+// WithPrompt returns a simulator using the given shell prompt.
+func (sim *UBoot) WithPrompt(prompt string) *UBoot {
+	sim.prompt = prompt
+	return sim
+}
+
+// WithBanner returns a simulator printing the given auto-boot banner.
+//
+// With an empty banner, the shell is available right away.
+func (sim *UBoot) WithBanner(banner string) *UBoot {
+	sim.banner = banner
+	return sim
+}
+
+// WithVersion returns a simulator reporting the given version, for example
+// "2016.11 (Jun 24 2020 - 10:05:31 +0800)".
+func (sim *UBoot) WithVersion(version string) *UBoot {
+	sim.version = version
+	return sim
+}
+
+// WithEnv returns a simulator with the given environment in persistent storage.
+func (sim *UBoot) WithEnv(env map[string]string) *UBoot {
+	sim.env = make(map[string]string, len(env))
+	sim.savedEnv = make(map[string]string, len(env))
+	for key, value := range env {
+		sim.env[key] = value
+		sim.savedEnv[key] = value
+	}
+	return sim
+}
+
+// WithFlashSize returns a simulator with SPI flash of the given size.
+//
+// Flash is initially erased.
+func (sim *UBoot) WithFlashSize(size int) *UBoot {
+	sim.flash = make([]byte, size)
+	for i := range sim.flash {
+		sim.flash[i] = 0xff
+	}
+	return sim
+}
+
+// WithRejectedBlocks returns a simulator rejecting the given YMODEM blocks once.
+//
+// Blocks are counted from the start of each transfer, the block with file
+// information is block 0. Rejected blocks are answered with NAK, as if they
+// were corrupted, and must be sent again.
+func (sim *UBoot) WithRejectedBlocks(blocks ...int) *UBoot {
+	for _, block := range blocks {
+		sim.rejected[block] = true
+	}
+	return sim
+}
+
+// WithMMC returns a simulator with eMMC of the given size, partitioned with
+// GPT into the given partitions.
+//
+// eMMC is initially erased, reading as zero.
+func (sim *UBoot) WithMMC(size uint64, partitions ...MMCPartition) *UBoot {
+	sim.mmc = newMemory()
+	sim.mmcSize = size
+	sim.mmcParts = append([]MMCPartition(nil), partitions...)
+	return sim
+}
+
+// Read returns data printed by the simulated u-boot.
+func (sim *UBoot) Read(p []byte) (int, error) {
+	sim.start()
+	return sim.out.Read(p)
+}
+
+// Write types data into the simulated u-boot.
+func (sim *UBoot) Write(p []byte) (int, error) {
+	sim.start()
+	return sim.in.Write(p)
+}
+
+// Close stops the simulation.
+func (sim *UBoot) Close() error {
+	sim.start()
+	sim.in.Close()
+	sim.out.Close()
+	<-sim.done
+	return nil
+}
+
+// Env returns a copy of the current environment.
+func (sim *UBoot) Env() map[string]string {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return copyEnv(sim.env)
+}
+
+// SavedEnv returns a copy of the environment in persistent storage.
+func (sim *UBoot) SavedEnv() map[string]string {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return copyEnv(sim.savedEnv)
+}
+
+// Memory returns a copy of the given region of memory.
+func (sim *UBoot) Memory(addr, size uint64) []byte {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return sim.mem.read(addr, size)
+}
+
+// Flash returns a copy of the given region of SPI flash.
+func (sim *UBoot) Flash(offset, size uint64) []byte {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return append([]byte(nil), sim.flash[offset:offset+size]...)
+}
+
+// MMC returns a copy of the given region of eMMC.
+func (sim *UBoot) MMC(offset, size uint64) []byte {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return sim.mmc.read(offset, size)
+}
+
+// Files returns the files received so far.
+func (sim *UBoot) Files() []File {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return append([]File(nil), sim.files...)
+}
+
+// Commands returns the commands executed so far.
+func (sim *UBoot) Commands() []string {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return append([]string(nil), sim.commands...)
+}
+
+// BaudRates returns the baud rates requested with setenv baudrate so far.
+func (sim *UBoot) BaudRates() []int {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return append([]int(nil), sim.baudRates...)
+}
+
+func (sim *UBoot) start() {
+	sim.once.Do(func() { go sim.run() })
+}
+
+// run boots u-boot and runs the shell until the simulation is closed.
+func (sim *UBoot) run() {
+	defer close(sim.done)
+	for {
+		if err := sim.boot(); err != nil {
+			return
+		}
+		reset, err := sim.shell()
+		if err != nil || !reset {
+			return
+		}
+		sim.mu.Lock()
+		sim.env = copyEnv(sim.savedEnv)
+		sim.probed = false
+		sim.mu.Unlock()
+	}
+}
+
+// boot prints the banner and waits for a key to stop auto-boot.
+//
+// The count-down never expires, auto-boot must always be interrupted.
+func (sim *UBoot) boot() error {
+	sim.printf("\r\n\r\nU-Boot %s\r\n\r\n", sim.version)
+	if sim.banner == "" {
+		return nil
+	}
+	sim.printf("%s:  3 ", sim.banner)
+	if _, err := sim.in.ReadByte(); err != nil {
+		return err
+	}
+	sim.printf("\b\b\b 0 \r\n")
+	return nil
+}
+
+func copyEnv(env map[string]string) map[string]string {
+	c := make(map[string]string, len(env))
+	for key, value := range env {
+		c[key] = value
+	}
+	return c
+}
+
+// sortedKeys returns the names of the variables in alphabetical order.
+func sortedKeys(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,390 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootsim_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zyga/oh-flash-tools/ubootshell"
+	"github.com/zyga/oh-flash-tools/ubootshell/ubootsim"
+)
+
+// connect returns a shell talking to the simulator over the given stream,
+// past auto-boot and with the prompt detected.
+//
+// The simulation is stopped after a while, so that a stuck conversation
+// fails the test instead of hanging it.
+func connect(t *testing.T, sim *ubootsim.UBoot, rwc io.ReadWriteCloser) *ubootshell.UBootShell {
+	t.Helper()
+	watchdog := time.AfterFunc(10*time.Second, func() { sim.Close() })
+	t.Cleanup(func() {
+		watchdog.Stop()
+		sim.Close()
+	})
+	uboot := ubootshell.NewUBootShell(context.Background(), rwc)
+	if err := uboot.InterruptBoot(); err != nil {
+		t.Fatalf("cannot interrupt boot: %v", err)
+	}
+	if err := uboot.ProbePrompt(); err != nil {
+		t.Fatalf("cannot detect prompt: %v", err)
+	}
+	return uboot
+}
+
+// writeFile writes the data to a temporary file and returns its name.
+func writeFile(t *testing.T, data []byte) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "ubootsim")
+	if err != nil {
+		t.Fatalf("cannot create file: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("cannot write file: %v", err)
+	}
+	return f.Name()
+}
+
+func TestPromptDetection(t *testing.T) {
+	sim := ubootsim.New().WithPrompt("=> ").WithEnv(map[string]string{"board": "rk3568"})
+	uboot := connect(t, sim, sim)
+	output, err := uboot.Command("printenv board")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.TrimSpace(output) != "board=rk3568" {
+		t.Fatalf("unexpected output of printenv: %q", output)
+	}
+	if err := uboot.SetEnv("bootdelay", "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value := sim.Env()["bootdelay"]; value != "0" {
+		t.Fatalf("expected bootdelay to be set, got %q", value)
+	}
+}
+
+// garbler corrupts the first write of the given text, as a noisy line would.
+type garbler struct {
+	*ubootsim.UBoot
+	text string
+	done bool
+}
+
+func (g *garbler) Write(p []byte) (int, error) {
+	if !g.done && string(p) == g.text {
+		g.done = true
+		garbled := append([]byte(nil), p...)
+		garbled[len(garbled)/2] ^= 0x20
+		return g.UBoot.Write(garbled)
+	}
+	return g.UBoot.Write(p)
+}
+
+func TestCommandEchoResync(t *testing.T) {
+	sim := ubootsim.New().WithEnv(map[string]string{"board": "hi3518ev300"})
+	uboot := connect(t, sim, &garbler{UBoot: sim, text: "printenv board"}).WithRetryCount(1)
+	output, err := uboot.Command("printenv board")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.TrimSpace(output) != "board=hi3518ev300" {
+		t.Fatalf("unexpected output of printenv: %q", output)
+	}
+	// The garbled line was cancelled with Ctrl-C rather than executed.
+	if cmds := sim.Commands(); len(cmds) != 1 || cmds[0] != "printenv board" {
+		t.Fatalf("unexpected commands executed: %q", cmds)
+	}
+}
+
+func TestCommandEchoMismatch(t *testing.T) {
+	sim := ubootsim.New()
+	uboot := connect(t, sim, &garbler{UBoot: sim, text: "printenv board"})
+	if _, err := uboot.Command("printenv board"); err == nil {
+		t.Fatalf("expected garbled command to fail without retries")
+	}
+	if cmds := sim.Commands(); len(cmds) != 0 {
+		t.Fatalf("unexpected commands executed: %q", cmds)
+	}
+}
+
+func TestStorageCommandFailure(t *testing.T) {
+	sim := ubootsim.New().WithFlashSize(1 << 20)
+	uboot := connect(t, sim, sim)
+	storage := ubootshell.NewSPIFlash(uboot)
+	err := storage.Write(0x42000000, 0x0, 0x1000)
+	if !errors.Is(err, ubootshell.ErrFlashWriteFailed) || !strings.Contains(err.Error(), "No SPI flash selected") {
+		t.Fatalf("expected write without probing flash to fail, got %v", err)
+	}
+	if _, err := uboot.ProbeFlash(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = storage.Write(0x42000000, 0xff000, 0x2000)
+	if !errors.Is(err, ubootshell.ErrFlashWriteFailed) || !strings.Contains(err.Error(), "past flash size") {
+		t.Fatalf("expected write past the end of flash to fail, got %v", err)
+	}
+	if !bytes.Equal(sim.Flash(0xff000, 0x1000), bytes.Repeat([]byte{0xff}, 0x1000)) {
+		t.Fatalf("failed write changed flash")
+	}
+	// Reading is not writing, failures are not reported as such.
+	err = storage.Read(0x42000000, 0xff000, 0x2000)
+	if err == nil || errors.Is(err, ubootshell.ErrFlashWriteFailed) {
+		t.Fatalf("expected read past the end of flash to fail, got %v", err)
+	}
+	if err := storage.Write(0x42000000, 0x0, 0x1000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadYModemWithRetries(t *testing.T) {
+	// The block with file information and the second data block are
+	// answered with NAK and must be sent again.
+	sim := ubootsim.New().WithRejectedBlocks(0, 2)
+	uboot := connect(t, sim, sim).WithFileSender(ubootshell.NewYModemSender())
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 200)
+	const addr = 0x42000000
+	if err := uboot.LoadFile(addr, writeFile(t, data)); err != nil {
+		t.Fatalf("cannot load file: %v", err)
+	}
+	files := sim.Files()
+	if len(files) != 1 {
+		t.Fatalf("expected one file to be received, got %d", len(files))
+	}
+	if files[0].Addr != addr || !bytes.Equal(files[0].Data, data) {
+		t.Fatalf("received data differs from sent data")
+	}
+	if !bytes.Equal(sim.Memory(addr, uint64(len(data))), data) {
+		t.Fatalf("data in memory differs from sent data")
+	}
+	// The shell is usable after the transfer.
+	if _, err := uboot.Command("version"); err != nil {
+		t.Fatalf("unexpected error after transfer: %v", err)
+	}
+}
+
+func TestLoadYModemTooManyRetries(t *testing.T) {
+	// The sender gives up after ten failed blocks.
+	sim := ubootsim.New().WithRejectedBlocks(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)
+	uboot := connect(t, sim, sim).WithFileSender(ubootshell.NewYModemSender())
+
+	data := bytes.Repeat([]byte{0x55}, 12*1024)
+	if err := uboot.LoadFile(0x42000000, writeFile(t, data)); err == nil {
+		t.Fatalf("expected transfer to fail")
+	}
+	if files := sim.Files(); len(files) != 0 {
+		t.Fatalf("expected no file to be received, got %d", len(files))
+	}
+}
+
+// canceller cancels a context once the given number of bytes was written.
+type canceller struct {
+	*ubootsim.UBoot
+	limit   int
+	written int
+	cancel  context.CancelFunc
+}
+
+func (c *canceller) Write(p []byte) (int, error) {
+	n, err := c.UBoot.Write(p)
+	if c.written += n; c.written >= c.limit {
+		c.cancel()
+	}
+	return n, err
+}
+
+func TestLoadInterrupted(t *testing.T) {
+	for _, sender := range []ubootshell.FileSender{ubootshell.NewYModemSender(), ubootshell.NewXModemSender()} {
+		sim := ubootsim.New()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		rwc := &canceller{UBoot: sim, limit: 4096, cancel: cancel}
+		uboot := connect(t, sim, rwc).WithFileSender(sender).WithContext(ctx)
+
+		data := bytes.Repeat([]byte{0x55}, 64*1024)
+		err := uboot.LoadFile(0x42000000, writeFile(t, data))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected %T transfer to be cancelled, got %v", sender, err)
+		}
+		// u-boot gives up on the transfer and returns to the shell.
+		if err := uboot.WaitForPrompt(); err != nil {
+			t.Fatalf("cannot find prompt after cancelled %T transfer: %v", sender, err)
+		}
+		if files := sim.Files(); len(files) != 0 {
+			t.Fatalf("expected no file to be received, got %d", len(files))
+		}
+		if _, err := uboot.Command("version"); err != nil {
+			t.Fatalf("unexpected error after cancelled %T transfer: %v", sender, err)
+		}
+	}
+}
+
+func TestSetEnvRefused(t *testing.T) {
+	sim := ubootsim.New().WithEnv(map[string]string{"ethaddr": "02:00:00:00:00:01"})
+	uboot := connect(t, sim, sim)
+	err := uboot.SetEnv("ethaddr", "02:00:00:00:00:02")
+	if err == nil || !strings.Contains(err.Error(), `Can't overwrite "ethaddr"`) {
+		t.Fatalf("expected overwriting ethaddr to fail, got %v", err)
+	}
+	err = uboot.DeleteEnv("ethaddr")
+	if err == nil || !strings.Contains(err.Error(), `Can't delete "ethaddr"`) {
+		t.Fatalf("expected deleting ethaddr to fail, got %v", err)
+	}
+	if err := uboot.SetEnv("eth1addr", "02:00:00:00:00:02"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRestoreEnv(t *testing.T) {
+	sim := ubootsim.New().WithEnv(map[string]string{
+		"baudrate": "115200",
+		"bootcmd":  "run distro_bootcmd",
+		"ethaddr":  "02:00:00:00:00:01",
+		"serial#":  "SN000001",
+		"stdout":   "serial",
+		"extra":    "1",
+	})
+	uboot := connect(t, sim, sim)
+	// A snapshot of another board.
+	err := uboot.RestoreEnv(ubootshell.Env{
+		"baudrate": "921600",
+		"bootcmd":  "bootm 0x42000000",
+		"ethaddr":  "02:00:00:00:00:02",
+		"other":    "2",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{
+		"baudrate": "115200",
+		"bootcmd":  "bootm 0x42000000",
+		"ethaddr":  "02:00:00:00:00:01",
+		"serial#":  "SN000001",
+		"stdout":   "serial",
+		"other":    "2",
+	}
+	env := sim.Env()
+	if len(env) != len(expected) {
+		t.Fatalf("unexpected environment: %v", env)
+	}
+	for key, value := range expected {
+		if env[key] != value {
+			t.Fatalf("unexpected environment: %v", env)
+		}
+	}
+}
+
+func TestMemoryAccessWidth(t *testing.T) {
+	sim := ubootsim.New()
+	uboot := connect(t, sim, sim)
+	for _, width := range []ubootshell.AccessWidth{0, 3, 8} {
+		if _, err := uboot.ReadMemoryWidth(0x42000000, 8, width); err == nil {
+			t.Fatalf("expected reading with width %d to fail", width)
+		}
+		if err := uboot.WriteMemoryWidth(0x42000000, make([]byte, 8), width); err == nil {
+			t.Fatalf("expected writing with width %d to fail", width)
+		}
+	}
+	if len(sim.Commands()) != 0 {
+		t.Fatalf("unexpected commands: %q", sim.Commands())
+	}
+}
+
+func TestSetEnvQuoting(t *testing.T) {
+	sim := ubootsim.New().WithEnv(map[string]string{"x": "old"})
+	uboot := connect(t, sim, sim)
+	for _, tc := range []struct {
+		key, value string
+		expanded   bool
+		expected   string
+	}{
+		{key: "x", value: "a;b", expected: "a;b"},
+		{key: "y", value: "${x} $x", expected: "${x} $x"},
+		{key: "y", value: "it's 'quoted'", expected: "it's 'quoted'"},
+		{key: "z", value: `${x} "q" \ $x`, expanded: true, expected: `a;b "q" \ a;b`},
+	} {
+		var err error
+		if tc.expanded {
+			err = uboot.SetEnvExpanded(tc.key, tc.value)
+		} else {
+			err = uboot.SetEnv(tc.key, tc.value)
+		}
+		if err != nil {
+			t.Fatalf("cannot set %s to %q: %v", tc.key, tc.value, err)
+		}
+		output, err := uboot.Command("printenv " + tc.key)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if expected := tc.key + "=" + tc.expected; strings.TrimSpace(output) != expected {
+			t.Fatalf("after setting %s to %q, expected %q, got %q", tc.key, tc.value, expected, output)
+		}
+	}
+}
+
+func TestMemoryRoundTrip(t *testing.T) {
+	sim := ubootsim.New()
+	uboot := connect(t, sim, sim)
+	// Runs of identical values are written with a single command.
+	data := append(bytes.Repeat([]byte{0xaa}, 20), []byte("0123456789abcdef\x00\xff\x7f")...)
+	for _, tc := range []struct {
+		addr  uint64
+		size  int
+		width ubootshell.AccessWidth
+	}{
+		{0x42000000, 36, 0},
+		{0x42000101, 35, 0},
+		{0x42000202, 34, 0},
+		{0x42000300, 36, ubootshell.ByteAccess},
+		{0x42000400, 36, ubootshell.WordAccess},
+		{0x42000500, 36, ubootshell.LongAccess},
+	} {
+		chunk := data[:tc.size]
+		var err error
+		if tc.width == 0 {
+			err = uboot.WriteMemory(tc.addr, chunk)
+		} else {
+			err = uboot.WriteMemoryWidth(tc.addr, chunk, tc.width)
+		}
+		if err != nil {
+			t.Fatalf("cannot write memory at %#x: %v", tc.addr, err)
+		}
+		if stored := sim.Memory(tc.addr, uint64(tc.size)); !bytes.Equal(stored, chunk) {
+			t.Fatalf("unexpected memory at %#x: %q", tc.addr, stored)
+		}
+		var read []byte
+		if tc.width == 0 {
+			read, err = uboot.ReadMemory(tc.addr, uint64(tc.size))
+		} else {
+			read, err = uboot.ReadMemoryWidth(tc.addr, uint64(tc.size), tc.width)
+		}
+		if err != nil {
+			t.Fatalf("cannot read memory at %#x: %v", tc.addr, err)
+		}
+		if !bytes.Equal(read, chunk) {
+			t.Fatalf("unexpected data read at %#x: %q, expected %q", tc.addr, read, chunk)
+		}
+	}
+}
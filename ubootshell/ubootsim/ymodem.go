@@ -0,0 +1,260 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootsim
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Control bytes of the YMODEM protocol.
+const (
+	asciiSOH = 0x01
+	asciiSTX = 0x02
+	asciiEOT = 0x04
+	asciiACK = 0x06
+	asciiNAK = 0x15
+	asciiCAN = 0x18
+	poll     = 'C'
+)
+
+// errCancelled is returned when the sender cancels the transfer.
+var errCancelled = errors.New("transfer cancelled by sender")
+
+// defaultLoadAddr is used by loady when no address is given.
+const defaultLoadAddr = 0x41000000
+
+// load receives a file with the given protocol and stores it in memory.
+func (sim *UBoot) load(name, protocol string, args []string, receive func() (File, error)) error {
+	addr := uint64(defaultLoadAddr)
+	if len(args) > 0 {
+		values, err := parseNumbers(args[:1])
+		if err != nil {
+			sim.printf("Usage:\r\n%s [ off ] [ baud ]\r\n", name)
+			return nil
+		}
+		addr = values[0]
+	}
+	sim.printf("## Ready for binary (%s) download to %#x at 115200 bps...\r\n", protocol, addr)
+	file, err := receive()
+	if err == errCancelled {
+		sim.printf("## Binary (%s) download aborted\r\n", protocol)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	file.Addr = addr
+	sim.mu.Lock()
+	sim.mem.write(addr, file.Data)
+	sim.files = append(sim.files, file)
+	sim.mu.Unlock()
+	sim.printf("## Total Size      = 0x%08x = %d Bytes\r\n", len(file.Data), len(file.Data))
+	return nil
+}
+
+// receiveX runs the receiving side of an XMODEM transfer.
+//
+// XMODEM does not tell the size of the file, the padding of the last block
+// is kept, as u-boot does.
+func (sim *UBoot) receiveX() (File, error) {
+	var file File
+	var data bytes.Buffer
+	sim.out.Write([]byte{poll})
+	for block, expected := 0, byte(1); ; {
+		header, err := sim.in.ReadByte()
+		if err != nil {
+			return file, err
+		}
+		var blockSize int
+		switch header {
+		case asciiSOH:
+			blockSize = 128
+		case asciiSTX:
+			blockSize = 1024
+		case asciiEOT:
+			sim.out.Write([]byte{asciiACK})
+			file.Data = data.Bytes()
+			return file, nil
+		case asciiCAN:
+			// Senders abort with two CAN bytes, neither reaches the shell.
+			next, err := sim.in.ReadByte()
+			if err != nil {
+				return file, err
+			}
+			if next == asciiCAN {
+				return file, errCancelled
+			}
+			continue
+		default:
+			continue
+		}
+		idx, payload, ok, err := sim.readBlock(blockSize)
+		if err != nil {
+			return file, err
+		}
+		if !ok || sim.reject(block) {
+			sim.out.Write([]byte{asciiNAK})
+			continue
+		}
+		switch {
+		case idx == expected-1:
+			sim.out.Write([]byte{asciiACK})
+			continue
+		case idx != expected:
+			sim.out.Write([]byte{asciiCAN, asciiCAN})
+			return file, fmt.Errorf("unexpected block %d, expected %d", idx, expected)
+		}
+		data.Write(payload)
+		sim.out.Write([]byte{asciiACK})
+		expected++
+		block++
+	}
+}
+
+// receive runs the receiving side of a YMODEM transfer of a single file.
+func (sim *UBoot) receive() (File, error) {
+	var file File
+	var size int64
+	var data bytes.Buffer
+	sim.out.Write([]byte{poll})
+	// Block numbers wrap around, file information is the first block of a file.
+	info := true
+	for block, expected := 0, byte(0); ; {
+		header, err := sim.in.ReadByte()
+		if err != nil {
+			return file, err
+		}
+		var blockSize int
+		switch header {
+		case asciiSOH:
+			blockSize = 128
+		case asciiSTX:
+			blockSize = 1024
+		case asciiEOT:
+			// Acknowledge the end of file and ask for the next one.
+			sim.out.Write([]byte{asciiACK, asciiACK, poll})
+			expected = 0
+			info = true
+			continue
+		case asciiCAN:
+			// Senders abort with two CAN bytes, neither reaches the shell.
+			next, err := sim.in.ReadByte()
+			if err != nil {
+				return file, err
+			}
+			if next == asciiCAN {
+				return file, errCancelled
+			}
+			continue
+		default:
+			// Garbage, wait for the sender to time out and try again.
+			continue
+		}
+		idx, payload, ok, err := sim.readBlock(blockSize)
+		if err != nil {
+			return file, err
+		}
+		if !ok || sim.reject(block) {
+			sim.out.Write([]byte{asciiNAK})
+			continue
+		}
+		switch {
+		case idx == expected-1 && block > 0:
+			// The acknowledgment was lost, the block was sent again.
+			sim.out.Write([]byte{asciiACK})
+			continue
+		case idx != expected:
+			sim.out.Write([]byte{asciiCAN, asciiCAN})
+			return file, fmt.Errorf("unexpected block %d, expected %d", idx, expected)
+		}
+		if info {
+			info = false
+			name := payload
+			if end := bytes.IndexByte(payload, 0); end >= 0 {
+				name = payload[:end]
+			}
+			if len(name) == 0 {
+				// Empty file information ends the session.
+				sim.out.Write([]byte{asciiACK})
+				file.Data = data.Bytes()
+				if int64(len(file.Data)) > size {
+					file.Data = file.Data[:size]
+				}
+				return file, nil
+			}
+			file.Name = string(name)
+			// The size follows the name, optionally followed by more fields.
+			if len(name) < len(payload) {
+				info := bytes.TrimRight(payload[len(name)+1:], "\x00")
+				if fields := bytes.Fields(info); len(fields) > 0 {
+					size, _ = strconv.ParseInt(string(fields[0]), 10, 64)
+				}
+			}
+			sim.out.Write([]byte{asciiACK, poll})
+		} else {
+			data.Write(payload)
+			sim.out.Write([]byte{asciiACK})
+		}
+		expected++
+		block++
+	}
+}
+
+// readBlock reads the remainder of a block with the given payload size.
+//
+// Blocks with invalid sequence numbers or CRC are reported as not ok.
+func (sim *UBoot) readBlock(blockSize int) (idx byte, payload []byte, ok bool, err error) {
+	frame := make([]byte, 2+blockSize+2)
+	for i := range frame {
+		if frame[i], err = sim.in.ReadByte(); err != nil {
+			return 0, nil, false, err
+		}
+	}
+	idx, payload = frame[0], frame[2:2+blockSize]
+	crc := uint16(frame[2+blockSize])<<8 | uint16(frame[3+blockSize])
+	return idx, payload, frame[1] == ^idx && crc == crc16(payload), nil
+}
+
+// reject returns true the first time a block selected with WithRejectedBlocks is received.
+func (sim *UBoot) reject(block int) bool {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if sim.rejected[block] {
+		delete(sim.rejected, block)
+		return true
+	}
+	return false
+}
+
+// crc16 computes CRC-16/XMODEM of the data.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubootshell
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Version describes a release of u-boot.
+//
+// Releases are named after the year and month, for example 2016.11. Release
+// candidates and vendor builds append a suffix, such as -rc1 or -dirty.
+type Version struct {
+	Year   int
+	Month  int
+	Suffix string
+	// BuildInfo is the text in parentheses following the version, usually
+	// the time of the build.
+	BuildInfo string
+}
+
+// versionRegexp matches the version string printed by u-boot.
+//
+// Both "version" and the vendor specific "getinfo version" commands print
+// text like "U-Boot 2016.11 (Jun 24 2020 - 10:05:31 +0800)".
+var versionRegexp = regexp.MustCompile(`U-Boot (\d{4})\.(\d{2})(\S*)(?: \(([^)\r\n]*)\))?`)
+
+// ParseVersion returns the version described in the output of the version command.
+func ParseVersion(output string) (Version, error) {
+	match := versionRegexp.FindStringSubmatch(output)
+	if match == nil {
+		return Version{}, fmt.Errorf("cannot find u-boot version in %q", output)
+	}
+	// Both numbers are guaranteed to be decimal digits by the regexp.
+	year, _ := strconv.Atoi(match[1])
+	month, _ := strconv.Atoi(match[2])
+	return Version{Year: year, Month: month, Suffix: match[3], BuildInfo: match[4]}, nil
+}
+
+// String returns the version as printed by u-boot, without the build info.
+func (v Version) String() string {
+	return fmt.Sprintf("%04d.%02d%s", v.Year, v.Month, v.Suffix)
+}
+
+// Before returns true if the release v is older than the release other.
+//
+// Suffixes are not compared.
+func (v Version) Before(other Version) bool {
+	if v.Year != other.Year {
+		return v.Year < other.Year
+	}
+	return v.Month < other.Month
+}
+
+// VersionRange is an inclusive range of u-boot releases.
+type VersionRange struct {
+	Min Version
+	Max Version
+}
+
+// Contains returns true if the release v is within the range.
+func (r VersionRange) Contains(v Version) bool {
+	return !v.Before(r.Min) && !r.Max.Before(v)
+}
+
+// String returns the range in the form "2016.01-2016.11".
+func (r VersionRange) String() string {
+	if r.Min == r.Max {
+		return r.Min.String()
+	}
+	return fmt.Sprintf("%s-%s", r.Min, r.Max)
+}
+
+// Version returns the version of u-boot running on the board.
+func (uboot *UBootShell) Version() (Version, error) {
+	output, err := uboot.regularCmd("version")
+	if err != nil {
+		return Version{}, err
+	}
+	return ParseVersion(output)
+}
+
+// WithStrictVersionCheck returns a shell refusing to work with unsupported versions.
+//
+// By default CheckVersion only warns about unsupported versions of u-boot.
+func (uboot *UBootShell) WithStrictVersionCheck(strict bool) *UBootShell {
+	uboot.strictVersion = strict
+	return uboot
+}
+
+// CheckVersion checks that the version of u-boot is within one of the given ranges.
+//
+// Unsupported versions are reported as warnings, or errors if strict version
+// checks are enabled.
+func (uboot *UBootShell) CheckVersion(supported ...VersionRange) (Version, error) {
+	v, err := uboot.Version()
+	if err != nil {
+		return Version{}, err
+	}
+	uboot.log.Printf("u-boot version: %s (%s)\n", v, v.BuildInfo)
+	for _, r := range supported {
+		if r.Contains(v) {
+			return v, nil
+		}
+	}
+	if uboot.strictVersion {
+		return v, fmt.Errorf("unsupported u-boot version %s, supported versions: %v", v, supported)
+	}
+	uboot.log.Printf("Warning: u-boot version %s is not known to work, supported versions: %v\n", v, supported)
+	return v, nil
+}
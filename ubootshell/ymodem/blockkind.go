@@ -40,3 +40,25 @@ func (b BlockKind) size() int {
 	}
 	return 128
 }
+
+// Mode denotes if data blocks are acknowledged by the receiver.
+type Mode bool
+
+const (
+	// AcknowledgedMode waits for acknowledgment of each data block.
+	AcknowledgedMode Mode = false
+	// StreamingMode sends data blocks back-to-back, as in YMODEM-G.
+	//
+	// Streaming is only used if the receiver asks for it, otherwise the
+	// transfer proceeds in the acknowledged mode. There is no recovery from
+	// errors, so this is only suitable for reliable links.
+	StreamingMode Mode = true
+)
+
+// String returns a description of the transfer mode.
+func (m Mode) String() string {
+	if m == StreamingMode {
+		return "streaming (YMODEM-G)"
+	}
+	return "acknowledged"
+}
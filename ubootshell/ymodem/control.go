@@ -24,13 +24,14 @@ import (
 type controlByte byte
 
 const (
-	asciiSOH   = 0x01
-	asciiSTX   = 0x02
-	asciiEOT   = 0x04
-	asciiACK   = 0x06
-	asciiNAK   = 0x15
-	asciiCAN   = 0x18
-	ymodemPOLL = 0x43
+	asciiSOH    = 0x01
+	asciiSTX    = 0x02
+	asciiEOT    = 0x04
+	asciiACK    = 0x06
+	asciiNAK    = 0x15
+	asciiCAN    = 0x18
+	ymodemPOLL  = 0x43
+	ymodemGPOLL = 0x47
 )
 
 // String returns the name of the control byte.
@@ -50,8 +51,10 @@ func (b controlByte) String() string {
 		return "CAN"
 	case ymodemPOLL:
 		return "POLL"
+	case ymodemGPOLL:
+		return "GPOLL"
 	default:
-		return fmt.Sprintf("%#x", b)
+		return fmt.Sprintf("%#x", byte(b))
 	}
 }
 
@@ -63,7 +66,6 @@ func readControlByte(reader io.Reader) (controlByte, error) {
 		return cb, fmt.Errorf("cannot read control byte: %w", err)
 	}
 	cb = controlByte(buf[0])
-	// fmt.Printf("Read control byte %q\n", cb)
 	return cb, nil
 }
 
@@ -72,6 +74,5 @@ func writeControlByte(writer io.Writer, cb controlByte) error {
 	if err != nil {
 		return fmt.Errorf("cannot write control byte: %w", err)
 	}
-	// fmt.Printf("Wrote control byte %q\n", cb)
 	return nil
 }
@@ -0,0 +1,83 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ymodem
+
+import (
+	"time"
+)
+
+// Stats describes the throughput of a transfer in progress.
+type Stats struct {
+	// Elapsed is the time since the transfer of the file started.
+	Elapsed time.Duration
+	// CurrentRate is the rate at which the last block was sent, in bytes per second.
+	CurrentRate float64
+	// AverageRate is the rate over the last few seconds, in bytes per second.
+	AverageRate float64
+	// Remaining is the estimated time left until the file is sent.
+	Remaining time.Duration
+}
+
+// StatsObserver is an Observer that is also notified about transfer throughput.
+type StatsObserver interface {
+	Observer
+	Stats(bytesSent, bytesTotal int64, stats Stats)
+}
+
+// rateWindow is the duration over which the average rate is computed.
+const rateWindow = 5 * time.Second
+
+type rateSample struct {
+	when  time.Time
+	bytes int64
+}
+
+// rateMeter computes throughput statistics from progress of a transfer.
+type rateMeter struct {
+	start   time.Time
+	samples []rateSample
+}
+
+func newRateMeter(now time.Time) *rateMeter {
+	return &rateMeter{
+		start:   now,
+		samples: []rateSample{{when: now}},
+	}
+}
+
+// update records that the given number of bytes was sent so far.
+func (m *rateMeter) update(now time.Time, bytesSent, bytesTotal int64) Stats {
+	last := m.samples[len(m.samples)-1]
+	m.samples = append(m.samples, rateSample{when: now, bytes: bytesSent})
+	// Forget samples older than the window, but keep one to measure from.
+	for len(m.samples) > 2 && now.Sub(m.samples[1].when) >= rateWindow {
+		m.samples = m.samples[1:]
+	}
+	stats := Stats{Elapsed: now.Sub(m.start)}
+	if dt := now.Sub(last.when).Seconds(); dt > 0 {
+		stats.CurrentRate = float64(bytesSent-last.bytes) / dt
+	}
+	first := m.samples[0]
+	if dt := now.Sub(first.when).Seconds(); dt > 0 {
+		stats.AverageRate = float64(bytesSent-first.bytes) / dt
+	}
+	if stats.AverageRate > 0 {
+		remaining := float64(bytesTotal-bytesSent) / stats.AverageRate
+		stats.Remaining = time.Duration(remaining * float64(time.Second))
+	}
+	return stats
+}
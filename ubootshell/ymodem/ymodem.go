@@ -19,36 +19,95 @@ package ymodem
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 )
 
+// ErrTransferFailed is matched by errors of transfers failing part-way
+// through the file data.
+var ErrTransferFailed = errors.New("file transfer failed")
+
+// TransferError describes failure to deliver a block of file data.
+type TransferError struct {
+	// Block is the 1-based index of the block that was not delivered.
+	Block int64
+	// Reason describes the failure.
+	Reason string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *TransferError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("cannot send file data: block %d: %s: %v", e.Block, e.Reason, e.Err)
+	}
+	return fmt.Sprintf("cannot send file data: block %d: %s", e.Block, e.Reason)
+}
+
+// Unwrap returns the underlying error.
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true for ErrTransferFailed.
+func (e *TransferError) Is(target error) bool {
+	return target == ErrTransferFailed
+}
+
+// File describes a single file sent in a transfer.
+type File struct {
+	// Reader provides at least Size bytes of data.
+	Reader io.Reader
+	// Name is the name of the file, without directory, announced to the receiver.
+	Name string
+	// Size is the number of bytes to send.
+	Size int64
+}
+
 // Transfer encapsulates state of an ymodem file transfer.
 type Transfer struct {
-	// file is the file being sent
-	file     *os.File
-	fileInfo os.FileInfo
+	// files are sent one after another in a single session
+	files []File
 
 	blockKind  BlockKind
+	mode       Mode
 	retryCount int
 	observer   Observer
+	xmodem     bool
 
-	fileBytesSent int64
+	// streaming is set when the receiver agreed to YMODEM-G.
+	streaming bool
 }
 
-// NewTransfer returns a transfer object for sending the given file.
-func NewTransfer(file *os.File) (*Transfer, error) {
+// NewTransfer returns a transfer object for sending data from the given reader.
+//
+// The receiver is told to store exactly size bytes in a file with the given
+// name. The reader must provide at least that much data.
+func NewTransfer(reader io.Reader, name string, size int64) *Transfer {
+	return NewBatchTransfer(File{Reader: reader, Name: name, Size: size})
+}
+
+// NewTransferFromFile returns a transfer object for sending the given file.
+func NewTransferFromFile(file *os.File) (*Transfer, error) {
 	fileInfo, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
-	tr := &Transfer{
-		file:     file,
-		fileInfo: fileInfo,
-	}
-	return tr, nil
+	return NewTransfer(file, file.Name(), fileInfo.Size()), nil
+}
+
+// NewBatchTransfer returns a transfer object for sending several files in one session.
+//
+// Not all receivers support batch transfers, the loady command of u-boot
+// for example expects exactly one file.
+func NewBatchTransfer(files ...File) *Transfer {
+	return &Transfer{files: files}
 }
 
 // WithRetryCount returns a transfer with the given number of retry attempts.
@@ -65,6 +124,10 @@ type Observer interface {
 }
 
 // WithObserver returns a transfer with an observer that is notified of progress.
+//
+// Observers implementing StatsObserver are also told about throughput.
+//
+// In batch transfers, the observer is notified about each file separately.
 func (tr *Transfer) WithObserver(observer Observer) *Transfer {
 	tr.observer = observer
 	return tr
@@ -76,84 +139,168 @@ func (tr *Transfer) WithBlockKind(blockKind BlockKind) *Transfer {
 	return tr
 }
 
+// WithMode returns a transfer with the given transfer mode.
+func (tr *Transfer) WithMode(mode Mode) *Transfer {
+	tr.mode = mode
+	return tr
+}
+
+// WithXModem returns a transfer using the XMODEM protocol instead.
+//
+// XMODEM is the predecessor of YMODEM, used by the loadx command of u-boot.
+// It sends data of a single file, without the block announcing its name and
+// size, so the receiver keeps the padding of the last block.
+func (tr *Transfer) WithXModem() *Transfer {
+	tr.xmodem = true
+	return tr
+}
+
+// poll returns the control byte used by the receiver to request data.
+func (tr *Transfer) poll() controlByte {
+	if tr.streaming {
+		return ymodemGPOLL
+	}
+	return ymodemPOLL
+}
+
 // SendTo completes the file transfer using the ymodem protocol.
-func (tr *Transfer) SendTo(stream io.ReadWriter) (err error) {
+//
+// The transfer is aborted when the context is cancelled. A write that is
+// waiting for the stream is interrupted and keeps going in the background
+// until it returns. A read that is already waiting for the receiver is only
+// abandoned once it returns, for example because the stream timed out.
+func (tr *Transfer) SendTo(ctx context.Context, stream io.ReadWriter) (err error) {
+	// Cancellation stops the transfer but not the abort request below.
+	cs := &contextStream{ctx: ctx, stream: stream}
 	defer func() {
 		// If we fail, tell the other side to abort.
 		if err != nil {
-			_, _ = stream.Write([]byte{asciiCAN, asciiCAN})
+			cs.abort()
 		}
 	}()
 	errPrefix := "cannot send file"
+	if tr.xmodem {
+		return tr.sendXModem(cs)
+	}
 
-	if err := tr.sendFileInfo(stream); err != nil {
+	// Wait for the receiver to request a file by sending 'C', or 'G' if
+	// it wants to stream data.
+	cmd, err := readControlByte(cs)
+	if err != nil {
 		return err
 	}
-	if err := tr.sendFileData(stream); err != nil {
-		return err
+	switch {
+	case cmd == ymodemPOLL:
+	case cmd == ymodemGPOLL && tr.mode == StreamingMode:
+		tr.streaming = true
+	default:
+		return fmt.Errorf("%s: expected initial POLL, got %q", errPrefix, cmd)
 	}
-	// Termination dance.
-	if err := writeControlByte(stream, asciiEOT); err != nil {
-		return err
+
+	// Each file ends with the receiver asking for the next one.
+	for _, file := range tr.files {
+		if err := tr.sendFileInfo(cs, file); err != nil {
+			return err
+		}
+		if err := tr.sendFileData(cs, file); err != nil {
+			return err
+		}
+		if err := tr.sendEndOfFile(cs); err != nil {
+			return err
+		}
 	}
-	cmd, err := readControlByte(stream)
-	if err != nil {
+	// Send empty block to indicate completion.
+	if err := sendBlock(cs, tr.blockKind, 0, nil, 0); err != nil {
 		return err
 	}
-	if cmd != asciiACK {
-		return fmt.Errorf("%s: expected 1st termination ACK, got %q", errPrefix, cmd)
-	}
-	cmd, err = readControlByte(stream)
+	cmd, err = readControlByte(cs)
 	if err != nil {
 		return err
 	}
 	if cmd != asciiACK {
-		return fmt.Errorf("%s: expected 2nd termination ACK, got %q", errPrefix, cmd)
+		return fmt.Errorf("%s: expected final termination ACK, got %q", errPrefix, cmd)
 	}
-	cmd, err = readControlByte(stream)
-	if err != nil {
-		return err
+	return nil
+}
+
+// sendXModem sends the only file of the transfer using XMODEM.
+//
+// The initial POLL of the receiver requests the first data block and the
+// acknowledgment of EOT ends the transfer.
+func (tr *Transfer) sendXModem(stream io.ReadWriter) error {
+	errPrefix := "cannot send file"
+	if len(tr.files) != 1 {
+		return fmt.Errorf("%s: XMODEM transfers exactly one file", errPrefix)
 	}
-	if cmd != ymodemPOLL {
-		return fmt.Errorf("%s: termination POLL, got %q", errPrefix, cmd)
+	if err := tr.sendFileData(stream, tr.files[0]); err != nil {
+		return err
 	}
-	// Send empty block to indicate completion.
-	if err := sendBlock(stream, tr.blockKind, 0, nil, 0); err != nil {
+	if err := writeControlByte(stream, asciiEOT); err != nil {
 		return err
 	}
-	cmd, err = readControlByte(stream)
+	cmd, err := readControlByte(stream)
 	if err != nil {
 		return err
 	}
 	if cmd != asciiACK {
-		return fmt.Errorf("%s: expected final termination ACK, got %q", errPrefix, cmd)
+		return fmt.Errorf("%s: expected termination ACK, got %q", errPrefix, cmd)
 	}
 	return nil
 }
 
-func (tr *Transfer) sendFileInfo(stream io.ReadWriter) error {
-	errPrefix := "cannot send file info"
+// sendEndOfFile tells the receiver that all the data of a file was sent.
+//
+// When streaming, data blocks were not acknowledged, so the acknowledgment
+// of EOT is the first sign that the receiver got all the data. Receivers
+// report errors by cancelling the transfer instead.
+func (tr *Transfer) sendEndOfFile(stream io.ReadWriter) error {
+	errPrefix := "cannot send file"
 
-	// Wait for the receiver to request a file by sending 'C'
+	// Termination dance.
+	if err := writeControlByte(stream, asciiEOT); err != nil {
+		return err
+	}
 	cmd, err := readControlByte(stream)
 	if err != nil {
 		return err
 	}
-	if cmd != ymodemPOLL {
-		return fmt.Errorf("%s: expected initial POLL, got %q", errPrefix, cmd)
+	switch cmd {
+	case asciiACK:
+	case asciiCAN:
+		return fmt.Errorf("%s: transfer aborted by recepient", errPrefix)
+	default:
+		return fmt.Errorf("%s: expected 1st termination ACK, got %q", errPrefix, cmd)
 	}
-
-	// Prepare the block with file name and size.
-	infoBlock, err := infoBlockForFile(tr.file)
+	if !tr.streaming {
+		cmd, err = readControlByte(stream)
+		if err != nil {
+			return err
+		}
+		if cmd != asciiACK {
+			return fmt.Errorf("%s: expected 2nd termination ACK, got %q", errPrefix, cmd)
+		}
+	}
+	cmd, err = readControlByte(stream)
 	if err != nil {
 		return err
 	}
+	if cmd != tr.poll() {
+		return fmt.Errorf("%s: expected termination %s, got %q", errPrefix, tr.poll(), cmd)
+	}
+	return nil
+}
+
+func (tr *Transfer) sendFileInfo(stream io.ReadWriter, file File) error {
+	errPrefix := "cannot send file info"
+
+	// Prepare the block with file name and size.
+	infoBlock := infoBlockFor(file.Name, file.Size)
 	// Keep trying, we count retry attempts inside.
 	for {
 		// Send the initial block with zero-byte padding. This is different from
 		// actual data blocks which are padded with 0x1A instead. Both values
 		// were determined by scanning USB traffic with Wireshark.
-		if err = sendBlock(stream, tr.blockKind, 0, infoBlock, 0); err != nil {
+		if err := sendBlock(stream, tr.blockKind, 0, infoBlock, 0); err != nil {
 			return err
 		}
 		// Did the bootloader acknowledge the request?
@@ -179,10 +326,9 @@ func (tr *Transfer) sendFileInfo(stream io.ReadWriter) error {
 			return fmt.Errorf("%s: expected ACK, NAK or CAN, got %q", errPrefix, cmd)
 		}
 	}
-	return nil
 }
 
-func (tr *Transfer) sendFileData(stream io.ReadWriter) error {
+func (tr *Transfer) sendFileData(stream io.ReadWriter, file File) error {
 	errPrefix := "cannot send file data"
 
 	// The recepient agreed to the file.
@@ -191,22 +337,27 @@ func (tr *Transfer) sendFileData(stream io.ReadWriter) error {
 	if err != nil {
 		return err
 	}
-	if cmd != ymodemPOLL {
-		return fmt.Errorf("%s: expected POLL, got %q", errPrefix, cmd)
+	if cmd != tr.poll() {
+		return fmt.Errorf("%s: expected %s, got %q", errPrefix, tr.poll(), cmd)
 	}
 
 	// Send the blocks, one by one, until we are done.
 	blockSize := tr.blockKind.size()
-	fileSize := tr.fileInfo.Size()
-	numBlocks := (fileSize + int64(blockSize) - 1) / int64(blockSize)
+	numBlocks := (file.Size + int64(blockSize) - 1) / int64(blockSize)
 	if tr.observer != nil {
-		tr.observer.Start(tr.file.Name(), tr.fileInfo.Size())
+		tr.observer.Start(file.Name, file.Size)
 	}
-	blockData := make([]byte, tr.blockKind.size())
+	var bytesSent int64
+	statsObserver, _ := tr.observer.(StatsObserver)
+	meter := newRateMeter(time.Now())
+	blockData := make([]byte, blockSize)
 	for blockIdx := int64(0); blockIdx < numBlocks; blockIdx++ {
-		n, err := tr.file.Read(blockData)
-		if err != nil && err != io.EOF {
-			return err
+		n := len(blockData)
+		if remaining := file.Size - bytesSent; remaining < int64(n) {
+			n = int(remaining)
+		}
+		if _, err := io.ReadFull(file.Reader, blockData[:n]); err != nil {
+			return fmt.Errorf("%s: cannot read block %d: %w", errPrefix, blockIdx+1, err)
 		}
 		// Keep trying, we count retry attempts inside.
 		for {
@@ -215,24 +366,34 @@ func (tr *Transfer) sendFileData(stream io.ReadWriter) error {
 			// eventually wrap over). They don't have to be able to cover the
 			// whole range of the data that needs sending.
 			if err = sendBlock(stream, tr.blockKind, uint8(blockIdx+1), blockData[:n], 0x1A); err != nil {
-				return err
+				return &TransferError{Block: blockIdx + 1, Reason: "cannot write block", Err: err}
+			}
+			// When streaming, blocks are not acknowledged.
+			if tr.streaming {
+				break
 			}
 			// Wait for the recepient to ack the block. If we didn't succeed, try again.
 			cmd, err := readControlByte(stream)
 			if err != nil {
-				return err
+				return &TransferError{Block: blockIdx + 1, Reason: "cannot read acknowledgement", Err: err}
+			}
+			if cmd == asciiACK {
+				break
 			}
-			if cmd != asciiACK {
-				tr.retryCount--
-				if tr.retryCount == 0 {
-					return fmt.Errorf("%s too many failed attempts", errPrefix)
-				}
+			if cmd == asciiCAN {
+				return &TransferError{Block: blockIdx + 1, Reason: "transfer aborted by recepient"}
+			}
+			tr.retryCount--
+			if tr.retryCount < 0 {
+				return &TransferError{Block: blockIdx + 1, Reason: "too many failed attempts"}
 			}
-			break
 		}
-		tr.fileBytesSent += int64(n)
+		bytesSent += int64(n)
 		if tr.observer != nil {
-			tr.observer.Progress(tr.fileBytesSent, fileSize)
+			tr.observer.Progress(bytesSent, file.Size)
+		}
+		if statsObserver != nil {
+			statsObserver.Stats(bytesSent, file.Size, meter.update(time.Now(), bytesSent, file.Size))
 		}
 	}
 	if tr.observer != nil {
@@ -241,17 +402,13 @@ func (tr *Transfer) sendFileData(stream io.ReadWriter) error {
 	return nil
 }
 
-// infoBlockForFile returns the 0-index block with file meta-data.
-func infoBlockForFile(file *os.File) ([]byte, error) {
+// infoBlockFor returns the 0-index block with file meta-data.
+func infoBlockFor(name string, size int64) []byte {
 	var buf bytes.Buffer
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return nil, err
-	}
-	buf.WriteString(filepath.Base(file.Name()))
+	buf.WriteString(filepath.Base(name))
 	buf.WriteByte(0x0)
-	buf.WriteString(fmt.Sprintf("%d", fileInfo.Size()))
-	return buf.Bytes(), nil
+	buf.WriteString(fmt.Sprintf("%d", size))
+	return buf.Bytes()
 }
 
 func sendBlock(stream io.ReadWriter, blockKind BlockKind, blockIdx uint8, data []byte, padding byte) error {
@@ -288,3 +445,76 @@ func sendBlock(stream io.ReadWriter, blockKind BlockKind, blockIdx uint8, data [
 	}
 	return nil
 }
+
+type ioResult struct {
+	n   int
+	err error
+}
+
+// contextStream fails reads and writes once the context is cancelled.
+//
+// Unless the context can never be cancelled, writes are done by a helper
+// goroutine, so that cancellation interrupts a write stuck on flow control.
+// Reads are not interrupted, as a read left running in the background would
+// take the output of the receiver meant for whoever uses the stream next.
+// Once cancelled, the stream is not used again except by abort.
+type contextStream struct {
+	ctx          context.Context
+	stream       io.ReadWriter
+	pendingWrite chan ioResult // write interrupted by cancellation, if any
+}
+
+func (s *contextStream) Read(p []byte) (int, error) {
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.stream.Read(p)
+}
+
+func (s *contextStream) Write(p []byte) (int, error) {
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if s.ctx.Done() == nil {
+		return s.stream.Write(p)
+	}
+	buf := append([]byte(nil), p...)
+	ch := make(chan ioResult, 1)
+	go func() {
+		n, err := s.stream.Write(buf)
+		ch <- ioResult{n: n, err: err}
+	}()
+	select {
+	case res := <-ch:
+		return res.n, res.err
+	case <-s.ctx.Done():
+		s.pendingWrite = ch
+		return 0, s.ctx.Err()
+	}
+}
+
+// abortGrace is the time the write interrupted by cancellation has to
+// complete before the receiver is asked to abort the transfer.
+const abortGrace = time.Second
+
+// abort asks the receiver to abort the transfer.
+//
+// The request must follow the write interrupted by cancellation, if any. If
+// that write is still stuck after a while, the request is not sent at all,
+// rather than being written in the middle of whatever comes next.
+func (s *contextStream) abort() {
+	if s.pendingWrite != nil {
+		timer := time.NewTimer(abortGrace)
+		defer timer.Stop()
+		select {
+		case res := <-s.pendingWrite:
+			s.pendingWrite = nil
+			if res.err != nil {
+				return
+			}
+		case <-timer.C:
+			return
+		}
+	}
+	_, _ = s.stream.Write([]byte{asciiCAN, asciiCAN})
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ymodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptedReceiver replies with prepared control bytes and records the data sent to it.
+type scriptedReceiver struct {
+	script *bytes.Reader
+	sent   bytes.Buffer
+}
+
+func newScriptedReceiver(script ...byte) *scriptedReceiver {
+	return &scriptedReceiver{script: bytes.NewReader(script)}
+}
+
+func (r *scriptedReceiver) Read(p []byte) (int, error) { return r.script.Read(p) }
+
+func (r *scriptedReceiver) Write(p []byte) (int, error) { return r.sent.Write(p) }
+
+// frameSize is the size of a small block with its header and checksum.
+const frameSize = 3 + 128 + 2
+
+func TestSendToEndOfFile(t *testing.T) {
+	data := strings.Repeat("x", 200)
+	for _, tc := range []struct {
+		name   string
+		mode   Mode
+		files  int
+		script []byte
+	}{{
+		name:  "acknowledged",
+		mode:  AcknowledgedMode,
+		files: 1,
+		script: []byte{
+			ymodemPOLL, asciiACK, ymodemPOLL, asciiACK, asciiACK,
+			asciiACK, asciiACK, ymodemPOLL, // EOT
+			asciiACK, // end of batch
+		},
+	}, {
+		name:  "streaming",
+		mode:  StreamingMode,
+		files: 1,
+		script: []byte{
+			ymodemGPOLL, asciiACK, ymodemGPOLL,
+			asciiACK, ymodemGPOLL, // EOT
+			asciiACK, // end of batch
+		},
+	}, {
+		name:  "streaming not requested by receiver",
+		mode:  StreamingMode,
+		files: 1,
+		script: []byte{
+			ymodemPOLL, asciiACK, ymodemPOLL, asciiACK, asciiACK,
+			asciiACK, asciiACK, ymodemPOLL, // EOT
+			asciiACK, // end of batch
+		},
+	}, {
+		name:  "acknowledged batch",
+		mode:  AcknowledgedMode,
+		files: 2,
+		script: []byte{
+			ymodemPOLL, asciiACK, ymodemPOLL, asciiACK, asciiACK,
+			asciiACK, asciiACK, ymodemPOLL, // EOT
+			asciiACK, ymodemPOLL, asciiACK, asciiACK,
+			asciiACK, asciiACK, ymodemPOLL, // EOT
+			asciiACK, // end of batch
+		},
+	}, {
+		name:  "streaming batch",
+		mode:  StreamingMode,
+		files: 2,
+		script: []byte{
+			ymodemGPOLL, asciiACK, ymodemGPOLL,
+			asciiACK, ymodemGPOLL, // EOT
+			asciiACK, ymodemGPOLL,
+			asciiACK, ymodemGPOLL, // EOT
+			asciiACK, // end of batch
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var files []File
+			for i := 0; i < tc.files; i++ {
+				files = append(files, File{Reader: strings.NewReader(data), Name: "file", Size: int64(len(data))})
+			}
+			receiver := newScriptedReceiver(tc.script...)
+			tr := NewBatchTransfer(files...).WithMode(tc.mode)
+			if err := tr.SendTo(context.Background(), receiver); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n := receiver.script.Len(); n != 0 {
+				t.Fatalf("%d control bytes of the receiver were not read", n)
+			}
+			// Each file is an info block, two data blocks and EOT.
+			sent := receiver.sent.Bytes()
+			fileSize := 3*frameSize + 1
+			if len(sent) != tc.files*fileSize+frameSize {
+				t.Fatalf("unexpected size of sent data: %d", len(sent))
+			}
+			for i := 0; i < tc.files; i++ {
+				if eot := sent[(i+1)*fileSize-1]; eot != asciiEOT {
+					t.Fatalf("expected EOT after file %d, got %q", i+1, controlByte(eot))
+				}
+			}
+			end := sent[tc.files*fileSize:]
+			if end[0] != asciiSOH || end[1] != 0 || end[2] != 0xFF || bytes.Count(end[3:3+128], []byte{0}) != 128 {
+				t.Fatalf("expected empty block at the end of the batch, got %q", end)
+			}
+		})
+	}
+}
+
+func TestSendToEndOfFileErrors(t *testing.T) {
+	data := strings.Repeat("x", 200)
+	for _, tc := range []struct {
+		name   string
+		mode   Mode
+		script []byte
+		err    string
+	}{{
+		name:   "acknowledged cancelled",
+		mode:   AcknowledgedMode,
+		script: []byte{ymodemPOLL, asciiACK, ymodemPOLL, asciiACK, asciiACK, asciiCAN},
+		err:    "transfer aborted by recepient",
+	}, {
+		name:   "acknowledged without 2nd ACK",
+		mode:   AcknowledgedMode,
+		script: []byte{ymodemPOLL, asciiACK, ymodemPOLL, asciiACK, asciiACK, asciiACK, ymodemPOLL},
+		err:    "expected 2nd termination ACK",
+	}, {
+		name:   "streaming cancelled",
+		mode:   StreamingMode,
+		script: []byte{ymodemGPOLL, asciiACK, ymodemGPOLL, asciiCAN},
+		err:    "transfer aborted by recepient",
+	}, {
+		name:   "streaming with plain POLL after EOT",
+		mode:   StreamingMode,
+		script: []byte{ymodemGPOLL, asciiACK, ymodemGPOLL, asciiACK, ymodemPOLL},
+		err:    "expected termination GPOLL",
+	}, {
+		name:   "streaming not allowed",
+		mode:   AcknowledgedMode,
+		script: []byte{ymodemGPOLL},
+		err:    "expected initial POLL",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			receiver := newScriptedReceiver(tc.script...)
+			tr := NewTransfer(strings.NewReader(data), "file", int64(len(data))).WithMode(tc.mode)
+			err := tr.SendTo(context.Background(), receiver)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected error containing %q, got %v", tc.err, err)
+			}
+			// The receiver is told to abort the transfer.
+			if !bytes.HasSuffix(receiver.sent.Bytes(), []byte{asciiCAN, asciiCAN}) {
+				t.Fatalf("expected transfer to be cancelled")
+			}
+		})
+	}
+}
+
+// stuckReceiver requests a file and then stops accepting data.
+type stuckReceiver struct {
+	polled  bool
+	written chan struct{}
+	release chan struct{}
+}
+
+func (r *stuckReceiver) Read(p []byte) (int, error) {
+	if r.polled {
+		<-r.release
+		return 0, io.EOF
+	}
+	r.polled = true
+	p[0] = byte(ymodemPOLL)
+	return 1, nil
+}
+
+func (r *stuckReceiver) Write(p []byte) (int, error) {
+	close(r.written)
+	<-r.release
+	return 0, io.ErrClosedPipe
+}
+
+func TestSendToCancelledMidBlock(t *testing.T) {
+	receiver := &stuckReceiver{written: make(chan struct{}), release: make(chan struct{})}
+	defer close(receiver.release)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-receiver.written
+		cancel()
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewTransfer(strings.NewReader("data"), "file", 4).SendTo(ctx, receiver)
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected cancellation, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stuck write was not interrupted")
+	}
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zmodem
+
+// crc16 computes the CRC-16/XMODEM checksum of the data.
+func crc16(data []byte) (crc uint16) {
+	for _, b := range data {
+		crc = crc16Update(crc, b)
+	}
+	return crc
+}
+
+func crc16Update(crc uint16, b byte) uint16 {
+	const crcPoly = 0x1021
+	crc ^= uint16(b) << 8
+	for i := 0; i < 8; i++ {
+		if crc&0x8000 != 0 {
+			crc = crc<<1 ^ crcPoly
+		} else {
+			crc <<= 1
+		}
+	}
+	return crc
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zmodem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	zPAD     = '*'
+	zDLE     = 0x18
+	zBIN     = 'A'
+	zHEX     = 'B'
+	zBIN32   = 'C'
+	zRUB0    = 'l'
+	zRUB1    = 'm'
+	asciiXON = 0x11
+)
+
+// frameType is the type of a ZMODEM header.
+type frameType byte
+
+const (
+	zRQINIT frameType = iota
+	zRINIT
+	zSINIT
+	zACK
+	zFILE
+	zSKIP
+	zNAK
+	zABORT
+	zFIN
+	zRPOS
+	zDATA
+	zEOF
+	zFERR
+	zCRC
+	zCHALLENGE
+	zCOMPL
+	zCAN
+	zFREECNT
+	zCOMMAND
+	zSTDERR
+)
+
+// String returns the name of the frame type.
+func (t frameType) String() string {
+	names := [...]string{
+		"ZRQINIT", "ZRINIT", "ZSINIT", "ZACK", "ZFILE", "ZSKIP", "ZNAK",
+		"ZABORT", "ZFIN", "ZRPOS", "ZDATA", "ZEOF", "ZFERR", "ZCRC",
+		"ZCHALLENGE", "ZCOMPL", "ZCAN", "ZFREECNT", "ZCOMMAND", "ZSTDERR",
+	}
+	if int(t) < len(names) {
+		return names[t]
+	}
+	return fmt.Sprintf("%#x", byte(t))
+}
+
+// Sub-packet terminators, following ZDLE.
+const (
+	zCRCE = 'h' // frame ends, header follows
+	zCRCG = 'i' // frame continues non-stop
+	zCRCQ = 'j' // frame continues, ZACK expected
+	zCRCW = 'k' // frame ends, ZACK expected
+)
+
+// Capabilities of the receiver, in ZF0 of ZRINIT.
+const (
+	canFC32 = 0x20 // receiver can use 32 bit CRC
+	escCTL  = 0x40 // receiver expects control characters to be escaped
+)
+
+// zCBIN is the binary conversion option, in ZF0 of ZFILE.
+const zCBIN = 1
+
+// errCancelled is returned when the other side cancels the session.
+var errCancelled = errors.New("transfer cancelled by recipient")
+
+// header is a ZMODEM header.
+//
+// The four data bytes either hold a little-endian file position or the
+// flags ZF3, ZF2, ZF1 and ZF0, in this order.
+type header struct {
+	kind frameType
+	data [4]byte
+}
+
+// posHeader returns a header carrying the given file position.
+func posHeader(kind frameType, pos int64) header {
+	h := header{kind: kind}
+	binary.LittleEndian.PutUint32(h.data[:], uint32(pos))
+	return h
+}
+
+// pos returns the file position carried by the header.
+func (h header) pos() int64 {
+	return int64(binary.LittleEndian.Uint32(h.data[:]))
+}
+
+// flags returns the ZF0 flags carried by the header.
+func (h header) flags() byte {
+	return h.data[3]
+}
+
+// encoder writes ZMODEM frames, escaping data as required by the receiver.
+type encoder struct {
+	buf    bytes.Buffer
+	crc32  bool
+	escCtl bool
+}
+
+// writeHex writes a header in the hex format, used before the receiver is known.
+func (enc *encoder) writeHex(w io.Writer, h header) error {
+	raw := append([]byte{byte(h.kind)}, h.data[:]...)
+	crc := crc16(raw)
+	raw = append(raw, byte(crc>>8), byte(crc))
+	enc.buf.Reset()
+	enc.buf.Write([]byte{zPAD, zPAD, zDLE, zHEX})
+	enc.buf.WriteString(hex.EncodeToString(raw))
+	enc.buf.WriteString("\r\n")
+	if h.kind != zACK && h.kind != zFIN {
+		enc.buf.WriteByte(asciiXON)
+	}
+	return enc.flush(w)
+}
+
+// writeBinary writes a header in the binary format, with 16 or 32 bit CRC.
+func (enc *encoder) writeBinary(w io.Writer, h header) error {
+	raw := append([]byte{byte(h.kind)}, h.data[:]...)
+	enc.buf.Reset()
+	enc.buf.WriteByte(zPAD)
+	enc.buf.WriteByte(zDLE)
+	if enc.crc32 {
+		enc.buf.WriteByte(zBIN32)
+		enc.escape(raw)
+		var crc [4]byte
+		binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(raw))
+		enc.escape(crc[:])
+	} else {
+		enc.buf.WriteByte(zBIN)
+		enc.escape(raw)
+		crc := crc16(raw)
+		enc.escape([]byte{byte(crc >> 8), byte(crc)})
+	}
+	return enc.flush(w)
+}
+
+// writeData writes a data sub-packet with the given terminator.
+func (enc *encoder) writeData(w io.Writer, data []byte, end byte) error {
+	enc.buf.Reset()
+	enc.escape(data)
+	enc.buf.WriteByte(zDLE)
+	enc.buf.WriteByte(end)
+	if enc.crc32 {
+		crc := crc32.Update(crc32.ChecksumIEEE(data), crc32.IEEETable, []byte{end})
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], crc)
+		enc.escape(buf[:])
+	} else {
+		crc := crc16Update(crc16(data), end)
+		enc.escape([]byte{byte(crc >> 8), byte(crc)})
+	}
+	if end == zCRCW {
+		enc.buf.WriteByte(asciiXON)
+	}
+	return enc.flush(w)
+}
+
+// escape appends data to the buffer, escaping bytes that disturb the link.
+func (enc *encoder) escape(data []byte) {
+	for _, b := range data {
+		switch {
+		case b == zDLE, b&0x7f == 0x10, b&0x7f == 0x11, b&0x7f == 0x13:
+			enc.buf.WriteByte(zDLE)
+			enc.buf.WriteByte(b ^ 0x40)
+		case enc.escCtl && b&0x60 == 0:
+			enc.buf.WriteByte(zDLE)
+			enc.buf.WriteByte(b ^ 0x40)
+		default:
+			enc.buf.WriteByte(b)
+		}
+	}
+}
+
+func (enc *encoder) flush(w io.Writer) error {
+	if _, err := w.Write(enc.buf.Bytes()); err != nil {
+		return fmt.Errorf("cannot send frame: %w", err)
+	}
+	return nil
+}
+
+// maxGarbage is the number of bytes to skip while looking for a header.
+const maxGarbage = 8192
+
+// readHeader reads the next header sent by the receiver.
+//
+// Anything preceding the header, such as messages printed by the receiver
+// or the end of an earlier hex header, is skipped.
+func readHeader(r io.Reader) (header, error) {
+	var h header
+	sawPad := false
+	cancels := 0
+	for skipped := 0; ; skipped++ {
+		if skipped > maxGarbage {
+			return h, fmt.Errorf("cannot find header in received data")
+		}
+		b, err := readByte(r)
+		if err != nil {
+			return h, err
+		}
+		if b == zDLE {
+			cancels++
+			if cancels >= 5 {
+				return h, errCancelled
+			}
+			if sawPad {
+				break
+			}
+			continue
+		}
+		cancels = 0
+		sawPad = b == zPAD
+	}
+	format, err := readByte(r)
+	if err != nil {
+		return h, err
+	}
+	var raw []byte
+	switch format {
+	case zHEX:
+		var text [14]byte
+		if _, err := io.ReadFull(r, text[:]); err != nil {
+			return h, err
+		}
+		raw = make([]byte, 7)
+		if _, err := hex.Decode(raw, text[:]); err != nil {
+			return h, fmt.Errorf("cannot decode hex header: %w", err)
+		}
+		if crc16(raw[:5]) != uint16(raw[5])<<8|uint16(raw[6]) {
+			return h, fmt.Errorf("hex header CRC mismatch")
+		}
+	case zBIN:
+		if raw, err = readEscaped(r, 7); err != nil {
+			return h, err
+		}
+		if crc16(raw[:5]) != uint16(raw[5])<<8|uint16(raw[6]) {
+			return h, fmt.Errorf("binary header CRC mismatch")
+		}
+	case zBIN32:
+		if raw, err = readEscaped(r, 9); err != nil {
+			return h, err
+		}
+		if crc32.ChecksumIEEE(raw[:5]) != binary.LittleEndian.Uint32(raw[5:]) {
+			return h, fmt.Errorf("binary header CRC mismatch")
+		}
+	default:
+		return h, fmt.Errorf("unsupported header format %q", format)
+	}
+	h.kind = frameType(raw[0])
+	copy(h.data[:], raw[1:5])
+	return h, nil
+}
+
+// readEscaped reads the given number of bytes, removing ZDLE escapes.
+func readEscaped(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, 0, n)
+	for len(buf) < n {
+		b, err := readByte(r)
+		if err != nil {
+			return nil, err
+		}
+		if b != zDLE {
+			buf = append(buf, b)
+			continue
+		}
+		if b, err = readByte(r); err != nil {
+			return nil, err
+		}
+		switch {
+		case b == zDLE:
+			return nil, errCancelled
+		case b == zRUB0:
+			buf = append(buf, 0x7f)
+		case b == zRUB1:
+			buf = append(buf, 0xff)
+		case b&0x60 == 0x40:
+			buf = append(buf, b^0x40)
+		default:
+			return nil, fmt.Errorf("invalid escape sequence %#x", b)
+		}
+	}
+	return buf, nil
+}
+
+// readByte reads a single byte without buffering data past it.
+//
+// Data following the transfer belongs to the shell of the receiver.
+func readByte(r io.Reader) (byte, error) {
+	var buf [1]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, fmt.Errorf("cannot read from receiver: %w", err)
+	}
+	return buf[0], nil
+}
@@ -0,0 +1,315 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package zmodem contains implementation of the sending side of ZMODEM protocol.
+//
+// Unlike YMODEM, data is streamed without waiting for acknowledgment of each
+// block. The receiver is only asked to acknowledge data at the end of each
+// window, or asks for re-transmission from a given position when data is lost.
+package zmodem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// subpacketSize is the amount of data in a single data sub-packet.
+const subpacketSize = 1024
+
+// DefaultWindowSize is the amount of data sent before waiting for acknowledgment.
+const DefaultWindowSize = 32 * 1024
+
+// Transfer encapsulates state of a zmodem file transfer.
+type Transfer struct {
+	// reader provides data of the file being sent, the receiver may ask
+	// for data from any position.
+	reader  io.ReadSeeker
+	name    string
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+
+	windowSize int
+	retryCount int
+	observer   Observer
+
+	enc encoder
+}
+
+// NewTransfer returns a transfer object for sending the given file.
+func NewTransfer(file *os.File) (*Transfer, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	tr := NewTransferFromReader(file, file.Name(), fileInfo.Size())
+	tr.modTime = fileInfo.ModTime()
+	tr.mode = fileInfo.Mode().Perm()
+	return tr, nil
+}
+
+// NewTransferFromReader returns a transfer object for sending data from the
+// given reader.
+//
+// The receiver is told to store exactly size bytes in a file with the given
+// name. The reader must provide at least that much data.
+func NewTransferFromReader(reader io.ReadSeeker, name string, size int64) *Transfer {
+	return &Transfer{
+		reader:     reader,
+		name:       name,
+		size:       size,
+		mode:       0644,
+		windowSize: DefaultWindowSize,
+	}
+}
+
+// WithRetryCount returns a transfer with the given number of retry attempts.
+func (tr *Transfer) WithRetryCount(retryCount int) *Transfer {
+	tr.retryCount = retryCount
+	return tr
+}
+
+// WithWindowSize returns a transfer waiting for acknowledgment every given number of bytes.
+//
+// Receivers with limited buffers announce their size, in which case the
+// smaller of the two is used.
+func (tr *Transfer) WithWindowSize(windowSize int) *Transfer {
+	tr.windowSize = windowSize
+	return tr
+}
+
+// Observer is the interface for observing file transfers.
+type Observer interface {
+	Start(file string, size int64)
+	Progress(bytesSent, bytesTotal int64)
+	Finish()
+}
+
+// WithObserver returns a transfer with an observer that is notified of progress.
+func (tr *Transfer) WithObserver(observer Observer) *Transfer {
+	tr.observer = observer
+	return tr
+}
+
+// SendTo completes the file transfer using the zmodem protocol.
+//
+// The stream must not buffer data past what was requested, as the receiver
+// prints messages once the session is over.
+func (tr *Transfer) SendTo(stream io.ReadWriter) (err error) {
+	defer func() {
+		// If we fail, tell the other side to abort.
+		if err != nil {
+			abort := append(bytes.Repeat([]byte{zDLE}, 10), bytes.Repeat([]byte{'\b'}, 10)...)
+			_, _ = stream.Write(abort)
+		}
+	}()
+	if err := tr.sendInit(stream); err != nil {
+		return err
+	}
+	pos, err := tr.sendFileInfo(stream)
+	if err != nil {
+		return err
+	}
+	if err := tr.sendFileData(stream, pos); err != nil {
+		return err
+	}
+	return tr.sendFinish(stream)
+}
+
+// sendInit asks the receiver to describe its capabilities.
+func (tr *Transfer) sendInit(stream io.ReadWriter) error {
+	errPrefix := "cannot initialize session"
+
+	if err := tr.enc.writeHex(stream, header{kind: zRQINIT}); err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		h, err := readHeader(stream)
+		if err != nil {
+			return fmt.Errorf("%s: %w", errPrefix, err)
+		}
+		switch h.kind {
+		case zRINIT:
+			tr.enc.crc32 = h.flags()&canFC32 != 0
+			tr.enc.escCtl = h.flags()&escCTL != 0
+			// Receivers that cannot stream announce their buffer size.
+			if bufSize := int(h.data[0]) | int(h.data[1])<<8; bufSize != 0 && bufSize < tr.windowSize {
+				tr.windowSize = bufSize
+			}
+			return nil
+		case zCHALLENGE:
+			if err := tr.enc.writeHex(stream, header{kind: zACK, data: h.data}); err != nil {
+				return err
+			}
+		default:
+			if attempt >= tr.retryCount {
+				return fmt.Errorf("%s: expected ZRINIT, got %s", errPrefix, h.kind)
+			}
+			if err := tr.enc.writeHex(stream, header{kind: zRQINIT}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendFileInfo sends the file name and size and returns the position to start from.
+func (tr *Transfer) sendFileInfo(stream io.ReadWriter) (int64, error) {
+	errPrefix := "cannot send file info"
+
+	var info bytes.Buffer
+	var modTime int64
+	if !tr.modTime.IsZero() {
+		modTime = tr.modTime.Unix()
+	}
+	info.WriteString(filepath.Base(tr.name))
+	info.WriteByte(0)
+	fmt.Fprintf(&info, "%d %o %o", tr.size, modTime, tr.mode)
+	info.WriteByte(0)
+	for attempt := 0; ; attempt++ {
+		if err := tr.enc.writeBinary(stream, header{kind: zFILE, data: [4]byte{0, 0, 0, zCBIN}}); err != nil {
+			return 0, err
+		}
+		if err := tr.enc.writeData(stream, info.Bytes(), zCRCW); err != nil {
+			return 0, err
+		}
+		h, err := readHeader(stream)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", errPrefix, err)
+		}
+		switch h.kind {
+		case zRPOS:
+			return h.pos(), nil
+		case zSKIP:
+			return 0, fmt.Errorf("%s: transfer rejected by recipient", errPrefix)
+		case zRINIT, zNAK:
+			if attempt >= tr.retryCount {
+				return 0, fmt.Errorf("%s: too many failed attempts", errPrefix)
+			}
+		default:
+			return 0, fmt.Errorf("%s: expected ZRPOS, got %s", errPrefix, h.kind)
+		}
+	}
+}
+
+// sendFileData streams the file, starting from the given position.
+//
+// Each window of data is sent as one frame, ending with a sub-packet that
+// requires acknowledgment. When the receiver reports an error it asks for
+// data from a given position, which is then sent in a new frame.
+func (tr *Transfer) sendFileData(stream io.ReadWriter, pos int64) error {
+	errPrefix := "cannot send file data"
+
+	fileSize := tr.size
+	if tr.observer != nil {
+		tr.observer.Start(tr.name, fileSize)
+		defer tr.observer.Finish()
+	}
+	buf := make([]byte, subpacketSize)
+	retries := 0
+	for {
+		if _, err := tr.reader.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		if err := tr.enc.writeBinary(stream, posHeader(zDATA, pos)); err != nil {
+			return err
+		}
+		windowEnd := pos + int64(tr.windowSize)
+		for {
+			chunk := buf
+			if remaining := fileSize - pos; remaining < int64(len(chunk)) {
+				if remaining < 0 {
+					remaining = 0
+				}
+				chunk = chunk[:remaining]
+			}
+			n, err := io.ReadFull(tr.reader, chunk)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			pos += int64(n)
+			end := byte(zCRCG)
+			switch {
+			case pos >= fileSize:
+				end = zCRCE
+			case pos >= windowEnd:
+				end = zCRCW
+			}
+			if err := tr.enc.writeData(stream, chunk[:n], end); err != nil {
+				return err
+			}
+			if tr.observer != nil {
+				tr.observer.Progress(pos, fileSize)
+			}
+			if end != zCRCG {
+				break
+			}
+		}
+		if pos >= fileSize {
+			if err := tr.enc.writeBinary(stream, posHeader(zEOF, pos)); err != nil {
+				return err
+			}
+		}
+		// Wait for acknowledgment of the window or the whole file.
+		h, err := readHeader(stream)
+		if err != nil {
+			return fmt.Errorf("%s: %w", errPrefix, err)
+		}
+		switch h.kind {
+		case zACK:
+			// Receivers acknowledge the position they have reached.
+		case zRINIT:
+			if pos >= fileSize {
+				return nil
+			}
+			return fmt.Errorf("%s: receiver finished at %d of %d bytes", errPrefix, pos, fileSize)
+		case zRPOS:
+			retries++
+			if retries > tr.retryCount {
+				return fmt.Errorf("%s: too many failed attempts", errPrefix)
+			}
+			pos = h.pos()
+		case zSKIP:
+			return fmt.Errorf("%s: transfer rejected by recipient", errPrefix)
+		default:
+			return fmt.Errorf("%s: expected ZACK, ZRPOS or ZRINIT, got %s", errPrefix, h.kind)
+		}
+	}
+}
+
+// sendFinish ends the session.
+func (tr *Transfer) sendFinish(stream io.ReadWriter) error {
+	errPrefix := "cannot finish session"
+
+	if err := tr.enc.writeHex(stream, header{kind: zFIN}); err != nil {
+		return err
+	}
+	h, err := readHeader(stream)
+	if err != nil {
+		return fmt.Errorf("%s: %w", errPrefix, err)
+	}
+	if h.kind != zFIN {
+		return fmt.Errorf("%s: expected ZFIN, got %s", errPrefix, h.kind)
+	}
+	// Over and out.
+	if _, err := stream.Write([]byte("OO")); err != nil {
+		return fmt.Errorf("%s: %w", errPrefix, err)
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2020 Huawei Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zmodem
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	if crc := crc16([]byte("123456789")); crc != 0x31c3 {
+		t.Fatalf("unexpected CRC-16/XMODEM of check string: %#x", crc)
+	}
+	if crc := crc16(nil); crc != 0 {
+		t.Fatalf("unexpected CRC-16/XMODEM of no data: %#x", crc)
+	}
+}
+
+func TestWriteHex(t *testing.T) {
+	for _, tc := range []struct {
+		h        header
+		expected string
+	}{
+		{header{kind: zRQINIT}, "**\x18B00000000000000\r\n\x11"},
+		{header{kind: zRINIT, data: [4]byte{0, 0, 0, 0x23}}, "**\x18B0100000023be50\r\n\x11"},
+		{posHeader(zRPOS, 0x1234), "**\x18B09341200006367\r\n\x11"},
+		// ZACK and ZFIN are not followed by XON.
+		{header{kind: zFIN}, "**\x18B0800000000022d\r\n"},
+	} {
+		var enc encoder
+		var buf bytes.Buffer
+		if err := enc.writeHex(&buf, tc.h); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf.String() != tc.expected {
+			t.Fatalf("unexpected %s header: %q, expected %q", tc.h.kind, buf.String(), tc.expected)
+		}
+	}
+}
+
+func TestWriteBinary(t *testing.T) {
+	for _, tc := range []struct {
+		crc32    bool
+		expected string
+	}{
+		{false, "*\x18A\x0a\x18\x51\x00\x00\x00\x2b\xbd"},
+		{true, "*\x18C\x0a\x18\x51\x00\x00\x00\x46\xdf\x37\x64"},
+	} {
+		enc := encoder{crc32: tc.crc32}
+		var buf bytes.Buffer
+		if err := enc.writeBinary(&buf, posHeader(zDATA, 0x11)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf.String() != tc.expected {
+			t.Fatalf("unexpected header with 32 bit CRC %v: %q, expected %q", tc.crc32, buf.String(), tc.expected)
+		}
+	}
+}
+
+func TestWriteData(t *testing.T) {
+	for _, tc := range []struct {
+		crc32, escCtl bool
+		expected      string
+	}{
+		{false, false, "\x18\x58a\x18k\x0f\x14\x11"},
+		{false, true, "\x18\x58a\x18k\x18\x4f\x18\x54\x11"},
+		{true, false, "\x18\x58a\x18k\xec\xc9\xf2\x4b\x11"},
+	} {
+		enc := encoder{crc32: tc.crc32, escCtl: tc.escCtl}
+		var buf bytes.Buffer
+		if err := enc.writeData(&buf, []byte("\x18a"), zCRCW); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf.String() != tc.expected {
+			t.Fatalf("unexpected sub-packet with 32 bit CRC %v, escaped control %v: %q, expected %q", tc.crc32, tc.escCtl, buf.String(), tc.expected)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	for _, tc := range []struct {
+		in        byte
+		plain     string
+		escCtlOut string
+	}{
+		{zDLE, "\x18\x58", "\x18\x58"},
+		{0x10, "\x18\x50", "\x18\x50"},
+		{asciiXON, "\x18\x51", "\x18\x51"},
+		{0x13, "\x18\x53", "\x18\x53"},
+		{0x90, "\x18\xd0", "\x18\xd0"},
+		{0x91, "\x18\xd1", "\x18\xd1"},
+		{0x93, "\x18\xd3", "\x18\xd3"},
+		{'\r', "\r", "\x18\x4d"},
+		{0x81, "\x81", "\x18\xc1"},
+		{'A', "A", "A"},
+		{0x7f, "\x7f", "\x7f"},
+	} {
+		for _, escCtl := range []bool{false, true} {
+			enc := encoder{escCtl: escCtl}
+			enc.escape([]byte{tc.in})
+			expected := tc.plain
+			if escCtl {
+				expected = tc.escCtlOut
+			}
+			if enc.buf.String() != expected {
+				t.Fatalf("unexpected escape of %#x with escaped control %v: %q, expected %q", tc.in, escCtl, enc.buf.String(), expected)
+			}
+			decoded, err := readEscaped(&enc.buf, 1)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if decoded[0] != tc.in {
+				t.Fatalf("escape of %#x decoded as %#x", tc.in, decoded[0])
+			}
+		}
+	}
+	// ZRUB0 and ZRUB1 are only decoded.
+	decoded, err := readEscaped(bytes.NewReader([]byte{zDLE, zRUB0, zDLE, zRUB1}), 2)
+	if err != nil || !bytes.Equal(decoded, []byte{0x7f, 0xff}) {
+		t.Fatalf("unexpected decoding of ZRUB0 and ZRUB1: %q, %v", decoded, err)
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	// The position contains bytes that must be escaped.
+	h := posHeader(zRPOS, 0x18111310)
+	for _, enc := range []encoder{{}, {crc32: true}, {escCtl: true}} {
+		var buf bytes.Buffer
+		if err := enc.writeBinary(&buf, h); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := enc.writeHex(&buf, h); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			decoded, err := readHeader(&buf)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if decoded != h {
+				t.Fatalf("header %v decoded as %v", h, decoded)
+			}
+		}
+	}
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected string
+	}{
+		{"**\x18B0100000023be51\r\n", "hex header CRC mismatch"},
+		{"*\x18A\x0a\x11\x00\x00\x00\x2b\xbe", "binary header CRC mismatch"},
+		{"*\x18C\x0a\x11\x00\x00\x00\x46\xdf\x37\x65", "binary header CRC mismatch"},
+		{"\x18\x18\x18\x18\x18", errCancelled.Error()},
+	} {
+		_, err := readHeader(bytes.NewReader([]byte(tc.in)))
+		if err == nil || err.Error() != tc.expected {
+			t.Fatalf("unexpected error reading %q: %v", tc.in, err)
+		}
+	}
+}
+
+// readSubpacket reads a data sub-packet with 16 bit CRC and returns its data and terminator.
+func readSubpacket(t *testing.T, r io.Reader) ([]byte, byte) {
+	t.Helper()
+	var data []byte
+	for {
+		b, err := readByte(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if b != zDLE {
+			data = append(data, b)
+			continue
+		}
+		if b, err = readByte(r); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		switch b {
+		case zCRCE, zCRCG, zCRCQ, zCRCW:
+			crc, err := readEscaped(r, 2)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if crc16Update(crc16(data), b) != uint16(crc[0])<<8|uint16(crc[1]) {
+				t.Fatalf("sub-packet CRC mismatch")
+			}
+			return data, b
+		default:
+			data = append(data, b^0x40)
+		}
+	}
+}
+
+// hexHeaders returns the given headers in the hex format, as a receiver sends them.
+func hexHeaders(t *testing.T, headers ...header) *bytes.Buffer {
+	t.Helper()
+	var enc encoder
+	var buf bytes.Buffer
+	for _, h := range headers {
+		if err := enc.writeHex(&buf, h); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return &buf
+}
+
+// scriptedReceiver replies with prepared headers and records the data sent to it.
+type scriptedReceiver struct {
+	script io.Reader
+	sent   bytes.Buffer
+}
+
+func (r *scriptedReceiver) Read(p []byte) (int, error) { return r.script.Read(p) }
+
+func (r *scriptedReceiver) Write(p []byte) (int, error) { return r.sent.Write(p) }
+
+func TestSendResumesFromRPOS(t *testing.T) {
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	receiver := &scriptedReceiver{script: hexHeaders(t,
+		header{kind: zRINIT},
+		// The receiver already has the first kilobyte.
+		posHeader(zRPOS, 1024),
+		// Data of the first window got lost past 2048 bytes.
+		posHeader(zRPOS, 2048),
+		// Having the whole file, the receiver waits for the next one.
+		header{kind: zRINIT},
+		header{kind: zFIN},
+	)}
+	tr := NewTransferFromReader(bytes.NewReader(data), "file.bin", int64(len(data))).WithWindowSize(2048).WithRetryCount(1)
+	if err := tr.SendTo(receiver); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Receive what was sent, as the receiver would.
+	sent := &receiver.sent
+	if h, err := readHeader(sent); err != nil || h.kind != zRQINIT {
+		t.Fatalf("expected ZRQINIT, got %v, %v", h, err)
+	}
+	if h, err := readHeader(sent); err != nil || h.kind != zFILE {
+		t.Fatalf("expected ZFILE, got %v, %v", h, err)
+	}
+	if info, end := readSubpacket(t, sent); string(info) != "file.bin\x004096 0 644\x00" || end != zCRCW {
+		t.Fatalf("unexpected file info %q", info)
+	}
+	received := append([]byte(nil), data[:1024]...)
+	var starts []int64
+	for {
+		h, err := readHeader(sent)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if h.kind == zEOF {
+			break
+		}
+		if h.kind != zDATA {
+			t.Fatalf("expected ZDATA, got %s", h.kind)
+		}
+		starts = append(starts, h.pos())
+		received = received[:h.pos()]
+		for {
+			chunk, end := readSubpacket(t, sent)
+			received = append(received, chunk...)
+			if end != zCRCG {
+				break
+			}
+		}
+	}
+	if len(starts) != 2 || starts[0] != 1024 || starts[1] != 2048 {
+		t.Fatalf("unexpected data frames starting at %v", starts)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received data differs from sent data")
+	}
+	if h, err := readHeader(sent); err != nil || h.kind != zFIN {
+		t.Fatalf("expected ZFIN, got %v, %v", h, err)
+	}
+	if rest := sent.String(); rest != "\r\nOO" {
+		t.Fatalf("unexpected end of session %q", rest)
+	}
+}